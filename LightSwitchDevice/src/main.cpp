@@ -1,12 +1,34 @@
 #include <WiFi.h>
 #include <PubSubClient.h>
 #include <ArduinoJson.h>
+#include <Preferences.h>
 #include "env.h"
 
 WiFiClient espClient;
 PubSubClient mqttClient(espClient);
+// the broker publishes the retained "offline" last will here when the connection drops
+const std::string status_topic = std::string("status/") + mqttClientId;
+// every command carries a correlation ID which is answered here with the outcome
+const std::string ack_topic = std::string("ack/") + mqttClientId;
+// the secret received when the device was provisioned, it survives restarts in the flash
+Preferences preferences;
+String deviceSecret;
 std::string lightState = "Off";
 
+void publishAck(const char* correlationId, const char* status, const char* error)
+{
+    StaticJsonDocument<256> ackDoc;
+    ackDoc["correlation_id"] = correlationId;
+    ackDoc["status"] = status;
+    if (error != nullptr) {
+        ackDoc["error"] = error;
+    }
+
+    char ackJsonBuffer[256];
+    serializeJson(ackDoc, ackJsonBuffer);
+    mqttClient.publish(ack_topic.c_str(), ackJsonBuffer);
+}
+
 void mqttCallback(char* topic, byte* payload, unsigned int length)
 {
     Serial.print("Message arrived on topic: ");
@@ -19,7 +41,17 @@ void mqttCallback(char* topic, byte* payload, unsigned int length)
     Serial.println(msg);
 
     if (strcmp(topic, toggle_topic.c_str()) == 0) {
-        if (strcmp(msg, "Light_state") == 0) {
+        StaticJsonDocument<256> commandDoc;
+        if (deserializeJson(commandDoc, msg)) {
+            Serial.println("Invalid command payload");
+            return;
+        }
+        const char* correlationId = commandDoc["correlation_id"] | "";
+        const char* action = commandDoc["action"] | "";
+
+        if (strcmp(action, "Light_state") != 0) {
+            publishAck(correlationId, "failed", "unknown action");
+        } else {
             StaticJsonDocument<200> doc;
             lightState = lightState == "On" ? "Off" : "On";
             doc["Action_name"] = "Light_state";
@@ -31,6 +63,7 @@ void mqttCallback(char* topic, byte* payload, unsigned int length)
             char jsonBuffer[512];
             serializeJson(doc, jsonBuffer);
             mqttClient.publish(state_topic.c_str(), jsonBuffer);
+            publishAck(correlationId, "succeeded", nullptr);
         }
     } else if (strcmp(topic, login_response_topic.c_str()) == 0) {
         Serial.println("Received login response");
@@ -46,15 +79,26 @@ void mqttCallback(char* topic, byte* payload, unsigned int length)
             return;
         }
 
-        const char* loginStatus = doc["login"];  // "successful"
+        const char* loginStatus = doc["login"] | "";  // "successful" or "rejected"
         JsonObject stateObj = doc["state"].as<JsonObject>();
 
         Serial.println("Login Status: ");
         Serial.println(loginStatus);
         if (strcmp(loginStatus, "successful") != 0) {
+            // unknown_device, not_provisioned, invalid_secret or invalid_token, retrying right away would not help
+            Serial.print("Login rejected: ");
+            Serial.println(doc["reason"] | "");
+            delay(60000);
             ESP.restart();
         }
 
+        const char* issuedSecret = doc["secret"] | "";
+        if (strcmp(issuedSecret, "") != 0) {
+            deviceSecret = issuedSecret;
+            preferences.putString("secret", deviceSecret);
+            Serial.println("Stored the device secret");
+        }
+
         const char* lightStateStr = stateObj["Light_state"];
         if (strcmp("On", lightStateStr) == 0 || strcmp("Off", lightStateStr) == 0) {
             lightState = lightStateStr;
@@ -90,18 +134,28 @@ void reconnect_mqtt_mqttClient()
 {
     while (!mqttClient.connected()) {
         Serial.print("Attempting MQTT connection...");
-        if (mqttClient.connect(mqttClientId)) {
+        // brokers checking device credentials expect the UUID as username and the secret (or the provisioning token
+        // until the device has a secret) as password, brokers without authentication ignore them
+        const char* mqttPassword = deviceSecret.length() > 0 ? deviceSecret.c_str() : provisioningToken;
+        if (mqttClient.connect(mqttClientId, mqttClientId, mqttPassword, status_topic.c_str(), 1, true, "offline")) {
             Serial.println("connected");
+            mqttClient.publish(status_topic.c_str(), "online", true);
 
-            StaticJsonDocument<200> doc;
+            StaticJsonDocument<256> doc;
             doc["uuid"] = mqttClientId;
             doc["name"] = name;
             doc["device_type"] = deviceType;
+            // provisioned devices log in with their secret, the token from env.h is only used to receive one
+            if (deviceSecret.length() > 0) {
+                doc["secret"] = deviceSecret.c_str();
+            } else {
+                doc["provisioning_token"] = provisioningToken;
+            }
 
             char jsonBuffer[512];
             serializeJson(doc, jsonBuffer);
 
-            mqttClient.subscribe(login_response_topic.c_str());
+            mqttClient.subscribe(login_response_topic.c_str(), 1);
             mqttClient.publish(login_request_topic.c_str(), jsonBuffer);
         } else {
             Serial.print("failed, rc=");
@@ -115,6 +169,8 @@ void reconnect_mqtt_mqttClient()
 void setup()
 {
     Serial.begin(115200);
+    preferences.begin("iot", false);
+    deviceSecret = preferences.getString("secret", "");
     setup_wifi();
     mqttClient.setServer(mqtt_broker, mqtt_port);
     mqttClient.setCallback(mqttCallback);
@@ -1,6 +1,7 @@
 #include <WiFi.h>
 #include <PubSubClient.h>
 #include <ArduinoJson.h>
+#include <Preferences.h>
 #include "env.h"
 #include <freertos/FreeRTOS.h>
 #include <freertos/task.h>
@@ -8,6 +9,13 @@
 
 WiFiClient espClient;
 PubSubClient mqttClient(espClient);
+// the broker publishes the retained "offline" last will here when the connection drops
+const std::string status_topic = std::string("status/") + mqttClientId;
+// every command carries a correlation ID which is answered here with the outcome
+const std::string ack_topic = std::string("ack/") + mqttClientId;
+// the secret received when the device was provisioned, it survives restarts in the flash
+Preferences preferences;
+String deviceSecret;
 
 SemaphoreHandle_t mutex;
 unsigned long lastMessageTime = 0;
@@ -28,6 +36,20 @@ void setup_wifi()
     Serial.println(WiFi.localIP());
 }
 
+void publishAck(const char* correlationId, const char* status, const char* error)
+{
+    StaticJsonDocument<256> ackDoc;
+    ackDoc["correlation_id"] = correlationId;
+    ackDoc["status"] = status;
+    if (error != nullptr) {
+        ackDoc["error"] = error;
+    }
+
+    char ackJsonBuffer[256];
+    serializeJson(ackDoc, ackJsonBuffer);
+    mqttClient.publish(ack_topic.c_str(), ackJsonBuffer);
+}
+
 void mqttCallback(char* topic, byte* payload, unsigned int length) {
     Serial.print("Message arrived on topic: ");
     Serial.println(topic);
@@ -42,7 +64,19 @@ void mqttCallback(char* topic, byte* payload, unsigned int length) {
     std::string payloadStr((char*)payload, length);
 
     if (strcmp(topic, number_input_topic.c_str()) == 0) {
-        long newInterval = atol(msg);
+        StaticJsonDocument<256> commandDoc;
+        if (deserializeJson(commandDoc, msg)) {
+            Serial.println("Invalid command payload");
+            return;
+        }
+        const char* correlationId = commandDoc["correlation_id"] | "";
+        const char* value = commandDoc["value"] | "";
+
+        long newInterval = atol(value);
+        if (newInterval <= 0) {
+            publishAck(correlationId, "failed", "interval has to be a positive number");
+            return;
+        }
 
         if (xSemaphoreTake(mutex, portMAX_DELAY) == pdTRUE) {
             messageInterval = newInterval;
@@ -50,13 +84,14 @@ void mqttCallback(char* topic, byte* payload, unsigned int length) {
         }
         StaticJsonDocument<200> doc;
         doc["Action_name"] = "Interval_ms";
-        doc["Interval_ms"] = msg;
+        doc["Interval_ms"] = value;
 
         Serial.println("Changed message interval");
 
         char jsonBuffer[512];
         serializeJson(doc, jsonBuffer);
         mqttClient.publish(state_topic.c_str(), jsonBuffer);
+        publishAck(correlationId, "succeeded", nullptr);
     } else if (strcmp(topic, login_response_topic.c_str()) == 0) {
         Serial.println("Received login response");
         StaticJsonDocument<512> doc;  // Adjust size based on expected payload complexity
@@ -69,15 +104,26 @@ void mqttCallback(char* topic, byte* payload, unsigned int length) {
         }
 
         // Extracting the login status and device states from the JSON payload
-        const char* loginStatus = doc["login"];  // "successful"
+        const char* loginStatus = doc["login"] | "";  // "successful" or "rejected"
         JsonObject stateObj = doc["state"].as<JsonObject>();
 
         Serial.println("Login Status: ");
         Serial.println(loginStatus);
-        if (strcmp(loginStatus, "successful") != 0){
+        if (strcmp(loginStatus, "successful") != 0) {
+            // unknown_device, not_provisioned, invalid_secret or invalid_token, retrying right away would not help
+            Serial.print("Login rejected: ");
+            Serial.println(doc["reason"] | "");
+            delay(60000);
             ESP.restart();
         }
 
+        const char* issuedSecret = doc["secret"] | "";
+        if (strcmp(issuedSecret, "") != 0) {
+            deviceSecret = issuedSecret;
+            preferences.putString("secret", deviceSecret);
+            Serial.println("Stored the device secret");
+        }
+
         const char* interval = stateObj["Interval_ms"];
         if (strcmp(interval,"") != 0){
             long newInterval = atol(interval);
@@ -96,17 +142,27 @@ void reconnect_mqtt()
 {
     while (!mqttClient.connected()) {
         Serial.print("Attempting MQTT connection...");
-        if (mqttClient.connect(mqttClientId)) {
+        // brokers checking device credentials expect the UUID as username and the secret (or the provisioning token
+        // until the device has a secret) as password, brokers without authentication ignore them
+        const char* mqttPassword = deviceSecret.length() > 0 ? deviceSecret.c_str() : provisioningToken;
+        if (mqttClient.connect(mqttClientId, mqttClientId, mqttPassword, status_topic.c_str(), 1, true, "offline")) {
             Serial.println("connected");
-            StaticJsonDocument<200> loginDoc;
+            mqttClient.publish(status_topic.c_str(), "online", true);
+            StaticJsonDocument<256> loginDoc;
             loginDoc["uuid"] = mqttClientId;
             loginDoc["name"] = name;
             loginDoc["device_type"] = deviceType;
+            // provisioned devices log in with their secret, the token from env.h is only used to receive one
+            if (deviceSecret.length() > 0) {
+                loginDoc["secret"] = deviceSecret.c_str();
+            } else {
+                loginDoc["provisioning_token"] = provisioningToken;
+            }
 
             char loginJsonBuffer[512];
             serializeJson(loginDoc, loginJsonBuffer);
 
-            mqttClient.subscribe(login_response_topic.c_str());
+            mqttClient.subscribe(login_response_topic.c_str(), 1);
             mqttClient.publish(login_request_topic.c_str(), loginJsonBuffer);
         } else {
             Serial.print("failed, rc=");
@@ -125,6 +181,8 @@ void setup()
     }
 
     Serial.begin(115200);
+    preferences.begin("iot", false);
+    deviceSecret = preferences.getString("secret", "");
     setup_wifi();
     mqttClient.setServer(mqtt_broker, mqtt_port);
     mqttClient.setCallback(mqttCallback);
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"NSI-semester-work/internal/model"
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// intervalAction is the number_input action the sensor sketches use for their reporting interval
+	intervalAction = "Interval_ms"
+	publishTimeout = 5 * time.Second
+)
+
+// settings are shared by every simulated device
+type settings struct {
+	brokerURL          string
+	provisioningToken  string
+	secrets            *secretStore
+	waveform           *waveform
+	interval           time.Duration
+	heartbeat          time.Duration
+	loginResponseTopic string
+	commandTopic       string
+}
+
+// commandPayload is what the server publishes to toggle, number_input and command topics
+type commandPayload struct {
+	CorrelationID string `json:"correlation_id"`
+	Action        string `json:"action"`
+	Value         string `json:"value"`
+}
+
+type loginResponse struct {
+	Login  string                     `json:"login"`
+	Reason string                     `json:"reason"`
+	State  map[string]json.RawMessage `json:"state"`
+	Secret string                     `json:"secret"`
+}
+
+// device behaves like the ESP32 sketches: it logs in after every (re)connect, restores its state from the login
+// response, answers commands and publishes readings of its provide_value actions
+type device struct {
+	uuid       string
+	name       string
+	deviceType model.DeviceType
+	actions    map[string]model.ActionType
+	// phase spreads the devices over the waveform period
+	phase    float64
+	settings *settings
+	client   MQTT.Client
+	started  time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	// wake interrupts the reporting wait when the interval changes
+	wake chan struct{}
+
+	mu        sync.Mutex
+	state     map[string]string
+	interval  time.Duration
+	readings  map[string]float64
+	reporting bool
+}
+
+func newDevice(uuid string, name string, deviceType model.DeviceType, actions map[string]model.ActionType, phase float64, settings *settings) *device {
+	d := &device{
+		uuid:       uuid,
+		name:       name,
+		deviceType: deviceType,
+		actions:    actions,
+		phase:      phase,
+		settings:   settings,
+		started:    time.Now(),
+		stop:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		state:      make(map[string]string),
+		interval:   settings.interval,
+		readings:   make(map[string]float64),
+	}
+	for actionName, actionType := range actions {
+		switch actionType {
+		case model.ActionTypeToggle:
+			d.state[actionName] = "Off"
+		case model.ActionTypeProvideValue:
+			d.readings[actionName] = math.NaN()
+		}
+	}
+	return d
+}
+
+func (d *device) topic(prefix string) string {
+	return prefix + d.uuid
+}
+
+// actionNames returns the names of the actions of given type in a stable order
+func (d *device) actionNames(actionType model.ActionType) []string {
+	var names []string
+	for actionName, t := range d.actions {
+		if t == actionType {
+			names = append(names, actionName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// start connects in the background, the client keeps retrying until the broker is reachable
+func (d *device) start() {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(d.settings.brokerURL)
+	opts.SetClientID(d.uuid)
+	// brokers checking device credentials expect the UUID as username and the secret (or the provisioning token until
+	// the device has a secret) as password, brokers without authentication ignore them
+	opts.SetCredentialsProvider(func() (string, string) {
+		if secret := d.settings.secrets.Get(d.uuid); secret != "" {
+			return d.uuid, secret
+		}
+		return d.uuid, d.settings.provisioningToken
+	})
+	opts.SetWill(d.topic("status/"), "offline", 1, true)
+	opts.SetOnConnectHandler(d.onConnect)
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		log.Printf("%s lost the connection: %s", d.name, err)
+	})
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOrderMatters(false)
+	opts.SetMaxReconnectInterval(time.Second * 10)
+
+	d.client = MQTT.NewClient(opts)
+	d.client.Connect()
+}
+
+// shutdown publishes the offline status a broker would publish as the will and disconnects, it is called when the
+// login is rejected and when the simulator stops
+func (d *device) shutdown() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		if d.client.IsConnectionOpen() {
+			d.client.Publish(d.topic("status/"), 1, true, "offline").WaitTimeout(publishTimeout)
+		}
+		d.client.Disconnect(250)
+	})
+}
+
+func (d *device) publish(topic string, qos byte, retained bool, payload interface{}) {
+	token := d.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		log.Printf("%s: broker did not acknowledge the publish to %s in time", d.name, topic)
+	} else if token.Error() != nil {
+		log.Printf("%s failed to publish to %s: %s", d.name, topic, token.Error())
+	}
+}
+
+func (d *device) publishJson(topic string, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("%s failed to encode the message for %s: %s", d.name, topic, err)
+		return
+	}
+	d.publish(topic, 0, false, payload)
+}
+
+// onConnect logs in, the login response continues the handshake
+func (d *device) onConnect(client MQTT.Client) {
+	d.publish(d.topic("status/"), 1, true, "online")
+
+	if token := client.Subscribe(d.topic(d.settings.loginResponseTopic), 1, d.handleLoginResponse); token.Wait() && token.Error() != nil {
+		log.Printf("%s failed to subscribe to its login response: %s", d.name, token.Error())
+		return
+	}
+
+	request := map[string]interface{}{
+		"uuid":        d.uuid,
+		"name":        d.name,
+		"device_type": d.deviceType,
+	}
+	// provisioned devices log in with their secret, the token is only used to receive one
+	if secret := d.settings.secrets.Get(d.uuid); secret != "" {
+		request["secret"] = secret
+	} else {
+		request["provisioning_token"] = d.settings.provisioningToken
+	}
+	if d.settings.heartbeat > 0 {
+		request["heartbeat_interval_ms"] = d.settings.heartbeat.Milliseconds()
+	}
+	d.publishJson(d.topic("login/request/"), request)
+}
+
+func (d *device) handleLoginResponse(client MQTT.Client, msg MQTT.Message) {
+	var response loginResponse
+	if err := json.Unmarshal(msg.Payload(), &response); err != nil {
+		log.Printf("%s received an invalid login response: %s", d.name, err)
+		return
+	}
+	if response.Login != "successful" {
+		// unknown_device, not_provisioned, invalid_secret or invalid_token, retrying would not help
+		log.Printf("%s: login rejected: %s", d.name, response.Reason)
+		go d.shutdown()
+		return
+	}
+
+	if response.Secret != "" {
+		if err := d.settings.secrets.Set(d.uuid, response.Secret); err != nil {
+			log.Printf("%s failed to store its secret: %s", d.name, err)
+		} else {
+			log.Printf("%s stored its new secret", d.name)
+		}
+	}
+	d.restoreState(response.State)
+
+	var filters []string
+	if len(d.actionNames(model.ActionTypeToggle)) > 0 {
+		filters = append(filters, d.topic("toggle/"))
+	}
+	if len(d.actionNames(model.ActionTypeNumberInput)) > 0 {
+		filters = append(filters, d.topic("number_input/")+"/+")
+	}
+	if len(d.actionNames(model.ActionTypeCommand)) > 0 {
+		filters = append(filters, d.topic(d.settings.commandTopic))
+	}
+	for _, filter := range filters {
+		if token := client.Subscribe(filter, 1, d.handleCommand); token.Wait() && token.Error() != nil {
+			log.Printf("%s failed to subscribe to %s: %s", d.name, filter, token.Error())
+		}
+	}
+	log.Printf("%s logged in", d.name)
+
+	d.mu.Lock()
+	startReporting := !d.reporting
+	d.reporting = true
+	d.mu.Unlock()
+	if startReporting {
+		go d.report()
+		if d.settings.heartbeat > 0 {
+			go d.sendHeartbeats()
+		}
+	}
+}
+
+// restoreState takes over the states the server remembers, values of actions the device does not have are ignored
+func (d *device) restoreState(state map[string]json.RawMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for actionName, raw := range state {
+		actionType := d.actions[actionName]
+		if actionType != model.ActionTypeToggle && actionType != model.ActionTypeNumberInput {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = strings.Trim(string(raw), `"`)
+		}
+		if actionType == model.ActionTypeToggle && value != "On" && value != "Off" {
+			continue
+		}
+		d.state[actionName] = value
+		if actionName == intervalAction {
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms > 0 {
+				d.interval = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// handleCommand executes toggle/<uuid>, number_input/<uuid>/<action> and command/<uuid> messages and acknowledges
+// them on ack/<uuid>
+func (d *device) handleCommand(client MQTT.Client, msg MQTT.Message) {
+	var command commandPayload
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+		log.Printf("%s received an invalid command on %s: %s", d.name, msg.Topic(), err)
+		return
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(msg.Topic(), "toggle/"):
+		err = d.toggle(command.Action)
+	case strings.HasPrefix(msg.Topic(), "number_input/"):
+		parts := strings.Split(msg.Topic(), "/")
+		err = d.setNumber(parts[len(parts)-1], command.Value)
+	default:
+		err = d.execute(command.Action)
+	}
+
+	ack := map[string]string{"correlation_id": command.CorrelationID, "status": string(model.CommandSucceeded)}
+	if err != nil {
+		ack["status"], ack["error"] = string(model.CommandFailed), err.Error()
+		log.Printf("%s failed command %s: %s", d.name, command.CorrelationID, err)
+	}
+	d.publishJson(d.topic("ack/"), ack)
+}
+
+func (d *device) toggle(actionName string) error {
+	if d.actions[actionName] != model.ActionTypeToggle {
+		return fmt.Errorf("unknown action")
+	}
+	d.mu.Lock()
+	state := "On"
+	if d.state[actionName] == "On" {
+		state = "Off"
+	}
+	d.state[actionName] = state
+	d.mu.Unlock()
+
+	log.Printf("%s toggled %s to %s", d.name, actionName, state)
+	d.publishJson(d.topic("state/"), map[string]string{"Action_name": actionName, actionName: state})
+	return nil
+}
+
+func (d *device) setNumber(actionName string, value string) error {
+	if d.actions[actionName] != model.ActionTypeNumberInput {
+		return fmt.Errorf("unknown action")
+	}
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	if actionName == intervalAction {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("interval has to be a positive number")
+		}
+		d.mu.Lock()
+		d.interval = time.Duration(ms) * time.Millisecond
+		d.mu.Unlock()
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+	d.mu.Lock()
+	d.state[actionName] = value
+	d.mu.Unlock()
+
+	log.Printf("%s set %s to %s", d.name, actionName, value)
+	d.publishJson(d.topic("state/"), map[string]string{"Action_name": actionName, actionName: value})
+	return nil
+}
+
+func (d *device) execute(actionName string) error {
+	if d.actions[actionName] != model.ActionTypeCommand {
+		return fmt.Errorf("unknown action")
+	}
+	log.Printf("%s executed %s", d.name, actionName)
+	return nil
+}
+
+// report publishes one provide_value message with every provide_value action until the device is stopped
+func (d *device) report() {
+	actionNames := d.actionNames(model.ActionTypeProvideValue)
+	if len(actionNames) == 0 {
+		return
+	}
+
+	for {
+		d.mu.Lock()
+		interval := d.interval
+		d.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-d.stop:
+			timer.Stop()
+			return
+		case <-d.wake:
+			// the new interval applies from now on
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		// readings are not queued while the connection is down, like the sketches
+		if !d.client.IsConnectionOpen() {
+			continue
+		}
+		elapsed := time.Since(d.started)
+		values := make(map[string]float64, len(actionNames))
+		d.mu.Lock()
+		for i, actionName := range actionNames {
+			// every action of the device gets its own phase too
+			phase := d.phase + float64(i)/float64(len(actionNames))
+			values[actionName] = d.settings.waveform.sample(elapsed, phase, d.readings[actionName])
+			d.readings[actionName] = values[actionName]
+		}
+		d.mu.Unlock()
+		d.publishJson(d.topic("provide_value/"), values)
+	}
+}
+
+func (d *device) sendHeartbeats() {
+	ticker := time.NewTicker(d.settings.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if d.client.IsConnectionOpen() {
+				d.publish(d.topic("status/"), 0, false, "heartbeat")
+			}
+		}
+	}
+}
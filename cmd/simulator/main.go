@@ -0,0 +1,172 @@
+// The simulator emulates devices speaking the same MQTT protocol as the ESP32 sketches, for demos and load tests of
+// dashboards, rules and alerts without hardware:
+//
+//	go run ./cmd/simulator -devices 10 -type temperature_sensor -token <provisioning token>
+package main
+
+import (
+	"NSI-semester-work/internal/config"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// connectSpacing spreads the connects of many devices, a broker would otherwise see all of them at once
+const connectSpacing = 20 * time.Millisecond
+
+// deviceUuid derives a name-based (version 5 style) UUID, so a device keeps its UUID, its secret and its data
+// between runs with the same seed
+func deviceUuid(seed string, deviceType model.DeviceType, number int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/%s/%d", seed, deviceType, number)))
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// parseActions reads name=type pairs separated by commas, e.g. "Light_state=toggle,Brightness=number_input"
+func parseActions(value string) (map[string]model.ActionType, error) {
+	actions := make(map[string]model.ActionType)
+	for _, pair := range strings.Split(value, ",") {
+		actionName, actionType, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || actionName == "" {
+			return nil, fmt.Errorf("invalid action %q, use name=type", pair)
+		}
+		switch t := model.ActionType(actionType); t {
+		case model.ActionTypeToggle, model.ActionTypeNumberInput, model.ActionTypeProvideValue, model.ActionTypeCommand:
+			actions[actionName] = t
+		default:
+			return nil, fmt.Errorf("action %s has unknown type %q", actionName, actionType)
+		}
+	}
+	return actions, nil
+}
+
+// templateActions returns the actions of the device type's template
+func templateActions(deviceType model.DeviceType) (map[string]model.ActionType, error) {
+	var known []string
+	for _, template := range db.ActionTemplates {
+		if template.DeviceType != deviceType {
+			known = append(known, template.DeviceType.String())
+			continue
+		}
+		actions := make(map[string]model.ActionType)
+		if err := json.Unmarshal([]byte(template.Actions), &actions); err != nil {
+			return nil, err
+		}
+		return actions, nil
+	}
+	return nil, fmt.Errorf("device type %s has no template, use one of %s or pass -actions", deviceType, strings.Join(known, ", "))
+}
+
+func main() {
+	defaults := config.Default().MQTT
+	brokerURL := flag.String("broker", "tcp://localhost:1883", "broker URL, tcp://, ssl:// and ws:// are supported")
+	count := flag.Int("devices", 1, "number of simulated devices")
+	deviceType := flag.String("type", "temperature_sensor", "device type sent at login")
+	actionsFlag := flag.String("actions", "", "actions as name=type pairs separated by commas, the template of -type when empty")
+	name := flag.String("name", "Simulated", "device names are this prefix followed by the type and number")
+	seed := flag.String("seed", "simulator", "devices are given the same UUIDs in every run with the same seed")
+	token := flag.String("token", os.Getenv("PROVISIONING_TOKEN"), "provisioning token of devices that have no secret yet, it needs a use per device")
+	secretsPath := flag.String("secrets", "simulator-secrets.json", "file the issued secrets are kept in between runs")
+	interval := flag.Duration("interval", 5*time.Second, "provide_value interval, devices with an Interval_ms action take it from their state")
+	shape := flag.String("waveform", "sine", "readings follow a sine, square, sawtooth, random, walk or constant waveform")
+	minValue := flag.Float64("min", 0, "lowest reading")
+	maxValue := flag.Float64("max", 100, "highest reading")
+	period := flag.Duration("period", 10*time.Minute, "period of the sine, square and sawtooth waveforms")
+	noise := flag.Float64("noise", 0, "amplitude of uniform noise added to every reading")
+	heartbeat := flag.Duration("heartbeat", 0, "heartbeat interval announced at login, 0 sends no heartbeats")
+	loginResponseTopic := flag.String("login-response-topic", defaults.LoginResponseTopic, "MQTT_LOGIN_RESPONSE_TOPIC of the server")
+	commandTopic := flag.String("command-topic", defaults.CommandTopic, "MQTT_COMMAND_TOPIC of the server")
+	flag.Parse()
+
+	if *count < 1 {
+		log.Fatal("at least one device has to be simulated")
+	}
+	if *interval <= 0 {
+		log.Fatal("the interval has to be positive")
+	}
+	if *heartbeat < 0 {
+		log.Fatal("the heartbeat interval can not be negative")
+	}
+
+	var actions map[string]model.ActionType
+	var err error
+	if *actionsFlag != "" {
+		actions, err = parseActions(*actionsFlag)
+	} else {
+		actions, err = templateActions(model.DeviceType(*deviceType))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	shapeWaveform, err := newWaveform(*shape, *minValue, *maxValue, *period, *noise)
+	if err != nil {
+		log.Fatal(err)
+	}
+	secrets, err := loadSecrets(*secretsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deviceSettings := &settings{
+		brokerURL:          *brokerURL,
+		provisioningToken:  *token,
+		secrets:            secrets,
+		waveform:           shapeWaveform,
+		interval:           *interval,
+		heartbeat:          *heartbeat,
+		loginResponseTopic: *loginResponseTopic,
+		commandTopic:       *commandTopic,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("simulating %d %s devices on %s\n", *count, *deviceType, *brokerURL)
+	devices := make([]*device, 0, *count)
+	for i := 0; i < *count; i++ {
+		number := i + 1
+		d := newDevice(
+			deviceUuid(*seed, model.DeviceType(*deviceType), number),
+			fmt.Sprintf("%s %s %d", *name, *deviceType, number),
+			model.DeviceType(*deviceType),
+			actions,
+			float64(i)/float64(*count),
+			deviceSettings,
+		)
+		d.start()
+		devices = append(devices, d)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(connectSpacing):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	<-ctx.Done()
+	fmt.Println("stopping the simulated devices")
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			d.shutdown()
+		}(d)
+	}
+	wg.Wait()
+}
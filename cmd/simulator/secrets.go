@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// secretStore keeps the secrets issued to the simulated devices in a JSON file, like the sketches keep theirs in
+// flash, so the devices log in with their secret on the next run instead of using up another provisioning token
+type secretStore struct {
+	mu      sync.Mutex
+	path    string
+	secrets map[string]string
+}
+
+// loadSecrets reads the secrets of earlier runs, a missing file is not an error
+func loadSecrets(path string) (*secretStore, error) {
+	store := &secretStore{path: path, secrets: make(map[string]string)}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the secrets file: %v", err)
+	}
+	if err = json.Unmarshal(content, &store.secrets); err != nil {
+		return nil, fmt.Errorf("secrets file %s is not a JSON object of UUIDs and secrets: %v", path, err)
+	}
+	return store, nil
+}
+
+func (s *secretStore) Get(uuid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secrets[uuid]
+}
+
+// Set stores the secret and rewrites the file, it is replaced in one step so a crash never leaves half of it
+func (s *secretStore) Set(uuid string, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secrets[uuid] = secret
+
+	content, err := json.MarshalIndent(s.secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(s.path), ".simulator-secrets-*")
+	if err != nil {
+		return fmt.Errorf("failed to write the secrets file: %v", err)
+	}
+	defer func(name string) {
+		// no-op once the file was renamed
+		_ = os.Remove(name)
+	}(temporary.Name())
+	if _, err = temporary.Write(content); err != nil {
+		_ = temporary.Close()
+		return fmt.Errorf("failed to write the secrets file: %v", err)
+	}
+	if err = temporary.Close(); err != nil {
+		return fmt.Errorf("failed to write the secrets file: %v", err)
+	}
+	if err = os.Rename(temporary.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write the secrets file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// waveform generates the provide_value readings, the periodic shapes go from min to max and back once per period
+type waveform struct {
+	shape  string
+	min    float64
+	max    float64
+	period time.Duration
+	// noise is the amplitude of uniform noise added to every reading
+	noise float64
+}
+
+func newWaveform(shape string, min float64, max float64, period time.Duration, noise float64) (*waveform, error) {
+	switch shape {
+	case "sine", "square", "sawtooth", "random", "walk", "constant":
+	default:
+		return nil, fmt.Errorf("unknown waveform %s, use sine, square, sawtooth, random, walk or constant", shape)
+	}
+	if max < min {
+		return nil, fmt.Errorf("the maximum %g is below the minimum %g", max, min)
+	}
+	if period <= 0 {
+		return nil, fmt.Errorf("the period has to be positive, got %s", period)
+	}
+	if noise < 0 {
+		return nil, fmt.Errorf("the noise can not be negative, got %g", noise)
+	}
+	return &waveform{shape: shape, min: min, max: max, period: period, noise: noise}, nil
+}
+
+// sample returns the reading at elapsed, phase (0 to 1) shifts the periodic shapes so devices do not report in
+// lockstep and previous is the last reading, which the random walk continues from (NaN before the first reading)
+func (w *waveform) sample(elapsed time.Duration, phase float64, previous float64) float64 {
+	position := math.Mod(elapsed.Seconds()/w.period.Seconds()+phase, 1)
+	amplitude := w.max - w.min
+
+	var value float64
+	switch w.shape {
+	case "sine":
+		value = w.min + amplitude*(1+math.Sin(2*math.Pi*position))/2
+	case "square":
+		value = w.max
+		if position >= 0.5 {
+			value = w.min
+		}
+	case "sawtooth":
+		value = w.min + amplitude*position
+	case "random":
+		value = w.min + amplitude*rand.Float64()
+	case "walk":
+		// a tenth of the range at most per reading, starting from the middle
+		if math.IsNaN(previous) {
+			previous = w.min + amplitude/2
+		}
+		value = math.Max(w.min, math.Min(w.max, previous+amplitude*(rand.Float64()-0.5)/5))
+	case "constant":
+		value = w.min + amplitude/2
+	}
+
+	value += w.noise * (2*rand.Float64() - 1)
+	return math.Round(value*100) / 100
+}
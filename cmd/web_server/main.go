@@ -1,120 +1,536 @@
 package main
 
 import (
+	"NSI-semester-work/internal/alerts"
+	"NSI-semester-work/internal/api_handlers"
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/broker"
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/config"
 	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/health"
 	"NSI-semester-work/internal/http_handlers"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/metrics"
 	"NSI-semester-work/internal/model"
 	"NSI-semester-work/internal/mqtt_handlers"
+	"NSI-semester-work/internal/presence"
+	"NSI-semester-work/internal/rules"
+	"NSI-semester-work/internal/scheduler"
+	"NSI-semester-work/internal/sse"
+	"NSI-semester-work/internal/webhooks"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
+	// schedules are evaluated in their own timezone, the container image has no zoneinfo
+	_ "time/tzdata"
 )
 
-func setupMqttClient() (MQTT.Client, error) {
-	var broker = os.Getenv("MQTT_BROKER")
-	var port = os.Getenv("MQTT_PORT")
+// mqttTLSConfig builds the TLS configuration of an mqtts connection, the system roots are trusted unless a CA bundle
+// is configured and a client certificate is only presented when one is configured
+func mqttTLSConfig(mqttConfig config.MQTTConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if mqttConfig.CAFile != "" {
+		bundle, err := os.ReadFile(mqttConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the MQTT CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("MQTT CA bundle %s contains no PEM certificates", mqttConfig.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if mqttConfig.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(mqttConfig.CertFile, mqttConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the MQTT client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// mqttClientId returns the configured client ID or a random one, the broker disconnects a client when another one
+// connects with the same ID, so every server instance needs its own
+func mqttClientId(mqttConfig config.MQTTConfig) (string, error) {
+	if mqttConfig.ClientID != "" {
+		return mqttConfig.ClientID, nil
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate MQTT client ID: %v", err)
+	}
+	return "go_web_server_mqtt_client_" + hex.EncodeToString(suffix), nil
+}
+
+// setupEmbeddedBroker starts the in-process broker and its listeners, devices are checked against their provisioning
+// only with device auth enabled
+func setupEmbeddedBroker(mqttConfig config.MQTTConfig, database db.Store) (*broker.Broker, error) {
+	embeddedConfig := mqttConfig.Embedded
+	var authenticator broker.Authenticator
+	if embeddedConfig.DeviceAuth {
+		authenticator = broker.NewDeviceAuthenticator(database, mqttConfig.LoginResponseTopic, mqttConfig.CommandTopic)
+	}
+	embedded := broker.New(authenticator)
+	if embeddedConfig.TCPAddress != "" {
+		if err := embedded.ListenTCP(embeddedConfig.TCPAddress); err != nil {
+			return nil, err
+		}
+		slog.Info("embedded mqtt broker listening", "address", embeddedConfig.TCPAddress)
+	}
+	if embeddedConfig.WebSocketAddress != "" {
+		if err := embedded.ListenWebSocket(embeddedConfig.WebSocketAddress); err != nil {
+			_ = embedded.Close()
+			return nil, err
+		}
+		slog.Info("embedded mqtt broker listening for websockets", "address", embeddedConfig.WebSocketAddress)
+	}
+	return embedded, nil
+}
+
+// setupMqttClient connects to the external broker, or in-process to the embedded one when it is not nil
+func setupMqttClient(mqttConfig config.MQTTConfig, embedded *broker.Broker, subscriptions *mqtt_handlers.Subscriptions) (MQTT.Client, error) {
 	opts := MQTT.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("mqtt://%s:%s", broker, port))
-	opts.SetClientID("go_web_server_mqtt_client")
-	opts.SetOnConnectHandler(mqtt_handlers.OnConnectHandler)
-	opts.SetConnectionLostHandler(mqtt_handlers.OnConnectionLost)
+	brokerURL := mqttConfig.BrokerURL()
+	if embedded != nil {
+		brokerURL = "mqtt://embedded"
+		opts.AddBroker(brokerURL)
+		opts.SetCustomOpenConnectionFn(func(*url.URL, MQTT.ClientOptions) (net.Conn, error) {
+			return embedded.Connect(), nil
+		})
+	} else {
+		if mqttConfig.TLS {
+			tlsConfig, err := mqttTLSConfig(mqttConfig)
+			if err != nil {
+				return nil, err
+			}
+			opts.SetTLSConfig(tlsConfig)
+		}
+		opts.AddBroker(brokerURL)
+		if mqttConfig.Username != "" {
+			opts.SetUsername(mqttConfig.Username)
+			opts.SetPassword(mqttConfig.Password)
+		}
+	}
+
+	clientId, err := mqttClientId(mqttConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetClientID(clientId)
+	opts.SetOnConnectHandler(func(client MQTT.Client) {
+		mqtt_handlers.OnConnectHandler(client)
+		subscriptions.OnConnect(client)
+	})
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		mqtt_handlers.OnConnectionLost(client, err)
+		subscriptions.OnConnectionLost(client, err)
+	})
 	opts.SetReconnectingHandler(mqtt_handlers.OnReconnectingHandler)
 	opts.SetAutoReconnect(true)
 	opts.SetOrderMatters(false)
 	opts.SetMaxReconnectInterval(time.Second * 10)
 
 	client := MQTT.NewClient(opts)
-	fmt.Println("connecting to mqtt broker")
+	slog.Info("connecting to mqtt broker", "broker", brokerURL, "client_id", clientId)
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		return nil, fmt.Errorf("unable to connect to client %s\n", token.Error())
+		return nil, fmt.Errorf("unable to connect to client: %v", token.Error())
 	}
 
 	return client, nil
 }
 
-func setupMqttSubscriptionHandlers(client MQTT.Client, database *db.Database, sseChannel chan model.Update) error {
-	if token := client.Subscribe("login/request/+", 0, func(client MQTT.Client, msg MQTT.Message) {
-		mqtt_handlers.HandleDeviceLogin(client, msg, database)
-	}); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to login topic: %v", token.Error())
-	}
-	if token := client.Subscribe("provide_value/+", 1, func(client MQTT.Client, msg MQTT.Message) { mqtt_handlers.ValueProvidedHandler(msg, database) }); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to post topic: %v", token.Error())
+// handleMessage counts the messages of a topic type and logs and counts the errors of their handler. Every message
+// gets an ID, the handler logs with logging.FromContext so its lines carry it, the topic and the device UUID.
+func handleMessage(topicType string, handler func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error) MQTT.MessageHandler {
+	return func(client MQTT.Client, msg MQTT.Message) {
+		metrics.MQTTMessages.WithLabelValues(topicType).Inc()
+
+		logger := slog.Default().With(slog.String(logging.KeyMessageID, logging.NewID()), slog.String("topic", msg.Topic()))
+		// every topic the server subscribes to ends with the UUID of the device
+		if levels := strings.Split(msg.Topic(), "/"); len(levels) >= 2 {
+			logger = logger.With(logging.DeviceUUID(levels[len(levels)-1]))
+		}
+		if err := handler(logging.NewContext(context.Background(), logger), client, msg); err != nil {
+			metrics.MQTTHandlerErrors.WithLabelValues(topicType).Inc()
+			logger.Error("failed to handle mqtt message", "topic_type", topicType, "error", err)
+		}
 	}
+}
+
+// setupMqttSubscriptionHandlers subscribes to the device topics, subscriptions renews them after every reconnect
+func setupMqttSubscriptionHandlers(client MQTT.Client, subscriptions *mqtt_handlers.Subscriptions, mqttConfig config.MQTTConfig, database db.Store, statePipeline *mqtt_handlers.StatePipeline, valuePipeline *mqtt_handlers.ValuePipeline, tracker *presence.Tracker, sender *commands.Sender, dispatcher *webhooks.Dispatcher) error {
+	subscriptions.Add("login/request/+", 0, handleMessage("login", func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error {
+		return mqtt_handlers.HandleDeviceLogin(ctx, client, msg, database, mqttConfig.LoginResponseTopic, func(device model.Device) {
+			tracker.SetHeartbeatInterval(device.ID, time.Duration(device.HeartbeatIntervalMs)*time.Millisecond)
+			tracker.Seen(device.ID)
+		}, dispatcher.HandleLogin)
+	}))
+	subscriptions.Add("status/+", 1, handleMessage("status", func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error {
+		return mqtt_handlers.StatusHandler(ctx, msg, database, tracker)
+	}))
+	subscriptions.Add("provide_value/+", 1, handleMessage("provide_value", func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error {
+		return mqtt_handlers.ValueProvidedHandler(ctx, msg, valuePipeline)
+	}))
+	subscriptions.Add("state/+", 1, handleMessage("state", func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error {
+		return mqtt_handlers.StateUpdatedHandler(ctx, msg, statePipeline)
+	}))
+	subscriptions.Add("ack/+", 1, handleMessage("ack", func(ctx context.Context, client MQTT.Client, msg MQTT.Message) error {
+		return mqtt_handlers.AckHandler(ctx, msg, database, sender)
+	}))
+
+	return subscriptions.Subscribe(client)
+}
+
+// setupHealthChecker checks the dependencies the server can not work without, the database and the broker connection
+// with the subscriptions to the device topics
+func setupHealthChecker(database db.Store, client MQTT.Client, subscriptions *mqtt_handlers.Subscriptions) *health.Checker {
+	checker := health.NewChecker(health.DefaultTimeout)
+	checker.Add("database", database.PingContext)
+	checker.Add("mqtt", func(ctx context.Context) error {
+		if !client.IsConnectionOpen() {
+			return errors.New("not connected to the mqtt broker")
+		}
+		return nil
+	})
+	checker.Add("mqtt_subscriptions", func(ctx context.Context) error {
+		return subscriptions.Check()
+	})
+	return checker
+}
 
-	if token := client.Subscribe("state/+", 1, func(client MQTT.Client, msg MQTT.Message) {
-		mqtt_handlers.StateUpdatedHandler(msg, database, sseChannel)
-	}); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to post topic: %v", token.Error())
+// setupAlertManager configures the notification channels, in-app notifications are always available while webhook and
+// email notifications are enabled by their configuration
+func setupAlertManager(alertsConfig config.AlertsConfig, database db.Store, hub *sse.Hub) *alerts.Manager {
+	notifiers := []alerts.Notifier{alerts.NewInAppNotifier(hub)}
+	if alertsConfig.WebhookURL != "" {
+		notifiers = append(notifiers, alerts.NewWebhookNotifier(alertsConfig.WebhookURL))
+	}
+	if smtp := alertsConfig.SMTP; smtp.Host != "" {
+		notifiers = append(notifiers, alerts.NewEmailNotifier(smtp.Host, smtp.Port, smtp.Username, smtp.Password,
+			smtp.From, smtp.To))
 	}
 
-	return nil
+	manager := alerts.NewManager(database, notifiers...)
+	if err := manager.Reload(); err != nil {
+		fatal("failed to load the alert definitions", err)
+	}
+	go manager.Run(nil)
+	return manager
 }
 
-func setupHttpServer(database *db.Database, mqttClient MQTT.Client, sseChannel chan model.Update) error {
-	serverHostname := os.Getenv("HTTP_SERVER_HOST")
-	port := os.Getenv("HTTP_SERVER_PORT")
+// setupPresenceTracker pushes presence changes over SSE, persists the last-seen time and supervises heartbeats
+func setupPresenceTracker(database db.Store, hub *sse.Hub) *presence.Tracker {
+	tracker := presence.NewTracker()
+	tracker.Attach(hub.PublishPresence)
+	tracker.Attach(func(p model.Presence) {
+		if p.LastSeen.IsZero() {
+			return
+		}
+		if err := database.UpdateDeviceLastSeen(p.DeviceID, p.LastSeen); err != nil {
+			slog.Error("failed to store the last-seen time", logging.DeviceID(p.DeviceID), "error", err)
+		}
+	})
+	go tracker.Run(5*time.Second, nil)
+	return tracker
+}
 
+func setupHttpServer(httpConfig config.HTTPConfig, checker *health.Checker, database db.Store, hub *sse.Hub, tracker *presence.Tracker, sender *commands.Sender, engine *rules.Engine, schedules *scheduler.Scheduler, alertManager *alerts.Manager, dispatcher *webhooks.Dispatcher) error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { http_handlers.HomeHandler(w, database) })
-	mux.HandleFunc("/dashboard_creator", func(w http.ResponseWriter, r *http.Request) { http_handlers.DashboardCreatorHandler(w, database) })
-	mux.HandleFunc("/device_features/{id}", func(w http.ResponseWriter, r *http.Request) { http_handlers.DeviceFeaturesHandler(w, r, database) })
-	mux.HandleFunc("/create_dashboard", func(w http.ResponseWriter, r *http.Request) { http_handlers.CreateDashboardHandler(w, r, database) })
-	mux.HandleFunc("/dashboard/{id}", func(w http.ResponseWriter, r *http.Request) { http_handlers.DisplayDashboardHandler(w, r, database) })
-	mux.HandleFunc("/device/{device_id}/command/{action_name}", func(w http.ResponseWriter, r *http.Request) {
-		http_handlers.SendCommandHandler(w, r, mqttClient, database)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { http_handlers.HomeHandler(w, r, database) })
+	mux.HandleFunc("GET /login", func(w http.ResponseWriter, r *http.Request) { http_handlers.LoginPageHandler(w, r, database) })
+	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) { http_handlers.LoginHandler(w, r, database) })
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) { http_handlers.LogoutHandler(w, r, database) })
+	mux.HandleFunc("GET /setup", func(w http.ResponseWriter, r *http.Request) { http_handlers.SetupPageHandler(w, r, database) })
+	mux.HandleFunc("POST /setup", func(w http.ResponseWriter, r *http.Request) { http_handlers.SetupHandler(w, r, database) })
+	mux.HandleFunc("GET /account", http_handlers.AccountHandler)
+	mux.HandleFunc("POST /account/password", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.ChangePasswordHandler(w, r, database)
+	})
+	// admin registers pages that only admins may use, everybody else only sees and controls what was granted to them
+	admin := func(pattern string, handler http.HandlerFunc) { mux.HandleFunc(pattern, auth.RequireAdmin(handler)) }
+	admin("GET /users", func(w http.ResponseWriter, r *http.Request) { http_handlers.UsersHandler(w, r, database) })
+	admin("POST /users", func(w http.ResponseWriter, r *http.Request) { http_handlers.CreateUserHandler(w, r, database) })
+	admin("POST /users/{user_id}/role", func(w http.ResponseWriter, r *http.Request) { http_handlers.SetUserRoleHandler(w, r, database) })
+	admin("GET /users/{user_id}/grants", func(w http.ResponseWriter, r *http.Request) { http_handlers.GrantsHandler(w, r, database) })
+	admin("POST /users/{user_id}/grants", func(w http.ResponseWriter, r *http.Request) { http_handlers.UpdateGrantsHandler(w, r, database) })
+	admin("DELETE /users/{user_id}", func(w http.ResponseWriter, r *http.Request) { http_handlers.DeleteUserHandler(w, r, database) })
+	admin("/dashboard_creator", func(w http.ResponseWriter, r *http.Request) { http_handlers.DashboardCreatorHandler(w, r, database) })
+	admin("GET /devices", func(w http.ResponseWriter, r *http.Request) { http_handlers.DevicesHandler(w, r, database, tracker) })
+	admin("POST /devices", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.CreateDeviceHandler(w, r, database, tracker)
+	})
+	admin("POST /devices/{device_id}/secret", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.RegenerateDeviceSecretHandler(w, r, database, tracker)
+	})
+	admin("POST /devices/{device_id}/rename", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.RenameDeviceHandler(w, r, database, tracker)
+	})
+	admin("POST /devices/{device_id}/retire", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.RetireDeviceHandler(w, r, database, tracker)
+	})
+	admin("DELETE /devices/{device_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteDeviceHandler(w, r, database, tracker)
+	})
+	admin("POST /provisioning_tokens", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.CreateProvisioningTokenHandler(w, r, database, tracker)
+	})
+	admin("DELETE /provisioning_tokens/{token_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteProvisioningTokenHandler(w, r, database, tracker)
+	})
+	admin("GET /rules", func(w http.ResponseWriter, r *http.Request) { http_handlers.RulesHandler(w, r, database) })
+	admin("POST /rules", func(w http.ResponseWriter, r *http.Request) { http_handlers.CreateRuleHandler(w, r, database, engine) })
+	admin("POST /rules/{rule_id}/enabled", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.SetRuleEnabledHandler(w, r, database, engine)
+	})
+	admin("DELETE /rules/{rule_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteRuleHandler(w, r, database, engine)
+	})
+	admin("GET /schedules", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.SchedulesHandler(w, r, database, schedules)
+	})
+	admin("POST /schedules", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.CreateScheduleHandler(w, r, database, schedules)
+	})
+	admin("POST /schedules/{schedule_id}/paused", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.PauseScheduleHandler(w, r, database, schedules)
+	})
+	admin("DELETE /schedules/{schedule_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteScheduleHandler(w, r, database, schedules)
+	})
+	admin("GET /alerts", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.AlertsHandler(w, r, database, alertManager)
+	})
+	admin("POST /alerts", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.CreateAlertDefinitionHandler(w, r, database, alertManager)
+	})
+	admin("POST /alerts/{definition_id}/enabled", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.SetAlertDefinitionEnabledHandler(w, r, database, alertManager)
+	})
+	admin("DELETE /alerts/{definition_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteAlertDefinitionHandler(w, r, database, alertManager)
+	})
+	admin("GET /webhooks", func(w http.ResponseWriter, r *http.Request) { http_handlers.WebhooksHandler(w, r, database) })
+	admin("POST /webhooks", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.CreateWebhookSubscriptionHandler(w, r, database, dispatcher)
+	})
+	admin("POST /webhooks/{subscription_id}/enabled", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.SetWebhookSubscriptionEnabledHandler(w, r, database, dispatcher)
+	})
+	admin("DELETE /webhooks/{subscription_id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DeleteWebhookSubscriptionHandler(w, r, database, dispatcher)
+	})
+	admin("/device_features/{id}", func(w http.ResponseWriter, r *http.Request) { http_handlers.DeviceFeaturesHandler(w, r, database) })
+	admin("/create_dashboard", func(w http.ResponseWriter, r *http.Request) { http_handlers.CreateDashboardHandler(w, r, database) })
+	mux.HandleFunc("/dashboard/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.DisplayDashboardHandler(w, r, database, tracker)
+	})
+	admin("DELETE /dashboard/{id}", func(w http.ResponseWriter, r *http.Request) { http_handlers.DeleteDashboardHandler(w, r, database) })
+	admin("GET /dashboard/{id}/edit", func(w http.ResponseWriter, r *http.Request) { http_handlers.EditDashboardHandler(w, r, database) })
+	admin("POST /dashboard/{id}/edit", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.UpdateDashboardHandler(w, r, database, tracker)
+	})
+	mux.HandleFunc("POST /device/{device_id}/command/{action_name}", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.SendCommandHandler(w, r, sender)
 	})
 	mux.HandleFunc("/device/{device_id}/provide_value/{action_name}", func(w http.ResponseWriter, r *http.Request) { http_handlers.GetLastSensorValueHandler(w, r, database) })
-	mux.HandleFunc("/device/{device_id}/toggle/{action_name}", func(w http.ResponseWriter, r *http.Request) { http_handlers.ToggleHandler(w, r, database, mqttClient) })
+	mux.HandleFunc("POST /device/{device_id}/toggle/{action_name}", func(w http.ResponseWriter, r *http.Request) { http_handlers.ToggleHandler(w, r, sender) })
 	mux.HandleFunc("/sseStateUpdates", func(w http.ResponseWriter, r *http.Request) {
-		http_handlers.SseStateHandler(w, r, database, sseChannel)
+		http_handlers.SseStateHandler(w, r, database, hub)
 	})
 	mux.HandleFunc("/device/{device_id}/state/{action_name}", func(w http.ResponseWriter, r *http.Request) { http_handlers.GetDeviceState(w, r, database) })
-	mux.HandleFunc("/device/number_input", func(w http.ResponseWriter, r *http.Request) {
-		http_handlers.NumberInputHandler(w, r, database, mqttClient)
+	mux.HandleFunc("POST /device/number_input", func(w http.ResponseWriter, r *http.Request) {
+		http_handlers.NumberInputHandler(w, r, sender)
+	})
+
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) { api_handlers.NotFoundHandler(w, r, mux) })
+	mux.HandleFunc("GET /api/v1/devices", func(w http.ResponseWriter, r *http.Request) { api_handlers.ListDevicesHandler(w, r, database, tracker) })
+	mux.HandleFunc("GET /api/v1/devices/{device_id}", func(w http.ResponseWriter, r *http.Request) { api_handlers.GetDeviceHandler(w, r, database, tracker) })
+	mux.HandleFunc("GET /api/v1/devices/{device_id}/state", func(w http.ResponseWriter, r *http.Request) { api_handlers.GetDeviceStateHandler(w, r, database) })
+	mux.HandleFunc("GET /api/v1/devices/{device_id}/values/latest", func(w http.ResponseWriter, r *http.Request) { api_handlers.GetLatestValuesHandler(w, r, database) })
+	mux.HandleFunc("GET /api/v1/devices/{device_id}/telemetry/{action_name}", func(w http.ResponseWriter, r *http.Request) {
+		api_handlers.GetTelemetryHistoryHandler(w, r, database)
 	})
+	mux.HandleFunc("POST /api/v1/devices/{device_id}/actions/{action_name}", func(w http.ResponseWriter, r *http.Request) {
+		api_handlers.SendActionHandler(w, r, database, sender)
+	})
+	mux.HandleFunc("GET /api/v1/devices/{device_id}/commands", func(w http.ResponseWriter, r *http.Request) {
+		api_handlers.ListDeviceCommandsHandler(w, r, database)
+	})
+	mux.HandleFunc("GET /api/v1/commands/{correlation_id}", func(w http.ResponseWriter, r *http.Request) { api_handlers.GetCommandHandler(w, r, database) })
+	mux.HandleFunc("GET /api/v1/dashboards", func(w http.ResponseWriter, r *http.Request) { api_handlers.ListDashboardsHandler(w, r, database) })
+	mux.HandleFunc("GET /api/v1/dashboards/{dashboard_id}", func(w http.ResponseWriter, r *http.Request) { api_handlers.GetDashboardHandler(w, r, database) })
+
+	// the metrics and health checks are served without a session so Prometheus and orchestrators can reach them
+	root := http.NewServeMux()
+	root.Handle("GET /metrics", metrics.Handler())
+	root.HandleFunc("GET /healthz", health.LiveHandler)
+	root.HandleFunc("GET /readyz", checker.ReadyHandler)
+	root.Handle("/", metrics.InstrumentHTTP(mux, logging.Middleware(auth.RequireLogin(database, mux))))
 
-	fmt.Printf("starting HTTP server: http://%s:%s\n", serverHostname, port)
-	if err := http.ListenAndServe(fmt.Sprintf("%s:%s", serverHostname, port), mux); err != nil {
-		return fmt.Errorf("unable to start server %s\n", err)
+	slog.Info("starting HTTP server", "address", httpConfig.Address())
+	if err := http.ListenAndServe(httpConfig.Address(), root); err != nil {
+		return fmt.Errorf("unable to start server: %v", err)
 	}
 	return nil
 }
 
+// runMigrateCommand runs "migrate up|down|status", up applies every pending migration (or up to -to), down reverts
+// the last -steps migrations and -dry-run prints the SQL instead of running it
+func runMigrateCommand(database *db.Database, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migrations that would run without running them")
+	target := flags.Int("to", 0, "up: the last version to apply, 0 applies every migration")
+	steps := flags.Int("steps", 1, "down: how many migrations to revert")
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status [-dry-run] [-to version] [-steps n]")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	migrator := db.NewMigrator(database, os.Stdout)
+	migrator.DryRun = *dryRun
+	switch args[0] {
+	case "up":
+		return migrator.Up(*target)
+	case "down":
+		return migrator.Down(*steps)
+	case "status":
+		return migrator.Status()
+	default:
+		return fmt.Errorf("unknown migrate command %s, use up, down or status", args[0])
+	}
+}
+
+// fatal logs the error with the configured logger and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
-	sseChannel := make(chan model.Update, 10)
-	mqttClient, err := setupMqttClient()
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML configuration file, environment variables override its values")
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatal(err)
-		return
 	}
-
-	dataSourceName := fmt.Sprintf("postgresql://%s:%s@%s/%s?sslmode=disable",
-		os.Getenv("POSTGRES_USER"),
-		os.Getenv("POSTGRES_PASSWORD"),
-		os.Getenv("POSTGRES_HOSTNAME"),
-		os.Getenv("POSTGRES_DB"),
-	)
-	database, err := db.NewDatabase(dataSourceName)
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	if err = logging.Setup(os.Stderr, cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatal(err)
 	}
-	defer func(database *db.Database) {
-		err = database.Close()
+
+	var database db.Store
+	if cfg.Demo {
+		if flag.Arg(0) == "migrate" {
+			slog.Error("there is nothing to migrate in demo mode, the data is kept in memory")
+			os.Exit(1)
+		}
+		slog.Info("demo mode: data is kept in memory and lost when the server stops")
+		database = db.NewMemoryStore()
+	} else {
+		postgres, err := db.NewDatabase(cfg.Postgres.DataSourceName())
 		if err != nil {
+			fatal("failed to connect to the database", err)
+		}
+		defer func(postgres *db.Database) {
+			err = postgres.Close()
+			if err != nil {
 
+			}
+		}(postgres)
+
+		if flag.Arg(0) == "migrate" {
+			if err = runMigrateCommand(postgres, flag.Args()[1:]); err != nil {
+				fatal("migration failed", err)
+			}
+			return
+		}
+		if cfg.Postgres.AutoMigrate {
+			if err = db.NewMigrator(postgres, os.Stdout).Up(0); err != nil {
+				fatal("failed to migrate the database", err)
+			}
 		}
-	}(database)
+		database = postgres
+	}
 
-	err = setupMqttSubscriptionHandlers(mqttClient, database, sseChannel)
+	hub := sse.NewHub()
+	var embeddedBroker *broker.Broker
+	if cfg.MQTT.Embedded.Enabled {
+		if embeddedBroker, err = setupEmbeddedBroker(cfg.MQTT, database); err != nil {
+			fatal("failed to start the embedded mqtt broker", err)
+		}
+		defer func(embeddedBroker *broker.Broker) {
+			err = embeddedBroker.Close()
+			if err != nil {
+
+			}
+		}(embeddedBroker)
+	}
+	subscriptions := mqtt_handlers.NewSubscriptions()
+	mqttClient, err := setupMqttClient(cfg.MQTT, embeddedBroker, subscriptions)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to connect to the mqtt broker", err)
 	}
 
-	if err = setupHttpServer(database, mqttClient, sseChannel); err != nil {
-		log.Fatal(err)
+	tracker := setupPresenceTracker(database, hub)
+
+	statePipeline := mqtt_handlers.NewStatePipeline(database)
+	statePipeline.Attach(hub.PublishUpdate)
+	statePipeline.Attach(func(update model.Update) { tracker.Seen(update.DeviceID) })
+	valuePipeline := mqtt_handlers.NewValuePipeline(database)
+	valuePipeline.Attach(hub.PublishReading)
+	valuePipeline.Attach(func(reading model.Reading) { tracker.Seen(reading.DeviceID) })
+
+	sender := commands.NewSender(database, mqttClient, tracker, commands.DefaultAckTimeout, cfg.MQTT.CommandTopic)
+	sender.Attach(hub.PublishCommand)
+
+	engine := rules.NewEngine(database, sender)
+	if err = engine.Reload(); err != nil {
+		fatal("failed to load the rules", err)
+	}
+	statePipeline.Attach(engine.HandleUpdate)
+	valuePipeline.Attach(engine.HandleReading)
+
+	alertManager := setupAlertManager(cfg.Alerts, database, hub)
+	valuePipeline.Attach(alertManager.HandleReading)
+
+	dispatcher := webhooks.NewDispatcher(database)
+	if err = dispatcher.Start(); err != nil {
+		fatal("failed to start the webhook dispatcher", err)
+	}
+	statePipeline.Attach(dispatcher.HandleUpdate)
+	valuePipeline.Attach(dispatcher.HandleReading)
+	sender.Attach(dispatcher.HandleCommand)
+
+	schedules := scheduler.NewScheduler(database, sender)
+	if err = schedules.Start(); err != nil {
+		fatal("failed to start the scheduler", err)
+	}
+	defer schedules.Stop()
+
+	err = setupMqttSubscriptionHandlers(mqttClient, subscriptions, cfg.MQTT, database, statePipeline, valuePipeline, tracker, sender, dispatcher)
+	if err != nil {
+		fatal("failed to subscribe to the device topics", err)
+	}
+
+	if err = setupHttpServer(cfg.HTTP, setupHealthChecker(database, mqttClient, subscriptions), database, hub, tracker, sender, engine, schedules, alertManager, dispatcher); err != nil {
+		fatal("http server stopped", err)
 	}
 }
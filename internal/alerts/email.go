@@ -0,0 +1,112 @@
+package alerts
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailNotifier sends notifications as plain text emails, authentication is only used when a username is set
+type EmailNotifier struct {
+	host string
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+func NewEmailNotifier(host string, port string, username string, password string, from string, to []string) *EmailNotifier {
+	notifier := &EmailNotifier{
+		host: host,
+		addr: net.JoinHostPort(host, port),
+		from: from,
+		to:   to,
+	}
+	if username != "" {
+		notifier.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return notifier
+}
+
+func (en *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (en *EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", en.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(en.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", notification.Subject())
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(notification.Message())
+	message.WriteString("\r\n")
+
+	if err := en.send(ctx, []byte(message.String())); err != nil {
+		return fmt.Errorf("failed to send alert email: %v", err)
+	}
+	return nil
+}
+
+// send does what smtp.SendMail does, but the connection gets the deadline of ctx and is closed when ctx is cancelled
+// so a server that stops answering can not block the notification forever
+func (en *EmailNotifier) send(ctx context.Context, message []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", en.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, en.host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: en.host}); err != nil {
+			return err
+		}
+	}
+	if en.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("the server does not support authentication")
+		}
+		if err = client.Auth(en.auth); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(en.from); err != nil {
+		return err
+	}
+	for _, to := range en.to {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,53 @@
+package alerts
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEmailNotifierStopsAtTheDeadline(t *testing.T) {
+	// the server accepts the connection but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := NewEmailNotifier(host, port, "", "", "iot@example.com", []string{"admin@example.com"})
+	for name, newContext := range map[string]func() (context.Context, context.CancelFunc){
+		"deadline": func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		},
+		"cancellation": func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			return ctx, cancel
+		},
+	} {
+		ctx, cancel := newContext()
+		started := time.Now()
+		err = notifier.Notify(ctx, Notification{})
+		cancel()
+		if err == nil {
+			t.Errorf("%s: a server that never answered accepted the email", name)
+		}
+		if elapsed := time.Since(started); elapsed > 5*time.Second {
+			t.Errorf("%s: Notify returned after %v", name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package alerts
+
+import (
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/sse"
+	"context"
+	"fmt"
+	"html"
+)
+
+// InAppNotifier pushes notifications over SSE as an "alert" event to every open web interface whose user may see the
+// device
+type InAppNotifier struct {
+	hub *sse.Hub
+}
+
+func NewInAppNotifier(hub *sse.Hub) *InAppNotifier {
+	return &InAppNotifier{hub: hub}
+}
+
+func (ian *InAppNotifier) Name() string {
+	return "in_app"
+}
+
+func (ian *InAppNotifier) Notify(_ context.Context, notification Notification) error {
+	class := "alert-danger"
+	if notification.Alert.State == model.AlertResolved {
+		class = "alert-success"
+	}
+	// the event is swapped into the page as is, so everything coming from users or devices is escaped
+	ian.hub.Publish(sse.Event{
+		Name: "alert",
+		Data: fmt.Sprintf(`<div class="alert %s alert-dismissible" role="alert"><strong>%s</strong> %s`+
+			`<button type="button" class="btn-close" data-bs-dismiss="alert" aria-label="Close"></button></div>`,
+			class, html.EscapeString(notification.Subject()), html.EscapeString(notification.Message())),
+		DeviceID: notification.Definition.DeviceID,
+	})
+	return nil
+}
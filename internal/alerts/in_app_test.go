@@ -0,0 +1,46 @@
+package alerts
+
+import (
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/sse"
+	"context"
+	"testing"
+)
+
+func TestInAppNotifierOnlyReachesUsersWhoSeeTheDevice(t *testing.T) {
+	hub := sse.NewHub()
+	notifier := NewInAppNotifier(hub)
+
+	// the device IDs are what the SSE handler subscribes with after narrowing them down to the visible devices
+	admin := hub.Subscribe(nil, []string{"alert"})
+	granted := hub.Subscribe([]int{7}, []string{"alert"})
+	withoutGrant := hub.Subscribe([]int{}, []string{"alert"})
+	otherDevice := hub.Subscribe([]int{8}, []string{"alert"})
+
+	notification := Notification{
+		Definition: model.AlertDefinition{Name: "Too hot", DeviceID: 7, Condition: model.AlertAbove, High: 30},
+		Alert:      model.Alert{State: model.AlertActive, Value: 31},
+		DeviceName: "Greenhouse",
+	}
+	if err := notifier.Notify(context.Background(), notification); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, subscriber := range map[string]*sse.Subscriber{"admin": admin, "granted": granted} {
+		select {
+		case event := <-subscriber.Events:
+			if event.Name != "alert" || event.DeviceID != 7 {
+				t.Errorf("%s received %+v", name, event)
+			}
+		default:
+			t.Errorf("%s did not receive the alert", name)
+		}
+	}
+	for name, subscriber := range map[string]*sse.Subscriber{"without grant": withoutGrant, "other device": otherDevice} {
+		select {
+		case event := <-subscriber.Events:
+			t.Errorf("%s received %+v", name, event)
+		default:
+		}
+	}
+}
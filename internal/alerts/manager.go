@@ -0,0 +1,246 @@
+package alerts
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// transitionBuffer is how many fired and resolved alerts may wait for being stored and sent
+	transitionBuffer = 256
+	notifyTimeout    = 10 * time.Second
+	activeAlertLimit = 1000
+)
+
+type watchKey struct {
+	deviceId   int
+	actionName string
+}
+
+// definitionState is the in-memory state of an enabled definition, breachedAt is zero while readings are in range
+type definitionState struct {
+	definition model.AlertDefinition
+	breachedAt time.Time
+	active     *model.Alert
+}
+
+// transition is a fired or resolved alert, the alert is shared with the definition state until it resolves so it may
+// only be read or written with Manager.mu held
+type transition struct {
+	definition model.AlertDefinition
+	alert      *model.Alert
+	resolved   bool
+	value      float64
+	at         time.Time
+}
+
+// Manager evaluates the enabled alert definitions on every reading. Alerts are stored and sent to their notification
+// channels by Run in the order they fired and resolved.
+type Manager struct {
+	database    db.Store
+	notifiers   map[string]Notifier
+	transitions chan transition
+
+	mu       sync.Mutex
+	states   map[int]*definitionState
+	watchers map[watchKey][]int
+}
+
+func NewManager(database db.Store, notifiers ...Notifier) *Manager {
+	manager := &Manager{
+		database:    database,
+		notifiers:   make(map[string]Notifier, len(notifiers)),
+		transitions: make(chan transition, transitionBuffer),
+		states:      make(map[int]*definitionState),
+		watchers:    make(map[watchKey][]int),
+	}
+	for _, notifier := range notifiers {
+		manager.notifiers[notifier.Name()] = notifier
+	}
+	return manager
+}
+
+// Channels returns the names of the configured notification channels
+func (m *Manager) Channels() []string {
+	channels := make([]string, 0, len(m.notifiers))
+	for name := range m.notifiers {
+		channels = append(channels, name)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Reload fetches the enabled definitions, it has to be called after definitions are changed. Active alerts of
+// definitions that were disabled are resolved without notifications.
+func (m *Manager) Reload() error {
+	definitions, err := m.database.FetchAlertDefinitions()
+	if err != nil {
+		return fmt.Errorf("failed to fetch alert definitions: %v", err)
+	}
+	activeAlerts, err := m.database.FetchAlerts(true, activeAlertLimit)
+	if err != nil {
+		return fmt.Errorf("failed to fetch active alerts: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := make(map[int]*definitionState)
+	watchers := make(map[watchKey][]int)
+	for _, definition := range definitions {
+		if !definition.Enabled {
+			continue
+		}
+		state, ok := m.states[definition.ID]
+		if !ok {
+			state = &definitionState{}
+		}
+		state.definition = definition
+		states[definition.ID] = state
+
+		key := watchKey{definition.DeviceID, definition.ActionName}
+		watchers[key] = append(watchers[key], definition.ID)
+	}
+
+	for i := range activeAlerts {
+		alert := &activeAlerts[i]
+		state, ok := states[alert.DefinitionID]
+		if !ok {
+			if err = m.database.ResolveAlert(alert.ID, time.Now()); err != nil {
+				slog.Error("failed to resolve alert of a removed definition", "alert_id", alert.ID, "error", err)
+			}
+			continue
+		}
+		if state.active == nil {
+			state.active, state.breachedAt = alert, alert.BreachedAt
+		}
+	}
+
+	m.states, m.watchers = states, watchers
+	return nil
+}
+
+// HandleReading is a mqtt_handlers.ValueConsumer, readings that are not numbers are ignored
+func (m *Manager) HandleReading(reading model.Reading) {
+	at := reading.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for actionName := range reading.Values {
+		value, ok := reading.Number(actionName)
+		if !ok {
+			continue
+		}
+		for _, definitionId := range m.watchers[watchKey{reading.DeviceID, actionName}] {
+			m.evaluate(m.states[definitionId], value, at)
+		}
+	}
+}
+
+// evaluate has to be called with m.mu held
+func (m *Manager) evaluate(state *definitionState, value float64, at time.Time) {
+	if !state.definition.Breached(value) {
+		state.breachedAt = time.Time{}
+		if state.active != nil {
+			m.enqueue(transition{definition: state.definition, alert: state.active, resolved: true, value: value, at: at})
+			state.active = nil
+		}
+		return
+	}
+
+	if state.breachedAt.IsZero() {
+		state.breachedAt = at
+	}
+	if state.active != nil || at.Sub(state.breachedAt) < state.definition.For() {
+		return
+	}
+
+	state.active = &model.Alert{
+		DefinitionID: state.definition.ID,
+		State:        model.AlertActive,
+		Value:        value,
+		BreachedAt:   state.breachedAt,
+		FiredAt:      at,
+	}
+	m.enqueue(transition{definition: state.definition, alert: state.active})
+}
+
+func (m *Manager) enqueue(t transition) {
+	select {
+	case m.transitions <- t:
+	default:
+		slog.Warn("alert queue full, dropping alert", "definition_id", t.definition.ID, logging.DeviceID(t.definition.DeviceID))
+	}
+}
+
+// Run stores and sends fired and resolved alerts until stop is closed
+func (m *Manager) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case t := <-m.transitions:
+			m.process(t)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *Manager) process(t transition) {
+	// the database calls and notifications work on a copy, only the ID given by InsertAlert is written back for the
+	// resolve transition
+	m.mu.Lock()
+	alert := *t.alert
+	m.mu.Unlock()
+
+	if t.resolved {
+		if alert.ID == 0 {
+			// storing the alert failed when it fired, there is nothing to resolve
+			return
+		}
+		alert.State, alert.Value, alert.ResolvedAt = model.AlertResolved, t.value, &t.at
+		if err := m.database.ResolveAlert(alert.ID, t.at); err != nil {
+			slog.Error("failed to resolve alert", "alert_id", alert.ID, logging.DeviceID(t.definition.DeviceID), "error", err)
+		}
+	} else {
+		if err := m.database.InsertAlert(&alert); err != nil {
+			slog.Error("failed to store alert", "definition_id", t.definition.ID, logging.DeviceID(t.definition.DeviceID), "error", err)
+			return
+		}
+		m.mu.Lock()
+		t.alert.ID = alert.ID
+		m.mu.Unlock()
+	}
+
+	notification := Notification{Definition: t.definition, Alert: alert}
+	if device, err := m.database.FetchDeviceWithActions(t.definition.DeviceID); err == nil {
+		notification.DeviceName = device.Name
+	} else {
+		notification.DeviceName = fmt.Sprintf("device %d", t.definition.DeviceID)
+	}
+
+	for _, channel := range t.definition.Channels {
+		notifier, ok := m.notifiers[channel]
+		if !ok {
+			slog.Warn("alert definition uses an unknown channel", "definition_id", t.definition.ID, "channel", channel)
+			continue
+		}
+		go func(notifier Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, notification); err != nil {
+				slog.Error("failed to send alert", "alert_id", alert.ID, "channel", notifier.Name(), logging.DeviceID(t.definition.DeviceID), "error", err)
+			}
+		}(notifier)
+	}
+}
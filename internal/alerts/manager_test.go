@@ -0,0 +1,232 @@
+package alerts
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// recordingNotifier passes the notifications to the test, Notify runs on its own goroutine
+type recordingNotifier struct {
+	notifications chan Notification
+}
+
+func (rn *recordingNotifier) Name() string {
+	return "recording"
+}
+
+func (rn *recordingNotifier) Notify(_ context.Context, notification Notification) error {
+	rn.notifications <- notification
+	return nil
+}
+
+// managerTest is a manager over a MemoryStore with a greenhouse thermometer and one definition watching it
+type managerTest struct {
+	t          *testing.T
+	database   *db.MemoryStore
+	notifier   *recordingNotifier
+	manager    *Manager
+	deviceId   int
+	definition model.AlertDefinition
+}
+
+func newManagerTest(t *testing.T, forSeconds int) *managerTest {
+	t.Helper()
+	database := db.NewMemoryStore()
+	templateId, err := database.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	if err = database.RegisterDevice(&model.Device{UUID: uuid, Name: "Greenhouse", ActionsTemplateId: templateId}); err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := database.GetDeviceIDByUUID(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	definition := model.AlertDefinition{Name: "Too hot", DeviceID: deviceId, ActionName: "Temperature",
+		Condition: model.AlertAbove, High: 30, ForSeconds: forSeconds, Channels: []string{"recording"}, Enabled: true}
+	if err = database.InsertAlertDefinition(&definition); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := &managerTest{t: t, database: database, notifier: &recordingNotifier{notifications: make(chan Notification, 100)},
+		deviceId: deviceId, definition: definition}
+	mt.restart()
+	return mt
+}
+
+// restart replaces the manager with a new one, like restarting the server does
+func (mt *managerTest) restart() {
+	mt.t.Helper()
+	mt.manager = NewManager(mt.database, mt.notifier)
+	if err := mt.manager.Reload(); err != nil {
+		mt.t.Fatal(err)
+	}
+}
+
+// read hands the temperature to the manager and processes the transitions it caused like Run does
+func (mt *managerTest) read(temperature float64, at time.Time) {
+	mt.t.Helper()
+	mt.manager.HandleReading(model.Reading{DeviceID: mt.deviceId, Timestamp: at,
+		Values: map[string]json.RawMessage{"Temperature": json.RawMessage(fmt.Sprint(temperature))}})
+	for {
+		select {
+		case t := <-mt.manager.transitions:
+			mt.manager.process(t)
+		default:
+			return
+		}
+	}
+}
+
+func (mt *managerTest) expectNotification(state model.AlertState, value float64) Notification {
+	mt.t.Helper()
+	select {
+	case notification := <-mt.notifier.notifications:
+		if notification.Alert.State != state || notification.Alert.Value != value || notification.DeviceName != "Greenhouse" ||
+			notification.Definition.ID != mt.definition.ID {
+			mt.t.Errorf("unexpected notification %+v, want %s with %g", notification, state, value)
+		}
+		return notification
+	case <-time.After(time.Second):
+		mt.t.Fatalf("no %s notification", state)
+	}
+	return Notification{}
+}
+
+func (mt *managerTest) expectNoNotification() {
+	mt.t.Helper()
+	select {
+	case notification := <-mt.notifier.notifications:
+		mt.t.Errorf("unexpected notification %+v", notification)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func (mt *managerTest) activeAlerts() []model.Alert {
+	mt.t.Helper()
+	alerts, err := mt.database.FetchAlerts(true, 10)
+	if err != nil {
+		mt.t.Fatal(err)
+	}
+	return alerts
+}
+
+func TestAlertFiresAfterTheDurationAndResolves(t *testing.T) {
+	mt := newManagerTest(t, 60)
+	start := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	// the alert fires only once the temperature stayed above the bound for a minute
+	mt.read(31, start)
+	mt.read(32, start.Add(30*time.Second))
+	mt.expectNoNotification()
+	if alerts := mt.activeAlerts(); len(alerts) != 0 {
+		t.Fatalf("the alert fired early: %+v", alerts)
+	}
+	mt.read(33, start.Add(time.Minute))
+	fired := mt.expectNotification(model.AlertActive, 33)
+	alerts := mt.activeAlerts()
+	if len(alerts) != 1 || alerts[0].ID == 0 || alerts[0].ID != fired.Alert.ID || !alerts[0].BreachedAt.Equal(start) ||
+		!alerts[0].FiredAt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected active alerts %+v", alerts)
+	}
+
+	// an active alert does not fire again
+	mt.read(34, start.Add(2*time.Minute))
+	mt.expectNoNotification()
+
+	// the first reading in range resolves it
+	mt.read(25, start.Add(3*time.Minute))
+	resolved := mt.expectNotification(model.AlertResolved, 25)
+	if resolved.Alert.ID != fired.Alert.ID || resolved.Alert.ResolvedAt == nil ||
+		!resolved.Alert.ResolvedAt.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("unexpected resolved alert %+v", resolved.Alert)
+	}
+	if alerts = mt.activeAlerts(); len(alerts) != 0 {
+		t.Errorf("the alert is still active: %+v", alerts)
+	}
+	mt.read(24, start.Add(4*time.Minute))
+	mt.expectNoNotification()
+
+	// a breach shorter than the duration does not fire
+	mt.read(35, start.Add(5*time.Minute))
+	mt.read(20, start.Add(5*time.Minute+59*time.Second))
+	mt.read(35, start.Add(6*time.Minute))
+	mt.expectNoNotification()
+	if alerts = mt.activeAlerts(); len(alerts) != 0 {
+		t.Errorf("a short breach fired: %+v", alerts)
+	}
+}
+
+func TestActiveAlertResolvesAfterRestart(t *testing.T) {
+	mt := newManagerTest(t, 0)
+	start := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	mt.read(40, start)
+	fired := mt.expectNotification(model.AlertActive, 40)
+
+	// the new manager picks the alert up from the database and neither fires it again nor forgets to resolve it
+	mt.restart()
+	mt.read(41, start.Add(time.Minute))
+	mt.expectNoNotification()
+	mt.read(20, start.Add(2*time.Minute))
+	if resolved := mt.expectNotification(model.AlertResolved, 20); resolved.Alert.ID != fired.Alert.ID {
+		t.Errorf("resolved alert %d, want %d", resolved.Alert.ID, fired.Alert.ID)
+	}
+	if alerts := mt.activeAlerts(); len(alerts) != 0 {
+		t.Errorf("the alert is still active: %+v", alerts)
+	}
+}
+
+func TestDisablingTheDefinitionResolvesItsAlert(t *testing.T) {
+	mt := newManagerTest(t, 0)
+	mt.read(40, time.Now())
+	mt.expectNotification(model.AlertActive, 40)
+
+	if err := mt.database.SetAlertDefinitionEnabled(mt.definition.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := mt.manager.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := mt.activeAlerts(); len(alerts) != 0 {
+		t.Errorf("the alert of the disabled definition is still active: %+v", alerts)
+	}
+	// disabled definitions are not evaluated and resolve without notifications
+	mt.read(50, time.Now())
+	mt.expectNoNotification()
+}
+
+func TestRunDoesNotRaceWithReadings(t *testing.T) {
+	// run with -race, Run stores the alerts while readings and reloads use the same definition state
+	mt := newManagerTest(t, 0)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		mt.manager.Run(stop)
+		close(stopped)
+	}()
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		temperature := 20.0
+		if i%2 == 0 {
+			temperature = 40
+		}
+		mt.manager.HandleReading(model.Reading{DeviceID: mt.deviceId, Timestamp: start.Add(time.Duration(i) * time.Second),
+			Values: map[string]json.RawMessage{"Temperature": json.RawMessage(fmt.Sprint(temperature))}})
+		if i%10 == 0 {
+			if err := mt.manager.Reload(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(stop)
+	<-stopped
+}
@@ -0,0 +1,36 @@
+package alerts
+
+import (
+	"NSI-semester-work/internal/model"
+	"context"
+	"fmt"
+)
+
+// Notification is sent to the channels of a definition when its alert fires and again when it resolves
+type Notification struct {
+	Definition model.AlertDefinition `json:"definition"`
+	Alert      model.Alert           `json:"alert"`
+	DeviceName string                `json:"device_name"`
+}
+
+func (n Notification) Subject() string {
+	if n.Alert.State == model.AlertResolved {
+		return fmt.Sprintf("[resolved] %s", n.Definition.Name)
+	}
+	return fmt.Sprintf("[alert] %s", n.Definition.Name)
+}
+
+func (n Notification) Message() string {
+	if n.Alert.State == model.AlertResolved {
+		return fmt.Sprintf("%s on %s is back in range (%s), last value %g", n.Definition.Name, n.DeviceName,
+			n.Definition.Describe(), n.Alert.Value)
+	}
+	return fmt.Sprintf("%s on %s: %s since %s, value %g", n.Definition.Name, n.DeviceName, n.Definition.Describe(),
+		n.Alert.BreachedAt.Format("2006-01-02 15:04:05"), n.Alert.Value)
+}
+
+// Notifier is a notification channel, Name is what alert definitions refer to
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, notification Notification) error
+}
@@ -0,0 +1,57 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// WebhookNotifier posts every notification as JSON to a fixed URL
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{}}
+}
+
+func (wn *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+type webhookPayload struct {
+	Notification
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(webhookPayload{
+		Notification: notification,
+		Subject:      notification.Subject(),
+		Message:      notification.Message(),
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := wn.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("alert webhook failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook answered %s", response.Status)
+	}
+	return nil
+}
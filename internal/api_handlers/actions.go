@@ -0,0 +1,161 @@
+package api_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxCommandWait      = 30 * time.Second
+	commandHistoryLimit = 100
+)
+
+type actionRequest struct {
+	Value interface{} `json:"value"`
+}
+
+func (a actionRequest) valueString() string {
+	switch value := a.Value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// SendActionHandler issues a toggle, number_input or command action, the type is taken from the device's actions
+func SendActionHandler(w http.ResponseWriter, r *http.Request, database db.Store, sender *commands.Sender) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+	if !auth.PermissionsFromContext(r.Context()).CanControlDevice(device.ID) {
+		writeError(w, http.StatusForbidden, "you may not control this device")
+		return
+	}
+	actionName := r.PathValue("action_name")
+
+	var request actionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	value := request.valueString()
+
+	actionType, err := commands.ValidateAction(device, actionName, value)
+	if err != nil {
+		switch {
+		case errors.Is(err, commands.ErrUnknownAction):
+			writeError(w, http.StatusNotFound, fmt.Sprintf("device has no action %q", actionName))
+		case errors.Is(err, commands.ErrInvalidValue):
+			writeError(w, http.StatusBadRequest, "number_input actions require a numeric value")
+		case errors.Is(err, commands.ErrUnsupportedActionType):
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s actions can not be issued", actionType))
+		default:
+			logging.FromContext(r.Context()).Error("error parsing actions", logging.DeviceID(device.ID), "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to parse device actions")
+		}
+		return
+	}
+
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	command, err := sender.Send("api", device.ID, actionType, actionName, value)
+	if err != nil {
+		switch {
+		case errors.Is(err, commands.ErrDeviceNotFound):
+			writeError(w, http.StatusNotFound, "device not found")
+		case errors.Is(err, commands.ErrDeviceOffline):
+			writeError(w, http.StatusConflict, "device is offline")
+		default:
+			logging.FromContext(r.Context()).Error("error sending action", logging.DeviceID(device.ID), "action", actionName, "error", err)
+			writeError(w, http.StatusBadGateway, "failed to publish action")
+		}
+		return
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		correlationId := command.CorrelationID
+		if command, err = sender.Wait(ctx, correlationId); err != nil {
+			logging.FromContext(r.Context()).Error("error waiting for command", "correlation_id", correlationId, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to fetch command status")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusAccepted, command)
+}
+
+// parseWait reads the optional wait query parameter, the time to wait for the device's acknowledgement
+func parseWait(r *http.Request) (time.Duration, error) {
+	if r.URL.Query().Get("wait") == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait < 0 || wait > maxCommandWait {
+		return 0, fmt.Errorf("wait has to be a duration up to %s", maxCommandWait)
+	}
+	return wait, nil
+}
+
+func GetCommandHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	correlationId := r.PathValue("correlation_id")
+	// malformed correlation IDs would be rejected by the uuid column, they are a client error and unknown as well
+	if !model.ValidUUID(correlationId) {
+		writeError(w, http.StatusNotFound, "command not found")
+		return
+	}
+	command, err := database.FetchCommand(correlationId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "command not found")
+			return
+		}
+		logging.FromContext(r.Context()).Error("error fetching command", "correlation_id", correlationId, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch command")
+		return
+	}
+	if !auth.PermissionsFromContext(r.Context()).CanViewDevice(command.DeviceID) {
+		writeError(w, http.StatusNotFound, "command not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, command)
+}
+
+func ListDeviceCommandsHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+
+	deviceCommands, err := database.FetchDeviceCommands(device.ID, commandHistoryLimit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error fetching commands", logging.DeviceID(device.ID), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch commands")
+		return
+	}
+	if deviceCommands == nil {
+		deviceCommands = []model.Command{}
+	}
+	writeJSON(w, http.StatusOK, deviceCommands)
+}
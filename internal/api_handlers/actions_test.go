@@ -0,0 +1,32 @@
+package api_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetCommandHandlerUnknownCommands(t *testing.T) {
+	database := db.NewMemoryStore()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	for _, correlationId := range []string{"not-a-uuid", "5f0c6f4e-3a1b-4c2d-9e8f-000000000001"} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/commands/"+correlationId, nil)
+		request = request.WithContext(logging.NewContext(request.Context(), logger))
+		request.SetPathValue("correlation_id", correlationId)
+		recorder := httptest.NewRecorder()
+		GetCommandHandler(recorder, request, database)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("the command %s answered %d", correlationId, recorder.Code)
+		}
+	}
+	// unknown and malformed correlation IDs are client errors, they are not logged as server errors
+	if bytes.Contains(logs.Bytes(), []byte("level=ERROR")) {
+		t.Errorf("unknown commands were logged as errors: %s", logs.String())
+	}
+}
@@ -0,0 +1,56 @@
+package api_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+func ListDashboardsHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	dashboards, err := database.FetchDashboards()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error fetching dashboards", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch dashboards")
+		return
+	}
+
+	permissions := auth.PermissionsFromContext(r.Context())
+	visible := make([]model.Dashboard, 0, len(dashboards))
+	for _, dashboard := range dashboards {
+		if permissions.CanViewDashboard(dashboard.DashboardId) {
+			visible = append(visible, dashboard)
+		}
+	}
+	writeJSON(w, http.StatusOK, visible)
+}
+
+func GetDashboardHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	dashboardId, err := pathId(r, "dashboard_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !auth.PermissionsFromContext(r.Context()).CanViewDashboard(dashboardId) {
+		writeError(w, http.StatusNotFound, "dashboard not found")
+		return
+	}
+
+	dashboard, err := database.FetchDashboard(dashboardId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "dashboard not found")
+			return
+		}
+		logging.FromContext(r.Context()).Error("error fetching dashboard", "dashboard_id", dashboardId, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch dashboard")
+		return
+	}
+	if dashboard.Devices == nil {
+		dashboard.Devices = []model.DeviceInDashboard{}
+	}
+	writeJSON(w, http.StatusOK, dashboard)
+}
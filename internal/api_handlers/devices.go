@@ -0,0 +1,170 @@
+package api_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type deviceResource struct {
+	ID              int                         `json:"id"`
+	UUID            string                      `json:"uuid"`
+	Name            string                      `json:"name"`
+	DeviceType      model.DeviceType            `json:"device_type"`
+	TemplateActions map[string]model.ActionType `json:"template_actions"`
+	CustomActions   map[string]model.ActionType `json:"custom_actions"`
+	LastLogin       *time.Time                  `json:"last_login"`
+	Retired         bool                        `json:"retired"`
+	Presence        model.Presence              `json:"presence"`
+}
+
+func newDeviceResource(device *model.Device, tracker *presence.Tracker) (*deviceResource, error) {
+	templateActions, customActions, err := device.ParseActions()
+	if err != nil {
+		return nil, err
+	}
+
+	resource := &deviceResource{
+		ID:              device.ID,
+		UUID:            device.UUID,
+		Name:            device.Name,
+		DeviceType:      device.DeviceType,
+		TemplateActions: templateActions,
+		CustomActions:   customActions,
+		Retired:         device.Retired,
+		Presence:        tracker.Lookup(device),
+	}
+	if !device.LastLogin.IsZero() {
+		resource.LastLogin = &device.LastLogin
+	}
+	return resource, nil
+}
+
+// fetchDevice writes the error response itself, callers only need to return when device is nil
+func fetchDevice(w http.ResponseWriter, r *http.Request, database db.Store) *model.Device {
+	deviceId, err := pathId(r, "device_id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	// devices the user may not see are reported as missing
+	if !auth.PermissionsFromContext(r.Context()).CanViewDevice(deviceId) {
+		writeError(w, http.StatusNotFound, "device not found")
+		return nil
+	}
+
+	device, err := database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "device not found")
+			return nil
+		}
+		logging.FromContext(r.Context()).Error("error fetching device", logging.DeviceID(deviceId), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch device")
+		return nil
+	}
+	return device
+}
+
+func ListDevicesHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error fetching devices", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch devices")
+		return
+	}
+
+	permissions := auth.PermissionsFromContext(r.Context())
+	resources := make([]*deviceResource, 0, len(devices))
+	for i := range devices {
+		if !permissions.CanViewDevice(devices[i].ID) {
+			continue
+		}
+		resource, err := newDeviceResource(&devices[i], tracker)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("error parsing actions", logging.DeviceID(devices[i].ID), "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to parse device actions")
+			return
+		}
+		resources = append(resources, resource)
+	}
+	writeJSON(w, http.StatusOK, resources)
+}
+
+func GetDeviceHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+
+	resource, err := newDeviceResource(device, tracker)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error parsing actions", logging.DeviceID(device.ID), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to parse device actions")
+		return
+	}
+	writeJSON(w, http.StatusOK, resource)
+}
+
+func GetDeviceStateHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+
+	stateJson, err := database.GetDeviceStates(device.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error fetching state", logging.DeviceID(device.ID), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch device state")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_id": device.ID,
+		"state":     json.RawMessage(stateJson),
+	})
+}
+
+// GetLatestValuesHandler returns the newest reading of every provide_value action, null if there is none yet
+func GetLatestValuesHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+
+	templateActions, customActions, err := device.ParseActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error parsing actions", logging.DeviceID(device.ID), "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to parse device actions")
+		return
+	}
+
+	values := make(map[string]*model.SensorValue)
+	for _, actions := range []map[string]model.ActionType{templateActions, customActions} {
+		for actionName, actionType := range actions {
+			if actionType != model.ActionTypeProvideValue {
+				continue
+			}
+			reading, err := database.GetLastSensorReading(device.ID, actionName)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				logging.FromContext(r.Context()).Error("error fetching last value", logging.DeviceID(device.ID), "action", actionName, "error", err)
+				writeError(w, http.StatusInternalServerError, "failed to fetch latest values")
+				return
+			}
+			values[actionName] = reading
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_id": device.ID,
+		"values":    values,
+	})
+}
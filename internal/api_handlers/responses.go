@@ -0,0 +1,64 @@
+package api_handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type errorBody struct {
+	Error apiError `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		// the status is already written, the client most likely went away
+		slog.Warn("failed to write api response", "error", err)
+	}
+}
+
+// writeError writes the error body shared by every /api/v1 endpoint
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorBody{Error: apiError{Status: status, Message: message}})
+}
+
+func pathId(r *http.Request, name string) (int, error) {
+	id, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, r.PathValue(name))
+	}
+	return id, nil
+}
+
+// apiMethods are the methods probed for the Allow header, HEAD is allowed wherever GET is
+var apiMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// NotFoundHandler is the /api/ catch-all of mux. Paths routed for other methods are answered with 405 Method Not
+// Allowed and the Allow header, like mux does without a catch-all, everything else with 404 Not Found.
+func NotFoundHandler(w http.ResponseWriter, r *http.Request, mux *http.ServeMux) {
+	_, catchAll := mux.Handler(r)
+	var allowed []string
+	for _, method := range apiMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != catchAll {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed for %s", r.Method, r.URL.Path))
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no such endpoint %s %s", r.Method, r.URL.Path))
+}
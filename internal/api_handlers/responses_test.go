@@ -0,0 +1,40 @@
+package api_handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotFoundHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) { NotFoundHandler(w, r, mux) })
+	mux.HandleFunc("GET /api/v1/devices/{device_id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /api/v1/devices/{device_id}/actions/{action_name}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("DELETE /api/v1/devices/{device_id}/actions/{action_name}", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{http.MethodGet, "/api/v1/devices/1", http.StatusOK, ""},
+		{http.MethodHead, "/api/v1/devices/1", http.StatusOK, ""},
+		{http.MethodDelete, "/api/v1/devices/1", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodGet, "/api/v1/devices/1/actions/Light_state", http.StatusMethodNotAllowed, "POST, DELETE"},
+		{http.MethodGet, "/api/v1/unknown", http.StatusNotFound, ""},
+		{http.MethodPost, "/api/v2/devices/1", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+		if recorder.Code != test.wantStatus || recorder.Header().Get("Allow") != test.wantAllow {
+			t.Errorf("%s %s answered %d with Allow %q, want %d with %q", test.method, test.path, recorder.Code,
+				recorder.Header().Get("Allow"), test.wantStatus, test.wantAllow)
+		}
+		if test.wantStatus != http.StatusOK && recorder.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s did not answer with the JSON error body", test.method, test.path)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package api_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxTelemetryPoints caps how many buckets a single history query may return
+	maxTelemetryPoints = 1000
+	// defaultTelemetryPoints is used to pick a bucket width when the client did not ask for one
+	defaultTelemetryPoints = 200
+	defaultTelemetryRange  = 24 * time.Hour
+	minTelemetryBucket     = time.Second
+)
+
+// parseBucket accepts Go durations ("30s", "5m", "1h") and whole days ("1d", "7d")
+func parseBucket(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid bucket %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	bucket, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bucket %q", value)
+	}
+	return bucket, nil
+}
+
+func parseTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339", value)
+	}
+	return t, nil
+}
+
+// parseHistoryRange reads from, to and bucket query parameters, applying defaults and the point cap
+func parseHistoryRange(r *http.Request) (from time.Time, to time.Time, bucket time.Duration, err error) {
+	query := r.URL.Query()
+	if to, err = parseTime(query.Get("to"), time.Now()); err != nil {
+		return
+	}
+	if from, err = parseTime(query.Get("from"), to.Add(-defaultTelemetryRange)); err != nil {
+		return
+	}
+	if !from.Before(to) {
+		err = fmt.Errorf("from must be before to")
+		return
+	}
+
+	span := to.Sub(from)
+	if query.Get("bucket") == "" {
+		bucket = (span / defaultTelemetryPoints).Truncate(time.Second)
+		if bucket < minTelemetryBucket {
+			bucket = minTelemetryBucket
+		}
+		return
+	}
+	if bucket, err = parseBucket(query.Get("bucket")); err != nil {
+		return
+	}
+	if bucket < minTelemetryBucket {
+		err = fmt.Errorf("bucket must be at least %s", minTelemetryBucket)
+		return
+	}
+	if span/bucket > maxTelemetryPoints {
+		err = fmt.Errorf("range of %s with bucket %s exceeds %d points, use a bucket of at least %s",
+			span, bucket, maxTelemetryPoints, (span/maxTelemetryPoints).Truncate(time.Second)+time.Second)
+		return
+	}
+	return
+}
+
+// GetTelemetryHistoryHandler returns min/max/avg/count/last of an action's readings per time bucket
+func GetTelemetryHistoryHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	device := fetchDevice(w, r, database)
+	if device == nil {
+		return
+	}
+	actionName := r.PathValue("action_name")
+
+	from, to, bucket, err := parseHistoryRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	points, err := database.GetSensorHistory(device.ID, actionName, from, to, bucket)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("error fetching history", logging.DeviceID(device.ID), "action", actionName, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to fetch telemetry history")
+		return
+	}
+	if points == nil {
+		points = []model.TelemetryBucket{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_id":      device.ID,
+		"action_name":    actionName,
+		"from":           from,
+		"to":             to,
+		"bucket":         bucket.String(),
+		"bucket_seconds": bucket.Seconds(),
+		"points":         points,
+	})
+}
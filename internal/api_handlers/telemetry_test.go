@@ -0,0 +1,137 @@
+package api_handlers
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBucket(t *testing.T) {
+	tests := map[string]time.Duration{
+		"30s": 30 * time.Second,
+		"5m":  5 * time.Minute,
+		"1h":  time.Hour,
+		"1d":  24 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+	}
+	for value, want := range tests {
+		if got, err := parseBucket(value); err != nil || got != want {
+			t.Errorf("parseBucket(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "d", "0d", "-1d", "1.5d", "hour", "5"} {
+		if got, err := parseBucket(value); err == nil {
+			t.Errorf("parseBucket(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+func TestParseHistoryRange(t *testing.T) {
+	to := time.Date(2026, time.May, 2, 12, 0, 0, 0, time.UTC)
+	toParam := to.Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		query      url.Values
+		wantFrom   time.Time
+		wantBucket time.Duration
+		wantErr    string
+	}{
+		{
+			name:     "the range defaults to the last 24 hours in 200 points",
+			query:    url.Values{"to": {toParam}},
+			wantFrom: to.Add(-24 * time.Hour), wantBucket: 432 * time.Second,
+		},
+		{
+			name:     "the default bucket is truncated to whole seconds",
+			query:    url.Values{"from": {to.Add(-time.Hour).Format(time.RFC3339)}, "to": {toParam}},
+			wantFrom: to.Add(-time.Hour), wantBucket: 18 * time.Second,
+		},
+		{
+			name:     "short ranges get the smallest bucket",
+			query:    url.Values{"from": {to.Add(-time.Minute).Format(time.RFC3339)}, "to": {toParam}},
+			wantFrom: to.Add(-time.Minute), wantBucket: time.Second,
+		},
+		{
+			name:     "timestamps with an offset",
+			query:    url.Values{"from": {"2026-05-02T13:00:00+02:00"}, "to": {toParam}, "bucket": {"1m"}},
+			wantFrom: to.Add(-time.Hour), wantBucket: time.Minute,
+		},
+		{
+			name:     "buckets in days",
+			query:    url.Values{"from": {to.Add(-30 * 24 * time.Hour).Format(time.RFC3339)}, "to": {toParam}, "bucket": {"1d"}},
+			wantFrom: to.Add(-30 * 24 * time.Hour), wantBucket: 24 * time.Hour,
+		},
+		{
+			name:     "exactly the maximum number of points",
+			query:    url.Values{"from": {to.Add(-1000 * time.Minute).Format(time.RFC3339)}, "to": {toParam}, "bucket": {"1m"}},
+			wantFrom: to.Add(-1000 * time.Minute), wantBucket: time.Minute,
+		},
+
+		{
+			name:    "more than the maximum number of points",
+			query:   url.Values{"from": {to.Add(-1001 * time.Minute).Format(time.RFC3339)}, "to": {toParam}, "bucket": {"1m"}},
+			wantErr: "exceeds 1000 points, use a bucket of at least 1m1s",
+		},
+		{
+			name:    "from after to",
+			query:   url.Values{"from": {to.Add(time.Hour).Format(time.RFC3339)}, "to": {toParam}},
+			wantErr: "from must be before to",
+		},
+		{
+			name:    "from equal to to",
+			query:   url.Values{"from": {toParam}, "to": {toParam}},
+			wantErr: "from must be before to",
+		},
+		{
+			name:    "malformed from",
+			query:   url.Values{"from": {"yesterday"}, "to": {toParam}},
+			wantErr: `invalid time "yesterday", expected RFC 3339`,
+		},
+		{
+			name:    "malformed to",
+			query:   url.Values{"to": {"2026-05-02 12:00:00"}},
+			wantErr: `invalid time "2026-05-02 12:00:00", expected RFC 3339`,
+		},
+		{
+			name:    "malformed bucket",
+			query:   url.Values{"to": {toParam}, "bucket": {"often"}},
+			wantErr: `invalid bucket "often"`,
+		},
+		{
+			name:    "bucket below a second",
+			query:   url.Values{"to": {toParam}, "bucket": {"500ms"}},
+			wantErr: "bucket must be at least 1s",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/api/v1/devices/1/telemetry/Temperature?"+test.query.Encode(), nil)
+			from, gotTo, bucket, err := parseHistoryRange(request)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseHistoryRange returned %v, want an error about %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !from.Equal(test.wantFrom) || !gotTo.Equal(to) || bucket != test.wantBucket {
+				t.Errorf("parseHistoryRange = %v, %v, %v, want %v, %v, %v", from, gotTo, bucket, test.wantFrom, to, test.wantBucket)
+			}
+		})
+	}
+}
+
+func TestParseHistoryRangeDefaultsToNow(t *testing.T) {
+	before := time.Now()
+	from, to, bucket, err := parseHistoryRange(httptest.NewRequest("GET", "/api/v1/devices/1/telemetry/Temperature", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Before(before) || to.After(time.Now()) || to.Sub(from) != 24*time.Hour || bucket != 432*time.Second {
+		t.Errorf("parseHistoryRange without parameters = %v, %v, %v", from, to, bucket)
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"time"
+)
+
+const (
+	SessionCookieName = "session"
+	SessionLifetime   = 7 * 24 * time.Hour
+	MinPasswordLength = 8
+	// maxPasswordLength is the longest password bcrypt hashes in full
+	maxPasswordLength = 72
+	tokenBytes        = 32
+)
+
+// dummyHash is compared against when a username does not exist, so failed logins take the same time either way
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// ValidatePassword checks a new password, the returned error is meant to be shown to the user
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("the password has to be at least %d characters long", MinPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("the password can be at most %d bytes long", maxPasswordLength)
+	}
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password belongs to user, user may be nil when the username does not exist
+func CheckPassword(user *model.User, password string) bool {
+	if user == nil {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// GenerateToken returns a random hex encoded token, used for sessions, device secrets and provisioning tokens
+func GenerateToken() (string, error) {
+	raw := make([]byte, tokenBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// HashToken returns the SHA-256 hash that is stored instead of a token, tokens are random so no salt is needed
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenMatches compares the token against a stored hash in constant time, an empty token never matches
+func TokenMatches(token string, hash string) bool {
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
+// sessionTokenHash returns the hash of the session token sent with the request
+func sessionTokenHash(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return HashToken(cookie.Value), true
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Lax keeps the cookie out of cross-site POST and DELETE requests, actions are never triggered by GET
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Login starts a new session of the user and sets its cookie
+func Login(w http.ResponseWriter, r *http.Request, database db.Store, user *model.User) error {
+	if err := database.DeleteExpiredSessions(); err != nil {
+		return err
+	}
+
+	token, err := GenerateToken()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(SessionLifetime)
+	if err := database.InsertSession(HashToken(token), user.ID, expires); err != nil {
+		return err
+	}
+	setSessionCookie(w, r, token, expires)
+	return nil
+}
+
+// Logout ends the session of the request and clears its cookie
+func Logout(w http.ResponseWriter, r *http.Request, database db.Store) error {
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	tokenHash, ok := sessionTokenHash(r)
+	if !ok {
+		return nil
+	}
+	return database.DeleteSession(tokenHash)
+}
+
+// ChangePassword stores the new password of the logged-in user and ends the user's other sessions
+func ChangePassword(r *http.Request, database db.Store, user *model.User, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err = database.UpdateUserPassword(user.ID, hash); err != nil {
+		return err
+	}
+	tokenHash, ok := sessionTokenHash(r)
+	if !ok {
+		return errors.New("the request has no session")
+	}
+	return database.DeleteOtherSessions(user.ID, tokenHash)
+}
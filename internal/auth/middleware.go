@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	LoginPath = "/login"
+	SetupPath = "/setup"
+)
+
+type contextKey struct{}
+
+// UserFromContext returns the logged-in user of a request that passed RequireLogin
+func UserFromContext(ctx context.Context) *model.User {
+	user, _ := ctx.Value(contextKey{}).(*model.User)
+	return user
+}
+
+// RequireLogin lets through requests with a valid session and the login and setup pages. Other requests are sent to
+// the login page, or to the setup page while there are no users yet.
+func RequireLogin(database db.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == LoginPath || r.URL.Path == SetupPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if tokenHash, ok := sessionTokenHash(r); ok {
+			user, err := database.FetchSessionUser(tokenHash)
+			if err == nil {
+				permissions, err := LoadPermissions(database, user)
+				if err != nil {
+					logging.FromContext(r.Context()).Error("failed to load permissions", "user", user.Username, "error", err)
+					http.Error(w, "Failed to check the permissions", http.StatusInternalServerError)
+					return
+				}
+				ctx := context.WithValue(r.Context(), contextKey{}, user)
+				ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("user", user.Username))
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, permissionsKey{}, permissions)))
+				return
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				logging.FromContext(r.Context()).Error("failed to fetch session", "error", err)
+				http.Error(w, "Failed to check the session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		target := LoginPath
+		if count, err := database.CountUsers(); err != nil {
+			logging.FromContext(r.Context()).Error("failed to count users", "error", err)
+		} else if count == 0 {
+			target = SetupPath
+		}
+		unauthorized(w, r, target)
+	})
+}
+
+// unauthorized answers API requests with a JSON error, htmx requests with a client side redirect and page loads with
+// a redirect
+func unauthorized(w http.ResponseWriter, r *http.Request, target string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		body := map[string]interface{}{"error": map[string]interface{}{"status": http.StatusUnauthorized, "message": "login required"}}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			logging.FromContext(r.Context()).Warn("failed to write api response", "error", err)
+		}
+		return
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", target)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
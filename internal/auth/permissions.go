@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Permissions resolves what the logged-in user may see and control. Admins may do everything, everybody else may see
+// the granted dashboards and devices, including every device shown on a granted dashboard, and operators may control
+// the devices granted with control access, directly or through a dashboard.
+type Permissions struct {
+	role      model.Role
+	dashboard map[int]model.Access
+	device    map[int]model.Access
+}
+
+type permissionsKey struct{}
+
+// LoadPermissions resolves the grants of the user, admins need none
+func LoadPermissions(database db.Store, user *model.User) (*Permissions, error) {
+	permissions := &Permissions{
+		role:      user.Role,
+		dashboard: make(map[int]model.Access),
+		device:    make(map[int]model.Access),
+	}
+	if user.Role == model.RoleAdmin {
+		return permissions, nil
+	}
+
+	grants, err := database.FetchGrants(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch grants of user %d: %v", user.ID, err)
+	}
+	var dashboardIds []int
+	for _, grant := range grants {
+		if grant.DashboardID != 0 {
+			permissions.dashboard[grant.DashboardID] = grant.Access
+			dashboardIds = append(dashboardIds, grant.DashboardID)
+		} else {
+			permissions.grantDevice(grant.DeviceID, grant.Access)
+		}
+	}
+	if len(dashboardIds) == 0 {
+		return permissions, nil
+	}
+
+	dashboardDevices, err := database.FetchDashboardDeviceIds(dashboardIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch devices of granted dashboards: %v", err)
+	}
+	for dashboardId, deviceIds := range dashboardDevices {
+		for _, deviceId := range deviceIds {
+			permissions.grantDevice(deviceId, permissions.dashboard[dashboardId])
+		}
+	}
+	return permissions, nil
+}
+
+// grantDevice keeps the stronger of the existing and the new access
+func (p *Permissions) grantDevice(deviceId int, access model.Access) {
+	if p.device[deviceId] != model.AccessControl {
+		p.device[deviceId] = access
+	}
+}
+
+func (p *Permissions) IsAdmin() bool {
+	return p.role == model.RoleAdmin
+}
+
+func (p *Permissions) CanViewDashboard(dashboardId int) bool {
+	_, ok := p.dashboard[dashboardId]
+	return p.IsAdmin() || ok
+}
+
+func (p *Permissions) CanViewDevice(deviceId int) bool {
+	_, ok := p.device[deviceId]
+	return p.IsAdmin() || ok
+}
+
+func (p *Permissions) CanControlDevice(deviceId int) bool {
+	if p.IsAdmin() {
+		return true
+	}
+	return p.role == model.RoleOperator && p.device[deviceId] == model.AccessControl
+}
+
+// ViewableDevices returns the IDs of the devices the user may see, nil means every device
+func (p *Permissions) ViewableDevices() []int {
+	if p.IsAdmin() {
+		return nil
+	}
+	deviceIds := make([]int, 0, len(p.device))
+	for deviceId := range p.device {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	return deviceIds
+}
+
+// PermissionsFromContext returns the permissions of a request that passed RequireLogin
+func PermissionsFromContext(ctx context.Context) *Permissions {
+	permissions, ok := ctx.Value(permissionsKey{}).(*Permissions)
+	if !ok {
+		// requests that did not pass RequireLogin may do nothing
+		return &Permissions{}
+	}
+	return permissions
+}
+
+// RequireAdmin answers requests of users who are not admins with 403 Forbidden
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !PermissionsFromContext(r.Context()).IsAdmin() {
+			http.Error(w, "Only admins may do this", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// permissionsTest has four devices, the kitchen dashboard shows the first two and the attic dashboard the third
+type permissionsTest struct {
+	database *db.MemoryStore
+	devices  []int
+	kitchen  int
+	attic    int
+}
+
+func newPermissionsTest(t *testing.T) *permissionsTest {
+	t.Helper()
+	database := db.NewMemoryStore()
+	test := &permissionsTest{database: database}
+	templateId, err := database.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		uuid := fmt.Sprintf("123e4567-e89b-12d3-a456-42661417400%d", i)
+		if err := database.RegisterDevice(&model.Device{UUID: uuid, Name: fmt.Sprintf("Device %d", i), ActionsTemplateId: templateId}); err != nil {
+			t.Fatal(err)
+		}
+		deviceId, err := database.GetDeviceIDByUUID(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.devices = append(test.devices, deviceId)
+	}
+
+	if test.kitchen, err = database.CreateDashboard("Kitchen"); err != nil {
+		t.Fatal(err)
+	}
+	if test.attic, err = database.CreateDashboard("Attic"); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.InsertDevicesToDashboard(test.kitchen, []model.DeviceInDashboard{
+		{Device: model.Device{ID: test.devices[0]}}, {Device: model.Device{ID: test.devices[1]}, Position: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.InsertDevicesToDashboard(test.attic, []model.DeviceInDashboard{{Device: model.Device{ID: test.devices[2]}}}); err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+func (pt *permissionsTest) load(t *testing.T, role model.Role, grants []model.Grant) *Permissions {
+	t.Helper()
+	user := &model.User{Username: t.Name(), PasswordHash: "hash", Role: role}
+	if err := pt.database.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.database.ReplaceGrants(user.ID, grants); err != nil {
+		t.Fatal(err)
+	}
+	permissions, err := LoadPermissions(pt.database, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return permissions
+}
+
+func TestPermissions(t *testing.T) {
+	pt := newPermissionsTest(t)
+	d := pt.devices
+	tests := []struct {
+		name   string
+		role   model.Role
+		grants []model.Grant
+		// view and control are the devices the user may see and control, dashboards the dashboards it may see
+		view       []int
+		control    []int
+		dashboards []int
+	}{
+		{
+			name: "viewer without grants",
+			role: model.RoleViewer,
+		},
+		{
+			name:       "viewer with a dashboard grant sees the devices on it",
+			role:       model.RoleViewer,
+			grants:     []model.Grant{{DashboardID: pt.kitchen, Access: model.AccessView}},
+			view:       []int{d[0], d[1]},
+			dashboards: []int{pt.kitchen},
+		},
+		{
+			name:   "viewers never control, not even with control grants",
+			role:   model.RoleViewer,
+			grants: []model.Grant{{DashboardID: pt.kitchen, Access: model.AccessControl}, {DeviceID: d[3], Access: model.AccessControl}},
+			view:   []int{d[0], d[1], d[3]}, dashboards: []int{pt.kitchen},
+		},
+		{
+			name:   "operator with a device control grant",
+			role:   model.RoleOperator,
+			grants: []model.Grant{{DeviceID: d[3], Access: model.AccessControl}},
+			view:   []int{d[3]}, control: []int{d[3]},
+		},
+		{
+			name:   "operator with view grants controls nothing",
+			role:   model.RoleOperator,
+			grants: []model.Grant{{DashboardID: pt.attic, Access: model.AccessView}, {DeviceID: d[0], Access: model.AccessView}},
+			view:   []int{d[0], d[2]}, dashboards: []int{pt.attic},
+		},
+		{
+			name: "a device grant does not weaken the control granted by a dashboard",
+			role: model.RoleOperator,
+			grants: []model.Grant{{DashboardID: pt.kitchen, Access: model.AccessControl},
+				{DeviceID: d[1], Access: model.AccessView}},
+			view: []int{d[0], d[1]}, control: []int{d[0], d[1]}, dashboards: []int{pt.kitchen},
+		},
+		{
+			name: "a device control grant is stronger than a dashboard view grant",
+			role: model.RoleOperator,
+			grants: []model.Grant{{DashboardID: pt.kitchen, Access: model.AccessView},
+				{DeviceID: d[1], Access: model.AccessControl}},
+			view: []int{d[0], d[1]}, control: []int{d[1]}, dashboards: []int{pt.kitchen},
+		},
+		{
+			name: "the strongest of two dashboards showing the device wins",
+			role: model.RoleOperator,
+			grants: []model.Grant{{DashboardID: pt.kitchen, Access: model.AccessView},
+				{DashboardID: pt.attic, Access: model.AccessControl}},
+			view: []int{d[0], d[1], d[2]}, control: []int{d[2]}, dashboards: []int{pt.kitchen, pt.attic},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			permissions := pt.load(t, test.role, test.grants)
+			if permissions.IsAdmin() {
+				t.Error("the user is an admin")
+			}
+			contains := func(ids []int, id int) bool {
+				for _, candidate := range ids {
+					if candidate == id {
+						return true
+					}
+				}
+				return false
+			}
+			for _, deviceId := range d {
+				if got := permissions.CanViewDevice(deviceId); got != contains(test.view, deviceId) {
+					t.Errorf("CanViewDevice(%d) = %v", deviceId, got)
+				}
+				if got := permissions.CanControlDevice(deviceId); got != contains(test.control, deviceId) {
+					t.Errorf("CanControlDevice(%d) = %v", deviceId, got)
+				}
+			}
+			for _, dashboardId := range []int{pt.kitchen, pt.attic} {
+				if got := permissions.CanViewDashboard(dashboardId); got != contains(test.dashboards, dashboardId) {
+					t.Errorf("CanViewDashboard(%d) = %v", dashboardId, got)
+				}
+			}
+
+			// a user without visible devices gets an empty list, nil would mean every device
+			viewable := permissions.ViewableDevices()
+			if viewable == nil {
+				t.Fatal("ViewableDevices returned nil for a user who is not an admin")
+			}
+			sort.Ints(viewable)
+			want := append([]int{}, test.view...)
+			sort.Ints(want)
+			if fmt.Sprint(viewable) != fmt.Sprint(want) {
+				t.Errorf("ViewableDevices = %v, want %v", viewable, want)
+			}
+		})
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	pt := newPermissionsTest(t)
+	// grants of admins are ignored, they may do everything
+	permissions := pt.load(t, model.RoleAdmin, []model.Grant{{DeviceID: pt.devices[0], Access: model.AccessView}})
+	if !permissions.IsAdmin() || permissions.ViewableDevices() != nil {
+		t.Errorf("admin permissions %+v, viewable devices %v", permissions, permissions.ViewableDevices())
+	}
+	for _, deviceId := range append(pt.devices, 4242) {
+		if !permissions.CanViewDevice(deviceId) || !permissions.CanControlDevice(deviceId) {
+			t.Errorf("the admin may not see or control device %d", deviceId)
+		}
+	}
+	if !permissions.CanViewDashboard(pt.attic) {
+		t.Error("the admin may not see a dashboard")
+	}
+}
+
+func TestPermissionsFromContext(t *testing.T) {
+	// requests that did not pass RequireLogin may do nothing
+	permissions := PermissionsFromContext(context.Background())
+	if permissions.IsAdmin() || permissions.CanViewDevice(1) || permissions.CanControlDevice(1) || permissions.CanViewDashboard(1) {
+		t.Error("a request without a login has permissions")
+	}
+	if viewable := permissions.ViewableDevices(); viewable == nil || len(viewable) != 0 {
+		t.Errorf("a request without a login may see %v", viewable)
+	}
+
+	pt := newPermissionsTest(t)
+	loaded := pt.load(t, model.RoleOperator, []model.Grant{{DeviceID: pt.devices[0], Access: model.AccessControl}})
+	ctx := context.WithValue(context.Background(), permissionsKey{}, loaded)
+	if !PermissionsFromContext(ctx).CanControlDevice(pt.devices[0]) {
+		t.Error("the permissions of the context were not used")
+	}
+}
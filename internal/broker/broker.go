@@ -0,0 +1,502 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// connectTimeout is how long a new connection may take to send CONNECT
+	connectTimeout = 10 * time.Second
+	// writeTimeout is how long writing one packet to a client may take before the client is dropped
+	writeTimeout = 10 * time.Second
+	// clientBuffer is how many packets a client may fall behind before it is disconnected
+	clientBuffer = 256
+	// maxInflight is how many unacknowledged QoS 1 messages a session keeps, the oldest one is dropped beyond that. It
+	// leaves room in the client buffer for resending all of them at once after a reconnect.
+	maxInflight = 100
+)
+
+// Authenticator decides who may connect to the broker and which topics they may use, connections opened with
+// Broker.Connect are trusted and never checked
+type Authenticator interface {
+	Authenticate(clientId string, username string, password []byte) bool
+	// Allow is called for every publish and subscription, topic is a subscription filter when publish is false
+	Allow(username string, topic string, publish bool) bool
+}
+
+// Broker is a small MQTT 3.1.1 broker for installs without a separate one. It supports QoS 0 and 1, retained
+// messages and last wills. Subscriptions asking for QoS 2 are granted QoS 1 in SUBACK, QoS 2 publishes are routed once
+// even when the client resends them before releasing them with PUBREL. Sessions of clients connecting with clean
+// session 0 are kept in memory after they disconnect: their subscriptions stay, QoS 1 messages are queued for them and
+// unacknowledged ones are sent again with the DUP flag when they reconnect.
+type Broker struct {
+	mu        sync.Mutex
+	auth      Authenticator
+	sessions  map[string]*session
+	retained  map[string]*message
+	listeners []io.Closer
+}
+
+// New creates a broker, a nil authenticator lets every client connect and use every topic
+func New(auth Authenticator) *Broker {
+	return &Broker{
+		auth:     auth,
+		sessions: make(map[string]*session),
+		retained: make(map[string]*message),
+	}
+}
+
+// session is what the broker keeps of a client, it ends with the connection unless the client asked for a persistent
+// session with clean session 0. Its fields are guarded by the broker mutex.
+type session struct {
+	clean bool
+	// client is the connection of the session, nil while the client is disconnected
+	client        *client
+	subscriptions map[string]byte
+	lastPacketId  uint16
+	// inflight holds the QoS 1 messages sent or queued but not acknowledged with PUBACK yet, order has their packet
+	// IDs in the order they were queued
+	inflight map[uint16]*inflightMessage
+	order    []uint16
+}
+
+type inflightMessage struct {
+	msg    *message
+	retain bool
+	// sent is set once the message was written to a connection, only those are marked as duplicates when resent
+	sent bool
+}
+
+func newSession(clean bool) *session {
+	return &session{
+		clean:         clean,
+		subscriptions: make(map[string]byte),
+		inflight:      make(map[uint16]*inflightMessage),
+	}
+}
+
+type client struct {
+	broker   *Broker
+	conn     net.Conn
+	id       string
+	username string
+	trusted  bool
+	will     *message
+	outgoing chan []byte
+	done     chan struct{}
+	once     sync.Once
+	// session is set by register before the read loop starts
+	session *session
+	// disconnected is set when the client said goodbye with DISCONNECT, its will is not published then
+	disconnected bool
+	// unreleased holds the packet IDs of QoS 2 publishes routed but not released yet, only the read loop uses it
+	unreleased map[uint16]bool
+}
+
+// send queues the packet without blocking, a client that does not keep up is disconnected
+func (c *client) send(data []byte) {
+	select {
+	case c.outgoing <- data:
+	case <-c.done:
+	default:
+		slog.Warn("mqtt client too slow, disconnecting it", "client_id", c.id)
+		c.close()
+	}
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case data := <-c.outgoing:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.conn.Write(data); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *client) allowed(topic string, publish bool) bool {
+	return c.trusted || c.broker.auth == nil || c.broker.auth.Allow(c.username, topic, publish)
+}
+
+// deliver sends the message with the given QoS to the client of the session. QoS 1 messages are kept until the client
+// acknowledges them, also while it is disconnected, QoS 0 messages are dropped then. It has to be called with the
+// broker mutex held.
+func (s *session) deliver(msg *message, qos byte, retain bool) {
+	if qos == 0 {
+		if s.client != nil {
+			s.client.send(encodePublish(msg, 0, retain, 0))
+		}
+		return
+	}
+
+	s.lastPacketId++
+	if s.lastPacketId == 0 {
+		s.lastPacketId = 1
+	}
+	if len(s.order) >= maxInflight {
+		slog.Warn("mqtt session has too many unacknowledged messages, dropping the oldest", "packet_id", s.order[0])
+		delete(s.inflight, s.order[0])
+		s.order = s.order[1:]
+	}
+	inflight := &inflightMessage{msg: msg, retain: retain}
+	s.inflight[s.lastPacketId] = inflight
+	s.order = append(s.order, s.lastPacketId)
+	if s.client != nil {
+		inflight.sent = true
+		s.client.send(encodePublish(msg, 1, retain, s.lastPacketId))
+	}
+}
+
+// acknowledge forgets the message the client acknowledged with PUBACK, it has to be called with the broker mutex held
+func (s *session) acknowledge(packetId uint16) {
+	if _, ok := s.inflight[packetId]; !ok {
+		return
+	}
+	delete(s.inflight, packetId)
+	for i, id := range s.order {
+		if id == packetId {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// resend sends the unacknowledged messages to the client that resumed the session, in the order they were queued.
+// It has to be called with the broker mutex held.
+func (s *session) resend() {
+	for _, packetId := range s.order {
+		inflight := s.inflight[packetId]
+		publish := encodePublish(inflight.msg, 1, inflight.retain, packetId)
+		if inflight.sent {
+			publish = markDuplicate(publish)
+		}
+		inflight.sent = true
+		s.client.send(publish)
+	}
+}
+
+// Connect returns an in-process connection to the broker, it is trusted so the server's own client needs no
+// credentials
+func (b *Broker) Connect() net.Conn {
+	server, clientSide := net.Pipe()
+	go b.serve(server, true)
+	return clientSide
+}
+
+// ListenTCP accepts MQTT connections on address until the broker is closed
+func (b *Broker) ListenTCP(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("embedded mqtt broker failed to listen on %s: %v", address, err)
+	}
+	b.mu.Lock()
+	b.listeners = append(b.listeners, listener)
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Error("embedded mqtt broker failed to accept a connection", "error", err)
+				continue
+			}
+			go b.serve(conn, false)
+		}
+	}()
+	return nil
+}
+
+// Close stops the listeners and disconnects every client
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	listeners := b.listeners
+	b.listeners = nil
+	var clients []*client
+	for _, s := range b.sessions {
+		if s.client != nil {
+			clients = append(clients, s.client)
+		}
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		errs = append(errs, listener.Close())
+	}
+	for _, c := range clients {
+		c.close()
+	}
+	return errors.Join(errs...)
+}
+
+func randomClientId() string {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	return "auto-" + hex.EncodeToString(suffix)
+}
+
+func (b *Broker) serve(conn net.Conn, trusted bool) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	first, err := readPacket(r)
+	if err != nil || first.kind != packetConnect {
+		return
+	}
+	connect, err := parseConnect(first.body)
+	if err != nil {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if !(connect.protocol == "MQTT" && connect.level == 4) && !(connect.protocol == "MQIsdp" && connect.level == 3) {
+		_, _ = conn.Write(encodeConnack(false, connackBadProtocol))
+		return
+	}
+	if connect.clientId == "" {
+		if !connect.cleanSession {
+			_, _ = conn.Write(encodeConnack(false, connackIdentifierRejected))
+			return
+		}
+		connect.clientId = randomClientId()
+	}
+	if !trusted && b.auth != nil && !b.auth.Authenticate(connect.clientId, connect.username, connect.password) {
+		slog.Warn("embedded mqtt broker refused client", "client_id", connect.clientId)
+		_, _ = conn.Write(encodeConnack(false, connackBadUsernamePassword))
+		return
+	}
+
+	c := &client{
+		broker:     b,
+		conn:       conn,
+		id:         connect.clientId,
+		username:   connect.username,
+		trusted:    trusted,
+		will:       connect.will,
+		outgoing:   make(chan []byte, clientBuffer),
+		done:       make(chan struct{}),
+		unreleased: make(map[uint16]bool),
+	}
+	b.register(c, connect.cleanSession)
+	go c.writeLoop()
+
+	c.readLoop(r, time.Duration(connect.keepAlive)*time.Second)
+	b.unregister(c)
+}
+
+// register attaches the client to its session and accepts the connection. A client asking for a clean session gets a
+// new one, otherwise it resumes the session it left and receives the messages it did not acknowledge. A client already
+// connected with the same ID is disconnected as the specification requires.
+func (b *Broker) register(c *client, clean bool) {
+	b.mu.Lock()
+	var previous *client
+	s, present := b.sessions[c.id]
+	if present {
+		// the previous connection must not end the session when it unregisters
+		previous, s.client = s.client, nil
+	}
+	if !present || clean || s.clean {
+		s, present = newSession(clean), false
+		b.sessions[c.id] = s
+	}
+	s.client = c
+	c.session = s
+	// CONNACK is queued before anything a publish may deliver to the session once the lock is released
+	c.send(encodeConnack(present, connackAccepted))
+	s.resend()
+	b.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+}
+
+// unregister detaches the client from its session, ends the session unless it is persistent and publishes the will
+// unless the client disconnected on purpose
+func (b *Broker) unregister(c *client) {
+	c.close()
+	b.mu.Lock()
+	if s := c.session; s.client == c {
+		s.client = nil
+		if s.clean && b.sessions[c.id] == s {
+			delete(b.sessions, c.id)
+		}
+	}
+	b.mu.Unlock()
+
+	if c.will != nil && !c.disconnected && c.allowed(c.will.topic, true) {
+		b.publish(c.will)
+	}
+}
+
+func (c *client) readLoop(r *bufio.Reader, keepAlive time.Duration) {
+	for {
+		// the specification allows one and a half keep alive periods of silence
+		deadline := time.Time{}
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive * 3 / 2)
+		}
+		_ = c.conn.SetReadDeadline(deadline)
+
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch p.kind {
+		case packetPublish:
+			msg, packetId, err := parsePublish(p)
+			if err != nil {
+				return
+			}
+			duplicate := false
+			switch msg.qos {
+			case 1:
+				c.send(encodeAck(packetPuback, packetId))
+			case 2:
+				// a resent QoS 2 publish is acknowledged again but routed only once, until PUBREL releases its ID
+				duplicate = c.unreleased[packetId]
+				c.unreleased[packetId] = true
+				c.send(encodeAck(packetPubrec, packetId))
+			}
+			// a refused publish is dropped silently, MQTT 3.1.1 has no way of telling the client
+			if !duplicate && c.allowed(msg.topic, true) {
+				c.broker.publish(msg)
+			}
+		case packetPubrel:
+			packetId, err := parseAck(p.body)
+			if err != nil {
+				return
+			}
+			delete(c.unreleased, packetId)
+			c.send(encodeAck(packetPubcomp, packetId))
+		case packetPuback:
+			packetId, err := parseAck(p.body)
+			if err != nil {
+				return
+			}
+			c.broker.mu.Lock()
+			c.session.acknowledge(packetId)
+			c.broker.mu.Unlock()
+		case packetPubrec, packetPubcomp:
+			// messages are delivered with at most QoS 1, the QoS 2 acknowledgements need no handling
+		case packetSubscribe:
+			packetId, subscriptions, err := parseSubscribe(p.body)
+			if err != nil {
+				return
+			}
+			c.broker.subscribe(c, packetId, subscriptions)
+		case packetUnsubscribe:
+			packetId, filters, err := parseUnsubscribe(p.body)
+			if err != nil {
+				return
+			}
+			c.broker.unsubscribe(c, filters)
+			c.send(encodeAck(packetUnsuback, packetId))
+		case packetPingreq:
+			c.send(encodePacket(packetPingresp, 0, nil))
+		case packetDisconnect:
+			c.disconnected = true
+			return
+		default:
+			// a second CONNECT or a packet only the broker sends is a protocol violation
+			return
+		}
+	}
+}
+
+func parseAck(body []byte) (uint16, error) {
+	r := &reader{body: body}
+	packetId := r.uint16()
+	return packetId, r.err
+}
+
+// publish routes the message to every subscribed session once, with the highest QoS of its matching subscriptions
+func (b *Broker) publish(msg *message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if msg.retain {
+		if len(msg.payload) == 0 {
+			delete(b.retained, msg.topic)
+		} else {
+			b.retained[msg.topic] = msg
+		}
+	}
+
+	for _, s := range b.sessions {
+		qos, subscribed := byte(0), false
+		for filter, granted := range s.subscriptions {
+			if matches(filter, msg.topic) {
+				qos, subscribed = max(qos, granted), true
+			}
+		}
+		if subscribed {
+			s.deliver(msg, min(qos, msg.qos), false)
+		}
+	}
+}
+
+// subscribe acknowledges the subscriptions and sends the retained messages matching them
+func (b *Broker) subscribe(c *client, packetId uint16, subscriptions []subscription) {
+	body := []byte{byte(packetId >> 8), byte(packetId)}
+	var granted []subscription
+	for _, sub := range subscriptions {
+		if !validFilter(sub.filter) || !c.allowed(sub.filter, false) {
+			body = append(body, subackFailure)
+			continue
+		}
+		// messages are sent with at most QoS 1, so that is the QoS granted to QoS 2 subscriptions
+		sub.qos = min(sub.qos, 1)
+		body = append(body, sub.qos)
+		granted = append(granted, sub)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range granted {
+		c.session.subscriptions[sub.filter] = sub.qos
+	}
+	c.send(encodePacket(packetSuback, 0, body))
+	for topic, msg := range b.retained {
+		for _, sub := range granted {
+			if matches(sub.filter, topic) {
+				c.session.deliver(msg, min(sub.qos, msg.qos), true)
+				break
+			}
+		}
+	}
+}
+
+func (b *Broker) unsubscribe(c *client, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, filter := range filters {
+		delete(c.session.subscriptions, filter)
+	}
+}
@@ -0,0 +1,382 @@
+package broker
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClient speaks raw MQTT to the broker over an in-memory connection
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dial connects a client that is checked by the broker's authenticator and returns the CONNACK return code
+func dial(t *testing.T, b *Broker, clientId string, username string, password string, will *message) (*testClient, byte) {
+	t.Helper()
+	server, clientSide := net.Pipe()
+	go b.serve(server, false)
+	c := &testClient{t: t, conn: clientSide, r: bufio.NewReader(clientSide)}
+	t.Cleanup(func() { _ = clientSide.Close() })
+
+	c.write(encodeConnect(clientId, username, password, will, 0))
+	connack := c.read()
+	if connack.kind != packetConnack || len(connack.body) != 2 {
+		t.Fatalf("expected CONNACK, got packet %d", connack.kind)
+	}
+	return c, connack.body[1]
+}
+
+func connected(t *testing.T, b *Broker, clientId string) *testClient {
+	t.Helper()
+	c, code := dial(t, b, clientId, "", "", nil)
+	if code != connackAccepted {
+		t.Fatalf("connect refused with %d", code)
+	}
+	return c
+}
+
+func (c *testClient) write(data []byte) {
+	c.t.Helper()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *testClient) read() *packet {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readPacket(c.r)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return p
+}
+
+// subscribe returns the return codes of the SUBACK
+func (c *testClient) subscribe(subscriptions ...subscription) []byte {
+	c.t.Helper()
+	c.write(encodeSubscribe(1, subscriptions...))
+	suback := c.read()
+	if suback.kind != packetSuback || binary.BigEndian.Uint16(suback.body) != 1 {
+		c.t.Fatalf("expected SUBACK, got packet %d", suback.kind)
+	}
+	return suback.body[2:]
+}
+
+func (c *testClient) publish(topic string, payload string, qos byte, packetId uint16) {
+	c.t.Helper()
+	c.write(encodePublish(&message{topic: topic, payload: []byte(payload)}, qos, false, packetId))
+}
+
+func (c *testClient) expectAck(kind byte, packetId uint16) {
+	c.t.Helper()
+	p := c.read()
+	if p.kind != kind || binary.BigEndian.Uint16(p.body) != packetId {
+		c.t.Fatalf("expected packet %d for %d, got packet %d %v", kind, packetId, p.kind, p.body)
+	}
+}
+
+func (c *testClient) expectMessage(topic string, payload string, qos byte) *message {
+	c.t.Helper()
+	p := c.read()
+	if p.kind != packetPublish {
+		c.t.Fatalf("expected PUBLISH, got packet %d", p.kind)
+	}
+	msg, _, err := parsePublish(p)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if msg.topic != topic || string(msg.payload) != payload || msg.qos != qos {
+		c.t.Fatalf("expected %s %q at QoS %d, got %s %q at QoS %d", topic, payload, qos, msg.topic, msg.payload, msg.qos)
+	}
+	return msg
+}
+
+func TestQoS1RoundTrip(t *testing.T) {
+	b := New(nil)
+	subscriber := connected(t, b, "subscriber")
+	publisher := connected(t, b, "publisher")
+
+	if codes := subscriber.subscribe(subscription{"state/+", 1}); codes[0] != 1 {
+		t.Fatalf("granted QoS %d", codes[0])
+	}
+	publisher.publish("state/device", "on", 1, 7)
+	publisher.expectAck(packetPuback, 7)
+	subscriber.expectMessage("state/device", "on", 1)
+
+	// the message is delivered with the lower QoS of the publish and the subscription
+	publisher.publish("state/device", "off", 0, 0)
+	subscriber.expectMessage("state/device", "off", 0)
+}
+
+func TestQoS2SubscriptionGrantedQoS1(t *testing.T) {
+	b := New(nil)
+	subscriber := connected(t, b, "subscriber")
+	publisher := connected(t, b, "publisher")
+
+	if codes := subscriber.subscribe(subscription{"ack/+", 2}); codes[0] != 1 {
+		t.Fatalf("granted QoS %d, want 1", codes[0])
+	}
+	publisher.publish("ack/device", "done", 2, 3)
+	publisher.expectAck(packetPubrec, 3)
+	subscriber.expectMessage("ack/device", "done", 1)
+}
+
+func TestQoS2PublishRoutedOnce(t *testing.T) {
+	b := New(nil)
+	subscriber := connected(t, b, "subscriber")
+	publisher := connected(t, b, "publisher")
+	subscriber.subscribe(subscription{"ack/+", 1})
+
+	publisher.publish("ack/device", "first", 2, 5)
+	publisher.expectAck(packetPubrec, 5)
+	// a resend before PUBREL, e.g. after the PUBREC was lost, is acknowledged again but not routed again
+	publisher.publish("ack/device", "first", 2, 5)
+	publisher.expectAck(packetPubrec, 5)
+	publisher.write(encodeAck(packetPubrel, 5))
+	publisher.expectAck(packetPubcomp, 5)
+	// once released the packet ID may be used for a new message
+	publisher.publish("ack/device", "second", 2, 5)
+	publisher.expectAck(packetPubrec, 5)
+
+	subscriber.expectMessage("ack/device", "first", 1)
+	subscriber.expectMessage("ack/device", "second", 1)
+}
+
+func TestRetainedMessages(t *testing.T) {
+	b := New(nil)
+	publisher := connected(t, b, "publisher")
+	publisher.write(encodePublish(&message{topic: "status/device", payload: []byte("online")}, 1, true, 1))
+	publisher.expectAck(packetPuback, 1)
+
+	subscriber := connected(t, b, "subscriber")
+	subscriber.subscribe(subscription{"status/+", 1})
+	if msg := subscriber.expectMessage("status/device", "online", 1); !msg.retain {
+		t.Error("the retained message is sent without the retain flag")
+	}
+
+	// an empty retained message clears the topic
+	publisher.write(encodePublish(&message{topic: "status/device"}, 0, true, 0))
+	subscriber.expectMessage("status/device", "", 0)
+	late := connected(t, b, "late")
+	late.subscribe(subscription{"status/+", 1})
+	publisher.publish("status/check", "ping", 0, 0)
+	late.expectMessage("status/check", "ping", 0)
+}
+
+func TestWillPublishedOnConnectionLoss(t *testing.T) {
+	b := New(nil)
+	subscriber := connected(t, b, "subscriber")
+	subscriber.subscribe(subscription{"status/+", 1})
+
+	will := &message{topic: "status/device", payload: []byte("offline"), qos: 1}
+	device, _ := dial(t, b, "device", "", "", will)
+	_ = device.conn.Close()
+	subscriber.expectMessage("status/device", "offline", 1)
+
+	// a client disconnecting on purpose does not leave its will
+	device, _ = dial(t, b, "device", "", "", will)
+	device.write(encodePacket(packetDisconnect, 0, nil))
+	_ = device.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := device.r.ReadByte(); err == nil {
+		t.Fatal("the connection is still open after DISCONNECT")
+	}
+	subscriber.publish("status/check", "end", 0, 0)
+	subscriber.expectMessage("status/check", "end", 0)
+}
+
+func TestDeviceAuthenticationAndACL(t *testing.T) {
+	database := db.NewMemoryStore()
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token), &model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+	b := New(NewDeviceAuthenticator(database, "login/response/", "command/"))
+
+	if _, code := dial(t, b, "login", "login", token, nil); code != connackBadUsernamePassword {
+		t.Errorf("a topic level as username got CONNACK %d", code)
+	}
+	if _, code := dial(t, b, "#", "#", token, nil); code != connackBadUsernamePassword {
+		t.Errorf("a wildcard as username got CONNACK %d", code)
+	}
+	if _, code := dial(t, b, deviceUuid, deviceUuid, "wrong", nil); code != connackBadUsernamePassword {
+		t.Errorf("a wrong token got CONNACK %d", code)
+	}
+
+	// the server's own connection is trusted
+	conn := b.Connect()
+	serverSide := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	t.Cleanup(func() { _ = conn.Close() })
+	serverSide.write(encodeConnect("server", "", "", nil, 0))
+	if connack := serverSide.read(); connack.kind != packetConnack || connack.body[1] != connackAccepted {
+		t.Fatalf("the server's connection was refused")
+	}
+	if codes := serverSide.subscribe(subscription{"status/+", 1}); codes[0] != 1 {
+		t.Fatalf("the server's subscription was refused")
+	}
+
+	device, code := dial(t, b, deviceUuid, deviceUuid, token, nil)
+	if code != connackAccepted {
+		t.Fatalf("the device was refused with %d", code)
+	}
+	codes := device.subscribe(
+		subscription{"login/response/" + deviceUuid, 0},
+		subscription{"number_input/" + deviceUuid + "/+", 1},
+		subscription{"login/response/+", 0},
+		subscription{"#", 0},
+		subscription{"status/" + otherUuid, 0},
+	)
+	want := []byte{0, 1, subackFailure, subackFailure, subackFailure}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("subscription %d got return code %#x, want %#x", i, codes[i], want[i])
+		}
+	}
+
+	// a publish to another device's topic is dropped, the device's own one is routed
+	device.publish("status/"+otherUuid, "offline", 1, 1)
+	device.expectAck(packetPuback, 1)
+	device.publish("status/"+deviceUuid, "online", 1, 2)
+	device.expectAck(packetPuback, 2)
+	serverSide.expectMessage("status/"+deviceUuid, "online", 1)
+}
+
+// resume connects with clean session 0 and returns whether the broker resumed a session
+func resume(t *testing.T, b *Broker, clientId string) (*testClient, bool) {
+	t.Helper()
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0, 0, 0)
+	body = appendString(body, clientId)
+
+	server, clientSide := net.Pipe()
+	go b.serve(server, false)
+	c := &testClient{t: t, conn: clientSide, r: bufio.NewReader(clientSide)}
+	t.Cleanup(func() { _ = clientSide.Close() })
+	c.write(encodePacket(packetConnect, 0, body))
+	connack := c.read()
+	if connack.kind != packetConnack || len(connack.body) != 2 || connack.body[1] != connackAccepted {
+		t.Fatalf("expected an accepting CONNACK, got packet %d %v", connack.kind, connack.body)
+	}
+	return c, connack.body[0]&0x01 != 0
+}
+
+// disconnect closes the connection and waits until the broker noticed
+func (c *testClient) disconnect(b *Broker, clientId string) {
+	c.t.Helper()
+	_ = c.conn.Close()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		s, ok := b.sessions[clientId]
+		gone := !ok || s.client == nil
+		b.mu.Unlock()
+		if gone {
+			return
+		}
+	}
+	c.t.Fatalf("the broker did not notice that %s disconnected", clientId)
+}
+
+// expectResent reads a message sent again after a reconnect and returns its packet ID
+func (c *testClient) expectResent(payload string, duplicate bool) uint16 {
+	c.t.Helper()
+	p := c.read()
+	if p.kind != packetPublish {
+		c.t.Fatalf("expected PUBLISH, got packet %d", p.kind)
+	}
+	msg, packetId, err := parsePublish(p)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if string(msg.payload) != payload || msg.qos != 1 || (p.flags&0x08 != 0) != duplicate {
+		c.t.Fatalf("expected %q at QoS 1 with DUP %v, got %q at QoS %d with flags %#x", payload, duplicate, msg.payload,
+			msg.qos, p.flags)
+	}
+	return packetId
+}
+
+// ping waits for PINGRESP, everything the broker sent before has been read then
+func (c *testClient) ping() {
+	c.t.Helper()
+	c.write(encodePacket(packetPingreq, 0, nil))
+	if p := c.read(); p.kind != packetPingresp {
+		c.t.Fatalf("expected PINGRESP, got packet %d", p.kind)
+	}
+}
+
+func TestPersistentSessionResendsUnacknowledgedMessages(t *testing.T) {
+	b := New(nil)
+	publisher := connected(t, b, "publisher")
+	device, present := resume(t, b, "device")
+	if present {
+		t.Error("a new session is reported as present")
+	}
+	device.subscribe(subscription{"command/+", 1})
+
+	// the device loses the connection before it acknowledged the command
+	publisher.publish("command/device", "on", 1, 1)
+	publisher.expectAck(packetPuback, 1)
+	first := device.expectResent("on", false)
+	device.disconnect(b, "device")
+
+	// QoS 1 messages are queued while it is away, QoS 0 ones are dropped
+	publisher.publish("command/device", "off", 1, 2)
+	publisher.expectAck(packetPuback, 2)
+	publisher.publish("command/device", "dropped", 0, 0)
+	publisher.ping()
+
+	device, present = resume(t, b, "device")
+	if !present {
+		t.Error("the resumed session is not reported as present")
+	}
+	if resent := device.expectResent("on", true); resent != first {
+		t.Errorf("the command was resent with packet ID %d, want %d", resent, first)
+	}
+	queued := device.expectResent("off", false)
+	device.write(encodeAck(packetPuback, first))
+	device.ping()
+	device.disconnect(b, "device")
+
+	// only the unacknowledged message is sent again, the subscription is kept
+	device, _ = resume(t, b, "device")
+	if resent := device.expectResent("off", true); resent != queued {
+		t.Errorf("the queued command was resent with packet ID %d, want %d", resent, queued)
+	}
+	device.write(encodeAck(packetPuback, queued))
+	publisher.publish("command/device", "toggle", 1, 3)
+	publisher.expectAck(packetPuback, 3)
+	device.expectResent("toggle", false)
+	device.disconnect(b, "device")
+
+	// a clean session replaces the stored one, the unacknowledged message is not resent and the subscription is gone
+	clean := connected(t, b, "device")
+	publisher.publish("command/device", "ignored", 1, 4)
+	publisher.expectAck(packetPuback, 4)
+	clean.ping()
+}
+
+func TestPersistentSessionKeepsTheNewestMessages(t *testing.T) {
+	b := New(nil)
+	device, _ := resume(t, b, "device")
+	device.subscribe(subscription{"command/+", 1})
+	device.disconnect(b, "device")
+
+	for i := 0; i <= maxInflight; i++ {
+		b.publish(&message{topic: "command/device", payload: []byte(fmt.Sprint(i)), qos: 1})
+	}
+	// the oldest message was dropped to keep the session bounded
+	device, _ = resume(t, b, "device")
+	for i := 1; i <= maxInflight; i++ {
+		device.expectResent(fmt.Sprint(i), false)
+	}
+	device.ping()
+}
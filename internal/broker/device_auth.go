@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// DeviceAuthenticator lets devices connect with their UUID as client ID and username. Provisioned devices use their
+// secret as password, devices that are not provisioned yet a provisioning token, which is only used up by the login
+// request that follows. Devices may only publish to the topics of the device protocol ending with their UUID and only
+// subscribe to their login response and command topics.
+type DeviceAuthenticator struct {
+	database           db.Store
+	loginResponseTopic string
+	commandTopic       string
+}
+
+// NewDeviceAuthenticator creates the authenticator, the topic prefixes are the configured MQTT_LOGIN_RESPONSE_TOPIC
+// and MQTT_COMMAND_TOPIC
+func NewDeviceAuthenticator(database db.Store, loginResponseTopic string, commandTopic string) *DeviceAuthenticator {
+	return &DeviceAuthenticator{database: database, loginResponseTopic: loginResponseTopic, commandTopic: commandTopic}
+}
+
+func (a *DeviceAuthenticator) Authenticate(clientId string, username string, password []byte) bool {
+	// every topic check relies on the username being a UUID, it can not contain wildcards or separators then
+	if !model.ValidUUID(username) || clientId != username {
+		return false
+	}
+
+	_, secretHash, tokenHash, err := a.database.FetchDeviceCredentials(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("failed to authenticate mqtt client", "client_id", clientId, "error", err)
+		return false
+	}
+	if secretHash != "" {
+		// until the device logged in with its secret it may use the token again, the login issues a new secret then
+		return auth.TokenMatches(string(password), secretHash) || auth.TokenMatches(string(password), tokenHash)
+	}
+
+	if len(password) == 0 {
+		return false
+	}
+	token, err := a.database.FetchProvisioningToken(auth.HashToken(string(password)))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to authenticate mqtt client", "client_id", clientId, "error", err)
+		}
+		return false
+	}
+	return token.Usable(time.Now())
+}
+
+// publishTopics are the topics a device publishes to, each followed by its UUID
+var publishTopics = []string{"login/request/", "status/", "provide_value/", "state/", "ack/"}
+
+func (a *DeviceAuthenticator) Allow(username string, topic string, publish bool) bool {
+	if publish {
+		for _, prefix := range publishTopics {
+			if topic == prefix+username {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a filter has to name one of the device's topics before any wildcard, so it can only match topics of the device
+	for _, base := range []string{a.loginResponseTopic + username, "toggle/" + username, "number_input/" + username, a.commandTopic + username} {
+		if topic == base || strings.HasPrefix(topic, base+"/") {
+			return true
+		}
+	}
+	return false
+}
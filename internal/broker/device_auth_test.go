@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"testing"
+)
+
+const (
+	deviceUuid = "123e4567-e89b-12d3-a456-426614174000"
+	otherUuid  = "9b2ef61e-0000-4000-8000-000000000001"
+)
+
+func newTestAuthenticator(t *testing.T) (*DeviceAuthenticator, string, string) {
+	t.Helper()
+	database := db.NewMemoryStore()
+
+	secret := "device-secret"
+	if _, err := database.CreateDevice(otherUuid, "Provisioned", auth.HashToken(secret)); err != nil {
+		t.Fatal(err)
+	}
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token), &model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return NewDeviceAuthenticator(database, "login/response/", "command/"), secret, token
+}
+
+func TestDeviceAuthenticatorAuthenticate(t *testing.T) {
+	a, secret, token := newTestAuthenticator(t)
+
+	tests := []struct {
+		name     string
+		clientId string
+		username string
+		password string
+		want     bool
+	}{
+		{"new device with provisioning token", deviceUuid, deviceUuid, token, true},
+		{"provisioned device with secret", otherUuid, otherUuid, secret, true},
+		{"provisioned device with provisioning token", otherUuid, otherUuid, token, false},
+		{"provisioned device with wrong secret", otherUuid, otherUuid, "wrong", false},
+		{"unknown token", deviceUuid, deviceUuid, "wrong", false},
+		{"no password", deviceUuid, deviceUuid, "", false},
+		{"client ID differs from username", otherUuid, deviceUuid, token, false},
+		{"topic level as username", "login", "login", token, false},
+		{"wildcard as username", "#", "#", token, false},
+		{"plus as username", "+", "+", token, false},
+		{"empty username", "", "", token, false},
+		{"UUID with a suffix", deviceUuid + "/x", deviceUuid + "/x", token, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Authenticate(tt.clientId, tt.username, []byte(tt.password)); got != tt.want {
+				t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.clientId, tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceAuthenticatorAllow(t *testing.T) {
+	a, _, _ := newTestAuthenticator(t)
+
+	tests := []struct {
+		topic   string
+		publish bool
+		want    bool
+	}{
+		{"login/request/" + deviceUuid, true, true},
+		{"status/" + deviceUuid, true, true},
+		{"provide_value/" + deviceUuid, true, true},
+		{"state/" + deviceUuid, true, true},
+		{"ack/" + deviceUuid, true, true},
+		{"status/" + otherUuid, true, false},
+		{"login/response/" + deviceUuid, true, false},
+		{"toggle/" + deviceUuid, true, false},
+		{"toggle/" + otherUuid, true, false},
+		{deviceUuid, true, false},
+		{"state/" + deviceUuid + "/x", true, false},
+		{"x/state/" + deviceUuid, true, false},
+
+		{"login/response/" + deviceUuid, false, true},
+		{"toggle/" + deviceUuid, false, true},
+		{"number_input/" + deviceUuid + "/+", false, true},
+		{"number_input/" + deviceUuid + "/#", false, true},
+		{"number_input/" + deviceUuid + "/Interval_ms", false, true},
+		{"command/" + deviceUuid, false, true},
+		{"login/response/+", false, false},
+		{"login/response/#", false, false},
+		{"login/response/" + otherUuid, false, false},
+		{"#", false, false},
+		{"+/" + deviceUuid, false, false},
+		{"+/+", false, false},
+		{"toggle/+", false, false},
+		{"number_input/+/" + deviceUuid, false, false},
+		{"status/" + deviceUuid, false, false},
+		{"state/" + otherUuid, false, false},
+		{"command/" + deviceUuid + "x", false, false},
+	}
+	for _, tt := range tests {
+		if got := a.Allow(deviceUuid, tt.topic, tt.publish); got != tt.want {
+			t.Errorf("Allow(%q, publish %v) = %v, want %v", tt.topic, tt.publish, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceAuthenticatorUnconfirmedSecret(t *testing.T) {
+	database := db.NewMemoryStore()
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token), &model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+	device := &model.Device{UUID: deviceUuid, Name: "Provisioned", ActionsTemplateId: -1}
+	secret := "device-secret"
+	if err := database.ProvisionDevice(device, auth.HashToken(token), auth.HashToken(secret)); err != nil {
+		t.Fatal(err)
+	}
+	a := NewDeviceAuthenticator(database, "login/response/", "command/")
+
+	// the used up token still lets the device in to ask for a new secret, until it logged in with the secret
+	if !a.Authenticate(deviceUuid, deviceUuid, []byte(token)) {
+		t.Error("the token of an unconfirmed secret was refused")
+	}
+	if !a.Authenticate(deviceUuid, deviceUuid, []byte(secret)) {
+		t.Error("the unconfirmed secret was refused")
+	}
+	if err := database.ConfirmDeviceSecret(device.ID); err != nil {
+		t.Fatal(err)
+	}
+	if a.Authenticate(deviceUuid, deviceUuid, []byte(token)) {
+		t.Error("the token was accepted after the secret was confirmed")
+	}
+}
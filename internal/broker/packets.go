@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types, the type is the upper nibble of the first byte
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetPubrec      byte = 5
+	packetPubrel      byte = 6
+	packetPubcomp     byte = 7
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// CONNACK return codes
+const (
+	connackAccepted            byte = 0
+	connackBadProtocol         byte = 1
+	connackIdentifierRejected  byte = 2
+	connackBadUsernamePassword byte = 4
+)
+
+// subackFailure is returned in SUBACK for subscriptions that were refused
+const subackFailure byte = 0x80
+
+// maxPacketSize limits the remaining length of incoming packets, devices only send small JSON documents
+const maxPacketSize = 1 << 20
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a control packet as read from the connection, body is everything after the fixed header
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return nil, errMalformed
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// encodePacket prepends the fixed header to the body
+func encodePacket(kind byte, flags byte, body []byte) []byte {
+	encoded := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(encoded, body...)
+}
+
+// reader consumes the fields of a packet body, the first error sticks so fields can be read without checking each one
+type reader struct {
+	body []byte
+	err  error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.body) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	b := r.body[0]
+	r.body = r.body[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.body) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	value := binary.BigEndian.Uint16(r.body)
+	r.body = r.body[2:]
+	return value
+}
+
+func (r *reader) bytes() []byte {
+	length := int(r.uint16())
+	if r.err != nil || len(r.body) < length {
+		r.err = errMalformed
+		return nil
+	}
+	value := r.body[:length]
+	r.body = r.body[length:]
+	return value
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func appendString(body []byte, value string) []byte {
+	body = binary.BigEndian.AppendUint16(body, uint16(len(value)))
+	return append(body, value...)
+}
+
+// message is an application message routed by the broker
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+type connectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientId     string
+	will         *message
+	username     string
+	password     []byte
+}
+
+func parseConnect(body []byte) (*connectPacket, error) {
+	r := &reader{body: body}
+	connect := &connectPacket{protocol: r.string(), level: r.byte()}
+	flags := r.byte()
+	connect.keepAlive = r.uint16()
+	connect.cleanSession = flags&0x02 != 0
+	connect.clientId = r.string()
+	if flags&0x04 != 0 {
+		connect.will = &message{topic: r.string(), payload: r.bytes(), qos: flags >> 3 & 0x03, retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		connect.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		connect.password = r.bytes()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if flags&0x01 != 0 || (connect.will != nil && connect.will.qos > 2) {
+		return nil, errMalformed
+	}
+	return connect, nil
+}
+
+// encodeConnack tells the client whether the broker resumed the session it left with clean session 0
+func encodeConnack(sessionPresent bool, returnCode byte) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 0x01
+	}
+	return encodePacket(packetConnack, 0, []byte{flags, returnCode})
+}
+
+// parsePublish reads a PUBLISH packet, packetId is 0 for QoS 0
+func parsePublish(p *packet) (msg *message, packetId uint16, err error) {
+	r := &reader{body: p.body}
+	msg = &message{topic: r.string(), qos: p.flags >> 1 & 0x03, retain: p.flags&0x01 != 0}
+	if msg.qos > 0 {
+		packetId = r.uint16()
+	}
+	if r.err != nil || msg.qos > 2 || !validTopic(msg.topic) {
+		return nil, 0, errMalformed
+	}
+	msg.payload = r.body
+	return msg, packetId, nil
+}
+
+func encodePublish(msg *message, qos byte, retain bool, packetId uint16) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendString(nil, msg.topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetId)
+	}
+	return encodePacket(packetPublish, flags, append(body, msg.payload...))
+}
+
+// markDuplicate sets the DUP flag of an encoded PUBLISH, it is set on messages sent again after a reconnect
+func markDuplicate(publish []byte) []byte {
+	publish[0] |= 0x08
+	return publish
+}
+
+// encodeAck encodes the packets consisting of a packet ID only, PUBACK, PUBREC, PUBREL, PUBCOMP and UNSUBACK
+func encodeAck(kind byte, packetId uint16) []byte {
+	var flags byte
+	if kind == packetPubrel {
+		flags = 0x02
+	}
+	return encodePacket(kind, flags, binary.BigEndian.AppendUint16(nil, packetId))
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func parseSubscribe(body []byte) (packetId uint16, subscriptions []subscription, err error) {
+	r := &reader{body: body}
+	packetId = r.uint16()
+	for r.err == nil && len(r.body) > 0 {
+		sub := subscription{filter: r.string(), qos: r.byte()}
+		if sub.qos > 2 {
+			return 0, nil, errMalformed
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	if r.err != nil || len(subscriptions) == 0 {
+		return 0, nil, errMalformed
+	}
+	return packetId, subscriptions, nil
+}
+
+func parseUnsubscribe(body []byte) (packetId uint16, filters []string, err error) {
+	r := &reader{body: body}
+	packetId = r.uint16()
+	for r.err == nil && len(r.body) > 0 {
+		filters = append(filters, r.string())
+	}
+	if r.err != nil || len(filters) == 0 {
+		return 0, nil, errMalformed
+	}
+	return packetId, filters, nil
+}
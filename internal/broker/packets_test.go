@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// encodeConnect builds the CONNECT packet a client sends, the broker only decodes it
+func encodeConnect(clientId string, username string, password string, will *message, keepAlive uint16) []byte {
+	flags := byte(0x02)
+	body := appendString(nil, "MQTT")
+	body = append(body, 4)
+	if will != nil {
+		flags |= 0x04 | will.qos<<3
+		if will.retain {
+			flags |= 0x20
+		}
+	}
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+	body = appendString(body, clientId)
+	if will != nil {
+		body = appendString(body, will.topic)
+		body = appendString(body, string(will.payload))
+	}
+	if username != "" {
+		body = appendString(body, username)
+	}
+	if password != "" {
+		body = appendString(body, password)
+	}
+	return encodePacket(packetConnect, 0, body)
+}
+
+func encodeSubscribe(packetId uint16, subscriptions ...subscription) []byte {
+	body := binary.BigEndian.AppendUint16(nil, packetId)
+	for _, sub := range subscriptions {
+		body = appendString(body, sub.filter)
+		body = append(body, sub.qos)
+	}
+	return encodePacket(packetSubscribe, 0x02, body)
+}
+
+func TestPacketRemainingLength(t *testing.T) {
+	// the boundaries of the one to four byte encodings of the remaining length
+	tests := []struct {
+		length      int
+		headerBytes int
+	}{
+		{0, 2}, {127, 2}, {128, 3}, {16383, 3}, {16384, 4}, {maxPacketSize, 4},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{0xab}, tt.length)
+		encoded := encodePacket(packetPublish, 0x03, body)
+		if len(encoded) != tt.length+tt.headerBytes {
+			t.Errorf("length %d: encoded to %d bytes, want %d", tt.length, len(encoded), tt.length+tt.headerBytes)
+		}
+
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("length %d: %v", tt.length, err)
+		}
+		if p.kind != packetPublish || p.flags != 0x03 || !bytes.Equal(p.body, body) {
+			t.Errorf("length %d: decoded kind %d flags %d and %d bytes", tt.length, p.kind, p.flags, len(p.body))
+		}
+	}
+}
+
+func TestReadPacketRejectsMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"five length bytes":  {packetPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"too large":          encodePacket(packetPublish, 0, make([]byte, maxPacketSize+1)),
+		"truncated body":     {packetPublish << 4, 0x05, 0x00},
+		"truncated length":   {packetPublish << 4, 0x80},
+		"missing everything": {},
+	}
+	for name, data := range tests {
+		if _, err := readPacket(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestParseConnect(t *testing.T) {
+	will := &message{topic: "status/device", payload: []byte("offline"), qos: 1, retain: true}
+	p, err := readPacket(bufio.NewReader(bytes.NewReader(encodeConnect("device", "user", "secret", will, 30))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect, err := parseConnect(p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connect.protocol != "MQTT" || connect.level != 4 || !connect.cleanSession || connect.keepAlive != 30 {
+		t.Errorf("unexpected header %+v", connect)
+	}
+	if connect.clientId != "device" || connect.username != "user" || string(connect.password) != "secret" {
+		t.Errorf("unexpected credentials %q %q %q", connect.clientId, connect.username, connect.password)
+	}
+	if connect.will == nil || connect.will.topic != will.topic || string(connect.will.payload) != "offline" ||
+		connect.will.qos != 1 || !connect.will.retain {
+		t.Errorf("unexpected will %+v", connect.will)
+	}
+
+	p, _ = readPacket(bufio.NewReader(bytes.NewReader(encodeConnect("device", "", "", nil, 0))))
+	if connect, err = parseConnect(p.body); err != nil || connect.will != nil || connect.username != "" || connect.password != nil {
+		t.Errorf("connect without will and credentials: %+v, %v", connect, err)
+	}
+
+	reserved := append([]byte(nil), p.body...)
+	reserved[7] |= 0x01
+	if _, err = parseConnect(reserved); err == nil {
+		t.Error("the reserved flag is accepted")
+	}
+	if _, err = parseConnect(p.body[:8]); err == nil {
+		t.Error("a truncated connect is accepted")
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	for qos := byte(0); qos <= 2; qos++ {
+		sent := &message{topic: "provide_value/device", payload: []byte(`{"Temperature":21.5}`), qos: qos}
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(encodePublish(sent, qos, true, 42))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, packetId, err := parsePublish(p)
+		if err != nil {
+			t.Fatalf("qos %d: %v", qos, err)
+		}
+		wantId := uint16(42)
+		if qos == 0 {
+			wantId = 0
+		}
+		if received.topic != sent.topic || !bytes.Equal(received.payload, sent.payload) || received.qos != qos ||
+			!received.retain || packetId != wantId {
+			t.Errorf("qos %d: received %+v with packet ID %d", qos, received, packetId)
+		}
+	}
+
+	wildcard := encodePublish(&message{topic: "status/+"}, 0, false, 0)
+	p, _ := readPacket(bufio.NewReader(bytes.NewReader(wildcard)))
+	if _, _, err := parsePublish(p); err == nil {
+		t.Error("a publish to a wildcard topic is accepted")
+	}
+	if _, _, err := parsePublish(&packet{kind: packetPublish, flags: 0x06, body: appendString(nil, "a")}); err == nil {
+		t.Error("QoS 3 is accepted")
+	}
+}
+
+func TestParseSubscribe(t *testing.T) {
+	p, _ := readPacket(bufio.NewReader(bytes.NewReader(encodeSubscribe(7, subscription{"a/+", 1}, subscription{"b/#", 2}))))
+	packetId, subscriptions, err := parseSubscribe(p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packetId != 7 || len(subscriptions) != 2 || subscriptions[0] != (subscription{"a/+", 1}) ||
+		subscriptions[1] != (subscription{"b/#", 2}) {
+		t.Errorf("parsed %d %+v", packetId, subscriptions)
+	}
+
+	p, _ = readPacket(bufio.NewReader(bytes.NewReader(encodeSubscribe(7, subscription{"a", 3}))))
+	if _, _, err = parseSubscribe(p.body); err == nil {
+		t.Error("QoS 3 is accepted")
+	}
+	if _, _, err = parseSubscribe([]byte{0, 7}); err == nil {
+		t.Error("a subscribe without filters is accepted")
+	}
+}
+
+func TestParseUnsubscribe(t *testing.T) {
+	body := appendString(binary.BigEndian.AppendUint16(nil, 9), "a/+")
+	body = appendString(body, "b")
+	packetId, filters, err := parseUnsubscribe(body)
+	if err != nil || packetId != 9 || len(filters) != 2 || filters[0] != "a/+" || filters[1] != "b" {
+		t.Errorf("parsed %d %v %v", packetId, filters, err)
+	}
+	if _, _, err = parseUnsubscribe([]byte{0, 9}); err == nil {
+		t.Error("an unsubscribe without filters is accepted")
+	}
+}
+
+func TestEncodeAck(t *testing.T) {
+	if got := encodeAck(packetPuback, 0x0102); !bytes.Equal(got, []byte{packetPuback << 4, 2, 1, 2}) {
+		t.Errorf("PUBACK encoded as %v", got)
+	}
+	// PUBREL is the only acknowledgement with fixed header flags
+	if got := encodeAck(packetPubrel, 1); got[0] != packetPubrel<<4|0x02 {
+		t.Errorf("PUBREL encoded with header %#x", got[0])
+	}
+}
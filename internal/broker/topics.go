@@ -0,0 +1,46 @@
+package broker
+
+import "strings"
+
+// validTopic reports whether a topic may be published to, topic names must not contain wildcards
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter reports whether a subscription filter is well-formed, + has to occupy a whole level and # has to be
+// the last level
+func validFilter(filter string) bool {
+	if filter == "" || strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches reports whether the topic matches the filter, wildcards at the first level do not match topics starting
+// with $, which are reserved for the broker
+func matches(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,71 @@
+package broker
+
+import "testing"
+
+func TestValidTopic(t *testing.T) {
+	tests := map[string]bool{
+		"status/device":   true,
+		"a":               true,
+		"/leading/slash":  true,
+		"":                false,
+		"status/+":        false,
+		"status/#":        false,
+		"sta+tus":         false,
+		"nul\x00in/topic": false,
+	}
+	for topic, want := range tests {
+		if got := validTopic(topic); got != want {
+			t.Errorf("validTopic(%q) = %v, want %v", topic, got, want)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	tests := map[string]bool{
+		"status/device": true,
+		"status/+":      true,
+		"+/+":           true,
+		"#":             true,
+		"status/#":      true,
+		"+/device/#":    true,
+		"":              false,
+		"status/dev+":   false,
+		"status/#/more": false,
+		"status/dev#":   false,
+		"nul\x00":       false,
+	}
+	for filter, want := range tests {
+		if got := validFilter(filter); got != want {
+			t.Errorf("validFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"status/device", "status/device", true},
+		{"status/device", "status/other", false},
+		{"status/+", "status/device", true},
+		{"status/+", "status/device/more", false},
+		{"status/+", "status", false},
+		{"+/+", "status/device", true},
+		{"status/#", "status", true},
+		{"status/#", "status/device/more", true},
+		{"#", "status/device", true},
+		{"number_input/+/+", "number_input/device/Interval_ms", true},
+		{"status/device", "status/device/", false},
+		{"status/+", "status/", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{"mqtt", "mqttv3.1"},
+	// clients authenticate with MQTT credentials, not with cookies, so cross-origin connections are harmless
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsConn carries the MQTT byte stream in binary WebSocket messages, a packet may span several messages
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			kind, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				return 0, errors.New("mqtt over websocket requires binary messages")
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection carrying MQTT
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		return
+	}
+	b.serve(&wsConn{Conn: conn}, false)
+}
+
+// ListenWebSocket accepts MQTT over WebSocket connections on address, on every path, until the broker is closed
+func (b *Broker) ListenWebSocket(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("embedded mqtt broker failed to listen on %s: %v", address, err)
+	}
+	server := &http.Server{Handler: b, ReadHeaderTimeout: connectTimeout}
+	b.mu.Lock()
+	b.listeners = append(b.listeners, server)
+	b.mu.Unlock()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("embedded mqtt broker websocket listener stopped", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,375 @@
+package commands
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAckTimeout is how long a device has to acknowledge a command before it is marked timed out
+	DefaultAckTimeout = 10 * time.Second
+	publishTimeout    = 5 * time.Second
+)
+
+var (
+	ErrDeviceNotFound        = errors.New("device not found")
+	ErrDeviceOffline         = errors.New("device is offline")
+	ErrUnsupportedActionType = errors.New("action type can not be sent to a device")
+	ErrCommandNotFound       = errors.New("command not found")
+	ErrUnknownAction         = errors.New("device has no such action")
+	ErrActionTypeMismatch    = errors.New("action is of another type")
+	ErrInvalidValue          = errors.New("number_input actions require a numeric value")
+)
+
+// Consumer is called with every status change of a command, it must not block
+type Consumer func(command model.Command)
+
+// payload is published to the device, it has to answer on ack/<uuid> with the same correlation ID
+type payload struct {
+	CorrelationID string `json:"correlation_id"`
+	Action        string `json:"action,omitempty"`
+	Value         string `json:"value,omitempty"`
+}
+
+// Ack is the answer of a device to a command
+type Ack struct {
+	CorrelationID string              `json:"correlation_id"`
+	Status        model.CommandStatus `json:"status"`
+	Error         string              `json:"error"`
+}
+
+type pendingCommand struct {
+	command model.Command
+	timer   *time.Timer
+	done    chan struct{}
+}
+
+// Sender publishes device actions to the MQTT topics the devices are subscribed to, stores every command and
+// tracks it until the device acknowledges it or the ack timeout passes
+type Sender struct {
+	database   db.Store
+	mqttClient MQTT.Client
+	tracker    *presence.Tracker
+	ackTimeout time.Duration
+	// commandTopic is the prefix of the topics command actions are published to
+	commandTopic string
+
+	mu        sync.Mutex
+	pending   map[string]*pendingCommand
+	consumers []Consumer
+}
+
+// NewSender creates a sender publishing command actions to commandTopic followed by the device UUID
+func NewSender(database db.Store, mqttClient MQTT.Client, tracker *presence.Tracker, ackTimeout time.Duration, commandTopic string) *Sender {
+	return &Sender{
+		database:     database,
+		mqttClient:   mqttClient,
+		tracker:      tracker,
+		ackTimeout:   ackTimeout,
+		commandTopic: commandTopic,
+		pending:      make(map[string]*pendingCommand),
+	}
+}
+
+func (s *Sender) Attach(consumer Consumer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consumers = append(s.consumers, consumer)
+}
+
+func (s *Sender) notify(command model.Command) {
+	s.mu.Lock()
+	consumers := s.consumers
+	s.mu.Unlock()
+
+	for _, consumer := range consumers {
+		consumer(command)
+	}
+}
+
+func (s *Sender) Toggle(deviceId int, actionName string) (*model.Command, error) {
+	return s.sendWeb(deviceId, model.ActionTypeToggle, actionName, "")
+}
+
+func (s *Sender) NumberInput(deviceId int, actionName string, value string) (*model.Command, error) {
+	return s.sendWeb(deviceId, model.ActionTypeNumberInput, actionName, value)
+}
+
+func (s *Sender) Command(deviceId int, actionName string) (*model.Command, error) {
+	return s.sendWeb(deviceId, model.ActionTypeCommand, actionName, "")
+}
+
+// ValidateAction looks the action up in the device's template and custom actions and checks the value it is sent
+// with. The type is returned whenever the device has the action, also together with ErrInvalidValue or
+// ErrUnsupportedActionType.
+func ValidateAction(device *model.Device, actionName string, value string) (model.ActionType, error) {
+	actionType, ok, err := device.ActionType(actionName)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse actions of device %d: %v", device.ID, err)
+	}
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownAction, actionName)
+	}
+	switch actionType {
+	case model.ActionTypeToggle, model.ActionTypeCommand:
+	case model.ActionTypeNumberInput:
+		if _, err = strconv.ParseFloat(value, 64); err != nil {
+			return actionType, ErrInvalidValue
+		}
+	default:
+		return actionType, ErrUnsupportedActionType
+	}
+	return actionType, nil
+}
+
+func (s *Sender) fetchDevice(deviceId int) (*model.Device, error) {
+	device, err := s.database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrDeviceNotFound
+		}
+		return nil, err
+	}
+	return device, nil
+}
+
+// sendWeb sends an action issued by a control of the web interface, the control has to match the action's type
+func (s *Sender) sendWeb(deviceId int, actionType model.ActionType, actionName string, value string) (*model.Command, error) {
+	device, err := s.fetchDevice(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	deviceActionType, err := ValidateAction(device, actionName, value)
+	if deviceActionType != "" && deviceActionType != actionType {
+		return nil, fmt.Errorf("%w: %s is a %s action", ErrActionTypeMismatch, actionName, deviceActionType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Send("web", device.ID, actionType, actionName, value)
+}
+
+// SendAction looks the type of the action up in the device's actions and sends it, it is used by rules and schedules
+func (s *Sender) SendAction(source string, action model.DeviceAction) (*model.Command, error) {
+	device, err := s.fetchDevice(action.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	actionType, err := ValidateAction(device, action.ActionName, action.Value)
+	if err != nil {
+		return nil, err
+	}
+	return s.Send(source, device.ID, actionType, action.ActionName, action.Value)
+}
+
+// newCorrelationId returns a random (version 4) UUID
+func newCorrelationId() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Send publishes the action of given type, value is only used by number_input actions. The action is not looked up,
+// callers check it with ValidateAction first. The returned command is delivered (accepted by the broker), the final
+// status is reported to the consumers and can be awaited with Wait.
+// Commands for devices known to be offline are stored as failed and ErrDeviceOffline is returned.
+func (s *Sender) Send(source string, deviceId int, actionType model.ActionType, actionName string, value string) (*model.Command, error) {
+	deviceUuid, err := s.database.GetDeviceUUID(deviceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrDeviceNotFound
+		}
+		return nil, err
+	}
+
+	var topic string
+	message := payload{}
+	switch actionType {
+	case model.ActionTypeToggle:
+		topic, message.Action = fmt.Sprintf("toggle/%s", deviceUuid), actionName
+	case model.ActionTypeNumberInput:
+		topic, message.Value = fmt.Sprintf("number_input/%s/%s", deviceUuid, actionName), value
+	case model.ActionTypeCommand:
+		topic, message.Action = s.commandTopic+deviceUuid, actionName
+	default:
+		return nil, ErrUnsupportedActionType
+	}
+
+	if message.CorrelationID, err = newCorrelationId(); err != nil {
+		return nil, fmt.Errorf("failed to generate correlation ID: %v", err)
+	}
+	command := model.Command{
+		CorrelationID: message.CorrelationID,
+		DeviceID:      deviceId,
+		ActionName:    actionName,
+		ActionType:    actionType,
+		Value:         value,
+		Source:        source,
+		Status:        model.CommandPending,
+	}
+
+	if devicePresence, _ := s.tracker.Get(deviceId); devicePresence.Status == model.PresenceOffline {
+		command.Status, command.Error = model.CommandFailed, ErrDeviceOffline.Error()
+		if err = s.database.InsertCommand(&command); err != nil {
+			return nil, err
+		}
+		s.notify(command)
+		return &command, ErrDeviceOffline
+	}
+
+	if err = s.database.InsertCommand(&command); err != nil {
+		return nil, err
+	}
+	s.notify(command)
+
+	payloadJson, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// the command has to be pending before publishing, a fast device could acknowledge it before Publish returns
+	s.track(command)
+	token := s.mqttClient.Publish(topic, 1, false, payloadJson)
+	if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		publishErr := token.Error()
+		if publishErr == nil {
+			publishErr = errors.New("broker did not acknowledge the publish in time")
+		}
+		s.resolve(command.CorrelationID, model.CommandFailed, publishErr.Error())
+		return nil, fmt.Errorf("failed to publish to %s: %v", topic, publishErr)
+	}
+
+	return s.update(command.CorrelationID, model.CommandDelivered), nil
+}
+
+func (s *Sender) track(command model.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[command.CorrelationID] = &pendingCommand{
+		command: command,
+		done:    make(chan struct{}),
+		timer: time.AfterFunc(s.ackTimeout, func() {
+			s.resolve(command.CorrelationID, model.CommandTimedOut, "device did not acknowledge the command")
+		}),
+	}
+}
+
+// update sets a non-final status of a pending command, unless the device already settled it
+func (s *Sender) update(correlationId string, status model.CommandStatus) *model.Command {
+	s.mu.Lock()
+	pending, ok := s.pending[correlationId]
+	if !ok {
+		s.mu.Unlock()
+		command, err := s.database.FetchCommand(correlationId)
+		if err != nil {
+			slog.Error("failed to fetch command", "correlation_id", correlationId, "error", err)
+			return nil
+		}
+		return command
+	}
+	pending.command.Status = status
+	command := pending.command
+	s.mu.Unlock()
+
+	if err := s.database.UpdateCommandStatus(correlationId, status, ""); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// the device was faster than the broker's acknowledgement
+			settled, err := s.database.FetchCommand(correlationId)
+			if err != nil {
+				slog.Error("failed to fetch command", "correlation_id", correlationId, "error", err)
+				return &command
+			}
+			return settled
+		}
+		slog.Error("failed to store command status", "correlation_id", correlationId, logging.DeviceID(command.DeviceID), "error", err)
+	}
+	s.notify(command)
+	return &command
+}
+
+// resolve settles the command with a final status, acks arriving after the timeout still update the stored command
+func (s *Sender) resolve(correlationId string, status model.CommandStatus, errorMessage string) {
+	s.mu.Lock()
+	pending, ok := s.pending[correlationId]
+	if ok {
+		delete(s.pending, correlationId)
+		pending.timer.Stop()
+	}
+	s.mu.Unlock()
+
+	if err := s.database.UpdateCommandStatus(correlationId, status, errorMessage); err != nil {
+		slog.Error("failed to store command status", "correlation_id", correlationId, "error", err)
+		return
+	}
+
+	command, err := s.database.FetchCommand(correlationId)
+	if err != nil {
+		slog.Error("failed to fetch command", "correlation_id", correlationId, "error", err)
+		return
+	}
+	if ok {
+		close(pending.done)
+	}
+	s.notify(*command)
+}
+
+// Acknowledge handles the answer of the device, acks of other devices' commands are rejected
+func (s *Sender) Acknowledge(deviceId int, ack Ack) error {
+	if ack.Status != model.CommandSucceeded && ack.Status != model.CommandFailed {
+		return fmt.Errorf("invalid ack status %q", ack.Status)
+	}
+
+	command, err := s.database.FetchCommand(ack.CorrelationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCommandNotFound
+		}
+		return err
+	}
+	if command.DeviceID != deviceId {
+		return fmt.Errorf("command %s was not sent to device %d", ack.CorrelationID, deviceId)
+	}
+
+	s.resolve(ack.CorrelationID, ack.Status, ack.Error)
+	return nil
+}
+
+// Wait blocks until the command is settled or ctx is done and returns its latest stored state
+func (s *Sender) Wait(ctx context.Context, correlationId string) (*model.Command, error) {
+	s.mu.Lock()
+	pending, ok := s.pending[correlationId]
+	s.mu.Unlock()
+
+	if ok {
+		select {
+		case <-pending.done:
+		case <-ctx.Done():
+		}
+	}
+
+	command, err := s.database.FetchCommand(correlationId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCommandNotFound
+		}
+		return nil, err
+	}
+	return command, nil
+}
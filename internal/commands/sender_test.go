@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+const senderUuid = "123e4567-e89b-12d3-a456-426614174000"
+
+const customActions = `{"Blink": "command", "Brightness": "number_input", "Temperature": "provide_value"}`
+
+// doneToken is a token that completed without an error
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// recordingClient records the topics published to, the rest of MQTT.Client is not used by the sender
+type recordingClient struct {
+	MQTT.Client
+	topics []string
+}
+
+func (c *recordingClient) Publish(topic string, _ byte, _ bool, _ interface{}) MQTT.Token {
+	c.topics = append(c.topics, topic)
+	return doneToken{}
+}
+
+func TestValidateAction(t *testing.T) {
+	device := &model.Device{ID: 1, TemplateActions: `{"Light_state": "toggle"}`, CustomActions: customActions}
+	tests := []struct {
+		action   string
+		value    string
+		wantType model.ActionType
+		wantErr  error
+	}{
+		{"Light_state", "", model.ActionTypeToggle, nil},
+		{"Blink", "", model.ActionTypeCommand, nil},
+		{"Brightness", "42.5", model.ActionTypeNumberInput, nil},
+		{"Brightness", "", model.ActionTypeNumberInput, ErrInvalidValue},
+		{"Brightness", "bright", model.ActionTypeNumberInput, ErrInvalidValue},
+		{"Temperature", "", model.ActionTypeProvideValue, ErrUnsupportedActionType},
+		{"Missing", "", "", ErrUnknownAction},
+	}
+	for _, test := range tests {
+		actionType, err := ValidateAction(device, test.action, test.value)
+		if actionType != test.wantType || !errors.Is(err, test.wantErr) {
+			t.Errorf("ValidateAction(%s, %q) = %s, %v, want %s, %v", test.action, test.value, actionType, err,
+				test.wantType, test.wantErr)
+		}
+	}
+
+	if _, err := ValidateAction(&model.Device{CustomActions: "not json"}, "Blink", ""); err == nil {
+		t.Error("actions that are not JSON were accepted")
+	}
+}
+
+func TestWebActionsAreValidated(t *testing.T) {
+	database := db.NewMemoryStore()
+	templateId, err := database.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.RegisterDevice(&model.Device{UUID: senderUuid, Name: "Lamp", ActionsTemplateId: templateId,
+		CustomActions: customActions}); err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := database.GetDeviceIDByUUID(senderUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &recordingClient{}
+	sender := NewSender(database, client, presence.NewTracker(), time.Minute, "command/")
+
+	rejected := []struct {
+		name    string
+		send    func() (*model.Command, error)
+		wantErr error
+	}{
+		{"toggle of a command", func() (*model.Command, error) { return sender.Toggle(deviceId, "Blink") }, ErrActionTypeMismatch},
+		{"toggle of a number input", func() (*model.Command, error) { return sender.Toggle(deviceId, "Brightness") }, ErrActionTypeMismatch},
+		{"command of a toggle", func() (*model.Command, error) { return sender.Command(deviceId, "Light_state") }, ErrActionTypeMismatch},
+		{"command of a provided value", func() (*model.Command, error) { return sender.Command(deviceId, "Temperature") }, ErrActionTypeMismatch},
+		{"unknown command", func() (*model.Command, error) { return sender.Command(deviceId, "Missing") }, ErrUnknownAction},
+		{"text number input", func() (*model.Command, error) { return sender.NumberInput(deviceId, "Brightness", "bright") }, ErrInvalidValue},
+		{"number input of a toggle", func() (*model.Command, error) { return sender.NumberInput(deviceId, "Light_state", "1") }, ErrActionTypeMismatch},
+		{"unknown device", func() (*model.Command, error) { return sender.Toggle(deviceId+1, "Light_state") }, ErrDeviceNotFound},
+		{"rule with a text value", func() (*model.Command, error) {
+			return sender.SendAction("rule:1", model.DeviceAction{DeviceID: deviceId, ActionName: "Brightness", Value: "bright"})
+		}, ErrInvalidValue},
+	}
+	for _, test := range rejected {
+		if command, err := test.send(); command != nil || !errors.Is(err, test.wantErr) {
+			t.Errorf("%s returned %+v, %v, want %v", test.name, command, err, test.wantErr)
+		}
+	}
+	if len(client.topics) != 0 {
+		t.Errorf("rejected actions were published to %v", client.topics)
+	}
+	if stored, _ := database.FetchDeviceCommands(deviceId, 10); len(stored) != 0 {
+		t.Errorf("rejected actions were stored: %+v", stored)
+	}
+
+	if _, err = sender.Toggle(deviceId, "Light_state"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sender.NumberInput(deviceId, "Brightness", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sender.Command(deviceId, "Blink"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"toggle/" + senderUuid, "number_input/" + senderUuid + "/Brightness", "command/" + senderUuid}
+	if len(client.topics) != len(want) {
+		t.Fatalf("published to %v, want %v", client.topics, want)
+	}
+	for i, topic := range want {
+		if client.topics[i] != topic {
+			t.Errorf("published to %v, want %v", client.topics, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Config is the configuration of the web server. It is read from an optional YAML file, every value can be
+// overridden by its environment variable, see applyEnv.
+type Config struct {
+	// Demo keeps all data in memory instead of PostgreSQL, it is lost when the server stops
+	Demo     bool           `yaml:"demo"`
+	Log      LogConfig      `yaml:"log"`
+	HTTP     HTTPConfig     `yaml:"http"`
+	Postgres PostgresConfig `yaml:"postgres"`
+	MQTT     MQTTConfig     `yaml:"mqtt"`
+	Alerts   AlertsConfig   `yaml:"alerts"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is text (key=value pairs) or json (one object per line)
+	Format string `yaml:"format"`
+}
+
+type HTTPConfig struct {
+	// Host is the address to listen on, empty listens on every interface
+	Host string `yaml:"host"`
+	Port string `yaml:"port"`
+}
+
+func (c HTTPConfig) Address() string {
+	return net.JoinHostPort(c.Host, c.Port)
+}
+
+type PostgresConfig struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Hostname may contain a port, e.g. db:5432
+	Hostname string `yaml:"hostname"`
+	Database string `yaml:"database"`
+	SSLMode  string `yaml:"sslmode"`
+	// AutoMigrate applies pending schema migrations at startup
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// DataSourceName returns the connection URL, the credentials are escaped so they may contain any character
+func (c PostgresConfig) DataSourceName() string {
+	dataSource := url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     c.Hostname,
+		Path:     "/" + c.Database,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return dataSource.String()
+}
+
+type MQTTConfig struct {
+	// Embedded runs a broker inside the web server, Broker, Port and the connection settings are not used then
+	Embedded EmbeddedBrokerConfig `yaml:"embedded"`
+	Broker   string               `yaml:"broker"`
+	// Port defaults to 1883, or 8883 with TLS
+	Port     string `yaml:"port"`
+	TLS      bool   `yaml:"tls"`
+	CAFile   string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// ClientID has to be unique per server instance, a random one is used when it is empty
+	ClientID string `yaml:"client_id"`
+	// LoginResponseTopic and CommandTopic are prefixes the device UUID is appended to
+	LoginResponseTopic string `yaml:"login_response_topic"`
+	CommandTopic       string `yaml:"command_topic"`
+}
+
+type EmbeddedBrokerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TCPAddress and WebSocketAddress are where devices connect, an empty address disables the listener
+	TCPAddress       string `yaml:"tcp_address"`
+	WebSocketAddress string `yaml:"websocket_address"`
+	// DeviceAuth only accepts devices presenting their secret or a provisioning token, see broker.DeviceAuthenticator
+	DeviceAuth bool `yaml:"device_auth"`
+}
+
+func (c MQTTConfig) BrokerURL() string {
+	scheme := "mqtt"
+	if c.TLS {
+		scheme = "mqtts"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(c.Broker, c.Port))
+}
+
+type AlertsConfig struct {
+	// WebhookURL receives every alert as a JSON POST, alert webhooks are disabled when it is empty
+	WebhookURL string     `yaml:"webhook_url"`
+	SMTP       SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig configures email alerts, they are disabled when Host is empty
+type SMTPConfig struct {
+	Host     string   `yaml:"host"`
+	Port     string   `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Default returns the configuration used for every value that is neither in the file nor in the environment
+func Default() Config {
+	return Config{
+		Log:      LogConfig{Level: "info", Format: "text"},
+		HTTP:     HTTPConfig{Port: "4444"},
+		Postgres: PostgresConfig{SSLMode: "disable", AutoMigrate: true},
+		MQTT: MQTTConfig{
+			Embedded:           EmbeddedBrokerConfig{TCPAddress: ":1883", WebSocketAddress: ":9001"},
+			LoginResponseTopic: "login/response/",
+			CommandTopic:       "command/",
+		},
+		Alerts: AlertsConfig{SMTP: SMTPConfig{Port: "25"}},
+	}
+}
+
+// Load reads the YAML file at path on top of the defaults, applies the environment variables and validates the
+// result. An empty path only uses the defaults and the environment.
+func Load(path string) (*Config, error) {
+	config := Default()
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		// a misspelled key would otherwise silently keep its default
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(&config, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if config.MQTT.Port == "" {
+		config.MQTT.Port = "1883"
+		if config.MQTT.TLS {
+			config.MQTT.Port = "8883"
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// applyEnv overrides the values whose environment variables are set, the variable names predate the config file
+func applyEnv(config *Config, lookup func(string) (string, bool)) error {
+	stringValues := map[string]*string{
+		"LOG_LEVEL":                 &config.Log.Level,
+		"LOG_FORMAT":                &config.Log.Format,
+		"HTTP_SERVER_HOST":          &config.HTTP.Host,
+		"HTTP_SERVER_PORT":          &config.HTTP.Port,
+		"POSTGRES_USER":             &config.Postgres.User,
+		"POSTGRES_PASSWORD":         &config.Postgres.Password,
+		"POSTGRES_HOSTNAME":         &config.Postgres.Hostname,
+		"POSTGRES_DB":               &config.Postgres.Database,
+		"POSTGRES_SSLMODE":          &config.Postgres.SSLMode,
+		"MQTT_BROKER":               &config.MQTT.Broker,
+		"MQTT_PORT":                 &config.MQTT.Port,
+		"MQTT_CA_FILE":              &config.MQTT.CAFile,
+		"MQTT_CERT_FILE":            &config.MQTT.CertFile,
+		"MQTT_KEY_FILE":             &config.MQTT.KeyFile,
+		"MQTT_USERNAME":             &config.MQTT.Username,
+		"MQTT_PASSWORD":             &config.MQTT.Password,
+		"MQTT_CLIENT_ID":            &config.MQTT.ClientID,
+		"MQTT_LOGIN_RESPONSE_TOPIC": &config.MQTT.LoginResponseTopic,
+		"MQTT_COMMAND_TOPIC":        &config.MQTT.CommandTopic,
+		"MQTT_EMBEDDED_TCP_ADDRESS": &config.MQTT.Embedded.TCPAddress,
+		"MQTT_EMBEDDED_WS_ADDRESS":  &config.MQTT.Embedded.WebSocketAddress,
+		"ALERT_WEBHOOK_URL":         &config.Alerts.WebhookURL,
+		"SMTP_HOST":                 &config.Alerts.SMTP.Host,
+		"SMTP_PORT":                 &config.Alerts.SMTP.Port,
+		"SMTP_USERNAME":             &config.Alerts.SMTP.Username,
+		"SMTP_PASSWORD":             &config.Alerts.SMTP.Password,
+		"SMTP_FROM":                 &config.Alerts.SMTP.From,
+	}
+	for name, target := range stringValues {
+		if value, ok := lookup(name); ok {
+			*target = value
+		}
+	}
+
+	boolValues := map[string]*bool{
+		"DEMO_MODE":             &config.Demo,
+		"POSTGRES_AUTO_MIGRATE": &config.Postgres.AutoMigrate,
+		"MQTT_TLS":              &config.MQTT.TLS,
+		"MQTT_EMBEDDED":         &config.MQTT.Embedded.Enabled,
+		"MQTT_EMBEDDED_AUTH":    &config.MQTT.Embedded.DeviceAuth,
+	}
+	for name, target := range boolValues {
+		value, ok := lookup(name)
+		if !ok || value == "" {
+			continue
+		}
+		switch value {
+		case "true":
+			*target = true
+		case "false":
+			*target = false
+		default:
+			return fmt.Errorf("%s has to be true or false, not %q", name, value)
+		}
+	}
+	if value, ok := lookup("ALERT_EMAIL_TO"); ok {
+		config.Alerts.SMTP.To = splitList(value)
+	}
+	return nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate reports every missing or invalid value at once, each named after its environment variable
+func (c *Config) Validate() error {
+	var problems []error
+	require := func(value string, name string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, fmt.Errorf("%s is required", name))
+		}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Errorf("LOG_LEVEL has to be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Errorf("LOG_FORMAT has to be text or json, got %q", c.Log.Format))
+	}
+	require(c.HTTP.Port, "HTTP_SERVER_PORT")
+	if !c.Demo {
+		require(c.Postgres.User, "POSTGRES_USER")
+		require(c.Postgres.Hostname, "POSTGRES_HOSTNAME")
+		require(c.Postgres.Database, "POSTGRES_DB")
+	}
+	if c.MQTT.Embedded.Enabled {
+		listenAddress := func(address string, name string) {
+			if _, _, err := net.SplitHostPort(address); address != "" && err != nil {
+				problems = append(problems, fmt.Errorf("%s has to be host:port or :port, got %q", name, address))
+			}
+		}
+		listenAddress(c.MQTT.Embedded.TCPAddress, "MQTT_EMBEDDED_TCP_ADDRESS")
+		listenAddress(c.MQTT.Embedded.WebSocketAddress, "MQTT_EMBEDDED_WS_ADDRESS")
+	} else {
+		require(c.MQTT.Broker, "MQTT_BROKER")
+		require(c.MQTT.Port, "MQTT_PORT")
+	}
+
+	topicPrefix := func(topic string, name string) {
+		if !strings.HasSuffix(topic, "/") || strings.ContainsAny(topic, "+#") {
+			problems = append(problems, fmt.Errorf("%s has to be a topic prefix ending with / and without wildcards, got %q", name, topic))
+		}
+	}
+	topicPrefix(c.MQTT.LoginResponseTopic, "MQTT_LOGIN_RESPONSE_TOPIC")
+	topicPrefix(c.MQTT.CommandTopic, "MQTT_COMMAND_TOPIC")
+	if (c.MQTT.CertFile == "") != (c.MQTT.KeyFile == "") {
+		problems = append(problems, errors.New("MQTT_CERT_FILE and MQTT_KEY_FILE have to be set together"))
+	}
+	if !c.MQTT.TLS && (c.MQTT.CAFile != "" || c.MQTT.CertFile != "") {
+		problems = append(problems, errors.New("MQTT_CA_FILE, MQTT_CERT_FILE and MQTT_KEY_FILE require MQTT_TLS=true"))
+	}
+
+	if c.Alerts.WebhookURL != "" {
+		target, err := url.Parse(c.Alerts.WebhookURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			problems = append(problems, errors.New("ALERT_WEBHOOK_URL has to be an absolute http or https URL"))
+		}
+	}
+	if c.Alerts.SMTP.Host != "" {
+		require(c.Alerts.SMTP.Port, "SMTP_PORT")
+		require(c.Alerts.SMTP.From, "SMTP_FROM")
+		if len(c.Alerts.SMTP.To) == 0 {
+			problems = append(problems, errors.New("ALERT_EMAIL_TO is required when SMTP_HOST is set"))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validConfig is the smallest configuration passing Validate with an external broker and PostgreSQL
+func validConfig() Config {
+	config := Default()
+	config.Postgres.User, config.Postgres.Hostname, config.Postgres.Database = "iot", "db", "iot"
+	config.MQTT.Broker, config.MQTT.Port = "mosquitto", "1883"
+	return config
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    func(config *Config)
+		wantErr string
+	}{
+		{
+			name: "unset variables keep the file values",
+			env:  map[string]string{},
+			want: func(config *Config) {},
+		},
+		{
+			name: "strings override the file",
+			env:  map[string]string{"HTTP_SERVER_PORT": "8080", "MQTT_BROKER": "broker.local", "POSTGRES_PASSWORD": "p@ss:/word"},
+			want: func(config *Config) {
+				config.HTTP.Port, config.MQTT.Broker, config.Postgres.Password = "8080", "broker.local", "p@ss:/word"
+			},
+		},
+		{
+			name: "set but empty strings clear the file value",
+			env:  map[string]string{"MQTT_PORT": "", "MQTT_EMBEDDED_WS_ADDRESS": ""},
+			want: func(config *Config) {
+				config.MQTT.Port, config.MQTT.Embedded.WebSocketAddress = "", ""
+			},
+		},
+		{
+			name: "booleans",
+			env:  map[string]string{"DEMO_MODE": "true", "MQTT_TLS": "true", "POSTGRES_AUTO_MIGRATE": "false"},
+			want: func(config *Config) {
+				config.Demo, config.MQTT.TLS, config.Postgres.AutoMigrate = true, true, false
+			},
+		},
+		{
+			name: "empty booleans keep the file value",
+			env:  map[string]string{"MQTT_TLS": "", "POSTGRES_AUTO_MIGRATE": ""},
+			want: func(config *Config) {},
+		},
+		{
+			name:    "invalid booleans are rejected",
+			env:     map[string]string{"MQTT_EMBEDDED": "yes"},
+			wantErr: `MQTT_EMBEDDED has to be true or false, not "yes"`,
+		},
+		{
+			name: "email recipients skip blanks",
+			env:  map[string]string{"ALERT_EMAIL_TO": " a@example.com, ,b@example.com,, "},
+			want: func(config *Config) {
+				config.Alerts.SMTP.To = []string{"a@example.com", "b@example.com"}
+			},
+		},
+		{
+			name: "blank email recipients clear the file value",
+			env:  map[string]string{"ALERT_EMAIL_TO": " , "},
+			want: func(config *Config) {
+				config.Alerts.SMTP.To = nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			config.Alerts.SMTP.To = []string{"file@example.com"}
+			lookup := func(name string) (string, bool) {
+				value, ok := test.env[name]
+				return value, ok
+			}
+
+			err := applyEnv(&config, lookup)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("applyEnv returned %v, want %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := validConfig()
+			want.Alerts.SMTP.To = []string{"file@example.com"}
+			test.want(&want)
+			if !reflect.DeepEqual(config, want) {
+				t.Errorf("applyEnv produced\n%+v\nwant\n%+v", config, want)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := map[string][]string{
+		"":              nil,
+		" ":             nil,
+		",,":            nil,
+		"a":             {"a"},
+		" a , b ":       {"a", "b"},
+		"a,,b, ,c":      {"a", "b", "c"},
+		"a@example.com": {"a@example.com"},
+	}
+	for list, want := range tests {
+		if got := splitList(list); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitList(%q) = %q, want %q", list, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *Config)
+		// wantErrs are the variables the error has to name, none means the configuration is valid
+		wantErrs []string
+	}{
+		{"valid", func(config *Config) {}, nil},
+		{"demo mode needs no database", func(config *Config) {
+			config.Demo = true
+			config.Postgres = PostgresConfig{}
+		}, nil},
+		{"embedded broker needs no external broker", func(config *Config) {
+			config.MQTT.Embedded.Enabled = true
+			config.MQTT.Broker, config.MQTT.Port = "", ""
+		}, nil},
+		{"embedded listeners can be disabled", func(config *Config) {
+			config.MQTT.Embedded.Enabled = true
+			config.MQTT.Embedded.TCPAddress, config.MQTT.Embedded.WebSocketAddress = "", ""
+		}, nil},
+		{"log level is case insensitive", func(config *Config) { config.Log.Level = "DEBUG" }, nil},
+		{"TLS with client certificate", func(config *Config) {
+			config.MQTT.TLS = true
+			config.MQTT.CAFile, config.MQTT.CertFile, config.MQTT.KeyFile = "ca.pem", "cert.pem", "key.pem"
+		}, nil},
+		{"email alerts", func(config *Config) {
+			config.Alerts.SMTP.Host, config.Alerts.SMTP.From = "mail", "iot@example.com"
+			config.Alerts.SMTP.To = []string{"admin@example.com"}
+		}, nil},
+
+		{"log settings", func(config *Config) {
+			config.Log.Level, config.Log.Format = "verbose", "xml"
+		}, []string{"LOG_LEVEL", "LOG_FORMAT"}},
+		{"missing database", func(config *Config) {
+			config.Postgres = PostgresConfig{}
+		}, []string{"POSTGRES_USER", "POSTGRES_HOSTNAME", "POSTGRES_DB"}},
+		{"missing broker", func(config *Config) {
+			config.MQTT.Broker, config.MQTT.Port = " ", ""
+		}, []string{"MQTT_BROKER", "MQTT_PORT"}},
+		{"missing HTTP port", func(config *Config) { config.HTTP.Port = "" }, []string{"HTTP_SERVER_PORT"}},
+		{"invalid embedded listeners", func(config *Config) {
+			config.MQTT.Embedded.Enabled = true
+			config.MQTT.Embedded.TCPAddress, config.MQTT.Embedded.WebSocketAddress = "1883", "localhost"
+		}, []string{"MQTT_EMBEDDED_TCP_ADDRESS", "MQTT_EMBEDDED_WS_ADDRESS"}},
+		{"topic prefixes", func(config *Config) {
+			config.MQTT.LoginResponseTopic, config.MQTT.CommandTopic = "login/response", "command/#/"
+		}, []string{"MQTT_LOGIN_RESPONSE_TOPIC", "MQTT_COMMAND_TOPIC"}},
+		{"certificate without key", func(config *Config) {
+			config.MQTT.TLS = true
+			config.MQTT.CertFile = "cert.pem"
+		}, []string{"MQTT_CERT_FILE and MQTT_KEY_FILE"}},
+		{"certificates without TLS", func(config *Config) {
+			config.MQTT.CAFile = "ca.pem"
+		}, []string{"MQTT_TLS=true"}},
+		{"relative webhook URL", func(config *Config) { config.Alerts.WebhookURL = "/hook" }, []string{"ALERT_WEBHOOK_URL"}},
+		{"webhook URL scheme", func(config *Config) { config.Alerts.WebhookURL = "ftp://example.com" }, []string{"ALERT_WEBHOOK_URL"}},
+		{"incomplete email alerts", func(config *Config) {
+			config.Alerts.SMTP.Host, config.Alerts.SMTP.Port = "mail", ""
+		}, []string{"SMTP_PORT", "SMTP_FROM", "ALERT_EMAIL_TO"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			test.change(&config)
+			err := config.Validate()
+			if len(test.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("a valid configuration was rejected: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("an invalid configuration was accepted")
+			}
+			// every problem is reported at once
+			for _, name := range test.wantErrs {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("the error does not name %s: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	content := "postgres:\n  user: iot\n  hostname: db\n  database: iot\nmqtt:\n  broker: mosquitto\n  tls: true\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantURL string
+	}{
+		{"TLS from the file defaults to 8883", map[string]string{}, "mqtts://mosquitto:8883"},
+		{"the environment disables TLS and the port defaults to 1883", map[string]string{"MQTT_TLS": "false"}, "mqtt://mosquitto:1883"},
+		{"an explicit port is kept", map[string]string{"MQTT_PORT": "18883"}, "mqtts://mosquitto:18883"},
+		{"the environment overrides the broker", map[string]string{"MQTT_BROKER": "::1"}, "mqtts://[::1]:8883"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// variables of the environment running the tests must not leak into the result
+			for _, name := range []string{"MQTT_TLS", "MQTT_PORT", "MQTT_BROKER", "MQTT_EMBEDDED", "DEMO_MODE"} {
+				// Setenv restores the variable after the test
+				t.Setenv(name, "")
+				if err := os.Unsetenv(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config, err := Load(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url := config.MQTT.BrokerURL(); url != test.wantURL {
+				t.Errorf("BrokerURL = %s, want %s", url, test.wantURL)
+			}
+		})
+	}
+
+	if err := os.WriteFile(file, []byte("mqtt:\n  brokr: mosquitto\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err == nil || !strings.Contains(err.Error(), "brokr") {
+		t.Errorf("a misspelled key returned %v", err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
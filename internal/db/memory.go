@@ -0,0 +1,1586 @@
+package db
+
+import (
+	"NSI-semester-work/internal/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActionTemplate maps the actions of a device type to their types, Actions is a JSON object
+type ActionTemplate struct {
+	DeviceType model.DeviceType
+	Actions    string
+}
+
+// ActionTemplates are the action templates of the 0002_action_templates migration, the in-memory store is seeded
+// with them and the device simulator uses them as the actions of its devices
+var ActionTemplates = []ActionTemplate{
+	{"temperature_sensor", `{"Interval_ms": "number_input", "Temperature": "provide_value"}`},
+	{"humidity_sensor", `{"Humidity": "provide_value", "Interval_ms": "number_input"}`},
+	{"soil_moisture_sensor", `{"Interval_ms": "number_input", "Soil_moisture": "provide_value"}`},
+	{"light_switch", `{"Light_state": "toggle"}`},
+}
+
+type memoryDevice struct {
+	device model.Device
+	// templateId is 0 when the device has no action template
+	templateId int
+	secretHash string
+	// tokenHash is the provisioning token the secret was issued for until the device confirms it
+	tokenHash string
+	state     map[string]json.RawMessage
+}
+
+type memoryDashboardDevice struct {
+	deviceId     int
+	position     int
+	shownActions map[string]model.ShownAction
+}
+
+type memoryDashboard struct {
+	id      int
+	name    string
+	devices []memoryDashboardDevice
+}
+
+type memoryReading struct {
+	deviceId  int
+	timestamp time.Time
+	data      map[string]json.RawMessage
+}
+
+type memoryRule struct {
+	rule      model.Rule
+	condition []byte
+}
+
+type memorySession struct {
+	userId    int
+	expiresAt time.Time
+}
+
+type memoryToken struct {
+	token model.ProvisioningToken
+	hash  string
+}
+
+// MemoryStore keeps everything in memory and loses it on exit, it is used by the demo mode and by tests. It follows
+// the constraints of the PostgreSQL schema, deleting a row also deletes the rows referencing it. store_test.go runs
+// the same Store contract against both implementations (Database only when TEST_DATABASE_URL is set).
+type MemoryStore struct {
+	mu sync.Mutex
+	// sequences holds the last ID used per table
+	sequences map[string]int
+
+	devices         map[int]*memoryDevice
+	dashboards      map[int]*memoryDashboard
+	readings        []memoryReading
+	commands        []model.Command
+	rules           map[int]*memoryRule
+	schedules       map[int]*model.Schedule
+	scheduleRuns    []model.ScheduleRun
+	definitions     map[int]*model.AlertDefinition
+	alerts          []model.Alert
+	subscriptions   map[int]*model.WebhookSubscription
+	deliveries      []model.WebhookDelivery
+	users           map[int]*model.User
+	sessions        map[string]memorySession
+	grants          map[int][]model.Grant
+	tokens          map[int]*memoryToken
+	templateActions map[int]string
+	templateIds     map[model.DeviceType]int
+}
+
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{
+		sequences:       make(map[string]int),
+		devices:         make(map[int]*memoryDevice),
+		dashboards:      make(map[int]*memoryDashboard),
+		rules:           make(map[int]*memoryRule),
+		schedules:       make(map[int]*model.Schedule),
+		definitions:     make(map[int]*model.AlertDefinition),
+		subscriptions:   make(map[int]*model.WebhookSubscription),
+		users:           make(map[int]*model.User),
+		sessions:        make(map[string]memorySession),
+		grants:          make(map[int][]model.Grant),
+		tokens:          make(map[int]*memoryToken),
+		templateActions: make(map[int]string),
+		templateIds:     make(map[model.DeviceType]int),
+	}
+	for _, template := range ActionTemplates {
+		id := m.nextId("action_templates")
+		m.templateActions[id] = template.Actions
+		m.templateIds[template.DeviceType] = id
+	}
+	return m
+}
+
+func (m *MemoryStore) nextId(table string) int {
+	m.sequences[table]++
+	return m.sequences[table]
+}
+
+// PingContext always succeeds, there is no connection to lose
+func (m *MemoryStore) PingContext(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
+
+// sortedIds returns the keys of a table in ascending order, so listings do not depend on map iteration
+func sortedIds[T any](table map[int]T) []int {
+	ids := make([]int, 0, len(table))
+	for id := range table {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// jsonText converts a JSON value like the ->> operator, strings lose their quotes and null is not a value
+func jsonText(value json.RawMessage) (string, bool) {
+	if value == nil || string(value) == "null" {
+		return "", false
+	}
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		return text, true
+	}
+	return string(value), true
+}
+
+func (m *MemoryStore) RegisterDevice(device *model.Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.registerDevice(device)
+	return err
+}
+
+// registerDevice inserts the device or records the login of a known one and returns the stored device, the caller
+// holds the lock
+func (m *MemoryStore) registerDevice(device *model.Device) (*memoryDevice, error) {
+	templateId := device.ActionsTemplateId
+	if templateId == -1 {
+		templateId = 0
+	} else if _, ok := m.templateActions[templateId]; !ok {
+		return nil, fmt.Errorf("failed insert device: unknown action template %d", templateId)
+	}
+
+	for _, stored := range m.devices {
+		if stored.device.UUID != device.UUID {
+			continue
+		}
+		stored.device.LastLogin = time.Now()
+		if stored.templateId == 0 {
+			stored.templateId = templateId
+		}
+		if stored.device.CustomActions == "" {
+			stored.device.CustomActions = device.CustomActions
+		}
+		return stored, nil
+	}
+
+	id := m.nextId("devices")
+	stored := &memoryDevice{
+		device: model.Device{
+			ID:            id,
+			UUID:          device.UUID,
+			Name:          device.Name,
+			CustomActions: device.CustomActions,
+			LastLogin:     time.Now(),
+		},
+		templateId: templateId,
+		state:      make(map[string]json.RawMessage),
+	}
+	m.devices[id] = stored
+	return stored, nil
+}
+
+func (m *MemoryStore) FetchDeviceNamesAndIds() (devices []model.Device, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.devices) {
+		stored := m.devices[id]
+		if !stored.device.Retired {
+			devices = append(devices, model.Device{ID: stored.device.ID, Name: stored.device.Name})
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices, nil
+}
+
+// deviceWithActions fills in the columns deviceWithActionsQuery joins and coalesces
+func (m *MemoryStore) deviceWithActions(stored *memoryDevice) model.Device {
+	device := stored.device
+	device.TemplateActions = "{}"
+	if stored.templateId != 0 {
+		device.TemplateActions = m.templateActions[stored.templateId]
+		for deviceType, id := range m.templateIds {
+			if id == stored.templateId {
+				device.DeviceType = deviceType
+			}
+		}
+	}
+	if device.CustomActions == "" {
+		device.CustomActions = "{}"
+	}
+	device.Provisioned = stored.secretHash != ""
+	return device
+}
+
+func (m *MemoryStore) FetchDeviceWithActions(deviceId int) (*model.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceId]
+	if !ok {
+		return nil, fmt.Errorf("no device found with ID %d: %w", deviceId, sql.ErrNoRows)
+	}
+	device := m.deviceWithActions(stored)
+	return &device, nil
+}
+
+func (m *MemoryStore) FetchDevicesWithActions() (devices []model.Device, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.devices) {
+		devices = append(devices, m.deviceWithActions(m.devices[id]))
+	}
+	return devices, nil
+}
+
+func (m *MemoryStore) deviceByUUID(uuid string) *memoryDevice {
+	for _, stored := range m.devices {
+		if stored.device.UUID == uuid {
+			return stored
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateDevice(uuid string, name string, secretHash string) (deviceId int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.deviceByUUID(uuid) != nil {
+		return 0, ErrDeviceExists
+	}
+	deviceId = m.nextId("devices")
+	m.devices[deviceId] = &memoryDevice{
+		device:     model.Device{ID: deviceId, UUID: uuid, Name: name},
+		secretHash: secretHash,
+		state:      make(map[string]json.RawMessage),
+	}
+	return deviceId, nil
+}
+
+func (m *MemoryStore) FetchDeviceCredentials(uuid string) (deviceId int, secretHash string, tokenHash string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := m.deviceByUUID(uuid)
+	if stored == nil {
+		return 0, "", "", sql.ErrNoRows
+	}
+	return stored.device.ID, stored.secretHash, stored.tokenHash, nil
+}
+
+// updateDevice applies update to the device or returns sql.ErrNoRows like expectAffected
+func (m *MemoryStore) updateDevice(deviceId int, update func(stored *memoryDevice)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	update(stored)
+	return nil
+}
+
+func (m *MemoryStore) SetDeviceSecret(deviceId int, secretHash string) error {
+	return m.updateDevice(deviceId, func(stored *memoryDevice) {
+		stored.secretHash = secretHash
+		stored.tokenHash = ""
+	})
+}
+
+func (m *MemoryStore) ConfirmDeviceSecret(deviceId int) error {
+	return m.updateDevice(deviceId, func(stored *memoryDevice) { stored.tokenHash = "" })
+}
+
+func (m *MemoryStore) RenameDevice(deviceId int, name string) error {
+	return m.updateDevice(deviceId, func(stored *memoryDevice) { stored.device.Name = name })
+}
+
+func (m *MemoryStore) SetDeviceRetired(deviceId int, retired bool) error {
+	return m.updateDevice(deviceId, func(stored *memoryDevice) { stored.device.Retired = retired })
+}
+
+// DeleteDevice removes the device and everything referencing it, like the cascading foreign keys do
+func (m *MemoryStore) DeleteDevice(deviceId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[deviceId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.devices, deviceId)
+
+	readings := m.readings[:0]
+	for _, reading := range m.readings {
+		if reading.deviceId != deviceId {
+			readings = append(readings, reading)
+		}
+	}
+	m.readings = readings
+
+	for _, dashboard := range m.dashboards {
+		devices := dashboard.devices[:0]
+		for _, device := range dashboard.devices {
+			if device.deviceId != deviceId {
+				devices = append(devices, device)
+			}
+		}
+		dashboard.devices = devices
+	}
+
+	commands := m.commands[:0]
+	for _, command := range m.commands {
+		if command.DeviceID != deviceId {
+			commands = append(commands, command)
+		}
+	}
+	m.commands = commands
+
+	for id, rule := range m.rules {
+		if rule.rule.Action.DeviceID == deviceId {
+			delete(m.rules, id)
+		}
+	}
+	for id, schedule := range m.schedules {
+		if schedule.Action.DeviceID == deviceId {
+			m.deleteSchedule(id)
+		}
+	}
+	for id, definition := range m.definitions {
+		if definition.DeviceID == deviceId {
+			m.deleteAlertDefinition(id)
+		}
+	}
+	for userId, grants := range m.grants {
+		kept := grants[:0]
+		for _, grant := range grants {
+			if grant.DeviceID != deviceId {
+				kept = append(kept, grant)
+			}
+		}
+		m.grants[userId] = kept
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateDeviceLastSeen(deviceId int, lastSeen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.devices[deviceId]; ok {
+		stored.device.LastSeen = lastSeen
+	}
+	return nil
+}
+
+func (m *MemoryStore) FetchTemplateActions(deviceType model.DeviceType) (actionTemplateId int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	actionTemplateId, ok := m.templateIds[deviceType]
+	if !ok {
+		return -1, sql.ErrNoRows
+	}
+	return actionTemplateId, nil
+}
+
+func (m *MemoryStore) GetDeviceIDByUUID(uuid string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := m.deviceByUUID(uuid)
+	if stored == nil {
+		return 0, sql.ErrNoRows
+	}
+	return stored.device.ID, nil
+}
+
+func (m *MemoryStore) GetDeviceUUID(deviceId int) (uuid string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceId]
+	if !ok {
+		return "", fmt.Errorf("error fetching UUID for device ID %d: %w", deviceId, sql.ErrNoRows)
+	}
+	return stored.device.UUID, nil
+}
+
+func (m *MemoryStore) dashboardNameTaken(name string, exceptId int) bool {
+	for id, dashboard := range m.dashboards {
+		if id != exceptId && dashboard.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dashboardDevices validates the devices like the foreign and primary keys of devices_in_dashboard do
+func (m *MemoryStore) dashboardDevices(devices []model.DeviceInDashboard) ([]memoryDashboardDevice, error) {
+	stored := make([]memoryDashboardDevice, 0, len(devices))
+	seen := make(map[int]bool)
+	for _, device := range devices {
+		if _, ok := m.devices[device.Device.ID]; !ok {
+			return nil, fmt.Errorf("error inserting device into dashboard: unknown device %d", device.Device.ID)
+		}
+		if seen[device.Device.ID] {
+			return nil, fmt.Errorf("error inserting device into dashboard: device %d is already on it", device.Device.ID)
+		}
+		seen[device.Device.ID] = true
+
+		shownActions := make(map[string]model.ShownAction, len(device.ShownActions))
+		for name, action := range device.ShownActions {
+			shownActions[name] = action
+		}
+		stored = append(stored, memoryDashboardDevice{
+			deviceId:     device.Device.ID,
+			position:     device.Position,
+			shownActions: shownActions,
+		})
+	}
+	return stored, nil
+}
+
+func (m *MemoryStore) CreateDashboard(name string) (dashboardId int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.dashboardNameTaken(name, 0) {
+		return 0, fmt.Errorf("a dashboard named %s already exists", name)
+	}
+	dashboardId = m.nextId("dashboards")
+	m.dashboards[dashboardId] = &memoryDashboard{id: dashboardId, name: name}
+	return dashboardId, nil
+}
+
+func (m *MemoryStore) InsertDevicesToDashboard(dashboardId int, devices []model.DeviceInDashboard) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dashboard, ok := m.dashboards[dashboardId]
+	if !ok {
+		return fmt.Errorf("error inserting device into dashboard: unknown dashboard %d", dashboardId)
+	}
+	stored, err := m.dashboardDevices(append(m.dashboardContents(dashboard), devices...))
+	if err != nil {
+		return err
+	}
+	dashboard.devices = stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateDashboard(dashboardId int, name string, devices []model.DeviceInDashboard) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dashboard, ok := m.dashboards[dashboardId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.dashboardNameTaken(name, dashboardId) {
+		return fmt.Errorf("error renaming dashboard: a dashboard named %s already exists", name)
+	}
+	stored, err := m.dashboardDevices(devices)
+	if err != nil {
+		return err
+	}
+	dashboard.name = name
+	dashboard.devices = stored
+	return nil
+}
+
+func (m *MemoryStore) DeleteDashboard(dashboardId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dashboards[dashboardId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.dashboards, dashboardId)
+	for userId, grants := range m.grants {
+		kept := grants[:0]
+		for _, grant := range grants {
+			if grant.DashboardID != dashboardId {
+				kept = append(kept, grant)
+			}
+		}
+		m.grants[userId] = kept
+	}
+	return nil
+}
+
+func (m *MemoryStore) FetchDashboards() ([]model.Dashboard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var dashboards []model.Dashboard
+	for _, dashboard := range m.dashboards {
+		dashboards = append(dashboards, model.Dashboard{DashboardId: dashboard.id, Name: dashboard.name})
+	}
+	sort.Slice(dashboards, func(i, j int) bool { return dashboards[i].Name < dashboards[j].Name })
+	return dashboards, nil
+}
+
+// dashboardContents returns the devices of the dashboard ordered by position, only their ID and name are set
+func (m *MemoryStore) dashboardContents(dashboard *memoryDashboard) []model.DeviceInDashboard {
+	var devices []model.DeviceInDashboard
+	for _, device := range dashboard.devices {
+		shownActions := make(map[string]model.ShownAction, len(device.shownActions))
+		for name, action := range device.shownActions {
+			shownActions[name] = action
+		}
+		devices = append(devices, model.DeviceInDashboard{
+			Device:       model.Device{ID: device.deviceId, Name: m.devices[device.deviceId].device.Name},
+			ShownActions: shownActions,
+			Position:     device.position,
+		})
+	}
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].Position < devices[j].Position })
+	return devices
+}
+
+// FetchDashboardContents returns an empty name for dashboards without devices, like the join it mirrors
+func (m *MemoryStore) FetchDashboardContents(dashboardID int) ([]model.DeviceInDashboard, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dashboard, ok := m.dashboards[dashboardID]
+	if !ok || len(dashboard.devices) == 0 {
+		return nil, "", nil
+	}
+	return m.dashboardContents(dashboard), dashboard.name, nil
+}
+
+func (m *MemoryStore) FetchDashboard(dashboardID int) (*model.Dashboard, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dashboard, ok := m.dashboards[dashboardID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &model.Dashboard{
+		DashboardId: dashboard.id,
+		Name:        dashboard.name,
+		Devices:     m.dashboardContents(dashboard),
+	}, nil
+}
+
+func (m *MemoryStore) FetchDashboardDeviceIds(dashboardIds []int) (devices map[int][]int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices = make(map[int][]int)
+	for _, dashboardId := range dashboardIds {
+		dashboard, ok := m.dashboards[dashboardId]
+		if !ok {
+			continue
+		}
+		for _, device := range dashboard.devices {
+			devices[dashboardId] = append(devices[dashboardId], device.deviceId)
+		}
+	}
+	return devices, nil
+}
+
+// UpdateDeviceState merges the new state into the stored one, unknown devices are ignored like the UPDATE does
+func (m *MemoryStore) UpdateDeviceState(deviceId int, newState map[string]interface{}) error {
+	values := make(map[string]json.RawMessage, len(newState))
+	for name, value := range newState {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[name] = encoded
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceId]
+	if !ok {
+		return nil
+	}
+	for name, value := range values {
+		stored.state[name] = value
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetDeviceState(deviceId int, actionName string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceId]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	state, ok := jsonText(stored.state[actionName])
+	if !ok {
+		return "", fmt.Errorf("device %d has no state of %s", deviceId, actionName)
+	}
+	return state, nil
+}
+
+func (m *MemoryStore) GetDeviceStates(deviceID int) (stateJson string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.devices[deviceID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	state, err := json.Marshal(stored.state)
+	if err != nil {
+		return "", err
+	}
+	return string(state), nil
+}
+
+func (m *MemoryStore) InsertProvidedValue(deviceId int, jsonData string) (timestamp time.Time, err error) {
+	var data map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(jsonData), &data); err != nil {
+		return time.Time{}, fmt.Errorf("error executing insert statement: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[deviceId]; !ok {
+		return time.Time{}, fmt.Errorf("error executing insert statement: unknown device %d", deviceId)
+	}
+	timestamp = time.Now()
+	m.readings = append(m.readings, memoryReading{deviceId: deviceId, timestamp: timestamp, data: data})
+	return timestamp, nil
+}
+
+// lastReading returns the newest reading of the device accepted by matches
+func (m *MemoryStore) lastReading(deviceId int, matches func(reading memoryReading) bool) (memoryReading, bool) {
+	var last memoryReading
+	found := false
+	for _, reading := range m.readings {
+		if reading.deviceId == deviceId && matches(reading) && (!found || !reading.timestamp.Before(last.timestamp)) {
+			last = reading
+			found = true
+		}
+	}
+	return last, found
+}
+
+func (m *MemoryStore) GetLastSensorValue(deviceId int, actionName string) (value string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reading, ok := m.lastReading(deviceId, func(memoryReading) bool { return true })
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	value, ok = jsonText(reading.data[actionName])
+	if !ok {
+		return "", fmt.Errorf("the last reading of device %d has no %s", deviceId, actionName)
+	}
+	return value, nil
+}
+
+func (m *MemoryStore) GetLastSensorReading(deviceId int, actionName string) (*model.SensorValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reading, ok := m.lastReading(deviceId, func(reading memoryReading) bool {
+		_, ok := reading.data[actionName]
+		return ok
+	})
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &model.SensorValue{Value: reading.data[actionName], Timestamp: reading.timestamp}, nil
+}
+
+// numericReading matches the values GetSensorHistory casts to double precision
+var numericReading = regexp.MustCompile(`^\s*[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?\s*$`)
+
+// bucketOrigin is the default origin of time_bucket
+var bucketOrigin = time.Date(2000, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+func (m *MemoryStore) GetSensorHistory(deviceId int, actionName string, from time.Time, to time.Time, bucket time.Duration) (buckets []model.TelemetryBucket, err error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("error querying sensor history: bucket has to be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byStart := make(map[time.Time]*model.TelemetryBucket)
+	lastAt := make(map[time.Time]time.Time)
+	for _, reading := range m.readings {
+		if reading.deviceId != deviceId || reading.timestamp.Before(from) || !reading.timestamp.Before(to) {
+			continue
+		}
+		text, ok := jsonText(reading.data[actionName])
+		if !ok || !numericReading.MatchString(text) {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			continue
+		}
+
+		offset := reading.timestamp.Sub(bucketOrigin)
+		start := bucketOrigin.Add(offset / bucket * bucket)
+		if offset%bucket < 0 {
+			start = start.Add(-bucket)
+		}
+		b, ok := byStart[start]
+		if !ok {
+			b = &model.TelemetryBucket{Bucket: start, Min: value, Max: value}
+			byStart[start] = b
+		}
+		b.Min = min(b.Min, value)
+		b.Max = max(b.Max, value)
+		b.Avg += value
+		b.Count++
+		if !reading.timestamp.Before(lastAt[start]) {
+			b.Last = value
+			lastAt[start] = reading.timestamp
+		}
+	}
+
+	for _, b := range byStart {
+		b.Avg /= float64(b.Count)
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket.Before(buckets[j].Bucket) })
+	return buckets, nil
+}
+
+func (m *MemoryStore) InsertCommand(command *model.Command) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[command.DeviceID]; !ok {
+		return fmt.Errorf("error inserting command: unknown device %d", command.DeviceID)
+	}
+	for _, stored := range m.commands {
+		if stored.CorrelationID == command.CorrelationID {
+			return fmt.Errorf("error inserting command: correlation ID %s is already used", command.CorrelationID)
+		}
+	}
+	command.ID = m.nextId("commands")
+	command.CreatedAt = time.Now()
+	stored := *command
+	stored.CompletedAt = copyTime(command.CompletedAt)
+	m.commands = append(m.commands, stored)
+	return nil
+}
+
+func (m *MemoryStore) UpdateCommandStatus(correlationId string, status model.CommandStatus, errorMessage string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.commands {
+		command := &m.commands[i]
+		if command.CorrelationID != correlationId {
+			continue
+		}
+		if !status.Final() && command.Status.Final() {
+			return sql.ErrNoRows
+		}
+		command.Status = status
+		command.Error = errorMessage
+		if status.Final() {
+			now := time.Now()
+			command.CompletedAt = &now
+		}
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryStore) FetchCommand(correlationId string) (*model.Command, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, command := range m.commands {
+		if command.CorrelationID == correlationId {
+			command.CompletedAt = copyTime(command.CompletedAt)
+			return &command, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) FetchDeviceCommands(deviceId int, limit int) (commands []model.Command, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.commands) - 1; i >= 0 && len(commands) < limit; i-- {
+		if command := m.commands[i]; command.DeviceID == deviceId {
+			command.CompletedAt = copyTime(command.CompletedAt)
+			commands = append(commands, command)
+		}
+	}
+	return commands, nil
+}
+
+func (m *MemoryStore) InsertRule(rule *model.Rule) error {
+	conditionJSON, err := json.Marshal(rule.Condition)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[rule.Action.DeviceID]; !ok {
+		return fmt.Errorf("error inserting rule: unknown device %d", rule.Action.DeviceID)
+	}
+	rule.ID = m.nextId("rules")
+	stored := *rule
+	stored.LastFired = copyTime(rule.LastFired)
+	m.rules[rule.ID] = &memoryRule{rule: stored, condition: conditionJSON}
+	return nil
+}
+
+func (m *MemoryStore) FetchRules() (rules []model.Rule, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.rules) {
+		stored := m.rules[id]
+		rule := stored.rule
+		rule.Condition = model.Condition{}
+		// the condition is a tree, decoding it again keeps callers from sharing its nodes
+		if err = json.Unmarshal(stored.condition, &rule.Condition); err != nil {
+			return nil, fmt.Errorf("invalid condition of rule %d: %v", rule.ID, err)
+		}
+		rule.LastFired = copyTime(rule.LastFired)
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, nil
+}
+
+func (m *MemoryStore) SetRuleEnabled(ruleId int, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.rules[ruleId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.rule.Enabled = enabled
+	return nil
+}
+
+func (m *MemoryStore) DeleteRule(ruleId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rules[ruleId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.rules, ruleId)
+	return nil
+}
+
+func (m *MemoryStore) RecordRuleFired(ruleId int, firedAt time.Time, errorMessage string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.rules[ruleId]; ok {
+		stored.rule.LastFired = &firedAt
+		stored.rule.LastError = errorMessage
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertSchedule(schedule *model.Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[schedule.Action.DeviceID]; !ok {
+		return fmt.Errorf("error inserting schedule: unknown device %d", schedule.Action.DeviceID)
+	}
+	schedule.ID = m.nextId("schedules")
+	stored := *schedule
+	stored.Weekdays = append([]time.Weekday(nil), schedule.Weekdays...)
+	m.schedules[schedule.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) FetchSchedules() (schedules []model.Schedule, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.schedules) {
+		schedule := *m.schedules[id]
+		schedule.Weekdays = append([]time.Weekday(nil), schedule.Weekdays...)
+		schedules = append(schedules, schedule)
+	}
+	sort.SliceStable(schedules, func(i, j int) bool { return schedules[i].Name < schedules[j].Name })
+	return schedules, nil
+}
+
+func (m *MemoryStore) SetSchedulePaused(scheduleId int, paused bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.schedules[scheduleId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.Paused = paused
+	return nil
+}
+
+// deleteSchedule removes the schedule with its runs, the caller holds the lock
+func (m *MemoryStore) deleteSchedule(scheduleId int) {
+	delete(m.schedules, scheduleId)
+	runs := m.scheduleRuns[:0]
+	for _, run := range m.scheduleRuns {
+		if run.ScheduleID != scheduleId {
+			runs = append(runs, run)
+		}
+	}
+	m.scheduleRuns = runs
+}
+
+func (m *MemoryStore) DeleteSchedule(scheduleId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[scheduleId]; !ok {
+		return sql.ErrNoRows
+	}
+	m.deleteSchedule(scheduleId)
+	return nil
+}
+
+func (m *MemoryStore) InsertScheduleRun(scheduleId int, ranAt time.Time, correlationId string, errorMessage string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.schedules[scheduleId]; !ok {
+		return fmt.Errorf("error recording run of schedule %d: unknown schedule", scheduleId)
+	}
+	m.scheduleRuns = append(m.scheduleRuns, model.ScheduleRun{
+		ID:            m.nextId("schedule_runs"),
+		ScheduleID:    scheduleId,
+		RanAt:         ranAt,
+		CorrelationID: correlationId,
+		Error:         errorMessage,
+	})
+	return nil
+}
+
+// FetchScheduleRuns fills in the name of the schedule and the status of the issued command like the joins it mirrors
+func (m *MemoryStore) FetchScheduleRuns(limit int) (runs []model.ScheduleRun, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, run := range m.scheduleRuns {
+		run.ScheduleName = m.schedules[run.ScheduleID].Name
+		for _, command := range m.commands {
+			if run.CorrelationID != "" && command.CorrelationID == run.CorrelationID {
+				run.CommandStatus = command.Status
+				if run.Error == "" {
+					run.Error = command.Error
+				}
+			}
+		}
+		runs = append(runs, run)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].RanAt.After(runs[j].RanAt) })
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (m *MemoryStore) InsertAlertDefinition(definition *model.AlertDefinition) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.devices[definition.DeviceID]; !ok {
+		return fmt.Errorf("error inserting alert definition: unknown device %d", definition.DeviceID)
+	}
+	definition.ID = m.nextId("alert_definitions")
+	stored := *definition
+	stored.Channels = append([]string{}, definition.Channels...)
+	m.definitions[definition.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) FetchAlertDefinitions() (definitions []model.AlertDefinition, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.definitions) {
+		definition := *m.definitions[id]
+		definition.Channels = append([]string{}, definition.Channels...)
+		definitions = append(definitions, definition)
+	}
+	sort.SliceStable(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions, nil
+}
+
+func (m *MemoryStore) SetAlertDefinitionEnabled(definitionId int, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.definitions[definitionId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.Enabled = enabled
+	return nil
+}
+
+// deleteAlertDefinition removes the definition with its alerts, the caller holds the lock
+func (m *MemoryStore) deleteAlertDefinition(definitionId int) {
+	delete(m.definitions, definitionId)
+	alerts := m.alerts[:0]
+	for _, alert := range m.alerts {
+		if alert.DefinitionID != definitionId {
+			alerts = append(alerts, alert)
+		}
+	}
+	m.alerts = alerts
+}
+
+func (m *MemoryStore) DeleteAlertDefinition(definitionId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.definitions[definitionId]; !ok {
+		return sql.ErrNoRows
+	}
+	m.deleteAlertDefinition(definitionId)
+	return nil
+}
+
+// InsertAlert fails when the definition already has an active alert, like idx_alerts_active_definition
+func (m *MemoryStore) InsertAlert(alert *model.Alert) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.definitions[alert.DefinitionID]; !ok {
+		return fmt.Errorf("error inserting alert: unknown alert definition %d", alert.DefinitionID)
+	}
+	for _, stored := range m.alerts {
+		if stored.DefinitionID == alert.DefinitionID && stored.State == model.AlertActive && alert.State == model.AlertActive {
+			return fmt.Errorf("error inserting alert: alert definition %d already has an active alert", alert.DefinitionID)
+		}
+	}
+	alert.ID = m.nextId("alerts")
+	stored := *alert
+	stored.ResolvedAt = copyTime(alert.ResolvedAt)
+	m.alerts = append(m.alerts, stored)
+	return nil
+}
+
+func (m *MemoryStore) ResolveAlert(alertId int, resolvedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.alerts {
+		if alert := &m.alerts[i]; alert.ID == alertId && alert.State == model.AlertActive {
+			alert.State = model.AlertResolved
+			alert.ResolvedAt = &resolvedAt
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) FetchAlerts(activeOnly bool, limit int) (alerts []model.Alert, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, alert := range m.alerts {
+		if !activeOnly || alert.State == model.AlertActive {
+			alert.ResolvedAt = copyTime(alert.ResolvedAt)
+			alerts = append(alerts, alert)
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].FiredAt.After(alerts[j].FiredAt) })
+	if len(alerts) > limit {
+		alerts = alerts[:limit]
+	}
+	return alerts, nil
+}
+
+func (m *MemoryStore) InsertWebhookSubscription(subscription *model.WebhookSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscription.ID = m.nextId("webhook_subscriptions")
+	stored := *subscription
+	stored.EventTypes = append([]model.WebhookEventType(nil), subscription.EventTypes...)
+	m.subscriptions[subscription.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) FetchWebhookSubscriptions() (subscriptions []model.WebhookSubscription, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range sortedIds(m.subscriptions) {
+		subscription := *m.subscriptions[id]
+		subscription.EventTypes = append([]model.WebhookEventType(nil), subscription.EventTypes...)
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (m *MemoryStore) SetWebhookSubscriptionEnabled(subscriptionId int, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.subscriptions[subscriptionId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.Enabled = enabled
+	return nil
+}
+
+func (m *MemoryStore) DeleteWebhookSubscription(subscriptionId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subscriptions[subscriptionId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.subscriptions, subscriptionId)
+	deliveries := m.deliveries[:0]
+	for _, delivery := range m.deliveries {
+		if delivery.SubscriptionID != subscriptionId {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	m.deliveries = deliveries
+	return nil
+}
+
+// InsertWebhookDelivery stores the delivery without attempts, like the column defaults do
+func (m *MemoryStore) InsertWebhookDelivery(delivery *model.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subscriptions[delivery.SubscriptionID]; !ok {
+		return fmt.Errorf("error inserting webhook delivery: unknown subscription %d", delivery.SubscriptionID)
+	}
+	delivery.ID = m.nextId("webhook_deliveries")
+	delivery.CreatedAt = time.Now()
+	m.deliveries = append(m.deliveries, model.WebhookDelivery{
+		ID:             delivery.ID,
+		SubscriptionID: delivery.SubscriptionID,
+		EventType:      delivery.EventType,
+		Payload:        delivery.Payload,
+		Status:         delivery.Status,
+		CreatedAt:      delivery.CreatedAt,
+	})
+	return nil
+}
+
+func (m *MemoryStore) UpdateWebhookDelivery(delivery *model.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.deliveries {
+		if stored := &m.deliveries[i]; stored.ID == delivery.ID {
+			stored.Status = delivery.Status
+			stored.Attempts = delivery.Attempts
+			stored.ResponseStatus = delivery.ResponseStatus
+			stored.Error = delivery.Error
+			stored.LastAttemptAt = copyTime(delivery.LastAttemptAt)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) FetchWebhookDeliveries(pendingOnly bool, limit int) (deliveries []model.WebhookDelivery, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if delivery := m.deliveries[i]; !pendingOnly || delivery.Status == model.DeliveryPending {
+			delivery.LastAttemptAt = copyTime(delivery.LastAttemptAt)
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *MemoryStore) DeleteFinishedWebhookDeliveries(before time.Time) (deleted int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.deliveries[:0]
+	for _, delivery := range m.deliveries {
+		if delivery.Status != model.DeliveryPending && delivery.CreatedAt.Before(before) {
+			deleted++
+			continue
+		}
+		kept = append(kept, delivery)
+	}
+	m.deliveries = kept
+	return deleted, nil
+}
+
+func (m *MemoryStore) CountUsers() (count int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.users), nil
+}
+
+// insertUser stores a copy of the user, the caller holds the lock
+func (m *MemoryStore) insertUser(user *model.User) error {
+	for _, stored := range m.users {
+		if stored.Username == user.Username {
+			return ErrUsernameTaken
+		}
+	}
+	user.ID = m.nextId("users")
+	user.CreatedAt = time.Now()
+	stored := *user
+	m.users[user.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) InsertFirstUser(user *model.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.users) > 0 {
+		return sql.ErrNoRows
+	}
+	user.Role = model.RoleAdmin
+	return m.insertUser(user)
+}
+
+func (m *MemoryStore) InsertUser(user *model.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insertUser(user)
+}
+
+func (m *MemoryStore) FetchUsers() (users []model.User, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *MemoryStore) FetchUser(userId int) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[userId]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user := *stored
+	return &user, nil
+}
+
+func (m *MemoryStore) FetchUserByUsername(username string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.users {
+		if stored.Username == username {
+			user := *stored
+			return &user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) SetUserRole(userId int, role model.Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("error updating role: unknown role %s", role)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[userId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.Role = role
+	return nil
+}
+
+func (m *MemoryStore) UpdateUserPassword(userId int, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[userId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.PasswordHash = passwordHash
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(userId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.users, userId)
+	delete(m.grants, userId)
+	for tokenHash, session := range m.sessions {
+		if session.userId == userId {
+			delete(m.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) InsertSession(tokenHash string, userId int, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userId]; !ok {
+		return fmt.Errorf("error inserting session: unknown user %d", userId)
+	}
+	if _, ok := m.sessions[tokenHash]; ok {
+		return errors.New("error inserting session: the token is already used")
+	}
+	m.sessions[tokenHash] = memorySession{userId: userId, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *MemoryStore) FetchSessionUser(tokenHash string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[tokenHash]
+	if !ok || !session.expiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	user := *m.users[session.userId]
+	return &user, nil
+}
+
+func (m *MemoryStore) DeleteSession(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteOtherSessions(userId int, keepTokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tokenHash, session := range m.sessions {
+		if session.userId == userId && tokenHash != keepTokenHash {
+			delete(m.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteExpiredSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for tokenHash, session := range m.sessions {
+		if !session.expiresAt.After(now) {
+			delete(m.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) FetchGrants(userId int) (grants []model.Grant, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append(grants, m.grants[userId]...), nil
+}
+
+// ReplaceGrants checks the grants like the constraints of the grants table before replacing any of them
+func (m *MemoryStore) ReplaceGrants(userId int, grants []model.Grant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userId]; !ok {
+		return fmt.Errorf("error inserting grant: unknown user %d", userId)
+	}
+	dashboards := make(map[int]bool)
+	devices := make(map[int]bool)
+	stored := make([]model.Grant, 0, len(grants))
+	for _, grant := range grants {
+		if (grant.DashboardID == 0) == (grant.DeviceID == 0) {
+			return errors.New("error inserting grant: a grant is either for a dashboard or a device")
+		}
+		if grant.Access != model.AccessView && grant.Access != model.AccessControl {
+			return fmt.Errorf("error inserting grant: unknown access %s", grant.Access)
+		}
+		if grant.DashboardID != 0 {
+			if _, ok := m.dashboards[grant.DashboardID]; !ok || dashboards[grant.DashboardID] {
+				return fmt.Errorf("error inserting grant: invalid dashboard %d", grant.DashboardID)
+			}
+			dashboards[grant.DashboardID] = true
+		} else {
+			if _, ok := m.devices[grant.DeviceID]; !ok || devices[grant.DeviceID] {
+				return fmt.Errorf("error inserting grant: invalid device %d", grant.DeviceID)
+			}
+			devices[grant.DeviceID] = true
+		}
+		grant.UserID = userId
+		stored = append(stored, grant)
+	}
+	m.grants[userId] = stored
+	return nil
+}
+
+func (m *MemoryStore) InsertProvisioningToken(tokenHash string, token *model.ProvisioningToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if token.UsesLeft < 0 {
+		return errors.New("error inserting provisioning token: uses can not be negative")
+	}
+	for _, stored := range m.tokens {
+		if stored.hash == tokenHash {
+			return errors.New("error inserting provisioning token: the token is already used")
+		}
+	}
+	token.ID = m.nextId("provisioning_tokens")
+	token.CreatedAt = time.Now()
+	stored := *token
+	stored.ExpiresAt = copyTime(token.ExpiresAt)
+	m.tokens[token.ID] = &memoryToken{token: stored, hash: tokenHash}
+	return nil
+}
+
+func (m *MemoryStore) FetchProvisioningTokens() (tokens []model.ProvisioningToken, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := sortedIds(m.tokens)
+	for i := len(ids) - 1; i >= 0; i-- {
+		token := m.tokens[ids[i]].token
+		token.ExpiresAt = copyTime(token.ExpiresAt)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (m *MemoryStore) FetchProvisioningToken(tokenHash string) (*model.ProvisioningToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.tokens {
+		if stored.hash == tokenHash {
+			token := stored.token
+			token.ExpiresAt = copyTime(token.ExpiresAt)
+			return &token, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) DeleteProvisioningToken(tokenId int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[tokenId]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.tokens, tokenId)
+	return nil
+}
+
+func (m *MemoryStore) ProvisionDevice(device *model.Device, tokenHash string, secretHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.tokens {
+		if stored.hash != tokenHash || !stored.token.Usable(time.Now()) {
+			continue
+		}
+		registered, err := m.registerDevice(device)
+		if err != nil {
+			return err
+		}
+		stored.token.UsesLeft--
+		registered.secretHash = secretHash
+		registered.tokenHash = tokenHash
+		device.ID = registered.device.ID
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryStore) ReissueDeviceSecret(deviceId int, tokenHash string, secretHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	device, ok := m.devices[deviceId]
+	if !ok || device.tokenHash == "" || device.tokenHash != tokenHash {
+		return sql.ErrNoRows
+	}
+	for _, stored := range m.tokens {
+		if stored.hash == tokenHash {
+			device.secretHash = secretHash
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
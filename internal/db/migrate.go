@@ -0,0 +1,299 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock held while migrating, so instances starting at the same time do not
+// migrate concurrently
+const migrationLock = 7305721
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one step of the schema, Down is empty when the step can not be reverted
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations returns the migrations embedded in the binary ordered by version
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts the embedded migrations, the applied versions are stored in schema_migrations
+type Migrator struct {
+	database *Database
+	// DryRun only prints what would be run
+	DryRun bool
+	// Output receives a line for every migration and with DryRun also its SQL
+	Output io.Writer
+}
+
+func NewMigrator(database *Database, output io.Writer) *Migrator {
+	return &Migrator{database: database, Output: output}
+}
+
+// withLock runs migrate on a single connection holding the migration lock, schema_migrations is created unless this
+// is a dry run
+func (m *Migrator) withLock(migrate func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.database.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(conn *sql.Conn) {
+		err = conn.Close()
+		if err != nil {
+
+		}
+	}(conn)
+
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("failed to acquire the migration lock: %v", err)
+	}
+	defer func() {
+		_, _ = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock)
+	}()
+
+	if m.DryRun {
+		return migrate(conn)
+	}
+	if _, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations
+		(
+		    version    INT PRIMARY KEY,
+		    name       TEXT        NOT NULL,
+		    applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	return migrate(conn)
+}
+
+// appliedVersions returns the applied versions, none when schema_migrations does not exist yet in a dry run
+func appliedVersions(conn *sql.Conn) (versions map[int]bool, err error) {
+	versions = make(map[int]bool)
+	var exists bool
+	if err = conn.QueryRowContext(context.Background(),
+		`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil || !exists {
+		return versions, err
+	}
+
+	rows, err := conn.QueryContext(context.Background(), `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// baseline marks the initial migration as applied on databases created by hand from db_create_script.md, which have
+// the tables but no schema_migrations rows. The migrations adding the tables and columns that script lacks only create
+// what is missing, so they bring these databases up to date.
+func (m *Migrator) baseline(conn *sql.Conn, migrations []Migration, applied map[int]bool) error {
+	if len(applied) > 0 || len(migrations) == 0 {
+		return nil
+	}
+	var exists bool
+	if err := conn.QueryRowContext(context.Background(),
+		`SELECT to_regclass('action_templates') IS NOT NULL`).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	initial := migrations[0]
+	_, _ = fmt.Fprintf(m.Output, "existing schema found, marking %d_%s as applied\n", initial.Version, initial.Name)
+	if m.DryRun {
+		applied[initial.Version] = true
+		return nil
+	}
+	if _, err := conn.ExecContext(context.Background(), `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+		initial.Version, initial.Name); err != nil {
+		return err
+	}
+	applied[initial.Version] = true
+	return nil
+}
+
+// run executes the SQL of one migration and records it in the same transaction
+func (m *Migrator) run(conn *sql.Conn, migration Migration, direction string, script string, record string, args ...any) error {
+	_, _ = fmt.Fprintf(m.Output, "%s %d_%s\n", direction, migration.Version, migration.Name)
+	if m.DryRun {
+		_, _ = fmt.Fprintln(m.Output, script)
+		return nil
+	}
+
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		// no-op once the transaction is committed
+		_ = tx.Rollback()
+	}(tx)
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s %s failed: %v", migration.Version, migration.Name, direction, err)
+	}
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migration %d_%s: %v", migration.Version, migration.Name, err)
+	}
+	return nil
+}
+
+// Up applies every migration up to and including target that has not been applied yet, a target of 0 applies all
+func (m *Migrator) Up(target int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	return m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		if err = m.baseline(conn, migrations, applied); err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if applied[migration.Version] || (target > 0 && migration.Version > target) {
+				continue
+			}
+			if err = m.run(conn, migration, "up", migration.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, migration.Version, migration.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the last steps applied migrations, newest first
+func (m *Migrator) Down(steps int) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	return m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := migrations[i]
+			if !applied[migration.Version] {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s can not be reverted", migration.Version, migration.Name)
+			}
+			if err = m.run(conn, migration, "down", migration.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, migration.Version); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status prints every migration and whether it was applied
+func (m *Migrator) Status() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	return m.withLock(func(conn *sql.Conn) error {
+		applied, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			status := "pending"
+			if applied[migration.Version] {
+				status = "applied"
+			}
+			_, _ = fmt.Fprintf(m.Output, "%d_%s %s\n", migration.Version, migration.Name, status)
+		}
+		return nil
+	})
+}
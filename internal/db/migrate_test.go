@@ -0,0 +1,74 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if migration.Down == "" {
+			t.Errorf("migration %d_%s has no down file", migration.Version, migration.Name)
+		}
+	}
+}
+
+// releasedInitial is the SHA-256 of the released 0001_initial.up.sql, databases that applied it never run it again, so
+// schema changes go into new migrations
+const releasedInitial = "9820d83fa2457a9bed61dafdaa2af64501762f86ecf3e5d62ae8e0dce285120e"
+
+func TestInitialMigrationIsUnchanged(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := migrations[0]
+	if initial.Name != "initial" {
+		t.Fatalf("the first migration is %s", initial.Name)
+	}
+	if sum := sha256.Sum256([]byte(initial.Up)); hex.EncodeToString(sum[:]) != releasedInitial {
+		t.Error("the released initial migration was changed")
+	}
+}
+
+var (
+	createdObject = regexp.MustCompile(`(?m)^\s*(CREATE TABLE|CREATE INDEX|CREATE UNIQUE INDEX|ADD COLUMN)( IF NOT EXISTS)? (\w+)`)
+	// tableColumn matches the column definitions inside CREATE TABLE
+	tableColumn = regexp.MustCompile(`(?m)^ {4}([a-z_]+) +[A-Z]`)
+)
+
+// TestLaterMigrationsSkipExistingObjects guards the databases baselined from db_create_script.md as well as those
+// created by the full initial migration, the later migrations must leave out what the initial one already created
+func TestLaterMigrationsSkipExistingObjects(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := make(map[string]bool)
+	for _, match := range createdObject.FindAllStringSubmatch(migrations[0].Up, -1) {
+		initial[match[3]] = true
+	}
+	for _, match := range tableColumn.FindAllStringSubmatch(migrations[0].Up, -1) {
+		initial[match[1]] = true
+	}
+	if !initial["devices"] || !initial["secret_hash"] || !initial["provisioning_tokens"] {
+		t.Fatalf("unexpected objects of the initial migration %v", initial)
+	}
+	for _, migration := range migrations[1:] {
+		for _, match := range createdObject.FindAllStringSubmatch(migration.Up, -1) {
+			if initial[match[3]] && match[2] == "" {
+				t.Errorf("migration %d_%s: %s %s fails when the initial migration created it", migration.Version,
+					migration.Name, match[1], match[3])
+			}
+		}
+	}
+}
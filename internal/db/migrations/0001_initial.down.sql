@@ -0,0 +1,19 @@
+-- Drops the whole schema including all data, tables are dropped in the reverse order of their creation
+DROP TABLE IF EXISTS provisioning_tokens;
+DROP TABLE IF EXISTS grants;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;
+DROP TABLE IF EXISTS alerts;
+DROP TABLE IF EXISTS alert_definitions;
+DROP TABLE IF EXISTS schedule_runs;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS rules;
+DROP TABLE IF EXISTS commands;
+DROP TABLE IF EXISTS sensor_data;
+DROP TABLE IF EXISTS devices_in_dashboard;
+DROP TABLE IF EXISTS dashboards;
+DROP TABLE IF EXISTS devices;
+DROP TABLE IF EXISTS action_templates;
+DROP TYPE IF EXISTS device_type;
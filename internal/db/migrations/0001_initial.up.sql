@@ -0,0 +1,231 @@
+-- Timescale provides the sensor_data hypertable
+CREATE EXTENSION IF NOT EXISTS timescaledb;
+
+-- Create a custom type for device types if you have a known set of types
+CREATE TYPE device_type AS ENUM ('temperature_sensor', 'humidity_sensor', 'soil_moisture_sensor', 'light_switch');
+-- Table for storing action templates with a JSONB validation check
+CREATE TABLE action_templates
+(
+    action_template_id SERIAL PRIMARY KEY,
+    device_type        device_type NOT NULL UNIQUE,
+    actions            JSONB NOT NULL,
+    CONSTRAINT check_actions CHECK (
+        (actions ? 'Temperature' AND jsonb_typeof(actions -> 'Temperature') = 'string') OR
+        (actions ? 'Humidity' AND jsonb_typeof(actions -> 'Humidity') = 'string') OR
+        (actions ? 'Soil_moisture' AND jsonb_typeof(actions -> 'Soil_moisture') = 'string') OR
+        (actions ? 'Light_state' AND jsonb_typeof(actions -> 'Light_state') = 'string')
+        )
+);
+
+-- Table for storing device information
+CREATE TABLE devices
+(
+    device_id          SERIAL PRIMARY KEY,
+    uuid               UUID UNIQUE NOT NULL,
+    device_name        TEXT        NOT NULL,
+    action_template_id INTEGER REFERENCES action_templates (action_template_id),
+    custom_actions     JSONB,
+    last_login         TIMESTAMP(0) DEFAULT CURRENT_TIMESTAMP,
+    state              JSONB DEFAULT '{}'::jsonb,
+    -- retired devices are hidden from dashboard creators, their data is kept
+    retired            BOOLEAN     NOT NULL DEFAULT false,
+    -- last time the device went online or offline, the current status is only kept in memory
+    last_seen          TIMESTAMPTZ,
+    -- SHA-256 hash of the secret the device presents on login, NULL until the device is provisioned
+    secret_hash        TEXT
+);
+
+-- Table for storing dashboard information
+CREATE TABLE dashboards
+(
+    dashboard_id SERIAL PRIMARY KEY,
+    name         TEXT UNIQUE NOT NULL
+);
+
+-- Table for storing device to dashboard mappings with position checking
+CREATE TABLE devices_in_dashboard
+(
+    device_id             INT NOT NULL,
+    dashboard_id          INT NOT NULL,
+    position_in_dashboard INT DEFAULT -1 CHECK (position_in_dashboard >= -1),
+    shown_actions         JSONB,
+    PRIMARY KEY (device_id, dashboard_id),
+    FOREIGN KEY (device_id) REFERENCES devices (device_id) ON DELETE CASCADE ON UPDATE CASCADE,
+    FOREIGN KEY (dashboard_id) REFERENCES dashboards (dashboard_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- Table for storing sensor data as a hypertable
+CREATE TABLE sensor_data
+(
+    timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    device_id INT                                   NOT NULL,
+    data      JSONB                                 NOT NULL,
+    CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES devices (device_id)
+);
+
+-- Table for storing commands sent to devices and their acknowledgements
+CREATE TABLE commands
+(
+    command_id     SERIAL PRIMARY KEY,
+    correlation_id UUID UNIQUE NOT NULL,
+    device_id      INT         NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name    TEXT        NOT NULL,
+    action_type    TEXT        NOT NULL,
+    value          TEXT,
+    source         TEXT        NOT NULL,
+    status         TEXT        NOT NULL DEFAULT 'pending',
+    error          TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at   TIMESTAMPTZ
+);
+
+-- Table for storing automation rules, the condition is a tree of comparisons (see model.Condition)
+CREATE TABLE rules
+(
+    rule_id          SERIAL PRIMARY KEY,
+    name             TEXT    NOT NULL,
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+    condition        JSONB   NOT NULL,
+    action_device_id INT     NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name      TEXT    NOT NULL,
+    action_value     TEXT,
+    cooldown_seconds INT     NOT NULL DEFAULT 0 CHECK (cooldown_seconds >= 0),
+    last_fired       TIMESTAMPTZ,
+    last_error       TEXT
+);
+
+-- Table for storing scheduled actions, cron schedules use cron_expression, daily and weekly ones time_of_day (HH:MM)
+-- and weekdays (comma separated, Sunday is 0)
+CREATE TABLE schedules
+(
+    schedule_id      SERIAL PRIMARY KEY,
+    name             TEXT    NOT NULL,
+    kind             TEXT    NOT NULL CHECK (kind IN ('cron', 'daily', 'weekly')),
+    cron_expression  TEXT,
+    time_of_day      TEXT,
+    weekdays         TEXT,
+    timezone         TEXT    NOT NULL DEFAULT 'UTC',
+    action_device_id INT     NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name      TEXT    NOT NULL,
+    action_value     TEXT,
+    paused           BOOLEAN NOT NULL DEFAULT false
+);
+
+-- Table for storing the history of schedule runs, the outcome of the issued command is kept in commands
+CREATE TABLE schedule_runs
+(
+    run_id         SERIAL PRIMARY KEY,
+    schedule_id    INT         NOT NULL REFERENCES schedules (schedule_id) ON DELETE CASCADE,
+    ran_at         TIMESTAMPTZ NOT NULL,
+    correlation_id UUID,
+    error          TEXT
+);
+
+-- Table for storing alert definitions on provide_value actions, channels are the notification channel names
+CREATE TABLE alert_definitions
+(
+    definition_id SERIAL PRIMARY KEY,
+    name          TEXT             NOT NULL,
+    device_id     INT              NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name   TEXT             NOT NULL,
+    condition     TEXT             NOT NULL CHECK (condition IN ('above', 'below', 'outside')),
+    low           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    high          DOUBLE PRECISION NOT NULL DEFAULT 0,
+    for_seconds   INT              NOT NULL DEFAULT 0 CHECK (for_seconds >= 0),
+    channels      TEXT[]           NOT NULL DEFAULT '{}',
+    enabled       BOOLEAN          NOT NULL DEFAULT true
+);
+
+-- Table for storing fired alerts, a definition has at most one active alert
+CREATE TABLE alerts
+(
+    alert_id      SERIAL PRIMARY KEY,
+    definition_id INT              NOT NULL REFERENCES alert_definitions (definition_id) ON DELETE CASCADE,
+    state         TEXT             NOT NULL DEFAULT 'active' CHECK (state IN ('active', 'resolved')),
+    value         DOUBLE PRECISION NOT NULL,
+    breached_at   TIMESTAMPTZ      NOT NULL,
+    fired_at      TIMESTAMPTZ      NOT NULL,
+    resolved_at   TIMESTAMPTZ
+);
+
+-- Table for storing outgoing webhook subscriptions, event_types are e.g. device.login or command.sent
+CREATE TABLE webhook_subscriptions
+(
+    subscription_id SERIAL PRIMARY KEY,
+    url             TEXT    NOT NULL,
+    secret          TEXT    NOT NULL,
+    event_types     TEXT[]  NOT NULL DEFAULT '{}',
+    enabled         BOOLEAN NOT NULL DEFAULT true
+);
+
+-- Table for storing the delivery log of webhooks, pending deliveries are retried
+CREATE TABLE webhook_deliveries
+(
+    delivery_id     SERIAL PRIMARY KEY,
+    subscription_id INT         NOT NULL REFERENCES webhook_subscriptions (subscription_id) ON DELETE CASCADE,
+    event_type      TEXT        NOT NULL,
+    payload         JSONB       NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    attempts        INT         NOT NULL DEFAULT 0,
+    response_status INT,
+    error           TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at TIMESTAMPTZ
+);
+
+-- Table for storing the accounts of the web interface
+CREATE TABLE users
+(
+    user_id       SERIAL PRIMARY KEY,
+    username      TEXT        NOT NULL UNIQUE,
+    password_hash TEXT        NOT NULL,
+    role          TEXT        NOT NULL DEFAULT 'viewer' CHECK (role IN ('viewer', 'operator', 'admin')),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table for storing login sessions, only the SHA-256 hash of the session token is stored
+CREATE TABLE sessions
+(
+    token_hash TEXT PRIMARY KEY,
+    user_id    INT         NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Table for storing what non-admin users may see and control, a grant is either for a dashboard or a device
+CREATE TABLE grants
+(
+    user_id      INT  NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    dashboard_id INT REFERENCES dashboards (dashboard_id) ON DELETE CASCADE,
+    device_id    INT REFERENCES devices (device_id) ON DELETE CASCADE,
+    access       TEXT NOT NULL CHECK (access IN ('view', 'control')),
+    CHECK ((dashboard_id IS NULL) <> (device_id IS NULL))
+);
+
+-- Table for storing provisioning tokens, devices that are not known yet present one on login to receive a secret
+CREATE TABLE provisioning_tokens
+(
+    token_id   SERIAL PRIMARY KEY,
+    token_hash TEXT        NOT NULL UNIQUE,
+    label      TEXT        NOT NULL DEFAULT '',
+    uses_left  INT         NOT NULL CHECK (uses_left >= 0),
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Convert sensor_data table to a hypertable
+SELECT create_hypertable('sensor_data', 'timestamp');
+
+-- Indexes for optimized query performance
+CREATE INDEX idx_timestamp_device_id ON sensor_data (timestamp DESC, device_id);
+CREATE INDEX idx_device_id ON sensor_data (device_id);
+CREATE INDEX idx_timestamp ON sensor_data (timestamp DESC);
+CREATE INDEX idx_device_type ON action_templates (device_type);
+CREATE INDEX idx_commands_device_id ON commands (device_id, created_at DESC);
+CREATE INDEX idx_schedule_runs_ran_at ON schedule_runs (ran_at DESC);
+CREATE INDEX idx_alerts_fired_at ON alerts (fired_at DESC);
+CREATE INDEX idx_webhook_deliveries_created_at ON webhook_deliveries (created_at DESC);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX idx_grants_dashboard ON grants (user_id, dashboard_id) WHERE dashboard_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_grants_device ON grants (user_id, device_id) WHERE device_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_alerts_active_definition ON alerts (definition_id) WHERE state = 'active';
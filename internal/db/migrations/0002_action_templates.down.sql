@@ -0,0 +1,7 @@
+-- Devices of these types lose their template actions, their custom actions are kept
+UPDATE devices SET action_template_id = NULL
+WHERE action_template_id IN (SELECT action_template_id
+                             FROM action_templates
+                             WHERE device_type IN ('temperature_sensor', 'humidity_sensor', 'soil_moisture_sensor', 'light_switch'));
+DELETE FROM action_templates
+WHERE device_type IN ('temperature_sensor', 'humidity_sensor', 'soil_moisture_sensor', 'light_switch');
@@ -0,0 +1,18 @@
+-- Populate the action_templates table, installs created from the old script already have the templates
+INSERT INTO action_templates (device_type, actions)
+VALUES ('temperature_sensor', '{
+  "Temperature": "provide_value",
+  "Interval_ms": "number_input"
+}'::jsonb),
+       ('humidity_sensor', '{
+         "Humidity": "provide_value",
+         "Interval_ms": "number_input"
+       }'::jsonb),
+       ('soil_moisture_sensor', '{
+         "Soil_moisture": "provide_value",
+         "Interval_ms": "number_input"
+       }'::jsonb),
+       ('light_switch', '{
+         "Light_state": "toggle"
+       }'::jsonb)
+ON CONFLICT (device_type) DO NOTHING;
@@ -0,0 +1,3 @@
+-- Retired devices are hidden from dashboard creators, their data is kept
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS retired BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+-- Last time the device went online or offline, the current status is only kept in memory
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ;
@@ -0,0 +1,17 @@
+-- Table for storing commands sent to devices and their acknowledgements
+CREATE TABLE IF NOT EXISTS commands
+(
+    command_id     SERIAL PRIMARY KEY,
+    correlation_id UUID UNIQUE NOT NULL,
+    device_id      INT         NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name    TEXT        NOT NULL,
+    action_type    TEXT        NOT NULL,
+    value          TEXT,
+    source         TEXT        NOT NULL,
+    status         TEXT        NOT NULL DEFAULT 'pending',
+    error          TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_commands_device_id ON commands (device_id, created_at DESC);
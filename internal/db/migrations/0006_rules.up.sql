@@ -0,0 +1,14 @@
+-- Table for storing automation rules, the condition is a tree of comparisons (see model.Condition)
+CREATE TABLE IF NOT EXISTS rules
+(
+    rule_id          SERIAL PRIMARY KEY,
+    name             TEXT    NOT NULL,
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+    condition        JSONB   NOT NULL,
+    action_device_id INT     NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name      TEXT    NOT NULL,
+    action_value     TEXT,
+    cooldown_seconds INT     NOT NULL DEFAULT 0 CHECK (cooldown_seconds >= 0),
+    last_fired       TIMESTAMPTZ,
+    last_error       TEXT
+);
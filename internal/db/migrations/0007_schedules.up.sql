@@ -0,0 +1,28 @@
+-- Table for storing scheduled actions, cron schedules use cron_expression, daily and weekly ones time_of_day (HH:MM)
+-- and weekdays (comma separated, Sunday is 0)
+CREATE TABLE IF NOT EXISTS schedules
+(
+    schedule_id      SERIAL PRIMARY KEY,
+    name             TEXT    NOT NULL,
+    kind             TEXT    NOT NULL CHECK (kind IN ('cron', 'daily', 'weekly')),
+    cron_expression  TEXT,
+    time_of_day      TEXT,
+    weekdays         TEXT,
+    timezone         TEXT    NOT NULL DEFAULT 'UTC',
+    action_device_id INT     NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name      TEXT    NOT NULL,
+    action_value     TEXT,
+    paused           BOOLEAN NOT NULL DEFAULT false
+);
+
+-- Table for storing the history of schedule runs, the outcome of the issued command is kept in commands
+CREATE TABLE IF NOT EXISTS schedule_runs
+(
+    run_id         SERIAL PRIMARY KEY,
+    schedule_id    INT         NOT NULL REFERENCES schedules (schedule_id) ON DELETE CASCADE,
+    ran_at         TIMESTAMPTZ NOT NULL,
+    correlation_id UUID,
+    error          TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedule_runs_ran_at ON schedule_runs (ran_at DESC);
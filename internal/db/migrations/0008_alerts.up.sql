@@ -0,0 +1,29 @@
+-- Table for storing alert definitions on provide_value actions, channels are the notification channel names
+CREATE TABLE IF NOT EXISTS alert_definitions
+(
+    definition_id SERIAL PRIMARY KEY,
+    name          TEXT             NOT NULL,
+    device_id     INT              NOT NULL REFERENCES devices (device_id) ON DELETE CASCADE,
+    action_name   TEXT             NOT NULL,
+    condition     TEXT             NOT NULL CHECK (condition IN ('above', 'below', 'outside')),
+    low           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    high          DOUBLE PRECISION NOT NULL DEFAULT 0,
+    for_seconds   INT              NOT NULL DEFAULT 0 CHECK (for_seconds >= 0),
+    channels      TEXT[]           NOT NULL DEFAULT '{}',
+    enabled       BOOLEAN          NOT NULL DEFAULT true
+);
+
+-- Table for storing fired alerts, a definition has at most one active alert
+CREATE TABLE IF NOT EXISTS alerts
+(
+    alert_id      SERIAL PRIMARY KEY,
+    definition_id INT              NOT NULL REFERENCES alert_definitions (definition_id) ON DELETE CASCADE,
+    state         TEXT             NOT NULL DEFAULT 'active' CHECK (state IN ('active', 'resolved')),
+    value         DOUBLE PRECISION NOT NULL,
+    breached_at   TIMESTAMPTZ      NOT NULL,
+    fired_at      TIMESTAMPTZ      NOT NULL,
+    resolved_at   TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_fired_at ON alerts (fired_at DESC);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_active_definition ON alerts (definition_id) WHERE state = 'active';
@@ -0,0 +1,26 @@
+-- Table for storing outgoing webhook subscriptions, event_types are e.g. device.login or command.sent
+CREATE TABLE IF NOT EXISTS webhook_subscriptions
+(
+    subscription_id SERIAL PRIMARY KEY,
+    url             TEXT    NOT NULL,
+    secret          TEXT    NOT NULL,
+    event_types     TEXT[]  NOT NULL DEFAULT '{}',
+    enabled         BOOLEAN NOT NULL DEFAULT true
+);
+
+-- Table for storing the delivery log of webhooks, pending deliveries are retried
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    delivery_id     SERIAL PRIMARY KEY,
+    subscription_id INT         NOT NULL REFERENCES webhook_subscriptions (subscription_id) ON DELETE CASCADE,
+    event_type      TEXT        NOT NULL,
+    payload         JSONB       NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    attempts        INT         NOT NULL DEFAULT 0,
+    response_status INT,
+    error           TEXT,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_created_at ON webhook_deliveries (created_at DESC);
@@ -0,0 +1,19 @@
+-- Table for storing the accounts of the web interface
+CREATE TABLE IF NOT EXISTS users
+(
+    user_id       SERIAL PRIMARY KEY,
+    username      TEXT        NOT NULL UNIQUE,
+    password_hash TEXT        NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table for storing login sessions, only the SHA-256 hash of the session token is stored
+CREATE TABLE IF NOT EXISTS sessions
+(
+    token_hash TEXT PRIMARY KEY,
+    user_id    INT         NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
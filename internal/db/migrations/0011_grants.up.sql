@@ -0,0 +1,18 @@
+-- Accounts created before roles existed could do everything, they become admins, new accounts are viewers
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'admin' CHECK (role IN ('viewer', 'operator', 'admin'));
+ALTER TABLE users
+    ALTER COLUMN role SET DEFAULT 'viewer';
+
+-- Table for storing what non-admin users may see and control, a grant is either for a dashboard or a device
+CREATE TABLE IF NOT EXISTS grants
+(
+    user_id      INT  NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+    dashboard_id INT REFERENCES dashboards (dashboard_id) ON DELETE CASCADE,
+    device_id    INT REFERENCES devices (device_id) ON DELETE CASCADE,
+    access       TEXT NOT NULL CHECK (access IN ('view', 'control')),
+    CHECK ((dashboard_id IS NULL) <> (device_id IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_grants_dashboard ON grants (user_id, dashboard_id) WHERE dashboard_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_grants_device ON grants (user_id, device_id) WHERE device_id IS NOT NULL;
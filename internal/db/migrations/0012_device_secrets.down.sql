@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS provisioning_tokens;
+ALTER TABLE devices
+    DROP COLUMN IF EXISTS secret_hash;
@@ -0,0 +1,14 @@
+-- SHA-256 hash of the secret the device presents on login, NULL until the device is provisioned
+ALTER TABLE devices
+    ADD COLUMN IF NOT EXISTS secret_hash TEXT;
+
+-- Table for storing provisioning tokens, devices that are not known yet present one on login to receive a secret
+CREATE TABLE IF NOT EXISTS provisioning_tokens
+(
+    token_id   SERIAL PRIMARY KEY,
+    token_hash TEXT        NOT NULL UNIQUE,
+    label      TEXT        NOT NULL DEFAULT '',
+    uses_left  INT         NOT NULL CHECK (uses_left >= 0),
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
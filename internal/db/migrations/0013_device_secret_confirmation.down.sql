@@ -0,0 +1,2 @@
+ALTER TABLE devices
+    DROP COLUMN IF EXISTS provisioning_token_hash;
@@ -0,0 +1,4 @@
+-- SHA-256 hash of the provisioning token a secret was issued for, NULL once the device logged in with that secret.
+-- Until then the device may present the token again to receive a new secret, e.g. when the login response was lost.
+ALTER TABLE devices
+    ADD COLUMN provisioning_token_hash TEXT;
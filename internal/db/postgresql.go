@@ -1,16 +1,20 @@
 package db
 
 import (
+	"NSI-semester-work/internal/metrics"
 	"NSI-semester-work/internal/model"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
-	"log"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Database holds the connection pool to the database
+// Database holds the connection pool to the database, the duration of every operation is recorded in
+// metrics.DBQueryDuration
 type Database struct {
 	*sql.DB
 }
@@ -32,29 +36,44 @@ func (db *Database) Disconnect() error {
 	return db.DB.Close()
 }
 
-// RegisterDevice registers or authenticates a new device in the database
-func (db *Database) RegisterDevice(device *model.Device) error {
-	query := `
+// registerDeviceQuery inserts the device or records the login of a known one, devices created by an admin get their
+// template and custom actions on their first login
+const registerDeviceQuery = `
         INSERT INTO devices (uuid, action_template_id, device_name, custom_actions)
-        VALUES ($1, $2, $3, $4) 
-        ON CONFLICT (uuid) DO UPDATE SET last_login = NOW()`
+        VALUES ($1, NULLIF($2, -1), $3, $4)
+        ON CONFLICT (uuid) DO UPDATE SET last_login = NOW(),
+            action_template_id = COALESCE(devices.action_template_id, EXCLUDED.action_template_id),
+            custom_actions = COALESCE(devices.custom_actions, EXCLUDED.custom_actions)
+        RETURNING device_id`
 
+// customActionsArg is NULL for devices without custom actions
+func customActionsArg(device *model.Device) sql.NullString {
 	//if Valid -> use String, else use Null
-	var customActions sql.NullString
 	if device.CustomActions != "" {
-		customActions = sql.NullString{String: device.CustomActions, Valid: true}
+		return sql.NullString{String: device.CustomActions, Valid: true}
 	}
-	_, err := db.Exec(query, device.UUID, device.ActionsTemplateId, device.Name, customActions)
+	return sql.NullString{}
+}
+
+// RegisterDevice registers a new device or records the login of a known one, devices created by an admin get their
+// template and custom actions on their first login
+func (db *Database) RegisterDevice(device *model.Device) error {
+	defer metrics.ObserveQuery("RegisterDevice", time.Now())
+	_, err := db.Exec(registerDeviceQuery, device.UUID, device.ActionsTemplateId, device.Name, customActionsArg(device))
 	if err != nil {
 		return fmt.Errorf("failed insert device %s\n", err)
 	}
 	return nil
 }
 
+// FetchDeviceNamesAndIds lists the devices that can be added to dashboards, retired devices are left out
 func (db *Database) FetchDeviceNamesAndIds() (devices []model.Device, err error) {
+	defer metrics.ObserveQuery("FetchDeviceNamesAndIds", time.Now())
 	rows, err := db.Query(`
 			SELECT devices.device_id, device_name
-			FROM devices`)
+			FROM devices
+			WHERE NOT devices.retired
+			ORDER BY device_name`)
 	if err != nil {
 		return nil, err
 	}
@@ -80,32 +99,210 @@ func (db *Database) FetchDeviceNamesAndIds() (devices []model.Device, err error)
 	return devices, nil
 }
 
-func (db *Database) FetchDeviceWithActions(deviceId int) (*model.Device, error) {
-	query := `
-		SELECT devices.device_id, devices.device_name, action_templates.actions, COALESCE(devices.custom_actions, '{}')
+const deviceWithActionsQuery = `
+		SELECT devices.device_id, devices.uuid, devices.device_name, COALESCE(action_templates.device_type::text, ''),
+		       COALESCE(action_templates.actions, '{}'), COALESCE(devices.custom_actions, '{}'), devices.last_login,
+		       devices.retired, devices.last_seen, devices.secret_hash IS NOT NULL
 		FROM devices
-		JOIN action_templates ON devices.action_template_id = action_templates.action_template_id
-		WHERE devices.device_id = $1;
+		LEFT JOIN action_templates ON devices.action_template_id = action_templates.action_template_id
 	`
 
-	row := db.QueryRow(query, deviceId)
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDeviceWithActions(row rowScanner) (*model.Device, error) {
 	var device model.Device
+	var deviceType string
 	var templateActions, customActions sql.NullString
+	var lastLogin, lastSeen sql.NullTime
 
-	if err := row.Scan(&device.ID, &device.Name, &templateActions, &customActions); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("no device found with ID %d", deviceId)
-		}
+	if err := row.Scan(&device.ID, &device.UUID, &device.Name, &deviceType, &templateActions, &customActions, &lastLogin, &device.Retired, &lastSeen, &device.Provisioned); err != nil {
 		return nil, err
 	}
 
+	device.DeviceType = model.DeviceType(deviceType)
 	device.TemplateActions = templateActions.String
 	device.CustomActions = customActions.String
+	device.LastLogin = lastLogin.Time
+	device.LastSeen = lastSeen.Time
 
 	return &device, nil
 }
 
+func (db *Database) FetchDeviceWithActions(deviceId int) (*model.Device, error) {
+	defer metrics.ObserveQuery("FetchDeviceWithActions", time.Now())
+	device, err := scanDeviceWithActions(db.QueryRow(deviceWithActionsQuery+`WHERE devices.device_id = $1`, deviceId))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no device found with ID %d: %w", deviceId, err)
+		}
+		return nil, err
+	}
+
+	return device, nil
+}
+
+func (db *Database) FetchDevicesWithActions() (devices []model.Device, err error) {
+	defer metrics.ObserveQuery("FetchDevicesWithActions", time.Now())
+	rows, err := db.Query(deviceWithActionsQuery + `ORDER BY devices.device_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		device, err := scanDeviceWithActions(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *device)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+var ErrDeviceExists = errors.New("a device with this UUID already exists")
+
+// CreateDevice stores a device that has not logged in yet together with the hash of its secret, it returns
+// ErrDeviceExists when the UUID is already used
+func (db *Database) CreateDevice(uuid string, name string, secretHash string) (deviceId int, err error) {
+	defer metrics.ObserveQuery("CreateDevice", time.Now())
+	err = db.QueryRow(`
+		INSERT INTO devices (uuid, device_name, secret_hash, last_login)
+		VALUES ($1, $2, $3, NULL)
+		RETURNING device_id`, uuid, name, secretHash).Scan(&deviceId)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return 0, ErrDeviceExists
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error creating device: %v", err)
+	}
+	return deviceId, nil
+}
+
+// FetchDeviceCredentials returns the ID and the secret hash of the device, the hash is empty for devices that were
+// never provisioned, unknown devices return sql.ErrNoRows. tokenHash is the hash of the provisioning token the secret
+// was issued for, it is empty once the device logged in with the secret.
+func (db *Database) FetchDeviceCredentials(uuid string) (deviceId int, secretHash string, tokenHash string, err error) {
+	defer metrics.ObserveQuery("FetchDeviceCredentials", time.Now())
+	var secret, token sql.NullString
+	err = db.QueryRow(`SELECT device_id, secret_hash, provisioning_token_hash FROM devices WHERE uuid = $1`, uuid).
+		Scan(&deviceId, &secret, &token)
+	if err != nil {
+		return 0, "", "", err
+	}
+	return deviceId, secret.String, token.String, nil
+}
+
+// SetDeviceSecret replaces the secret, it counts as confirmed because the admin hands it over to the device
+func (db *Database) SetDeviceSecret(deviceId int, secretHash string) error {
+	defer metrics.ObserveQuery("SetDeviceSecret", time.Now())
+	result, err := db.Exec(`UPDATE devices SET secret_hash = $1, provisioning_token_hash = NULL WHERE device_id = $2`,
+		secretHash, deviceId)
+	if err != nil {
+		return fmt.Errorf("error updating device secret: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// ConfirmDeviceSecret records that the device logged in with the secret issued for its provisioning token, the token
+// can not be used to get a new secret afterwards
+func (db *Database) ConfirmDeviceSecret(deviceId int) error {
+	defer metrics.ObserveQuery("ConfirmDeviceSecret", time.Now())
+	result, err := db.Exec(`UPDATE devices SET provisioning_token_hash = NULL WHERE device_id = $1`, deviceId)
+	if err != nil {
+		return fmt.Errorf("error confirming device secret: %v", err)
+	}
+	return expectAffected(result)
+}
+
+func (db *Database) RenameDevice(deviceId int, name string) error {
+	defer metrics.ObserveQuery("RenameDevice", time.Now())
+	result, err := db.Exec(`UPDATE devices SET device_name = $1 WHERE device_id = $2`, name, deviceId)
+	if err != nil {
+		return fmt.Errorf("error renaming device: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// SetDeviceRetired hides (or shows again) the device in dashboard creators, its data is kept
+func (db *Database) SetDeviceRetired(deviceId int, retired bool) error {
+	defer metrics.ObserveQuery("SetDeviceRetired", time.Now())
+	result, err := db.Exec(`UPDATE devices SET retired = $1 WHERE device_id = $2`, retired, deviceId)
+	if err != nil {
+		return fmt.Errorf("error retiring device: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// DeleteDevice removes the device together with its telemetry, sensor_data does not cascade so it is deleted first
+func (db *Database) DeleteDevice(deviceId int) error {
+	defer metrics.ObserveQuery("DeleteDevice", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		// no-op once the transaction is committed
+		_ = tx.Rollback()
+	}(tx)
+
+	if _, err = tx.Exec(`DELETE FROM sensor_data WHERE device_id = $1`, deviceId); err != nil {
+		return fmt.Errorf("error deleting telemetry: %v", err)
+	}
+	result, err := tx.Exec(`DELETE FROM devices WHERE device_id = $1`, deviceId)
+	if err != nil {
+		return fmt.Errorf("error deleting device: %v", err)
+	}
+	if err = expectAffected(result); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) UpdateDeviceLastSeen(deviceId int, lastSeen time.Time) error {
+	defer metrics.ObserveQuery("UpdateDeviceLastSeen", time.Now())
+	_, err := db.Exec(`UPDATE devices SET last_seen = $1 WHERE device_id = $2`, lastSeen, deviceId)
+	if err != nil {
+		return fmt.Errorf("error updating last seen: %v", err)
+	}
+	return nil
+}
+
+// expectAffected turns an update or delete that matched no rows into sql.ErrNoRows
+func expectAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// uniqueViolation is the PostgreSQL error code of a unique constraint violation
+const uniqueViolation = "23505"
+
+var ErrUsernameTaken = errors.New("username is already taken")
+
 func (db *Database) CreateDashboard(name string) (dashboardId int, err error) {
+	defer metrics.ObserveQuery("CreateDashboard", time.Now())
 	err = db.QueryRow(`INSERT INTO dashboards (name) VALUES ($1) RETURNING dashboard_id`, name).Scan(&dashboardId)
 	if err != nil {
 		return 0, err
@@ -114,6 +311,7 @@ func (db *Database) CreateDashboard(name string) (dashboardId int, err error) {
 }
 
 func (db *Database) InsertDevicesToDashboard(dashboardId int, devices []model.DeviceInDashboard) error {
+	defer metrics.ObserveQuery("InsertDevicesToDashboard", time.Now())
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -146,10 +344,63 @@ func (db *Database) InsertDevicesToDashboard(dashboardId int, devices []model.De
 	return nil
 }
 
+// UpdateDashboard renames the dashboard and replaces its devices, shown actions and positions in one transaction
+func (db *Database) UpdateDashboard(dashboardId int, name string, devices []model.DeviceInDashboard) error {
+	defer metrics.ObserveQuery("UpdateDashboard", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		// no-op once the transaction is committed
+		_ = tx.Rollback()
+	}(tx)
+
+	result, err := tx.Exec(`UPDATE dashboards SET name = $1 WHERE dashboard_id = $2`, name, dashboardId)
+	if err != nil {
+		return fmt.Errorf("error renaming dashboard: %w", err)
+	}
+	if err = expectAffected(result); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM devices_in_dashboard WHERE dashboard_id = $1`, dashboardId); err != nil {
+		return fmt.Errorf("error removing devices from dashboard: %v", err)
+	}
+
+	for _, device := range devices {
+		shownActionsJSON, err := json.Marshal(device.ShownActions)
+		if err != nil {
+			return fmt.Errorf("error marshaling shown actions: %v", err)
+		}
+		_, err = tx.Exec(`INSERT INTO devices_in_dashboard (device_id, dashboard_id, position_in_dashboard, shown_actions) VALUES ($1, $2, $3, $4)`,
+			device.Device.ID, dashboardId, device.Position, string(shownActionsJSON))
+		if err != nil {
+			return fmt.Errorf("error inserting device into dashboard: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// DeleteDashboard removes the dashboard, devices_in_dashboard rows are removed by the cascading foreign key
+func (db *Database) DeleteDashboard(dashboardId int) error {
+	defer metrics.ObserveQuery("DeleteDashboard", time.Now())
+	result, err := db.Exec(`DELETE FROM dashboards WHERE dashboard_id = $1`, dashboardId)
+	if err != nil {
+		return fmt.Errorf("error deleting dashboard: %v", err)
+	}
+	return expectAffected(result)
+}
+
 func (db *Database) FetchDashboards() ([]model.Dashboard, error) {
+	defer metrics.ObserveQuery("FetchDashboards", time.Now())
 	var dashboards []model.Dashboard
 
-	rows, err := db.Query(`SELECT dashboard_id, name FROM dashboards`)
+	rows, err := db.Query(`SELECT dashboard_id, name FROM dashboards ORDER BY name`)
 	if err != nil {
 		return nil, err // Return nil slice and the error
 	}
@@ -177,6 +428,7 @@ func (db *Database) FetchDashboards() ([]model.Dashboard, error) {
 }
 
 func (db *Database) FetchDashboardContents(dashboardID int) ([]model.DeviceInDashboard, string, error) {
+	defer metrics.ObserveQuery("FetchDashboardContents", time.Now())
 	var devices []model.DeviceInDashboard
 	var dashboardName string
 
@@ -208,7 +460,7 @@ func (db *Database) FetchDashboardContents(dashboardID int) ([]model.DeviceInDas
 		}
 
 		// Initialize the map to store action name to action type mappings
-		device.ShownActions = make(map[string]string)
+		device.ShownActions = make(map[string]model.ShownAction)
 		// Unmarshal the JSON string into the map
 		if err := json.Unmarshal([]byte(shownActionsJSON), &device.ShownActions); err != nil {
 			return nil, "", fmt.Errorf("error unmarshaling JSON: %v", err)
@@ -224,7 +476,24 @@ func (db *Database) FetchDashboardContents(dashboardID int) ([]model.DeviceInDas
 	return devices, dashboardName, nil
 }
 
+func (db *Database) FetchDashboard(dashboardID int) (*model.Dashboard, error) {
+	defer metrics.ObserveQuery("FetchDashboard", time.Now())
+	var dashboard model.Dashboard
+	err := db.QueryRow(`SELECT dashboard_id, name FROM dashboards WHERE dashboard_id = $1`, dashboardID).
+		Scan(&dashboard.DashboardId, &dashboard.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboard.Devices, _, err = db.FetchDashboardContents(dashboardID)
+	if err != nil {
+		return nil, err
+	}
+	return &dashboard, nil
+}
+
 func (db *Database) FetchTemplateActions(deviceType model.DeviceType) (actionTemplateId int, err error) {
+	defer metrics.ObserveQuery("FetchTemplateActions", time.Now())
 	query := `SELECT action_template_id FROM action_templates WHERE device_type = $1;`
 
 	row := db.QueryRow(query, deviceType)
@@ -240,6 +509,7 @@ func (db *Database) FetchTemplateActions(deviceType model.DeviceType) (actionTem
 }
 
 func (db *Database) GetDeviceIDByUUID(uuid string) (int, error) {
+	defer metrics.ObserveQuery("GetDeviceIDByUUID", time.Now())
 	var deviceID int
 	err := db.QueryRow("SELECT device_id FROM devices WHERE uuid = $1", uuid).Scan(&deviceID)
 	if err != nil {
@@ -248,17 +518,20 @@ func (db *Database) GetDeviceIDByUUID(uuid string) (int, error) {
 	return deviceID, nil
 }
 
-func (db *Database) InsertProvidedValue(deviceId int, jsonData string) error {
-	sqlStatement := `INSERT INTO sensor_data (device_id, data) VALUES ($1, $2::jsonb)`
-	_, err := db.Exec(sqlStatement, deviceId, jsonData)
+// InsertProvidedValue stores the reading and returns the timestamp it was stored with
+func (db *Database) InsertProvidedValue(deviceId int, jsonData string) (timestamp time.Time, err error) {
+	defer metrics.ObserveQuery("InsertProvidedValue", time.Now())
+	sqlStatement := `INSERT INTO sensor_data (device_id, data) VALUES ($1, $2::jsonb) RETURNING timestamp`
+	err = db.QueryRow(sqlStatement, deviceId, jsonData).Scan(&timestamp)
 	if err != nil {
-		return fmt.Errorf("error executing insert statement: %v", err)
+		return time.Time{}, fmt.Errorf("error executing insert statement: %v", err)
 	}
 
-	return nil
+	return timestamp, nil
 }
 
 func (db *Database) GetLastSensorValue(deviceId int, actionName string) (value string, err error) {
+	defer metrics.ObserveQuery("GetLastSensorValue", time.Now())
 	query := `SELECT data->>$1 AS value FROM sensor_data WHERE device_id = $2 ORDER BY timestamp DESC LIMIT 1`
 	row := db.QueryRow(query, actionName, deviceId)
 	err = row.Scan(&value)
@@ -268,18 +541,80 @@ func (db *Database) GetLastSensorValue(deviceId int, actionName string) (value s
 	return value, nil
 }
 
+// GetLastSensorReading returns the newest reading that contains actionName, keeping its JSON type
+func (db *Database) GetLastSensorReading(deviceId int, actionName string) (*model.SensorValue, error) {
+	defer metrics.ObserveQuery("GetLastSensorReading", time.Now())
+	query := `
+		SELECT data->$1, timestamp FROM sensor_data
+		WHERE device_id = $2 AND data ? $1
+		ORDER BY timestamp DESC LIMIT 1`
+
+	var reading model.SensorValue
+	var value []byte
+	if err := db.QueryRow(query, actionName, deviceId).Scan(&value, &reading.Timestamp); err != nil {
+		return nil, err
+	}
+	reading.Value = value
+	return &reading, nil
+}
+
+// GetSensorHistory aggregates numeric readings of actionName in [from, to) into buckets using TimescaleDB time_bucket,
+// readings that are not numbers (or numeric strings) are skipped
+func (db *Database) GetSensorHistory(deviceId int, actionName string, from time.Time, to time.Time, bucket time.Duration) (buckets []model.TelemetryBucket, err error) {
+	defer metrics.ObserveQuery("GetSensorHistory", time.Now())
+	query := `
+		SELECT time_bucket(make_interval(secs => $1), timestamp) AS bucket,
+		       min(value), max(value), avg(value), count(*), last(value, timestamp)
+		FROM (
+			SELECT timestamp, (data->>$2)::double precision AS value
+			FROM sensor_data
+			WHERE device_id = $3 AND timestamp >= $4 AND timestamp < $5
+			  AND jsonb_typeof(data->$2) IN ('number', 'string')
+			  AND (data->>$2) ~ '^\s*[-+]?[0-9]*\.?[0-9]+([eE][-+]?[0-9]+)?\s*$'
+		) AS readings
+		GROUP BY bucket
+		ORDER BY bucket`
+
+	rows, err := db.Query(query, bucket.Seconds(), actionName, deviceId, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error querying sensor history: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var b model.TelemetryBucket
+		if err = rows.Scan(&b.Bucket, &b.Min, &b.Max, &b.Avg, &b.Count, &b.Last); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+		buckets = append(buckets, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error processing rows: %v", err)
+	}
+
+	return buckets, nil
+}
+
 func (db *Database) GetDeviceUUID(deviceId int) (uuid string, err error) {
+	defer metrics.ObserveQuery("GetDeviceUUID", time.Now())
 	query := `SELECT uuid FROM devices WHERE device_id = $1`
 
 	err = db.QueryRow(query, deviceId).Scan(&uuid)
 	if err != nil {
-		return "", fmt.Errorf("error fetching UUID for device ID %d: %v", deviceId, err)
+		return "", fmt.Errorf("error fetching UUID for device ID %d: %w", deviceId, err)
 	}
 
 	return uuid, nil
 }
 
 func (db *Database) UpdateDeviceState(deviceId int, newState map[string]interface{}) error {
+	defer metrics.ObserveQuery("UpdateDeviceState", time.Now())
 	newStateJSON, err := json.Marshal(newState)
 	if err != nil {
 		return err
@@ -291,17 +626,13 @@ func (db *Database) UpdateDeviceState(deviceId int, newState map[string]interfac
 }
 
 func (db *Database) GetDeviceState(deviceId int, actionName string) (string, error) {
+	defer metrics.ObserveQuery("GetDeviceState", time.Now())
 	var actionState string
 	err := db.QueryRow(`
         SELECT state->>$1 FROM devices WHERE device_id = $2
     `, actionName, deviceId).Scan(&actionState)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			// Log and return not found as a custom error if needed
-			log.Printf("No entry found for device ID %d and action %s\n", deviceId, actionName)
-			return "", err
-		}
-		log.Printf("Database error: %v\n", err)
+		// the callers log the error, sql.ErrNoRows tells them the device does not exist
 		return "", err
 	}
 
@@ -309,6 +640,7 @@ func (db *Database) GetDeviceState(deviceId int, actionName string) (string, err
 }
 
 func (db *Database) GetDeviceStates(deviceID int) (stateJson string, err error) {
+	defer metrics.ObserveQuery("GetDeviceStates", time.Now())
 	query := "SELECT state FROM devices WHERE device_id = $1"
 	err = db.QueryRow(query, deviceID).Scan(&stateJson)
 	if err != nil {
@@ -316,3 +648,1026 @@ func (db *Database) GetDeviceStates(deviceID int) (stateJson string, err error)
 	}
 	return stateJson, nil
 }
+
+// InsertCommand stores the command and fills in its ID and creation time
+func (db *Database) InsertCommand(command *model.Command) error {
+	defer metrics.ObserveQuery("InsertCommand", time.Now())
+	query := `
+		INSERT INTO commands (correlation_id, device_id, action_name, action_type, value, source, status, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING command_id, created_at`
+
+	err := db.QueryRow(query, command.CorrelationID, command.DeviceID, command.ActionName, command.ActionType,
+		command.Value, command.Source, command.Status, command.Error).Scan(&command.ID, &command.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting command: %v", err)
+	}
+	return nil
+}
+
+// UpdateCommandStatus sets the status of the command, final statuses also set completed_at. A non-final status never
+// replaces a final one, sql.ErrNoRows is returned in that case
+func (db *Database) UpdateCommandStatus(correlationId string, status model.CommandStatus, errorMessage string) error {
+	defer metrics.ObserveQuery("UpdateCommandStatus", time.Now())
+	query := `
+		UPDATE commands
+		SET status = $1, error = $2, completed_at = CASE WHEN $3 THEN NOW() ELSE completed_at END
+		WHERE correlation_id = $4 AND ($3 OR status NOT IN ('succeeded', 'failed', 'timed_out'))`
+
+	result, err := db.Exec(query, status, errorMessage, status.Final(), correlationId)
+	if err != nil {
+		return fmt.Errorf("error updating command status: %v", err)
+	}
+	return expectAffected(result)
+}
+
+const commandColumns = `command_id, correlation_id, device_id, action_name, action_type, COALESCE(value, ''), source,
+		status, COALESCE(error, ''), created_at, completed_at`
+
+func scanCommand(row rowScanner) (*model.Command, error) {
+	var command model.Command
+	var completedAt sql.NullTime
+	err := row.Scan(&command.ID, &command.CorrelationID, &command.DeviceID, &command.ActionName, &command.ActionType,
+		&command.Value, &command.Source, &command.Status, &command.Error, &command.CreatedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	if completedAt.Valid {
+		command.CompletedAt = &completedAt.Time
+	}
+	return &command, nil
+}
+
+func (db *Database) FetchCommand(correlationId string) (*model.Command, error) {
+	defer metrics.ObserveQuery("FetchCommand", time.Now())
+	return scanCommand(db.QueryRow(`SELECT `+commandColumns+` FROM commands WHERE correlation_id = $1`, correlationId))
+}
+
+// FetchDeviceCommands returns the newest commands of the device first
+func (db *Database) FetchDeviceCommands(deviceId int, limit int) (commands []model.Command, err error) {
+	defer metrics.ObserveQuery("FetchDeviceCommands", time.Now())
+	rows, err := db.Query(`SELECT `+commandColumns+` FROM commands WHERE device_id = $1 ORDER BY created_at DESC LIMIT $2`,
+		deviceId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		command, err := scanCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, *command)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return commands, nil
+}
+
+// InsertRule stores the rule and fills in its ID
+func (db *Database) InsertRule(rule *model.Rule) error {
+	defer metrics.ObserveQuery("InsertRule", time.Now())
+	conditionJSON, err := json.Marshal(rule.Condition)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO rules (name, enabled, condition, action_device_id, action_name, action_value, cooldown_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING rule_id`
+
+	err = db.QueryRow(query, rule.Name, rule.Enabled, conditionJSON, rule.Action.DeviceID, rule.Action.ActionName,
+		rule.Action.Value, rule.CooldownSeconds).Scan(&rule.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting rule: %v", err)
+	}
+	return nil
+}
+
+// FetchRules returns all rules ordered by name
+func (db *Database) FetchRules() (rules []model.Rule, err error) {
+	defer metrics.ObserveQuery("FetchRules", time.Now())
+	query := `
+		SELECT rule_id, name, enabled, condition, action_device_id, action_name, COALESCE(action_value, ''),
+		       cooldown_seconds, last_fired, COALESCE(last_error, '')
+		FROM rules ORDER BY name, rule_id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var rule model.Rule
+		var conditionJSON []byte
+		var lastFired sql.NullTime
+		if err = rows.Scan(&rule.ID, &rule.Name, &rule.Enabled, &conditionJSON, &rule.Action.DeviceID,
+			&rule.Action.ActionName, &rule.Action.Value, &rule.CooldownSeconds, &lastFired, &rule.LastError); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(conditionJSON, &rule.Condition); err != nil {
+			return nil, fmt.Errorf("invalid condition of rule %d: %v", rule.ID, err)
+		}
+		if lastFired.Valid {
+			rule.LastFired = &lastFired.Time
+		}
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (db *Database) SetRuleEnabled(ruleId int, enabled bool) error {
+	defer metrics.ObserveQuery("SetRuleEnabled", time.Now())
+	result, err := db.Exec(`UPDATE rules SET enabled = $1 WHERE rule_id = $2`, enabled, ruleId)
+	if err != nil {
+		return fmt.Errorf("error updating rule: %v", err)
+	}
+	return expectAffected(result)
+}
+
+func (db *Database) DeleteRule(ruleId int) error {
+	defer metrics.ObserveQuery("DeleteRule", time.Now())
+	result, err := db.Exec(`DELETE FROM rules WHERE rule_id = $1`, ruleId)
+	if err != nil {
+		return fmt.Errorf("error deleting rule: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// RecordRuleFired stores when the rule fired and the error of issuing its action, an empty message clears it
+func (db *Database) RecordRuleFired(ruleId int, firedAt time.Time, errorMessage string) error {
+	defer metrics.ObserveQuery("RecordRuleFired", time.Now())
+	_, err := db.Exec(`UPDATE rules SET last_fired = $1, last_error = NULLIF($2, '') WHERE rule_id = $3`,
+		firedAt, errorMessage, ruleId)
+	if err != nil {
+		return fmt.Errorf("error recording rule %d: %v", ruleId, err)
+	}
+	return nil
+}
+
+func weekdaysToString(weekdays []time.Weekday) string {
+	days := make([]string, len(weekdays))
+	for i, day := range weekdays {
+		days[i] = strconv.Itoa(int(day))
+	}
+	return strings.Join(days, ",")
+}
+
+func weekdaysFromString(days string) ([]time.Weekday, error) {
+	if days == "" {
+		return nil, nil
+	}
+	var weekdays []time.Weekday
+	for _, day := range strings.Split(days, ",") {
+		number, err := strconv.Atoi(day)
+		if err != nil {
+			return nil, err
+		}
+		weekdays = append(weekdays, time.Weekday(number))
+	}
+	return weekdays, nil
+}
+
+// InsertSchedule stores the schedule and fills in its ID
+func (db *Database) InsertSchedule(schedule *model.Schedule) error {
+	defer metrics.ObserveQuery("InsertSchedule", time.Now())
+	query := `
+		INSERT INTO schedules (name, kind, cron_expression, time_of_day, weekdays, timezone, action_device_id,
+		                       action_name, action_value, paused)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6, $7, $8, NULLIF($9, ''), $10)
+		RETURNING schedule_id`
+
+	err := db.QueryRow(query, schedule.Name, schedule.Kind, schedule.CronExpression, schedule.TimeOfDay,
+		weekdaysToString(schedule.Weekdays), schedule.Timezone, schedule.Action.DeviceID, schedule.Action.ActionName,
+		schedule.Action.Value, schedule.Paused).Scan(&schedule.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting schedule: %v", err)
+	}
+	return nil
+}
+
+// FetchSchedules returns all schedules ordered by name
+func (db *Database) FetchSchedules() (schedules []model.Schedule, err error) {
+	defer metrics.ObserveQuery("FetchSchedules", time.Now())
+	query := `
+		SELECT schedule_id, name, kind, COALESCE(cron_expression, ''), COALESCE(time_of_day, ''),
+		       COALESCE(weekdays, ''), timezone, action_device_id, action_name, COALESCE(action_value, ''), paused
+		FROM schedules ORDER BY name, schedule_id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var schedule model.Schedule
+		var weekdays string
+		if err = rows.Scan(&schedule.ID, &schedule.Name, &schedule.Kind, &schedule.CronExpression,
+			&schedule.TimeOfDay, &weekdays, &schedule.Timezone, &schedule.Action.DeviceID, &schedule.Action.ActionName,
+			&schedule.Action.Value, &schedule.Paused); err != nil {
+			return nil, err
+		}
+		if schedule.Weekdays, err = weekdaysFromString(weekdays); err != nil {
+			return nil, fmt.Errorf("invalid weekdays of schedule %d: %v", schedule.ID, err)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return schedules, nil
+}
+
+func (db *Database) SetSchedulePaused(scheduleId int, paused bool) error {
+	defer metrics.ObserveQuery("SetSchedulePaused", time.Now())
+	result, err := db.Exec(`UPDATE schedules SET paused = $1 WHERE schedule_id = $2`, paused, scheduleId)
+	if err != nil {
+		return fmt.Errorf("error updating schedule: %v", err)
+	}
+	return expectAffected(result)
+}
+
+func (db *Database) DeleteSchedule(scheduleId int) error {
+	defer metrics.ObserveQuery("DeleteSchedule", time.Now())
+	result, err := db.Exec(`DELETE FROM schedules WHERE schedule_id = $1`, scheduleId)
+	if err != nil {
+		return fmt.Errorf("error deleting schedule: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// InsertScheduleRun records one run of a schedule, correlationId is empty when no command could be issued
+func (db *Database) InsertScheduleRun(scheduleId int, ranAt time.Time, correlationId string, errorMessage string) error {
+	defer metrics.ObserveQuery("InsertScheduleRun", time.Now())
+	_, err := db.Exec(`
+		INSERT INTO schedule_runs (schedule_id, ran_at, correlation_id, error)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, NULLIF($4, ''))`,
+		scheduleId, ranAt, correlationId, errorMessage)
+	if err != nil {
+		return fmt.Errorf("error recording run of schedule %d: %v", scheduleId, err)
+	}
+	return nil
+}
+
+// FetchScheduleRuns returns the newest runs of all schedules first, together with the status of the issued commands
+func (db *Database) FetchScheduleRuns(limit int) (runs []model.ScheduleRun, err error) {
+	defer metrics.ObserveQuery("FetchScheduleRuns", time.Now())
+	query := `
+		SELECT r.run_id, r.schedule_id, s.name, r.ran_at, COALESCE(r.correlation_id::text, ''),
+		       COALESCE(c.status, ''), COALESCE(NULLIF(r.error, ''), c.error, '')
+		FROM schedule_runs r
+		JOIN schedules s ON s.schedule_id = r.schedule_id
+		LEFT JOIN commands c ON c.correlation_id = r.correlation_id
+		ORDER BY r.ran_at DESC LIMIT $1`
+
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var run model.ScheduleRun
+		if err = rows.Scan(&run.ID, &run.ScheduleID, &run.ScheduleName, &run.RanAt, &run.CorrelationID,
+			&run.CommandStatus, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// InsertAlertDefinition stores the definition and fills in its ID
+func (db *Database) InsertAlertDefinition(definition *model.AlertDefinition) error {
+	defer metrics.ObserveQuery("InsertAlertDefinition", time.Now())
+	query := `
+		INSERT INTO alert_definitions (name, device_id, action_name, condition, low, high, for_seconds, channels, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING definition_id`
+
+	err := db.QueryRow(query, definition.Name, definition.DeviceID, definition.ActionName, definition.Condition,
+		definition.Low, definition.High, definition.ForSeconds, pq.Array(definition.Channels), definition.Enabled).
+		Scan(&definition.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting alert definition: %v", err)
+	}
+	return nil
+}
+
+// FetchAlertDefinitions returns all alert definitions ordered by name
+func (db *Database) FetchAlertDefinitions() (definitions []model.AlertDefinition, err error) {
+	defer metrics.ObserveQuery("FetchAlertDefinitions", time.Now())
+	query := `
+		SELECT definition_id, name, device_id, action_name, condition, low, high, for_seconds, channels, enabled
+		FROM alert_definitions ORDER BY name, definition_id`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var definition model.AlertDefinition
+		if err = rows.Scan(&definition.ID, &definition.Name, &definition.DeviceID, &definition.ActionName,
+			&definition.Condition, &definition.Low, &definition.High, &definition.ForSeconds,
+			pq.Array(&definition.Channels), &definition.Enabled); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return definitions, nil
+}
+
+func (db *Database) SetAlertDefinitionEnabled(definitionId int, enabled bool) error {
+	defer metrics.ObserveQuery("SetAlertDefinitionEnabled", time.Now())
+	result, err := db.Exec(`UPDATE alert_definitions SET enabled = $1 WHERE definition_id = $2`, enabled, definitionId)
+	if err != nil {
+		return fmt.Errorf("error updating alert definition: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// DeleteAlertDefinition deletes the definition together with its alerts
+func (db *Database) DeleteAlertDefinition(definitionId int) error {
+	defer metrics.ObserveQuery("DeleteAlertDefinition", time.Now())
+	result, err := db.Exec(`DELETE FROM alert_definitions WHERE definition_id = $1`, definitionId)
+	if err != nil {
+		return fmt.Errorf("error deleting alert definition: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// InsertAlert stores a newly fired alert and fills in its ID
+func (db *Database) InsertAlert(alert *model.Alert) error {
+	defer metrics.ObserveQuery("InsertAlert", time.Now())
+	query := `
+		INSERT INTO alerts (definition_id, state, value, breached_at, fired_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING alert_id`
+
+	err := db.QueryRow(query, alert.DefinitionID, alert.State, alert.Value, alert.BreachedAt, alert.FiredAt).
+		Scan(&alert.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting alert: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) ResolveAlert(alertId int, resolvedAt time.Time) error {
+	defer metrics.ObserveQuery("ResolveAlert", time.Now())
+	_, err := db.Exec(`UPDATE alerts SET state = 'resolved', resolved_at = $1 WHERE alert_id = $2 AND state = 'active'`,
+		resolvedAt, alertId)
+	if err != nil {
+		return fmt.Errorf("error resolving alert %d: %v", alertId, err)
+	}
+	return nil
+}
+
+// FetchAlerts returns the newest alerts first, activeOnly limits them to alerts that are not resolved yet
+func (db *Database) FetchAlerts(activeOnly bool, limit int) (alerts []model.Alert, err error) {
+	defer metrics.ObserveQuery("FetchAlerts", time.Now())
+	query := `
+		SELECT alert_id, definition_id, state, value, breached_at, fired_at, resolved_at
+		FROM alerts WHERE NOT $1 OR state = 'active'
+		ORDER BY fired_at DESC LIMIT $2`
+
+	rows, err := db.Query(query, activeOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var alert model.Alert
+		var resolvedAt sql.NullTime
+		if err = rows.Scan(&alert.ID, &alert.DefinitionID, &alert.State, &alert.Value, &alert.BreachedAt,
+			&alert.FiredAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		if resolvedAt.Valid {
+			alert.ResolvedAt = &resolvedAt.Time
+		}
+		alerts = append(alerts, alert)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
+
+func eventTypesToStrings(eventTypes []model.WebhookEventType) []string {
+	types := make([]string, len(eventTypes))
+	for i, eventType := range eventTypes {
+		types[i] = string(eventType)
+	}
+	return types
+}
+
+// InsertWebhookSubscription stores the subscription and fills in its ID
+func (db *Database) InsertWebhookSubscription(subscription *model.WebhookSubscription) error {
+	defer metrics.ObserveQuery("InsertWebhookSubscription", time.Now())
+	query := `
+		INSERT INTO webhook_subscriptions (url, secret, event_types, enabled)
+		VALUES ($1, $2, $3, $4)
+		RETURNING subscription_id`
+
+	err := db.QueryRow(query, subscription.URL, subscription.Secret,
+		pq.Array(eventTypesToStrings(subscription.EventTypes)), subscription.Enabled).Scan(&subscription.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting webhook subscription: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) FetchWebhookSubscriptions() (subscriptions []model.WebhookSubscription, err error) {
+	defer metrics.ObserveQuery("FetchWebhookSubscriptions", time.Now())
+	rows, err := db.Query(`
+		SELECT subscription_id, url, secret, event_types, enabled
+		FROM webhook_subscriptions ORDER BY subscription_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var subscription model.WebhookSubscription
+		var eventTypes []string
+		if err = rows.Scan(&subscription.ID, &subscription.URL, &subscription.Secret, pq.Array(&eventTypes),
+			&subscription.Enabled); err != nil {
+			return nil, err
+		}
+		for _, eventType := range eventTypes {
+			subscription.EventTypes = append(subscription.EventTypes, model.WebhookEventType(eventType))
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (db *Database) SetWebhookSubscriptionEnabled(subscriptionId int, enabled bool) error {
+	defer metrics.ObserveQuery("SetWebhookSubscriptionEnabled", time.Now())
+	result, err := db.Exec(`UPDATE webhook_subscriptions SET enabled = $1 WHERE subscription_id = $2`,
+		enabled, subscriptionId)
+	if err != nil {
+		return fmt.Errorf("error updating webhook subscription: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// DeleteWebhookSubscription deletes the subscription together with its delivery log
+func (db *Database) DeleteWebhookSubscription(subscriptionId int) error {
+	defer metrics.ObserveQuery("DeleteWebhookSubscription", time.Now())
+	result, err := db.Exec(`DELETE FROM webhook_subscriptions WHERE subscription_id = $1`, subscriptionId)
+	if err != nil {
+		return fmt.Errorf("error deleting webhook subscription: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// InsertWebhookDelivery stores a pending delivery and fills in its ID and creation time
+func (db *Database) InsertWebhookDelivery(delivery *model.WebhookDelivery) error {
+	defer metrics.ObserveQuery("InsertWebhookDelivery", time.Now())
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event_type, payload, status)
+		VALUES ($1, $2, $3, $4)
+		RETURNING delivery_id, created_at`
+
+	err := db.QueryRow(query, delivery.SubscriptionID, delivery.EventType, delivery.Payload, delivery.Status).
+		Scan(&delivery.ID, &delivery.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting webhook delivery: %v", err)
+	}
+	return nil
+}
+
+// UpdateWebhookDelivery stores the outcome of the last attempt of the delivery
+func (db *Database) UpdateWebhookDelivery(delivery *model.WebhookDelivery) error {
+	defer metrics.ObserveQuery("UpdateWebhookDelivery", time.Now())
+	_, err := db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_status = NULLIF($3, 0), error = NULLIF($4, ''), last_attempt_at = $5
+		WHERE delivery_id = $6`,
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.Error, delivery.LastAttemptAt, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("error updating webhook delivery %d: %v", delivery.ID, err)
+	}
+	return nil
+}
+
+// FetchWebhookDeliveries returns the newest deliveries first, pendingOnly limits them to deliveries still being retried
+func (db *Database) FetchWebhookDeliveries(pendingOnly bool, limit int) (deliveries []model.WebhookDelivery, err error) {
+	defer metrics.ObserveQuery("FetchWebhookDeliveries", time.Now())
+	rows, err := db.Query(`
+		SELECT delivery_id, subscription_id, event_type, payload, status, attempts, COALESCE(response_status, 0),
+		       COALESCE(error, ''), created_at, last_attempt_at
+		FROM webhook_deliveries WHERE NOT $1 OR status = 'pending'
+		ORDER BY created_at DESC LIMIT $2`, pendingOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var delivery model.WebhookDelivery
+		var lastAttemptAt sql.NullTime
+		if err = rows.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.EventType, &delivery.Payload,
+			&delivery.Status, &delivery.Attempts, &delivery.ResponseStatus, &delivery.Error, &delivery.CreatedAt,
+			&lastAttemptAt); err != nil {
+			return nil, err
+		}
+		if lastAttemptAt.Valid {
+			delivery.LastAttemptAt = &lastAttemptAt.Time
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// DeleteFinishedWebhookDeliveries removes succeeded and failed deliveries created before the given time, pending
+// deliveries are kept however old they are
+func (db *Database) DeleteFinishedWebhookDeliveries(before time.Time) (int64, error) {
+	defer metrics.ObserveQuery("DeleteFinishedWebhookDeliveries", time.Now())
+	result, err := db.Exec(`DELETE FROM webhook_deliveries WHERE status <> 'pending' AND created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting webhook deliveries: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (db *Database) CountUsers() (count int, err error) {
+	defer metrics.ObserveQuery("CountUsers", time.Now())
+	if err = db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting users: %v", err)
+	}
+	return count, nil
+}
+
+// InsertFirstUser stores the user as an admin only while there are no users yet, it returns sql.ErrNoRows once a user
+// exists so two concurrent first-run setups can not both create an account
+func (db *Database) InsertFirstUser(user *model.User) error {
+	defer metrics.ObserveQuery("InsertFirstUser", time.Now())
+	query := `
+		INSERT INTO users (username, password_hash, role)
+		SELECT $1, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM users)
+		RETURNING user_id, created_at`
+
+	user.Role = model.RoleAdmin
+	err := db.QueryRow(query, user.Username, user.PasswordHash, user.Role).Scan(&user.ID, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting first user: %v", err)
+	}
+	return nil
+}
+
+// InsertUser stores the user and fills in its ID, it returns ErrUsernameTaken when the username is already used
+func (db *Database) InsertUser(user *model.User) error {
+	defer metrics.ObserveQuery("InsertUser", time.Now())
+	query := `
+		INSERT INTO users (username, password_hash, role)
+		VALUES ($1, $2, $3)
+		RETURNING user_id, created_at`
+
+	err := db.QueryRow(query, user.Username, user.PasswordHash, user.Role).Scan(&user.ID, &user.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting user: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) FetchUsers() (users []model.User, err error) {
+	defer metrics.ObserveQuery("FetchUsers", time.Now())
+	rows, err := db.Query(`SELECT user_id, username, password_hash, role, created_at FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var user model.User
+		if err = rows.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (db *Database) FetchUser(userId int) (*model.User, error) {
+	defer metrics.ObserveQuery("FetchUser", time.Now())
+	var user model.User
+	err := db.QueryRow(`SELECT user_id, username, password_hash, role, created_at FROM users WHERE user_id = $1`,
+		userId).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FetchUserByUsername returns sql.ErrNoRows when there is no such user
+func (db *Database) FetchUserByUsername(username string) (*model.User, error) {
+	defer metrics.ObserveQuery("FetchUserByUsername", time.Now())
+	var user model.User
+	err := db.QueryRow(`SELECT user_id, username, password_hash, role, created_at FROM users WHERE username = $1`,
+		username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (db *Database) SetUserRole(userId int, role model.Role) error {
+	defer metrics.ObserveQuery("SetUserRole", time.Now())
+	result, err := db.Exec(`UPDATE users SET role = $1 WHERE user_id = $2`, role, userId)
+	if err != nil {
+		return fmt.Errorf("error updating role: %v", err)
+	}
+	return expectAffected(result)
+}
+
+func (db *Database) UpdateUserPassword(userId int, passwordHash string) error {
+	defer metrics.ObserveQuery("UpdateUserPassword", time.Now())
+	result, err := db.Exec(`UPDATE users SET password_hash = $1 WHERE user_id = $2`, passwordHash, userId)
+	if err != nil {
+		return fmt.Errorf("error updating password: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// DeleteUser deletes the user together with its sessions
+func (db *Database) DeleteUser(userId int) error {
+	defer metrics.ObserveQuery("DeleteUser", time.Now())
+	result, err := db.Exec(`DELETE FROM users WHERE user_id = $1`, userId)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// InsertSession stores a session under the hash of its token, the token itself is only known to the browser
+func (db *Database) InsertSession(tokenHash string, userId int, expiresAt time.Time) error {
+	defer metrics.ObserveQuery("InsertSession", time.Now())
+	_, err := db.Exec(`INSERT INTO sessions (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+		tokenHash, userId, expiresAt)
+	if err != nil {
+		return fmt.Errorf("error inserting session: %v", err)
+	}
+	return nil
+}
+
+// FetchSessionUser returns the user of a session that has not expired yet, or sql.ErrNoRows
+func (db *Database) FetchSessionUser(tokenHash string) (*model.User, error) {
+	defer metrics.ObserveQuery("FetchSessionUser", time.Now())
+	var user model.User
+	err := db.QueryRow(`
+		SELECT users.user_id, username, password_hash, role, users.created_at
+		FROM sessions JOIN users ON users.user_id = sessions.user_id
+		WHERE token_hash = $1 AND expires_at > NOW()`, tokenHash).
+		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (db *Database) DeleteSession(tokenHash string) error {
+	defer metrics.ObserveQuery("DeleteSession", time.Now())
+	if _, err := db.Exec(`DELETE FROM sessions WHERE token_hash = $1`, tokenHash); err != nil {
+		return fmt.Errorf("error deleting session: %v", err)
+	}
+	return nil
+}
+
+// DeleteOtherSessions logs the user out everywhere except the session with keepTokenHash
+func (db *Database) DeleteOtherSessions(userId int, keepTokenHash string) error {
+	defer metrics.ObserveQuery("DeleteOtherSessions", time.Now())
+	_, err := db.Exec(`DELETE FROM sessions WHERE user_id = $1 AND token_hash <> $2`, userId, keepTokenHash)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) DeleteExpiredSessions() error {
+	defer metrics.ObserveQuery("DeleteExpiredSessions", time.Now())
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("error deleting expired sessions: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) FetchGrants(userId int) (grants []model.Grant, err error) {
+	defer metrics.ObserveQuery("FetchGrants", time.Now())
+	rows, err := db.Query(`
+		SELECT user_id, COALESCE(dashboard_id, 0), COALESCE(device_id, 0), access
+		FROM grants WHERE user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var grant model.Grant
+		if err = rows.Scan(&grant.UserID, &grant.DashboardID, &grant.DeviceID, &grant.Access); err != nil {
+			return nil, err
+		}
+		grants = append(grants, grant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+// ReplaceGrants swaps all grants of the user for the given ones
+func (db *Database) ReplaceGrants(userId int, grants []model.Grant) error {
+	defer metrics.ObserveQuery("ReplaceGrants", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer func(tx *sql.Tx) {
+		// no-op once the transaction is committed
+		_ = tx.Rollback()
+	}(tx)
+
+	if _, err = tx.Exec(`DELETE FROM grants WHERE user_id = $1`, userId); err != nil {
+		return fmt.Errorf("error deleting grants: %v", err)
+	}
+	for _, grant := range grants {
+		_, err = tx.Exec(`
+			INSERT INTO grants (user_id, dashboard_id, device_id, access)
+			VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4)`,
+			userId, grant.DashboardID, grant.DeviceID, grant.Access)
+		if err != nil {
+			return fmt.Errorf("error inserting grant: %v", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing grants: %v", err)
+	}
+	return nil
+}
+
+// FetchDashboardDeviceIds maps each of the dashboards to the IDs of the devices shown on it
+func (db *Database) FetchDashboardDeviceIds(dashboardIds []int) (devices map[int][]int, err error) {
+	defer metrics.ObserveQuery("FetchDashboardDeviceIds", time.Now())
+	rows, err := db.Query(`
+		SELECT dashboard_id, device_id FROM devices_in_dashboard WHERE dashboard_id = ANY($1)`,
+		pq.Array(dashboardIds))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	devices = make(map[int][]int)
+	for rows.Next() {
+		var dashboardId, deviceId int
+		if err = rows.Scan(&dashboardId, &deviceId); err != nil {
+			return nil, err
+		}
+		devices[dashboardId] = append(devices[dashboardId], deviceId)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+func (db *Database) InsertProvisioningToken(tokenHash string, token *model.ProvisioningToken) error {
+	defer metrics.ObserveQuery("InsertProvisioningToken", time.Now())
+	err := db.QueryRow(`
+		INSERT INTO provisioning_tokens (token_hash, label, uses_left, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING token_id, created_at`, tokenHash, token.Label, token.UsesLeft, token.ExpiresAt).
+		Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error inserting provisioning token: %v", err)
+	}
+	return nil
+}
+
+func (db *Database) FetchProvisioningTokens() (tokens []model.ProvisioningToken, err error) {
+	defer metrics.ObserveQuery("FetchProvisioningTokens", time.Now())
+	rows, err := db.Query(`
+		SELECT token_id, label, uses_left, expires_at, created_at
+		FROM provisioning_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err = rows.Close()
+		if err != nil {
+
+		}
+	}(rows)
+
+	for rows.Next() {
+		var token model.ProvisioningToken
+		var expiresAt sql.NullTime
+		if err = rows.Scan(&token.ID, &token.Label, &token.UsesLeft, &expiresAt, &token.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			token.ExpiresAt = &expiresAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// FetchProvisioningToken returns the token with the hash, whether or not it is still usable, or sql.ErrNoRows
+func (db *Database) FetchProvisioningToken(tokenHash string) (*model.ProvisioningToken, error) {
+	defer metrics.ObserveQuery("FetchProvisioningToken", time.Now())
+	var token model.ProvisioningToken
+	var expiresAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT token_id, label, uses_left, expires_at, created_at
+		FROM provisioning_tokens WHERE token_hash = $1`, tokenHash).
+		Scan(&token.ID, &token.Label, &token.UsesLeft, &expiresAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	return &token, nil
+}
+
+func (db *Database) DeleteProvisioningToken(tokenId int) error {
+	defer metrics.ObserveQuery("DeleteProvisioningToken", time.Now())
+	result, err := db.Exec(`DELETE FROM provisioning_tokens WHERE token_id = $1`, tokenId)
+	if err != nil {
+		return fmt.Errorf("error deleting provisioning token: %v", err)
+	}
+	return expectAffected(result)
+}
+
+// ProvisionDevice uses up one use of the token, registers the device like RegisterDevice and stores the secret issued
+// for it in one transaction, so no device is registered without its secret. It fills in the ID of the device and
+// returns sql.ErrNoRows when the token does not exist, has expired or has no uses left.
+func (db *Database) ProvisionDevice(device *model.Device, tokenHash string, secretHash string) error {
+	defer metrics.ObserveQuery("ProvisionDevice", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		// no-op once the transaction is committed
+		_ = tx.Rollback()
+	}(tx)
+
+	result, err := tx.Exec(`
+		UPDATE provisioning_tokens SET uses_left = uses_left - 1
+		WHERE token_hash = $1 AND uses_left > 0 AND (expires_at IS NULL OR expires_at > NOW())`, tokenHash)
+	if err != nil {
+		return fmt.Errorf("error consuming provisioning token: %v", err)
+	}
+	if err = expectAffected(result); err != nil {
+		return err
+	}
+	var deviceId int
+	err = tx.QueryRow(registerDeviceQuery, device.UUID, device.ActionsTemplateId, device.Name, customActionsArg(device)).
+		Scan(&deviceId)
+	if err != nil {
+		return fmt.Errorf("failed insert device %s", err)
+	}
+	_, err = tx.Exec(`UPDATE devices SET secret_hash = $1, provisioning_token_hash = $2 WHERE device_id = $3`,
+		secretHash, tokenHash, deviceId)
+	if err != nil {
+		return fmt.Errorf("error updating device secret: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	device.ID = deviceId
+	return nil
+}
+
+// ReissueDeviceSecret replaces a secret the device never confirmed, without using up the token again. It returns
+// sql.ErrNoRows when the secret was confirmed, was issued for another token or the token was deleted meanwhile.
+func (db *Database) ReissueDeviceSecret(deviceId int, tokenHash string, secretHash string) error {
+	defer metrics.ObserveQuery("ReissueDeviceSecret", time.Now())
+	result, err := db.Exec(`
+		UPDATE devices SET secret_hash = $1
+		WHERE device_id = $2 AND provisioning_token_hash = $3
+		  AND EXISTS (SELECT 1 FROM provisioning_tokens WHERE token_hash = $3)`, secretHash, deviceId, tokenHash)
+	if err != nil {
+		return fmt.Errorf("error updating device secret: %v", err)
+	}
+	return expectAffected(result)
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"NSI-semester-work/internal/model"
+	"context"
+	"time"
+)
+
+// DeviceStore keeps the registered devices and their credentials
+type DeviceStore interface {
+	RegisterDevice(device *model.Device) error
+	FetchDeviceNamesAndIds() ([]model.Device, error)
+	FetchDeviceWithActions(deviceId int) (*model.Device, error)
+	FetchDevicesWithActions() ([]model.Device, error)
+	CreateDevice(uuid string, name string, secretHash string) (int, error)
+	FetchDeviceCredentials(uuid string) (deviceId int, secretHash string, tokenHash string, err error)
+	SetDeviceSecret(deviceId int, secretHash string) error
+	ConfirmDeviceSecret(deviceId int) error
+	RenameDevice(deviceId int, name string) error
+	SetDeviceRetired(deviceId int, retired bool) error
+	DeleteDevice(deviceId int) error
+	UpdateDeviceLastSeen(deviceId int, lastSeen time.Time) error
+	FetchTemplateActions(deviceType model.DeviceType) (int, error)
+	GetDeviceIDByUUID(uuid string) (int, error)
+	GetDeviceUUID(deviceId int) (string, error)
+}
+
+// DashboardStore keeps the dashboards and the devices shown on them
+type DashboardStore interface {
+	CreateDashboard(name string) (int, error)
+	InsertDevicesToDashboard(dashboardId int, devices []model.DeviceInDashboard) error
+	UpdateDashboard(dashboardId int, name string, devices []model.DeviceInDashboard) error
+	DeleteDashboard(dashboardId int) error
+	FetchDashboards() ([]model.Dashboard, error)
+	FetchDashboardContents(dashboardID int) ([]model.DeviceInDashboard, string, error)
+	FetchDashboard(dashboardID int) (*model.Dashboard, error)
+	FetchDashboardDeviceIds(dashboardIds []int) (map[int][]int, error)
+}
+
+// StateStore keeps the last reported state of every device action
+type StateStore interface {
+	UpdateDeviceState(deviceId int, newState map[string]interface{}) error
+	GetDeviceState(deviceId int, actionName string) (string, error)
+	GetDeviceStates(deviceID int) (string, error)
+}
+
+// SensorDataStore keeps the values provided by devices
+type SensorDataStore interface {
+	InsertProvidedValue(deviceId int, jsonData string) (time.Time, error)
+	GetLastSensorValue(deviceId int, actionName string) (string, error)
+	GetLastSensorReading(deviceId int, actionName string) (*model.SensorValue, error)
+	GetSensorHistory(deviceId int, actionName string, from time.Time, to time.Time, bucket time.Duration) ([]model.TelemetryBucket, error)
+}
+
+type CommandStore interface {
+	InsertCommand(command *model.Command) error
+	UpdateCommandStatus(correlationId string, status model.CommandStatus, errorMessage string) error
+	FetchCommand(correlationId string) (*model.Command, error)
+	FetchDeviceCommands(deviceId int, limit int) ([]model.Command, error)
+}
+
+type RuleStore interface {
+	InsertRule(rule *model.Rule) error
+	FetchRules() ([]model.Rule, error)
+	SetRuleEnabled(ruleId int, enabled bool) error
+	DeleteRule(ruleId int) error
+	RecordRuleFired(ruleId int, firedAt time.Time, errorMessage string) error
+}
+
+type ScheduleStore interface {
+	InsertSchedule(schedule *model.Schedule) error
+	FetchSchedules() ([]model.Schedule, error)
+	SetSchedulePaused(scheduleId int, paused bool) error
+	DeleteSchedule(scheduleId int) error
+	InsertScheduleRun(scheduleId int, ranAt time.Time, correlationId string, errorMessage string) error
+	FetchScheduleRuns(limit int) ([]model.ScheduleRun, error)
+}
+
+type AlertStore interface {
+	InsertAlertDefinition(definition *model.AlertDefinition) error
+	FetchAlertDefinitions() ([]model.AlertDefinition, error)
+	SetAlertDefinitionEnabled(definitionId int, enabled bool) error
+	DeleteAlertDefinition(definitionId int) error
+	InsertAlert(alert *model.Alert) error
+	ResolveAlert(alertId int, resolvedAt time.Time) error
+	FetchAlerts(activeOnly bool, limit int) ([]model.Alert, error)
+}
+
+type WebhookStore interface {
+	InsertWebhookSubscription(subscription *model.WebhookSubscription) error
+	FetchWebhookSubscriptions() ([]model.WebhookSubscription, error)
+	SetWebhookSubscriptionEnabled(subscriptionId int, enabled bool) error
+	DeleteWebhookSubscription(subscriptionId int) error
+	InsertWebhookDelivery(delivery *model.WebhookDelivery) error
+	UpdateWebhookDelivery(delivery *model.WebhookDelivery) error
+	FetchWebhookDeliveries(pendingOnly bool, limit int) ([]model.WebhookDelivery, error)
+	DeleteFinishedWebhookDeliveries(before time.Time) (int64, error)
+}
+
+// UserStore keeps the accounts of the web interface, their sessions and grants
+type UserStore interface {
+	CountUsers() (int, error)
+	InsertFirstUser(user *model.User) error
+	InsertUser(user *model.User) error
+	FetchUsers() ([]model.User, error)
+	FetchUser(userId int) (*model.User, error)
+	FetchUserByUsername(username string) (*model.User, error)
+	SetUserRole(userId int, role model.Role) error
+	UpdateUserPassword(userId int, passwordHash string) error
+	DeleteUser(userId int) error
+	InsertSession(tokenHash string, userId int, expiresAt time.Time) error
+	FetchSessionUser(tokenHash string) (*model.User, error)
+	DeleteSession(tokenHash string) error
+	DeleteOtherSessions(userId int, keepTokenHash string) error
+	DeleteExpiredSessions() error
+	FetchGrants(userId int) ([]model.Grant, error)
+	ReplaceGrants(userId int, grants []model.Grant) error
+}
+
+type ProvisioningStore interface {
+	InsertProvisioningToken(tokenHash string, token *model.ProvisioningToken) error
+	FetchProvisioningTokens() ([]model.ProvisioningToken, error)
+	FetchProvisioningToken(tokenHash string) (*model.ProvisioningToken, error)
+	DeleteProvisioningToken(tokenId int) error
+	ProvisionDevice(device *model.Device, tokenHash string, secretHash string) error
+	ReissueDeviceSecret(deviceId int, tokenHash string, secretHash string) error
+}
+
+// Store is every persistence operation of the server, it is implemented by Database (PostgreSQL) and MemoryStore.
+// Lookups of missing rows return sql.ErrNoRows in both implementations.
+type Store interface {
+	DeviceStore
+	DashboardStore
+	StateStore
+	SensorDataStore
+	CommandStore
+	RuleStore
+	ScheduleStore
+	AlertStore
+	WebhookStore
+	UserStore
+	ProvisioningStore
+	// PingContext checks that the store is reachable, it is the database check of /readyz
+	PingContext(ctx context.Context) error
+	Close() error
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,975 @@
+package db
+
+import (
+	"NSI-semester-work/internal/model"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// The contract of Store is run against MemoryStore and, when TEST_DATABASE_URL points to an empty TimescaleDB
+// database, against Database, so the demo mode and the tests using MemoryStore behave like production.
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestDatabase(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	database, err := NewDatabase(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Disconnect() })
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, func(t *testing.T) Store {
+		// every test starts from a freshly migrated schema
+		migrator := NewMigrator(database, io.Discard)
+		if err := migrator.Down(len(migrations)); err != nil {
+			t.Fatal(err)
+		}
+		if err := migrator.Up(0); err != nil {
+			t.Fatal(err)
+		}
+		return database
+	})
+}
+
+const (
+	storeUuid      = "123e4567-e89b-12d3-a456-426614174000"
+	otherStoreUuid = "9b2ef61e-0000-4000-8000-000000000001"
+	correlationId  = "5f0c6f4e-3a1b-4c2d-9e8f-000000000001"
+)
+
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := map[string]func(t *testing.T, store Store){
+		"devices":           testDevices,
+		"device secrets":    testDeviceSecrets,
+		"dashboards":        testDashboards,
+		"state":             testState,
+		"sensor data":       testSensorData,
+		"commands":          testCommands,
+		"rules":             testRules,
+		"schedules":         testSchedules,
+		"alerts":            testAlerts,
+		"webhooks":          testWebhooks,
+		"users":             testUsers,
+		"grants":            testGrants,
+		"delete cascades":   testDeleteDeviceCascades,
+		"missing rows":      testMissingRows,
+		"provisioning":      testProvisioning,
+		"template actions":  testTemplateActions,
+		"ping":              testPing,
+		"dashboard devices": testDashboardDeviceIds,
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+// registerDevice registers a light switch and returns its ID
+func registerDevice(t *testing.T, store Store, uuid string, name string) int {
+	t.Helper()
+	templateId, err := store.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RegisterDevice(&model.Device{UUID: uuid, Name: name, ActionsTemplateId: templateId}); err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := store.GetDeviceIDByUUID(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deviceId
+}
+
+func testDevices(t *testing.T, store Store) {
+	lampId := registerDevice(t, store, storeUuid, "Lamp")
+	heaterId := registerDevice(t, store, otherStoreUuid, "Heater")
+
+	// a second login keeps the device and its name
+	if again := registerDevice(t, store, storeUuid, "Renamed by the device"); again != lampId {
+		t.Errorf("the second login created device %d", again)
+	}
+	device, err := store.FetchDeviceWithActions(lampId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Lamp" || device.UUID != storeUuid || device.DeviceType != "light_switch" ||
+		device.CustomActions != "{}" || device.Provisioned {
+		t.Errorf("unexpected device %+v", device)
+	}
+	templateActions, _, err := device.ParseActions()
+	if err != nil || templateActions["Light_state"] != model.ActionTypeToggle {
+		t.Errorf("unexpected template actions %v, %v", templateActions, err)
+	}
+	if uuid, err := store.GetDeviceUUID(lampId); err != nil || uuid != storeUuid {
+		t.Errorf("GetDeviceUUID = %s, %v", uuid, err)
+	}
+
+	if err = store.RenameDevice(lampId, "Desk lamp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetDeviceRetired(heaterId, true); err != nil {
+		t.Fatal(err)
+	}
+	// retired devices can not be added to dashboards, the list is ordered by name
+	devices, err := store.FetchDeviceNamesAndIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].ID != lampId || devices[0].Name != "Desk lamp" {
+		t.Errorf("unexpected devices %+v", devices)
+	}
+	all, err := store.FetchDevicesWithActions()
+	if err != nil || len(all) != 2 || all[0].ID != lampId || !all[1].Retired {
+		t.Errorf("unexpected devices with actions %+v, %v", all, err)
+	}
+
+	lastSeen := time.Now().Truncate(time.Second)
+	if err = store.UpdateDeviceLastSeen(lampId, lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	if device, _ = store.FetchDeviceWithActions(lampId); !device.LastSeen.Equal(lastSeen) {
+		t.Errorf("last seen is %v, want %v", device.LastSeen, lastSeen)
+	}
+}
+
+func testDeviceSecrets(t *testing.T, store Store) {
+	deviceId, err := store.CreateDevice(storeUuid, "Lamp", "secret-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CreateDevice(storeUuid, "Again", "other-hash"); !errors.Is(err, ErrDeviceExists) {
+		t.Errorf("creating a device twice returned %v", err)
+	}
+	id, secretHash, tokenHash, err := store.FetchDeviceCredentials(storeUuid)
+	if err != nil || id != deviceId || secretHash != "secret-hash" || tokenHash != "" {
+		t.Errorf("FetchDeviceCredentials = %d, %s, %s, %v", id, secretHash, tokenHash, err)
+	}
+
+	// the device gets its template and custom actions on its first login
+	templateId, _ := store.FetchTemplateActions("light_switch")
+	if err = store.RegisterDevice(&model.Device{UUID: storeUuid, Name: "Ignored", ActionsTemplateId: templateId,
+		CustomActions: `{"Blink": "command"}`}); err != nil {
+		t.Fatal(err)
+	}
+	device, err := store.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "Lamp" || device.DeviceType != "light_switch" || !device.Provisioned {
+		t.Errorf("unexpected device %+v", device)
+	}
+	if _, customActions, _ := device.ParseActions(); customActions["Blink"] != model.ActionTypeCommand {
+		t.Errorf("unexpected custom actions %s", device.CustomActions)
+	}
+
+	if err = store.SetDeviceSecret(deviceId, "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if _, secretHash, _, _ = store.FetchDeviceCredentials(storeUuid); secretHash != "new-hash" {
+		t.Errorf("the secret hash is %s", secretHash)
+	}
+	if _, _, _, err = store.FetchDeviceCredentials(otherStoreUuid); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("credentials of an unknown device returned %v", err)
+	}
+}
+
+func testDashboards(t *testing.T, store Store) {
+	lampId := registerDevice(t, store, storeUuid, "Lamp")
+	heaterId := registerDevice(t, store, otherStoreUuid, "Heater")
+
+	kitchenId, err := store.CreateDashboard("Kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.CreateDashboard("Kitchen"); err == nil {
+		t.Error("a second dashboard with the same name was created")
+	}
+	atticId, err := store.CreateDashboard("Attic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dashboards without devices have no name in their contents, like the join
+	if devices, name, err := store.FetchDashboardContents(kitchenId); err != nil || len(devices) != 0 || name != "" {
+		t.Errorf("contents of an empty dashboard: %+v, %q, %v", devices, name, err)
+	}
+
+	shown := map[string]model.ShownAction{"Light_state": {Type: model.ActionTypeToggle}}
+	if err = store.InsertDevicesToDashboard(kitchenId, []model.DeviceInDashboard{
+		{Device: model.Device{ID: heaterId}, Position: 1},
+		{Device: model.Device{ID: lampId}, Position: 0, ShownActions: shown},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertDevicesToDashboard(kitchenId, []model.DeviceInDashboard{{Device: model.Device{ID: lampId}}}); err == nil {
+		t.Error("a device was added to a dashboard twice")
+	}
+
+	devices, name, err := store.FetchDashboardContents(kitchenId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "Kitchen" || len(devices) != 2 || devices[0].Device.ID != lampId || devices[0].Device.Name != "Lamp" ||
+		devices[0].ShownActions["Light_state"].Type != model.ActionTypeToggle || devices[1].Device.ID != heaterId {
+		t.Errorf("unexpected contents %q %+v", name, devices)
+	}
+
+	dashboards, err := store.FetchDashboards()
+	if err != nil || len(dashboards) != 2 || dashboards[0].Name != "Attic" || dashboards[1].DashboardId != kitchenId {
+		t.Errorf("unexpected dashboards %+v, %v", dashboards, err)
+	}
+
+	// updating replaces the name and every device
+	if err = store.UpdateDashboard(kitchenId, "Living room", []model.DeviceInDashboard{{Device: model.Device{ID: heaterId}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.UpdateDashboard(atticId, "Living room", nil); err == nil {
+		t.Error("a dashboard was renamed to the name of another one")
+	}
+	dashboard, err := store.FetchDashboard(kitchenId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dashboard.Name != "Living room" || len(dashboard.Devices) != 1 || dashboard.Devices[0].Device.ID != heaterId {
+		t.Errorf("unexpected dashboard %+v", dashboard)
+	}
+
+	if err = store.DeleteDashboard(kitchenId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.FetchDashboard(kitchenId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("fetching a deleted dashboard returned %v", err)
+	}
+}
+
+func testDashboardDeviceIds(t *testing.T, store Store) {
+	lampId := registerDevice(t, store, storeUuid, "Lamp")
+	dashboardId, err := store.CreateDashboard("Kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyId, err := store.CreateDashboard("Empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertDevicesToDashboard(dashboardId, []model.DeviceInDashboard{{Device: model.Device{ID: lampId}}}); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := store.FetchDashboardDeviceIds([]int{dashboardId, emptyId})
+	if err != nil || len(devices) != 1 || len(devices[dashboardId]) != 1 || devices[dashboardId][0] != lampId {
+		t.Errorf("FetchDashboardDeviceIds = %v, %v", devices, err)
+	}
+}
+
+func testState(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+
+	if states, err := store.GetDeviceStates(deviceId); err != nil || states != "{}" {
+		t.Errorf("the initial state is %s, %v", states, err)
+	}
+	if err := store.UpdateDeviceState(deviceId, map[string]interface{}{"Light_state": "on", "Interval_ms": 500}); err != nil {
+		t.Fatal(err)
+	}
+	// updates are merged into the stored state
+	if err := store.UpdateDeviceState(deviceId, map[string]interface{}{"Light_state": "off"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := store.GetDeviceState(deviceId, "Light_state"); err != nil || state != "off" {
+		t.Errorf("Light_state = %s, %v", state, err)
+	}
+	if state, err := store.GetDeviceState(deviceId, "Interval_ms"); err != nil || state != "500" {
+		t.Errorf("Interval_ms = %s, %v", state, err)
+	}
+	if _, err := store.GetDeviceState(deviceId, "Unknown"); err == nil {
+		t.Error("the state of an unknown action was returned")
+	}
+
+	states, err := store.GetDeviceStates(deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err = json.Unmarshal([]byte(states), &decoded); err != nil || decoded["Light_state"] != "off" ||
+		decoded["Interval_ms"] != float64(500) {
+		t.Errorf("unexpected states %s, %v", states, err)
+	}
+}
+
+func testSensorData(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Thermometer")
+
+	if _, err := store.GetLastSensorValue(deviceId, "Temperature"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the last value without readings returned %v", err)
+	}
+	first, err := store.InsertProvidedValue(deviceId, `{"Temperature": 21.5, "Humidity": 40}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second reading is the newest, it has no humidity
+	time.Sleep(10 * time.Millisecond)
+	if _, err = store.InsertProvidedValue(deviceId, `{"Temperature": "23"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertProvidedValue(deviceId, `not json`); err == nil {
+		t.Error("a reading that is not JSON was stored")
+	}
+
+	if value, err := store.GetLastSensorValue(deviceId, "Temperature"); err != nil || value != "23" {
+		t.Errorf("the last temperature is %s, %v", value, err)
+	}
+	// the last reading that has the action, not the last reading of the device
+	reading, err := store.GetLastSensorReading(deviceId, "Humidity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reading.Value) != "40" || !reading.Timestamp.Equal(first) {
+		t.Errorf("the last humidity is %s at %v, want 40 at %v", reading.Value, reading.Timestamp, first)
+	}
+
+	buckets, err := store.GetSensorHistory(deviceId, "Temperature", first.Add(-time.Hour), time.Now().Add(time.Hour), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, bucket := range buckets {
+		count += bucket.Count
+	}
+	if count != 2 {
+		t.Errorf("the history has %d readings in %+v", count, buckets)
+	}
+	if len(buckets) == 1 && (buckets[0].Min != 21.5 || buckets[0].Max != 23 || buckets[0].Avg != 22.25 || buckets[0].Last != 23) {
+		t.Errorf("unexpected bucket %+v", buckets[0])
+	}
+}
+
+func testCommands(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	command := &model.Command{CorrelationID: correlationId, DeviceID: deviceId, ActionName: "Light_state",
+		ActionType: model.ActionTypeToggle, Source: "web", Status: model.CommandPending}
+	if err := store.InsertCommand(command); err != nil {
+		t.Fatal(err)
+	}
+	if command.ID == 0 || command.CreatedAt.IsZero() {
+		t.Errorf("the command was not given an ID and creation time: %+v", command)
+	}
+	if err := store.InsertCommand(&model.Command{CorrelationID: correlationId, DeviceID: deviceId, ActionName: "Light_state",
+		ActionType: model.ActionTypeToggle, Source: "web", Status: model.CommandPending}); err == nil {
+		t.Error("a correlation ID was used twice")
+	}
+
+	if err := store.UpdateCommandStatus(correlationId, model.CommandDelivered, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateCommandStatus(correlationId, model.CommandFailed, "relay stuck"); err != nil {
+		t.Fatal(err)
+	}
+	// a late non-final status does not replace the final one
+	if err := store.UpdateCommandStatus(correlationId, model.CommandDelivered, ""); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("replacing a final status returned %v", err)
+	}
+
+	stored, err := store.FetchCommand(correlationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != model.CommandFailed || stored.Error != "relay stuck" || stored.CompletedAt == nil {
+		t.Errorf("unexpected command %+v", stored)
+	}
+	commands, err := store.FetchDeviceCommands(deviceId, 10)
+	if err != nil || len(commands) != 1 || commands[0].CorrelationID != correlationId {
+		t.Errorf("FetchDeviceCommands = %+v, %v", commands, err)
+	}
+	if _, err = store.FetchCommand("00000000-0000-4000-8000-000000000000"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("fetching an unknown command returned %v", err)
+	}
+}
+
+func testRules(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	condition := model.Condition{Any: []model.Condition{
+		{DeviceID: deviceId, ActionName: "Light_state", Operator: "==", Value: "on"},
+		{DeviceID: deviceId, ActionName: "Light_state", Operator: "==", Value: "off"},
+	}}
+	for _, name := range []string{"Second", "First"} {
+		rule := &model.Rule{Name: name, Enabled: true, Condition: condition,
+			Action: model.DeviceAction{DeviceID: deviceId, ActionName: "Light_state"}, CooldownSeconds: 60}
+		if err := store.InsertRule(rule); err != nil {
+			t.Fatal(err)
+		}
+		if rule.ID == 0 {
+			t.Error("the rule was not given an ID")
+		}
+	}
+
+	rules, err := store.FetchRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Name != "First" || len(rules[0].Condition.Any) != 2 ||
+		rules[0].Condition.Any[1].Value != "off" || rules[0].LastFired != nil {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+
+	firedAt := time.Now().Truncate(time.Second)
+	if err = store.RecordRuleFired(rules[0].ID, firedAt, "device offline"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetRuleEnabled(rules[0].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	rules, _ = store.FetchRules()
+	if rules[0].Enabled || rules[0].LastFired == nil || !rules[0].LastFired.Equal(firedAt) || rules[0].LastError != "device offline" {
+		t.Errorf("unexpected rule %+v", rules[0])
+	}
+
+	if err = store.DeleteRule(rules[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ = store.FetchRules(); len(rules) != 1 || rules[0].Name != "Second" {
+		t.Errorf("unexpected rules after deleting %+v", rules)
+	}
+}
+
+func testSchedules(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	schedule := &model.Schedule{Name: "Evening", Kind: model.ScheduleWeekly, TimeOfDay: "19:30",
+		Weekdays: []time.Weekday{time.Monday, time.Friday}, Timezone: "Europe/Prague",
+		Action: model.DeviceAction{DeviceID: deviceId, ActionName: "Light_state"}}
+	if err := store.InsertSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	schedules, err := store.FetchSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 1 || schedules[0].ID != schedule.ID || schedules[0].TimeOfDay != "19:30" ||
+		len(schedules[0].Weekdays) != 2 || schedules[0].Weekdays[1] != time.Friday || schedules[0].Timezone != "Europe/Prague" {
+		t.Fatalf("unexpected schedules %+v", schedules)
+	}
+	if err = store.SetSchedulePaused(schedule.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if schedules, _ = store.FetchSchedules(); !schedules[0].Paused {
+		t.Error("the schedule was not paused")
+	}
+
+	// the run follows the status of the command it issued
+	command := &model.Command{CorrelationID: correlationId, DeviceID: deviceId, ActionName: "Light_state",
+		ActionType: model.ActionTypeToggle, Source: "schedule", Status: model.CommandSucceeded}
+	if err = store.InsertCommand(command); err != nil {
+		t.Fatal(err)
+	}
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err = store.InsertScheduleRun(schedule.ID, earlier, "", "device offline"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertScheduleRun(schedule.ID, time.Now().Truncate(time.Second), correlationId, ""); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := store.FetchScheduleRuns(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].CommandStatus != model.CommandSucceeded || runs[0].ScheduleName != "Evening" ||
+		runs[1].Error != "device offline" || !runs[1].RanAt.Equal(earlier) {
+		t.Errorf("unexpected runs %+v", runs)
+	}
+	if runs, _ = store.FetchScheduleRuns(1); len(runs) != 1 {
+		t.Errorf("the limit returned %d runs", len(runs))
+	}
+
+	if err = store.DeleteSchedule(schedule.ID); err != nil {
+		t.Fatal(err)
+	}
+	if runs, _ = store.FetchScheduleRuns(10); len(runs) != 0 {
+		t.Errorf("the runs of a deleted schedule are kept: %+v", runs)
+	}
+}
+
+func testAlerts(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Thermometer")
+	definition := &model.AlertDefinition{Name: "Too hot", DeviceID: deviceId, ActionName: "Temperature",
+		Condition: model.AlertAbove, High: 30, ForSeconds: 60, Channels: []string{"in_app", "email"}, Enabled: true}
+	if err := store.InsertAlertDefinition(definition); err != nil {
+		t.Fatal(err)
+	}
+	definitions, err := store.FetchAlertDefinitions()
+	if err != nil || len(definitions) != 1 || definitions[0].High != 30 || len(definitions[0].Channels) != 2 {
+		t.Fatalf("unexpected definitions %+v, %v", definitions, err)
+	}
+	if err = store.SetAlertDefinitionEnabled(definition.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if definitions, _ = store.FetchAlertDefinitions(); definitions[0].Enabled {
+		t.Error("the definition was not disabled")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	alert := &model.Alert{DefinitionID: definition.ID, State: model.AlertActive, Value: 31, BreachedAt: now.Add(-time.Minute), FiredAt: now}
+	if err = store.InsertAlert(alert); err != nil {
+		t.Fatal(err)
+	}
+	// a definition has at most one active alert
+	if err = store.InsertAlert(&model.Alert{DefinitionID: definition.ID, State: model.AlertActive, Value: 32,
+		BreachedAt: now, FiredAt: now}); err == nil {
+		t.Error("a second active alert was stored")
+	}
+	if alerts, err := store.FetchAlerts(true, 10); err != nil || len(alerts) != 1 || alerts[0].ID != alert.ID {
+		t.Errorf("active alerts %+v, %v", alerts, err)
+	}
+
+	if err = store.ResolveAlert(alert.ID, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if alerts, _ := store.FetchAlerts(true, 10); len(alerts) != 0 {
+		t.Errorf("resolved alerts are active: %+v", alerts)
+	}
+	alerts, err := store.FetchAlerts(false, 10)
+	if err != nil || len(alerts) != 1 || alerts[0].State != model.AlertResolved || alerts[0].ResolvedAt == nil ||
+		!alerts[0].ResolvedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected alerts %+v, %v", alerts, err)
+	}
+
+	if err = store.DeleteAlertDefinition(definition.ID); err != nil {
+		t.Fatal(err)
+	}
+	if alerts, _ = store.FetchAlerts(false, 10); len(alerts) != 0 {
+		t.Errorf("the alerts of a deleted definition are kept: %+v", alerts)
+	}
+}
+
+func testWebhooks(t *testing.T, store Store) {
+	subscription := &model.WebhookSubscription{URL: "https://example.com/hook", Secret: "secret",
+		EventTypes: []model.WebhookEventType{model.WebhookDeviceLogin, model.WebhookCommandSent}, Enabled: true}
+	if err := store.InsertWebhookSubscription(subscription); err != nil {
+		t.Fatal(err)
+	}
+	subscriptions, err := store.FetchWebhookSubscriptions()
+	if err != nil || len(subscriptions) != 1 || subscriptions[0].Secret != "secret" ||
+		!subscriptions[0].Wants(model.WebhookCommandSent) || subscriptions[0].Wants(model.WebhookTelemetry) {
+		t.Fatalf("unexpected subscriptions %+v, %v", subscriptions, err)
+	}
+	if err = store.SetWebhookSubscriptionEnabled(subscription.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions, _ = store.FetchWebhookSubscriptions(); subscriptions[0].Enabled {
+		t.Error("the subscription was not disabled")
+	}
+
+	delivery := &model.WebhookDelivery{SubscriptionID: subscription.ID, EventType: model.WebhookDeviceLogin,
+		Payload: `{"uuid": "x"}`, Status: model.DeliveryPending}
+	if err = store.InsertWebhookDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.ID == 0 || delivery.CreatedAt.IsZero() {
+		t.Errorf("the delivery was not given an ID and creation time: %+v", delivery)
+	}
+	if pending, err := store.FetchWebhookDeliveries(true, 10); err != nil || len(pending) != 1 || pending[0].Attempts != 0 {
+		t.Errorf("pending deliveries %+v, %v", pending, err)
+	}
+
+	attemptAt := time.Now().Truncate(time.Second)
+	delivery.Status = model.DeliverySucceeded
+	delivery.Attempts = 2
+	delivery.ResponseStatus = 204
+	delivery.LastAttemptAt = &attemptAt
+	if err = store.UpdateWebhookDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.FetchWebhookDeliveries(true, 10); len(pending) != 0 {
+		t.Errorf("succeeded deliveries are pending: %+v", pending)
+	}
+	deliveries, err := store.FetchWebhookDeliveries(false, 10)
+	if err != nil || len(deliveries) != 1 || deliveries[0].Attempts != 2 || deliveries[0].ResponseStatus != 204 ||
+		deliveries[0].LastAttemptAt == nil || !deliveries[0].LastAttemptAt.Equal(attemptAt) {
+		t.Errorf("unexpected deliveries %+v, %v", deliveries, err)
+	}
+
+	// only finished deliveries older than the cut-off are pruned
+	pending := &model.WebhookDelivery{SubscriptionID: subscription.ID, EventType: model.WebhookCommandSent,
+		Payload: `{}`, Status: model.DeliveryPending}
+	if err = store.InsertWebhookDelivery(pending); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := store.DeleteFinishedWebhookDeliveries(delivery.CreatedAt.Add(-time.Hour)); err != nil || deleted != 0 {
+		t.Errorf("deleting deliveries older than an hour deleted %d, %v", deleted, err)
+	}
+	if deleted, err := store.DeleteFinishedWebhookDeliveries(time.Now().Add(time.Hour)); err != nil || deleted != 1 {
+		t.Errorf("deleting finished deliveries deleted %d, %v", deleted, err)
+	}
+	if deliveries, _ = store.FetchWebhookDeliveries(false, 10); len(deliveries) != 1 || deliveries[0].ID != pending.ID {
+		t.Errorf("unexpected deliveries after pruning %+v", deliveries)
+	}
+
+	if err = store.DeleteWebhookSubscription(subscription.ID); err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, _ = store.FetchWebhookDeliveries(false, 10); len(deliveries) != 0 {
+		t.Errorf("the deliveries of a deleted subscription are kept: %+v", deliveries)
+	}
+}
+
+func testUsers(t *testing.T, store Store) {
+	admin := &model.User{Username: "admin", PasswordHash: "hash", Role: model.RoleViewer}
+	if err := store.InsertFirstUser(admin); err != nil {
+		t.Fatal(err)
+	}
+	if admin.ID == 0 || admin.Role != model.RoleAdmin {
+		t.Errorf("the first user is %+v", admin)
+	}
+	if err := store.InsertFirstUser(&model.User{Username: "second", PasswordHash: "hash"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("a second first user returned %v", err)
+	}
+	viewer := &model.User{Username: "viewer", PasswordHash: "hash", Role: model.RoleViewer}
+	if err := store.InsertUser(viewer); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertUser(&model.User{Username: "viewer", PasswordHash: "hash", Role: model.RoleViewer}); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("a taken username returned %v", err)
+	}
+	if count, err := store.CountUsers(); err != nil || count != 2 {
+		t.Errorf("CountUsers = %d, %v", count, err)
+	}
+
+	if err := store.SetUserRole(viewer.ID, model.RoleOperator); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateUserPassword(viewer.ID, "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := store.FetchUserByUsername("viewer"); err != nil || user.Role != model.RoleOperator || user.PasswordHash != "new-hash" {
+		t.Errorf("FetchUserByUsername = %+v, %v", user, err)
+	}
+	if users, err := store.FetchUsers(); err != nil || len(users) != 2 || users[0].Username != "admin" {
+		t.Errorf("FetchUsers = %+v, %v", users, err)
+	}
+
+	// expired sessions do not log anybody in and are cleaned up
+	if err := store.InsertSession("current", viewer.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertSession("other", viewer.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertSession("expired", viewer.ID, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := store.FetchSessionUser("current"); err != nil || user.ID != viewer.ID {
+		t.Errorf("FetchSessionUser = %+v, %v", user, err)
+	}
+	if _, err := store.FetchSessionUser("expired"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("an expired session returned %v", err)
+	}
+	if err := store.DeleteOtherSessions(viewer.ID, "current"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FetchSessionUser("other"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("another session survived DeleteOtherSessions: %v", err)
+	}
+	if err := store.DeleteExpiredSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteSession("current"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FetchSessionUser("current"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("a deleted session returned %v", err)
+	}
+
+	if err := store.InsertSession("last", viewer.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteUser(viewer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FetchSessionUser("last"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the session of a deleted user returned %v", err)
+	}
+	if _, err := store.FetchUser(viewer.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("a deleted user returned %v", err)
+	}
+}
+
+func testGrants(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	dashboardId, err := store.CreateDashboard("Kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Username: "viewer", PasswordHash: "hash", Role: model.RoleViewer}
+	if err = store.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := [][]model.Grant{
+		{{DashboardID: dashboardId, DeviceID: deviceId, Access: model.AccessView}},
+		{{Access: model.AccessView}},
+		{{DeviceID: deviceId, Access: "everything"}},
+		{{DeviceID: deviceId, Access: model.AccessView}, {DeviceID: deviceId, Access: model.AccessControl}},
+	}
+	for _, grants := range invalid {
+		if err = store.ReplaceGrants(user.ID, grants); err == nil {
+			t.Errorf("the grants %+v were stored", grants)
+		}
+	}
+
+	if err = store.ReplaceGrants(user.ID, []model.Grant{
+		{DashboardID: dashboardId, Access: model.AccessView},
+		{DeviceID: deviceId, Access: model.AccessControl},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	grants, err := store.FetchGrants(user.ID)
+	if err != nil || len(grants) != 2 {
+		t.Fatalf("FetchGrants = %+v, %v", grants, err)
+	}
+	for _, grant := range grants {
+		if grant.UserID != user.ID {
+			t.Errorf("unexpected grant %+v", grant)
+		}
+	}
+
+	// deleting the dashboard deletes its grant
+	if err = store.DeleteDashboard(dashboardId); err != nil {
+		t.Fatal(err)
+	}
+	if grants, _ = store.FetchGrants(user.ID); len(grants) != 1 || grants[0].DeviceID != deviceId || grants[0].Access != model.AccessControl {
+		t.Errorf("unexpected grants after deleting the dashboard %+v", grants)
+	}
+}
+
+func testDeleteDeviceCascades(t *testing.T, store Store) {
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	otherId := registerDevice(t, store, otherStoreUuid, "Heater")
+	dashboardId, err := store.CreateDashboard("Kitchen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertDevicesToDashboard(dashboardId, []model.DeviceInDashboard{
+		{Device: model.Device{ID: deviceId}}, {Device: model.Device{ID: otherId}, Position: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.InsertProvidedValue(deviceId, `{"Temperature": 20}`); err != nil {
+		t.Fatal(err)
+	}
+	action := model.DeviceAction{DeviceID: deviceId, ActionName: "Light_state"}
+	if err = store.InsertCommand(&model.Command{CorrelationID: correlationId, DeviceID: deviceId, ActionName: "Light_state",
+		ActionType: model.ActionTypeToggle, Source: "web", Status: model.CommandPending}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertRule(&model.Rule{Name: "Rule", Enabled: true, Action: action,
+		Condition: model.Condition{DeviceID: otherId, ActionName: "Light_state", Operator: "==", Value: "on"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertSchedule(&model.Schedule{Name: "Schedule", Kind: model.ScheduleDaily, TimeOfDay: "08:00",
+		Timezone: "UTC", Action: action}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertAlertDefinition(&model.AlertDefinition{Name: "Alert", DeviceID: deviceId, ActionName: "Temperature",
+		Condition: model.AlertAbove, High: 30, Channels: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.DeleteDevice(deviceId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.FetchDeviceWithActions(deviceId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("fetching the deleted device returned %v", err)
+	}
+	if _, err = store.GetLastSensorValue(deviceId, "Temperature"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the telemetry of the deleted device is kept: %v", err)
+	}
+	if _, err = store.FetchCommand(correlationId); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the commands of the deleted device are kept: %v", err)
+	}
+	if rules, _ := store.FetchRules(); len(rules) != 0 {
+		t.Errorf("the rules of the deleted device are kept: %+v", rules)
+	}
+	if schedules, _ := store.FetchSchedules(); len(schedules) != 0 {
+		t.Errorf("the schedules of the deleted device are kept: %+v", schedules)
+	}
+	if definitions, _ := store.FetchAlertDefinitions(); len(definitions) != 0 {
+		t.Errorf("the alert definitions of the deleted device are kept: %+v", definitions)
+	}
+	if dashboard, err := store.FetchDashboard(dashboardId); err != nil || len(dashboard.Devices) != 1 || dashboard.Devices[0].Device.ID != otherId {
+		t.Errorf("the dashboard after deleting a device: %+v, %v", dashboard, err)
+	}
+}
+
+// testMissingRows checks that updates and deletes of rows that do not exist return sql.ErrNoRows
+func testMissingRows(t *testing.T, store Store) {
+	const missing = 4242
+	updates := map[string]func() error{
+		"SetDeviceSecret":               func() error { return store.SetDeviceSecret(missing, "hash") },
+		"ConfirmDeviceSecret":           func() error { return store.ConfirmDeviceSecret(missing) },
+		"RenameDevice":                  func() error { return store.RenameDevice(missing, "name") },
+		"SetDeviceRetired":              func() error { return store.SetDeviceRetired(missing, true) },
+		"DeleteDevice":                  func() error { return store.DeleteDevice(missing) },
+		"UpdateDashboard":               func() error { return store.UpdateDashboard(missing, "name", nil) },
+		"DeleteDashboard":               func() error { return store.DeleteDashboard(missing) },
+		"UpdateCommandStatus":           func() error { return store.UpdateCommandStatus(correlationId, model.CommandSucceeded, "") },
+		"SetRuleEnabled":                func() error { return store.SetRuleEnabled(missing, true) },
+		"DeleteRule":                    func() error { return store.DeleteRule(missing) },
+		"SetSchedulePaused":             func() error { return store.SetSchedulePaused(missing, true) },
+		"DeleteSchedule":                func() error { return store.DeleteSchedule(missing) },
+		"SetAlertDefinitionEnabled":     func() error { return store.SetAlertDefinitionEnabled(missing, true) },
+		"DeleteAlertDefinition":         func() error { return store.DeleteAlertDefinition(missing) },
+		"SetWebhookSubscriptionEnabled": func() error { return store.SetWebhookSubscriptionEnabled(missing, true) },
+		"DeleteWebhookSubscription":     func() error { return store.DeleteWebhookSubscription(missing) },
+		"SetUserRole":                   func() error { return store.SetUserRole(missing, model.RoleAdmin) },
+		"UpdateUserPassword":            func() error { return store.UpdateUserPassword(missing, "hash") },
+		"DeleteUser":                    func() error { return store.DeleteUser(missing) },
+		"DeleteProvisioningToken":       func() error { return store.DeleteProvisioningToken(missing) },
+	}
+	for name, update := range updates {
+		if err := update(); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s returned %v", name, err)
+		}
+	}
+
+	lookups := map[string]func() error{
+		"FetchDeviceWithActions": func() error { _, err := store.FetchDeviceWithActions(missing); return err },
+		"GetDeviceIDByUUID":      func() error { _, err := store.GetDeviceIDByUUID(storeUuid); return err },
+		"GetDeviceUUID":          func() error { _, err := store.GetDeviceUUID(missing); return err },
+		"GetDeviceStates":        func() error { _, err := store.GetDeviceStates(missing); return err },
+		"FetchDashboard":         func() error { _, err := store.FetchDashboard(missing); return err },
+		"FetchUser":              func() error { _, err := store.FetchUser(missing); return err },
+		"FetchUserByUsername":    func() error { _, err := store.FetchUserByUsername("nobody"); return err },
+		"FetchProvisioningToken": func() error { _, err := store.FetchProvisioningToken("hash"); return err },
+		"FetchTemplateActions":   func() error { _, err := store.FetchTemplateActions("toaster"); return err },
+	}
+	for name, lookup := range lookups {
+		if err := lookup(); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s returned %v", name, err)
+		}
+	}
+}
+
+func testProvisioning(t *testing.T, store Store) {
+	expired := time.Now().Add(-time.Hour)
+	if err := store.InsertProvisioningToken("expired-hash", &model.ProvisioningToken{Label: "old", UsesLeft: 5, ExpiresAt: &expired}); err != nil {
+		t.Fatal(err)
+	}
+	token := &model.ProvisioningToken{Label: "batch", UsesLeft: 1}
+	if err := store.InsertProvisioningToken("token-hash", token); err != nil {
+		t.Fatal(err)
+	}
+	if token.ID == 0 {
+		t.Error("the token was not given an ID")
+	}
+	if err := store.InsertProvisioningToken("token-hash", &model.ProvisioningToken{UsesLeft: 1}); err == nil {
+		t.Error("a token hash was stored twice")
+	}
+	if err := store.InsertProvisioningToken("negative-hash", &model.ProvisioningToken{UsesLeft: -1}); err == nil {
+		t.Error("a token with negative uses was stored")
+	}
+	if tokens, err := store.FetchProvisioningTokens(); err != nil || len(tokens) != 2 {
+		t.Errorf("FetchProvisioningTokens = %+v, %v", tokens, err)
+	}
+
+	// the lamp was added by an admin, provisioning it must not register it again
+	deviceId := registerDevice(t, store, storeUuid, "Lamp")
+	templateId, err := store.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lamp := &model.Device{UUID: storeUuid, Name: "Lamp", ActionsTemplateId: templateId}
+	if err = store.ProvisionDevice(lamp, "expired-hash", "secret-hash"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("provisioning with an expired token returned %v", err)
+	}
+	if err = store.ProvisionDevice(lamp, "token-hash", "secret-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if lamp.ID != deviceId {
+		t.Errorf("the provisioned lamp has ID %d, want %d", lamp.ID, deviceId)
+	}
+	_, secretHash, tokenHash, err := store.FetchDeviceCredentials(storeUuid)
+	if err != nil || secretHash != "secret-hash" || tokenHash != "token-hash" {
+		t.Errorf("the credentials after provisioning are %s, %s, %v", secretHash, tokenHash, err)
+	}
+	if stored, _ := store.FetchProvisioningToken("token-hash"); stored.UsesLeft != 0 || stored.Usable(time.Now()) {
+		t.Errorf("the token was not used up: %+v", stored)
+	}
+	// the token is used up, the heater is not registered without a secret
+	heater := &model.Device{UUID: otherStoreUuid, Name: "Heater", ActionsTemplateId: templateId}
+	if err = store.ProvisionDevice(heater, "token-hash", "other-secret"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("provisioning with a used up token returned %v", err)
+	}
+	if _, err = store.GetDeviceIDByUUID(otherStoreUuid); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("the device was registered without its secret: %v", err)
+	}
+	// unknown devices are registered together with their secret
+	if err = store.InsertProvisioningToken("heater-hash", &model.ProvisioningToken{Label: "heater", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.ProvisionDevice(heater, "heater-hash", "other-secret"); err != nil {
+		t.Fatal(err)
+	}
+	otherId, secretHash, _, err := store.FetchDeviceCredentials(otherStoreUuid)
+	if err != nil || otherId == 0 || otherId != heater.ID || secretHash != "other-secret" {
+		t.Errorf("the provisioned heater is %d with %s, %v, want ID %d", otherId, secretHash, err, heater.ID)
+	}
+
+	// an unconfirmed secret can be issued again for the same token only
+	if err = store.ReissueDeviceSecret(deviceId, "expired-hash", "other-secret"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("reissuing with another token returned %v", err)
+	}
+	if err = store.ReissueDeviceSecret(deviceId, "token-hash", "second-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.ConfirmDeviceSecret(deviceId); err != nil {
+		t.Fatal(err)
+	}
+	_, secretHash, tokenHash, _ = store.FetchDeviceCredentials(storeUuid)
+	if secretHash != "second-secret" || tokenHash != "" {
+		t.Errorf("the credentials after confirming are %s, %s", secretHash, tokenHash)
+	}
+	if err = store.ReissueDeviceSecret(deviceId, "token-hash", "third-secret"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("reissuing a confirmed secret returned %v", err)
+	}
+
+	if err = store.DeleteProvisioningToken(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.FetchProvisioningToken("token-hash"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("fetching a deleted token returned %v", err)
+	}
+}
+
+func testTemplateActions(t *testing.T, store Store) {
+	for _, template := range ActionTemplates {
+		templateId, err := store.FetchTemplateActions(template.DeviceType)
+		if err != nil || templateId <= 0 {
+			t.Errorf("the template of %s is %d, %v", template.DeviceType, templateId, err)
+		}
+	}
+}
+
+func testPing(t *testing.T, store Store) {
+	if err := store.PingContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
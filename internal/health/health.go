@@ -0,0 +1,134 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds every check, a dependency that does not answer in time is reported as failing
+const DefaultTimeout = 2 * time.Second
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports whether a dependency works, it returns nil when it does and should give up once ctx is done
+type Check func(ctx context.Context) error
+
+type CheckResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Report is the body of /readyz, Status is ok only when every check passed
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the readiness checks of the server's dependencies
+type Checker struct {
+	mu      sync.Mutex
+	checks  []namedCheck
+	timeout time.Duration
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check, its name is the key of its result in the report
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Run runs every check concurrently, so a hanging dependency delays the report by the timeout at most
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := c.checks
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, named := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- check(ctx) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			results[i] = CheckResult{Status: StatusOK, DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				results[i].Status, results[i].Error = StatusFail, err.Error()
+			}
+		}(i, named.check)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, named := range checks {
+		report.Checks[named.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func writeReport(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("failed to write health report", "error", err)
+	}
+}
+
+// LiveHandler answers 200 OK as long as the process serves HTTP, it checks no dependency so an orchestrator does not
+// restart the server because of an outage of the database or the broker
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// ReadyHandler answers 200 OK when every check passed and 503 Service Unavailable otherwise, the body lists the result
+// of every check
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+		var failed []string
+		for name, result := range report.Checks {
+			if result.Status != StatusOK {
+				failed = append(failed, name+": "+result.Error)
+			}
+		}
+		sort.Strings(failed)
+		slog.Warn("readiness check failed", "failed", failed)
+	}
+	writeReport(w, status, report)
+}
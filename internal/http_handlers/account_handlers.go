@@ -0,0 +1,334 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// renderStandalone renders the login and setup pages, which are full pages shown without the sidebar
+func renderStandalone(w http.ResponseWriter, r *http.Request, status int, name string, data map[string]interface{}) {
+	t, err := template.ParseFiles("ui/html/" + name)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load template", "template", name, "error", err)
+		http.Error(w, "Failed to load the template", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err = t.Execute(w, data); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+	}
+}
+
+// hasUsers tells whether the first-run setup already happened
+func hasUsers(w http.ResponseWriter, r *http.Request, database db.Store) (bool, bool) {
+	count, err := database.CountUsers()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to count users", "error", err)
+		http.Error(w, "Failed to count users", http.StatusInternalServerError)
+		return false, false
+	}
+	return count > 0, true
+}
+
+func LoginPageHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	exists, ok := hasUsers(w, r, database)
+	if !ok {
+		return
+	}
+	if !exists {
+		http.Redirect(w, r, auth.SetupPath, http.StatusSeeOther)
+		return
+	}
+	renderStandalone(w, r, http.StatusOK, "login.gohtml", nil)
+}
+
+func LoginHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(r.PostFormValue("username"))
+
+	user, err := database.FetchUserByUsername(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logging.FromContext(r.Context()).Error("failed to fetch user", "error", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if !auth.CheckPassword(user, r.PostFormValue("password")) {
+		renderStandalone(w, r, http.StatusUnauthorized, "login.gohtml", map[string]interface{}{
+			"Error":    "Wrong username or password",
+			"Username": username,
+		})
+		return
+	}
+
+	if err = auth.Login(w, r, database, user); err != nil {
+		logging.FromContext(r.Context()).Error("failed to log in", "username", user.Username, "error", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	if err := auth.Logout(w, r, database); err != nil {
+		logging.FromContext(r.Context()).Error("failed to log out", "error", err)
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", auth.LoginPath)
+		return
+	}
+	http.Redirect(w, r, auth.LoginPath, http.StatusSeeOther)
+}
+
+func SetupPageHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	exists, ok := hasUsers(w, r, database)
+	if !ok {
+		return
+	}
+	if exists {
+		http.Redirect(w, r, auth.LoginPath, http.StatusSeeOther)
+		return
+	}
+	renderStandalone(w, r, http.StatusOK, "setup.gohtml", nil)
+}
+
+// parseNewUser reads the username and the confirmed password of the setup and user forms, the returned error is meant
+// to be shown to the user
+func parseNewUser(r *http.Request) (*model.User, error) {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	password := r.PostFormValue("password")
+	if err := auth.ValidatePassword(password); err != nil {
+		return nil, err
+	}
+	if password != r.PostFormValue("passwordConfirmation") {
+		return nil, errors.New("the passwords do not match")
+	}
+	role := model.RoleViewer
+	if r.PostFormValue("role") != "" {
+		role = model.Role(r.PostFormValue("role"))
+	}
+	if !role.Valid() {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return &model.User{Username: username, PasswordHash: hash, Role: role}, nil
+}
+
+// SetupHandler creates the first account and logs it in, it is only available while there are no users
+func SetupHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	user, err := parseNewUser(r)
+	if err != nil {
+		renderStandalone(w, r, http.StatusBadRequest, "setup.gohtml", map[string]interface{}{
+			"Error":    err.Error(),
+			"Username": r.PostFormValue("username"),
+		})
+		return
+	}
+	if err = database.InsertFirstUser(user); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Redirect(w, r, auth.LoginPath, http.StatusSeeOther)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to create the account", "error", err)
+		http.Error(w, "Failed to create the account", http.StatusInternalServerError)
+		return
+	}
+
+	if err = auth.Login(w, r, database, user); err != nil {
+		logging.FromContext(r.Context()).Error("failed to log in", "username", user.Username, "error", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func renderAccount(w http.ResponseWriter, r *http.Request, formError string, message string) {
+	t, err := template.ParseFiles("ui/html/account.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load account template", "error", err)
+		http.Error(w, "Failed to load the account template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.Execute(w, map[string]interface{}{
+		"User":              auth.UserFromContext(r.Context()),
+		"MinPasswordLength": auth.MinPasswordLength,
+		"FormError":         formError,
+		"Message":           message,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func AccountHandler(w http.ResponseWriter, r *http.Request) {
+	renderAccount(w, r, "", "")
+}
+
+// ChangePasswordHandler changes the password of the logged-in user, who stays logged in only in this browser
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	user := auth.UserFromContext(r.Context())
+
+	if !auth.CheckPassword(user, r.PostFormValue("currentPassword")) {
+		renderAccount(w, r, "The current password is wrong", "")
+		return
+	}
+	password := r.PostFormValue("password")
+	if err := auth.ValidatePassword(password); err != nil {
+		renderAccount(w, r, err.Error(), "")
+		return
+	}
+	if password != r.PostFormValue("passwordConfirmation") {
+		renderAccount(w, r, "the passwords do not match", "")
+		return
+	}
+
+	if err := auth.ChangePassword(r, database, user, password); err != nil {
+		logging.FromContext(r.Context()).Error("failed to change password", "username", user.Username, "error", err)
+		http.Error(w, "Failed to change the password", http.StatusInternalServerError)
+		return
+	}
+	renderAccount(w, r, "", "Password changed, other sessions were logged out.")
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, database db.Store, templateName string, formError string) {
+	users, err := database.FetchUsers()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch users", "error", err)
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+
+	t, err := template.ParseFiles("ui/html/users.gohtml", "ui/html/user_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load users template", "error", err)
+		http.Error(w, "Failed to load the users template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Users":             users,
+		"Roles":             model.Roles,
+		"CurrentUser":       auth.UserFromContext(r.Context()),
+		"MinPasswordLength": auth.MinPasswordLength,
+		"FormError":         formError,
+		"Username":          r.PostFormValue("username"),
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func UsersHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	renderUsers(w, r, database, "users.gohtml", "")
+}
+
+func CreateUserHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	user, err := parseNewUser(r)
+	if err != nil {
+		renderUsers(w, r, database, "users.gohtml", err.Error())
+		return
+	}
+	if err = database.InsertUser(user); err != nil {
+		if errors.Is(err, db.ErrUsernameTaken) {
+			renderUsers(w, r, database, "users.gohtml", err.Error())
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to create user", "error", err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	r.PostForm.Del("username")
+	renderUsers(w, r, database, "users.gohtml", "")
+}
+
+// otherUserIdFromPath rejects changes of the logged-in user's own account, so there is always an admin left
+func otherUserIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userId, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if userId == auth.UserFromContext(r.Context()).ID {
+		http.Error(w, "You can not change your own account here", http.StatusConflict)
+		return 0, false
+	}
+	return userId, true
+}
+
+func writeUserError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
+func SetUserRoleHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	userId, ok := otherUserIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	role := model.Role(r.PostFormValue("role"))
+	if !role.Valid() {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.SetUserRole(userId, role); err != nil {
+		writeUserError(w, r, err, "Failed to change role")
+		return
+	}
+	renderUsers(w, r, database, "user_list.gohtml", "")
+}
+
+// DeleteUserHandler deletes another user, users can not delete themselves so there is always one account left
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	userId, ok := otherUserIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteUser(userId); err != nil {
+		writeUserError(w, r, err, "Failed to delete user")
+		return
+	}
+	renderUsers(w, r, database, "user_list.gohtml", "")
+}
@@ -0,0 +1,107 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// actionTarget is a device action offered in the forms of rules, schedules and alerts, Key is the value of the select
+type actionTarget struct {
+	Key        string
+	DeviceName string
+	ActionName string
+	ActionType model.ActionType
+}
+
+// fetchActionTargets lists the toggle, number_input and command actions of all active devices
+func fetchActionTargets(devices []model.Device) []actionTarget {
+	return collectActionTargets(devices, func(actionType model.ActionType) bool {
+		return actionType != model.ActionTypeProvideValue
+	})
+}
+
+// fetchValueTargets lists the provide_value actions of all active devices
+func fetchValueTargets(devices []model.Device) []actionTarget {
+	return collectActionTargets(devices, func(actionType model.ActionType) bool {
+		return actionType == model.ActionTypeProvideValue
+	})
+}
+
+func collectActionTargets(devices []model.Device, wanted func(actionType model.ActionType) bool) []actionTarget {
+	targets := make([]actionTarget, 0)
+	for _, device := range devices {
+		if device.Retired {
+			continue
+		}
+		templateActions, customActions, err := device.ParseActions()
+		if err != nil {
+			slog.Error("error parsing actions", logging.DeviceID(device.ID), "error", err)
+			continue
+		}
+		for _, actions := range []map[string]model.ActionType{templateActions, customActions} {
+			for actionName, actionType := range actions {
+				if !wanted(actionType) {
+					continue
+				}
+				targets = append(targets, actionTarget{
+					Key:        fmt.Sprintf("%d:%s", device.ID, actionName),
+					DeviceName: device.Name,
+					ActionName: actionName,
+					ActionType: actionType,
+				})
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Key < targets[j].Key })
+	return targets
+}
+
+// describeAction formats the action for people, deviceNames maps device IDs to names
+func describeAction(action model.DeviceAction, deviceNames map[int]string) string {
+	description := fmt.Sprintf("%s.%s", deviceNames[action.DeviceID], action.ActionName)
+	if action.Value != "" {
+		description += " = " + action.Value
+	}
+	return description
+}
+
+// parseActionForm reads the action select and the actionValue input, the returned error is meant to be shown to the user
+func parseActionForm(r *http.Request, database db.Store) (*model.DeviceAction, error) {
+	deviceIdStr, actionName, ok := strings.Cut(r.FormValue("action"), ":")
+	deviceId, err := strconv.Atoi(deviceIdStr)
+	if !ok || err != nil {
+		return nil, errors.New("choose the action to issue")
+	}
+	device, err := database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("the device of the action does not exist")
+		}
+		return nil, err
+	}
+	actionType, ok, err := device.ActionType(actionName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || actionType == model.ActionTypeProvideValue {
+		return nil, fmt.Errorf("%s can not be issued on %s", actionName, device.Name)
+	}
+
+	action := model.DeviceAction{DeviceID: deviceId, ActionName: actionName}
+	if actionType == model.ActionTypeNumberInput {
+		action.Value = strings.TrimSpace(r.FormValue("actionValue"))
+		if _, err = strconv.ParseFloat(action.Value, 64); err != nil {
+			return nil, errors.New("number_input actions need a numeric value")
+		}
+	}
+	return &action, nil
+}
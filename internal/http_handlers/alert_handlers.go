@@ -0,0 +1,235 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/alerts"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const alertHistoryLimit = 50
+
+type alertDefinitionRow struct {
+	Definition model.AlertDefinition
+	DeviceName string
+}
+
+type alertRow struct {
+	Alert          model.Alert
+	DefinitionName string
+	DeviceName     string
+}
+
+// renderAlerts renders the alerts page or only the alert list, form holds the values of a rejected form
+func renderAlerts(w http.ResponseWriter, r *http.Request, database db.Store, manager *alerts.Manager, templateName string, formError string, form url.Values) {
+	definitions, err := database.FetchAlertDefinitions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch alert definitions", "error", err)
+		http.Error(w, "Failed to fetch alert definitions", http.StatusInternalServerError)
+		return
+	}
+	recentAlerts, err := database.FetchAlerts(false, alertHistoryLimit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch alerts", "error", err)
+		http.Error(w, "Failed to fetch alerts", http.StatusInternalServerError)
+		return
+	}
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	deviceNames := make(map[int]string, len(devices))
+	for _, device := range devices {
+		deviceNames[device.ID] = device.Name
+	}
+	definitionRows := make([]alertDefinitionRow, len(definitions))
+	definitionsById := make(map[int]model.AlertDefinition, len(definitions))
+	for i, definition := range definitions {
+		definitionRows[i] = alertDefinitionRow{Definition: definition, DeviceName: deviceNames[definition.DeviceID]}
+		definitionsById[definition.ID] = definition
+	}
+	alertRows := make([]alertRow, len(recentAlerts))
+	for i, alert := range recentAlerts {
+		definition := definitionsById[alert.DefinitionID]
+		alertRows[i] = alertRow{Alert: alert, DefinitionName: definition.Name, DeviceName: deviceNames[definition.DeviceID]}
+	}
+
+	t, err := template.ParseFiles("ui/html/alerts.gohtml", "ui/html/alert_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load alerts template", "error", err)
+		http.Error(w, "Failed to load the alerts template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Definitions": definitionRows,
+		"Alerts":      alertRows,
+		"Targets":     fetchValueTargets(devices),
+		"Channels":    manager.Channels(),
+		"FormError":   formError,
+		"Form":        form,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func alertDefinitionIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("definition_id"))
+	if err != nil {
+		http.Error(w, "Invalid alert definition ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// reloadAlerts applies definition changes to the running alert manager, the change itself is already stored
+func reloadAlerts(r *http.Request, manager *alerts.Manager) {
+	if err := manager.Reload(); err != nil {
+		logging.FromContext(r.Context()).Error("failed to reload alert definitions", "error", err)
+	}
+}
+
+func AlertsHandler(w http.ResponseWriter, r *http.Request, database db.Store, manager *alerts.Manager) {
+	renderAlerts(w, r, database, manager, "alerts.gohtml", "", nil)
+}
+
+func parseBound(r *http.Request, name string) (float64, error) {
+	value := strings.TrimSpace(r.FormValue(name))
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// parseAlertDefinitionForm builds a definition from the alert form, the returned error is meant to be shown to the user
+func parseAlertDefinitionForm(r *http.Request, database db.Store, manager *alerts.Manager) (*model.AlertDefinition, error) {
+	definition := model.AlertDefinition{
+		Name:      strings.TrimSpace(r.FormValue("alertName")),
+		Condition: model.AlertCondition(r.FormValue("condition")),
+		Enabled:   true,
+	}
+	if definition.Name == "" {
+		return nil, errors.New("alert name is required")
+	}
+
+	deviceIdStr, actionName, ok := strings.Cut(r.FormValue("action"), ":")
+	deviceId, err := strconv.Atoi(deviceIdStr)
+	if !ok || err != nil {
+		return nil, errors.New("choose the value to watch")
+	}
+	device, err := database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("the device does not exist")
+		}
+		return nil, err
+	}
+	if actionType, ok, err := device.ActionType(actionName); err != nil || !ok || actionType != model.ActionTypeProvideValue {
+		return nil, fmt.Errorf("%s is not a provide_value action of %s", actionName, device.Name)
+	}
+	definition.DeviceID, definition.ActionName = deviceId, actionName
+
+	if definition.Low, err = parseBound(r, "low"); err != nil {
+		return nil, errors.New("the low bound has to be a number")
+	}
+	if definition.High, err = parseBound(r, "high"); err != nil {
+		return nil, errors.New("the high bound has to be a number")
+	}
+	if forSeconds := strings.TrimSpace(r.FormValue("forSeconds")); forSeconds != "" {
+		if definition.ForSeconds, err = strconv.Atoi(forSeconds); err != nil {
+			return nil, errors.New("duration has to be a whole number of seconds")
+		}
+	}
+	if err = definition.Validate(); err != nil {
+		return nil, err
+	}
+
+	available := make(map[string]bool)
+	for _, channel := range manager.Channels() {
+		available[channel] = true
+	}
+	for _, channel := range r.Form["channels"] {
+		if !available[channel] {
+			return nil, fmt.Errorf("notification channel %s is not configured", channel)
+		}
+		definition.Channels = append(definition.Channels, channel)
+	}
+	if len(definition.Channels) == 0 {
+		return nil, errors.New("choose at least one notification channel")
+	}
+	return &definition, nil
+}
+
+func CreateAlertDefinitionHandler(w http.ResponseWriter, r *http.Request, database db.Store, manager *alerts.Manager) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	definition, err := parseAlertDefinitionForm(r, database, manager)
+	if err != nil {
+		renderAlerts(w, r, database, manager, "alerts.gohtml", err.Error(), r.PostForm)
+		return
+	}
+	if err = database.InsertAlertDefinition(definition); err != nil {
+		logging.FromContext(r.Context()).Error("failed to create alert", "error", err)
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+	reloadAlerts(r, manager)
+	renderAlerts(w, r, database, manager, "alerts.gohtml", "", nil)
+}
+
+// SetAlertDefinitionEnabledHandler enables the definition, or disables it when the enabled form value is "false"
+func SetAlertDefinitionEnabledHandler(w http.ResponseWriter, r *http.Request, database db.Store, manager *alerts.Manager) {
+	definitionId, ok := alertDefinitionIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.SetAlertDefinitionEnabled(definitionId, r.FormValue("enabled") != "false"); err != nil {
+		writeAlertError(w, r, err, "Failed to update alert")
+		return
+	}
+	reloadAlerts(r, manager)
+	renderAlerts(w, r, database, manager, "alert_list.gohtml", "", nil)
+}
+
+func DeleteAlertDefinitionHandler(w http.ResponseWriter, r *http.Request, database db.Store, manager *alerts.Manager) {
+	definitionId, ok := alertDefinitionIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteAlertDefinition(definitionId); err != nil {
+		writeAlertError(w, r, err, "Failed to delete alert")
+		return
+	}
+	reloadAlerts(r, manager)
+	renderAlerts(w, r, database, manager, "alert_list.gohtml", "", nil)
+}
+
+func writeAlertError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
@@ -0,0 +1,231 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type editorAction struct {
+	Name  string
+	Type  model.ActionType
+	Shown bool
+	Chart bool
+}
+
+type editorDevice struct {
+	ID          int
+	Name        string
+	InDashboard bool
+	Position    int
+	Actions     []editorAction
+}
+
+// buildEditorDevices lists every device with all of its actions, devices already in the dashboard come first in
+// their dashboard order and retired devices are only kept if they are already in the dashboard
+func buildEditorDevices(devices []model.Device, dashboard *model.Dashboard) ([]editorDevice, error) {
+	inDashboard := make(map[int]model.DeviceInDashboard)
+	for _, device := range dashboard.Devices {
+		inDashboard[device.Device.ID] = device
+	}
+
+	editorDevices := make([]editorDevice, 0, len(devices))
+	for i := range devices {
+		entry, ok := inDashboard[devices[i].ID]
+		if devices[i].Retired && !ok {
+			continue
+		}
+
+		templateActions, customActions, err := devices[i].ParseActions()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse actions of device %d: %v", devices[i].ID, err)
+		}
+
+		editorDevice := editorDevice{
+			ID:          devices[i].ID,
+			Name:        devices[i].Name,
+			InDashboard: ok,
+			Position:    entry.Position,
+		}
+		for _, actions := range []map[string]model.ActionType{templateActions, customActions} {
+			for actionName, actionType := range actions {
+				shownAction, shown := entry.ShownActions[actionName]
+				editorDevice.Actions = append(editorDevice.Actions, editorAction{
+					Name:  actionName,
+					Type:  actionType,
+					Shown: shown,
+					Chart: shownAction.Chart,
+				})
+			}
+		}
+		sort.Slice(editorDevice.Actions, func(i, j int) bool {
+			return editorDevice.Actions[i].Name < editorDevice.Actions[j].Name
+		})
+		editorDevices = append(editorDevices, editorDevice)
+	}
+
+	sort.SliceStable(editorDevices, func(i, j int) bool {
+		if editorDevices[i].InDashboard != editorDevices[j].InDashboard {
+			return editorDevices[i].InDashboard
+		}
+		if editorDevices[i].InDashboard {
+			return editorDevices[i].Position < editorDevices[j].Position
+		}
+		return editorDevices[i].Name < editorDevices[j].Name
+	})
+	for i := range editorDevices {
+		editorDevices[i].Position = i
+	}
+	return editorDevices, nil
+}
+
+// renderDashboardList renders the sidebar dashboard list, oob marks it for an htmx out of band swap
+func renderDashboardList(w http.ResponseWriter, r *http.Request, database db.Store, oob bool) {
+	dashboards, err := database.FetchDashboards()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch dashboards", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t, err := template.ParseFiles("ui/html/dashboard_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load template", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = t.Execute(w, map[string]interface{}{
+		"Dashboards": dashboards,
+		"OOB":        oob,
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to execute template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func dashboardIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid dashboard ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func EditDashboardHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	id, ok := dashboardIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	dashboard, err := database.FetchDashboard(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Dashboard not found", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to fetch dashboard", "dashboard_id", id, "error", err)
+		http.Error(w, "Failed to fetch dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	editorDevices, err := buildEditorDevices(devices, dashboard)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to parse device actions", "error", err)
+		http.Error(w, "Failed to parse device actions", http.StatusInternalServerError)
+		return
+	}
+
+	t, err := template.ParseFiles("ui/html/dashboard_editor.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load dashboard editor template", "error", err)
+		http.Error(w, "Failed to load the dashboard editor template", http.StatusInternalServerError)
+		return
+	}
+	if err := t.Execute(w, map[string]interface{}{
+		"ID":      dashboard.DashboardId,
+		"Name":    dashboard.Name,
+		"Devices": editorDevices,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func UpdateDashboardHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	id, ok := dashboardIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	dashboardName := r.FormValue("dashboardName")
+	if dashboardName == "" {
+		http.Error(w, "Dashboard name is required", http.StatusBadRequest)
+		return
+	}
+
+	deviceEntries, err := parseDashboardDevices(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = database.UpdateDashboard(id, dashboardName, deviceEntries); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Dashboard not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to update dashboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	renderDashboard(w, r, database, tracker, auth.PermissionsFromContext(r.Context()), id)
+	renderDashboardList(w, r, database, true)
+}
+
+func DeleteDashboardHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	id, ok := dashboardIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteDashboard(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Dashboard not found", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to delete dashboard", "dashboard_id", id, "error", err)
+		http.Error(w, "Failed to delete dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	renderDashboardList(w, r, database, true)
+	_, err := fmt.Fprintln(w, `<p>Dashboard deleted.</p>`)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("unable to print confirmation", "error", err)
+	}
+}
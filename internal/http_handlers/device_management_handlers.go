@@ -0,0 +1,297 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// issuedCredential is a device secret or provisioning token shown once right after it was generated, only its hash
+// is stored
+type issuedCredential struct {
+	Label string
+	Value string
+}
+
+// renderDeviceList renders the devices page or only the device list, form holds the values of a rejected form
+func renderDeviceList(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker, templateName string, formError string, form url.Values, issued *issuedCredential) {
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+	tokens, err := database.FetchProvisioningTokens()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch provisioning tokens", "error", err)
+		http.Error(w, "Failed to fetch provisioning tokens", http.StatusInternalServerError)
+		return
+	}
+
+	devicePresence := make(map[int]model.Presence)
+	for i := range devices {
+		devicePresence[devices[i].ID] = tracker.Lookup(&devices[i])
+	}
+
+	t, err := template.ParseFiles("ui/html/devices.gohtml", "ui/html/device_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load devices template", "error", err)
+		http.Error(w, "Failed to load the devices template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Devices":            devices,
+		"Presence":           devicePresence,
+		"ProvisioningTokens": tokens,
+		"Now":                time.Now(),
+		"FormError":          formError,
+		"Form":               form,
+		"Issued":             issued,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func deviceIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("device_id"))
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeDeviceError reports a failed device update, sql.ErrNoRows means the device does not exist
+func writeDeviceError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
+func DevicesHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	renderDeviceList(w, r, database, tracker, "devices.gohtml", "", nil, nil)
+}
+
+// CreateDeviceHandler pre-creates a device with a new secret, the device logs in with its UUID and the secret
+func CreateDeviceHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	uuid := strings.ToLower(strings.TrimSpace(r.FormValue("uuid")))
+	name := strings.TrimSpace(r.FormValue("deviceName"))
+	if !model.ValidUUID(uuid) {
+		renderDeviceList(w, r, database, tracker, "devices.gohtml", "the UUID has to look like 123e4567-e89b-12d3-a456-426614174000", r.PostForm, nil)
+		return
+	}
+	if name == "" {
+		renderDeviceList(w, r, database, tracker, "devices.gohtml", "the device name is required", r.PostForm, nil)
+		return
+	}
+
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to create device", "error", err)
+		http.Error(w, "Failed to create device", http.StatusInternalServerError)
+		return
+	}
+	if _, err = database.CreateDevice(uuid, name, auth.HashToken(secret)); err != nil {
+		if errors.Is(err, db.ErrDeviceExists) {
+			renderDeviceList(w, r, database, tracker, "devices.gohtml", err.Error(), r.PostForm, nil)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to create device", "error", err)
+		http.Error(w, "Failed to create device", http.StatusInternalServerError)
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "devices.gohtml", "", nil, &issuedCredential{Label: "Secret of " + name, Value: secret})
+}
+
+// RegenerateDeviceSecretHandler replaces the secret of the device, the device has to be flashed with the new one
+func RegenerateDeviceSecretHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	deviceId, ok := deviceIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	device, err := database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to fetch device")
+		return
+	}
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to generate secret", "error", err)
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	if err = database.SetDeviceSecret(deviceId, auth.HashToken(secret)); err != nil {
+		writeDeviceError(w, r, err, "Failed to update device secret")
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "devices.gohtml", "", nil, &issuedCredential{Label: "Secret of " + device.Name, Value: secret})
+}
+
+func RenameDeviceHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	deviceId, ok := deviceIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("deviceName"))
+	if name == "" {
+		http.Error(w, "Device name is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.RenameDevice(deviceId, name); err != nil {
+		writeDeviceError(w, r, err, "Failed to rename device")
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "device_list.gohtml", "", nil, nil)
+}
+
+// RetireDeviceHandler retires the device, or brings it back when the retired form value is "false"
+func RetireDeviceHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	deviceId, ok := deviceIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	retired := r.FormValue("retired") != "false"
+	if err := database.SetDeviceRetired(deviceId, retired); err != nil {
+		writeDeviceError(w, r, err, "Failed to retire device")
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "device_list.gohtml", "", nil, nil)
+}
+
+// DeleteDeviceHandler deletes the device and all of its telemetry, the HX-Prompt header has to repeat the device name
+func DeleteDeviceHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	deviceId, ok := deviceIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	device, err := database.FetchDeviceWithActions(deviceId)
+	if err != nil {
+		writeDeviceError(w, r, err, "Failed to fetch device")
+		return
+	}
+	if r.Header.Get("HX-Prompt") != device.Name {
+		http.Error(w, "Device name does not match, device was not deleted", http.StatusBadRequest)
+		return
+	}
+
+	if err = database.DeleteDevice(deviceId); err != nil {
+		writeDeviceError(w, r, err, "Failed to delete device")
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "device_list.gohtml", "", nil, nil)
+}
+
+const maxProvisioningTokenUses = 1000
+
+func provisioningTokenIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("token_id"))
+	if err != nil {
+		http.Error(w, "Invalid provisioning token ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// parseProvisioningTokenForm builds a token from the provisioning token form, the returned error is meant to be shown
+// to the user
+func parseProvisioningTokenForm(r *http.Request) (*model.ProvisioningToken, error) {
+	token := model.ProvisioningToken{Label: strings.TrimSpace(r.FormValue("label")), UsesLeft: 1}
+	if uses := strings.TrimSpace(r.FormValue("uses")); uses != "" {
+		parsed, err := strconv.Atoi(uses)
+		if err != nil || parsed < 1 || parsed > maxProvisioningTokenUses {
+			return nil, fmt.Errorf("the number of uses has to be between 1 and %d", maxProvisioningTokenUses)
+		}
+		token.UsesLeft = parsed
+	}
+	if hours := strings.TrimSpace(r.FormValue("expiresInHours")); hours != "" {
+		parsed, err := strconv.Atoi(hours)
+		if err != nil || parsed < 1 {
+			return nil, errors.New("the token has to expire after a positive number of hours")
+		}
+		expiresAt := time.Now().Add(time.Duration(parsed) * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+	return &token, nil
+}
+
+// CreateProvisioningTokenHandler creates a token that unknown devices present on their first login to be registered
+func CreateProvisioningTokenHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	token, err := parseProvisioningTokenForm(r)
+	if err != nil {
+		renderDeviceList(w, r, database, tracker, "devices.gohtml", err.Error(), r.PostForm, nil)
+		return
+	}
+	value, err := auth.GenerateToken()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to create provisioning token", "error", err)
+		http.Error(w, "Failed to create provisioning token", http.StatusInternalServerError)
+		return
+	}
+	if err = database.InsertProvisioningToken(auth.HashToken(value), token); err != nil {
+		logging.FromContext(r.Context()).Error("failed to create provisioning token", "error", err)
+		http.Error(w, "Failed to create provisioning token", http.StatusInternalServerError)
+		return
+	}
+	label := "Provisioning token"
+	if token.Label != "" {
+		label += " " + token.Label
+	}
+	renderDeviceList(w, r, database, tracker, "devices.gohtml", "", nil, &issuedCredential{Label: label, Value: value})
+}
+
+func DeleteProvisioningTokenHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	tokenId, ok := provisioningTokenIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteProvisioningToken(tokenId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Provisioning token not found", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Error("Failed to delete provisioning token", "error", err)
+		http.Error(w, "Failed to delete provisioning token", http.StatusInternalServerError)
+		return
+	}
+	renderDeviceList(w, r, database, tracker, "devices.gohtml", "", nil, nil)
+}
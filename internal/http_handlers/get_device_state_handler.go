@@ -2,6 +2,7 @@ package http_handlers
 
 import (
 	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -9,7 +10,7 @@ import (
 	"strconv"
 )
 
-func GetDeviceState(w http.ResponseWriter, r *http.Request, database *db.Database) {
+func GetDeviceState(w http.ResponseWriter, r *http.Request, database db.Store) {
 	deviceIdStr := r.PathValue("device_id")
 	actionName := r.PathValue("action_name")
 
@@ -18,6 +19,9 @@ func GetDeviceState(w http.ResponseWriter, r *http.Request, database *db.Databas
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
+	if !allowView(w, r, deviceId) {
+		return
+	}
 
 	state, err := database.GetDeviceState(deviceId, actionName)
 	if err != nil {
@@ -31,7 +35,7 @@ func GetDeviceState(w http.ResponseWriter, r *http.Request, database *db.Databas
 
 	_, err = fmt.Fprintln(w, state)
 	if err != nil {
-		fmt.Printf("unable to print state: %s\n", err)
+		logging.FromContext(r.Context()).Error("unable to print state", "error", err)
 		return
 	}
 }
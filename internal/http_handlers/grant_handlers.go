@@ -0,0 +1,138 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+type grantRow struct {
+	ID     int
+	Name   string
+	Access model.Access
+}
+
+func renderGrants(w http.ResponseWriter, r *http.Request, database db.Store, userId int, message string) {
+	user, err := database.FetchUser(userId)
+	if err != nil {
+		writeUserError(w, r, err, "Failed to fetch user")
+		return
+	}
+	grants, err := database.FetchGrants(userId)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch grants", "error", err)
+		http.Error(w, "Failed to fetch grants", http.StatusInternalServerError)
+		return
+	}
+	dashboards, err := database.FetchDashboards()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch dashboards", "error", err)
+		http.Error(w, "Failed to fetch dashboards", http.StatusInternalServerError)
+		return
+	}
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	dashboardAccess := make(map[int]model.Access)
+	deviceAccess := make(map[int]model.Access)
+	for _, grant := range grants {
+		if grant.DashboardID != 0 {
+			dashboardAccess[grant.DashboardID] = grant.Access
+		} else {
+			deviceAccess[grant.DeviceID] = grant.Access
+		}
+	}
+	dashboardRows := make([]grantRow, len(dashboards))
+	for i, dashboard := range dashboards {
+		dashboardRows[i] = grantRow{ID: dashboard.DashboardId, Name: dashboard.Name, Access: dashboardAccess[dashboard.DashboardId]}
+	}
+	deviceRows := make([]grantRow, len(devices))
+	for i, device := range devices {
+		deviceRows[i] = grantRow{ID: device.ID, Name: device.Name, Access: deviceAccess[device.ID]}
+	}
+
+	t, err := template.ParseFiles("ui/html/user_grants.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load grants template", "error", err)
+		http.Error(w, "Failed to load the grants template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.Execute(w, map[string]interface{}{
+		"User":       user,
+		"Dashboards": dashboardRows,
+		"Devices":    deviceRows,
+		"Message":    message,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func GrantsHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	userId, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	renderGrants(w, r, database, userId, "")
+}
+
+// parseGrantForm reads the dashboard-<id> and device-<id> selects, an empty value means no access
+func parseGrantForm(r *http.Request, userId int) ([]model.Grant, error) {
+	var grants []model.Grant
+	for key := range r.PostForm {
+		var id int
+		var grant model.Grant
+		if _, err := fmt.Sscanf(key, "dashboard-%d", &id); err == nil {
+			grant.DashboardID = id
+		} else if _, err = fmt.Sscanf(key, "device-%d", &id); err == nil {
+			grant.DeviceID = id
+		} else {
+			continue
+		}
+
+		grant.UserID, grant.Access = userId, model.Access(r.PostFormValue(key))
+		switch grant.Access {
+		case "":
+			continue
+		case model.AccessView, model.AccessControl:
+			grants = append(grants, grant)
+		default:
+			return nil, fmt.Errorf("unknown access %q", grant.Access)
+		}
+	}
+	return grants, nil
+}
+
+// UpdateGrantsHandler replaces all grants of the user with the submitted ones
+func UpdateGrantsHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	userId, ok := otherUserIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	grants, err := parseGrantForm(r, userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = database.ReplaceGrants(userId, grants); err != nil {
+		logging.FromContext(r.Context()).Error("failed to save grants", "error", err)
+		http.Error(w, "Failed to save grants", http.StatusInternalServerError)
+		return
+	}
+	renderGrants(w, r, database, userId, "Permissions saved.")
+}
@@ -1,14 +1,12 @@
 package http_handlers
 
 import (
-	"NSI-semester-work/internal/db"
-	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"NSI-semester-work/internal/commands"
 	"net/http"
 	"strconv"
 )
 
-func NumberInputHandler(w http.ResponseWriter, r *http.Request, database *db.Database, mqttClient MQTT.Client) {
+func NumberInputHandler(w http.ResponseWriter, r *http.Request, sender *commands.Sender) {
 	err := r.ParseForm()
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
@@ -24,12 +22,14 @@ func NumberInputHandler(w http.ResponseWriter, r *http.Request, database *db.Dat
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
+	if !allowControl(w, r, deviceId) {
+		return
+	}
 
-	deviceUuid, err := database.GetDeviceUUID(deviceId)
-
-	topic := fmt.Sprintf("number_input/%s/%s", deviceUuid, actionName)
-	if token := mqttClient.Publish(topic, 0, false, inputValue); token.Wait() && token.Error() != nil {
-		http.Error(w, "Failed to send command", http.StatusInternalServerError)
+	command, err := sender.NumberInput(deviceId, actionName, inputValue)
+	if err != nil {
+		writeSendError(w, err)
 		return
 	}
+	writeCommandStatus(w, r, command)
 }
@@ -0,0 +1,185 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/rules"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type ruleRow struct {
+	Rule      model.Rule
+	Condition string
+	Target    string
+}
+
+// renderRules renders the rules page or only the rule list, form holds the values of a rejected rule form
+func renderRules(w http.ResponseWriter, r *http.Request, database db.Store, templateName string, formError string, form url.Values) {
+	allRules, err := database.FetchRules()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch rules", "error", err)
+		http.Error(w, "Failed to fetch rules", http.StatusInternalServerError)
+		return
+	}
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	deviceNames := make(map[int]string, len(devices))
+	for _, device := range devices {
+		deviceNames[device.ID] = device.Name
+	}
+	rows := make([]ruleRow, len(allRules))
+	for i, rule := range allRules {
+		rows[i] = ruleRow{
+			Rule:      rule,
+			Condition: rule.Condition.Describe(deviceNames),
+			Target:    describeAction(rule.Action, deviceNames),
+		}
+	}
+
+	t, err := template.ParseFiles("ui/html/rules.gohtml", "ui/html/rule_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load rules template", "error", err)
+		http.Error(w, "Failed to load the rules template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Rules":     rows,
+		"Targets":   fetchActionTargets(devices),
+		"Devices":   devices,
+		"FormError": formError,
+		"Form":      form,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func ruleIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("rule_id"))
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// reloadRules applies rule changes to the running engine, the change itself is already stored
+func reloadRules(r *http.Request, engine *rules.Engine) {
+	if err := engine.Reload(); err != nil {
+		logging.FromContext(r.Context()).Error("failed to reload rules", "error", err)
+	}
+}
+
+func RulesHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	renderRules(w, r, database, "rules.gohtml", "", nil)
+}
+
+// parseRuleForm builds a rule from the rule form, the returned error is meant to be shown to the user
+func parseRuleForm(r *http.Request, database db.Store) (*model.Rule, error) {
+	rule := model.Rule{
+		Name:    strings.TrimSpace(r.FormValue("ruleName")),
+		Enabled: true,
+	}
+	if rule.Name == "" {
+		return nil, errors.New("rule name is required")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(r.FormValue("condition")))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule.Condition); err != nil {
+		return nil, fmt.Errorf("invalid condition JSON: %v", err)
+	}
+	if err := rule.Condition.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid condition: %v", err)
+	}
+
+	action, err := parseActionForm(r, database)
+	if err != nil {
+		return nil, err
+	}
+	rule.Action = *action
+
+	if cooldown := strings.TrimSpace(r.FormValue("cooldownSeconds")); cooldown != "" {
+		if rule.CooldownSeconds, err = strconv.Atoi(cooldown); err != nil || rule.CooldownSeconds < 0 {
+			return nil, errors.New("cooldown has to be a whole number of seconds")
+		}
+	}
+	return &rule, nil
+}
+
+func CreateRuleHandler(w http.ResponseWriter, r *http.Request, database db.Store, engine *rules.Engine) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := parseRuleForm(r, database)
+	if err != nil {
+		renderRules(w, r, database, "rules.gohtml", err.Error(), r.PostForm)
+		return
+	}
+	if err = database.InsertRule(rule); err != nil {
+		logging.FromContext(r.Context()).Error("failed to create rule", "error", err)
+		http.Error(w, "Failed to create rule", http.StatusInternalServerError)
+		return
+	}
+	reloadRules(r, engine)
+	renderRules(w, r, database, "rules.gohtml", "", nil)
+}
+
+// SetRuleEnabledHandler enables the rule, or disables it when the enabled form value is "false"
+func SetRuleEnabledHandler(w http.ResponseWriter, r *http.Request, database db.Store, engine *rules.Engine) {
+	ruleId, ok := ruleIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.SetRuleEnabled(ruleId, r.FormValue("enabled") != "false"); err != nil {
+		writeRuleError(w, r, err, "Failed to update rule")
+		return
+	}
+	reloadRules(r, engine)
+	renderRules(w, r, database, "rule_list.gohtml", "", nil)
+}
+
+func DeleteRuleHandler(w http.ResponseWriter, r *http.Request, database db.Store, engine *rules.Engine) {
+	ruleId, ok := ruleIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteRule(ruleId); err != nil {
+		writeRuleError(w, r, err, "Failed to delete rule")
+		return
+	}
+	reloadRules(r, engine)
+	renderRules(w, r, database, "rule_list.gohtml", "", nil)
+}
+
+func writeRuleError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
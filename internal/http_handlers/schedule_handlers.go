@@ -0,0 +1,216 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/scheduler"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const scheduleRunHistoryLimit = 50
+
+type scheduleRow struct {
+	Schedule model.Schedule
+	When     string
+	Target   string
+	NextRun  time.Time
+}
+
+// renderSchedules renders the schedules page or only the schedule list, form holds the values of a rejected form
+func renderSchedules(w http.ResponseWriter, r *http.Request, database db.Store, schedules *scheduler.Scheduler, templateName string, formError string, form url.Values) {
+	allSchedules, err := database.FetchSchedules()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch schedules", "error", err)
+		http.Error(w, "Failed to fetch schedules", http.StatusInternalServerError)
+		return
+	}
+	runs, err := database.FetchScheduleRuns(scheduleRunHistoryLimit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch schedule runs", "error", err)
+		http.Error(w, "Failed to fetch schedule runs", http.StatusInternalServerError)
+		return
+	}
+	devices, err := database.FetchDevicesWithActions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	deviceNames := make(map[int]string, len(devices))
+	for _, device := range devices {
+		deviceNames[device.ID] = device.Name
+	}
+	rows := make([]scheduleRow, len(allSchedules))
+	for i, schedule := range allSchedules {
+		rows[i] = scheduleRow{
+			Schedule: schedule,
+			When:     schedule.Describe(),
+			Target:   describeAction(schedule.Action, deviceNames),
+			NextRun:  schedules.NextRun(schedule.ID),
+		}
+		if location, err := time.LoadLocation(schedule.Timezone); err == nil && !rows[i].NextRun.IsZero() {
+			rows[i].NextRun = rows[i].NextRun.In(location)
+		}
+	}
+
+	t, err := template.ParseFiles("ui/html/schedules.gohtml", "ui/html/schedule_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load schedules template", "error", err)
+		http.Error(w, "Failed to load the schedules template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Schedules": rows,
+		"Runs":      runs,
+		"Targets":   fetchActionTargets(devices),
+		"Weekdays":  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday},
+		"FormError": formError,
+		"Form":      form,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func scheduleIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("schedule_id"))
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// reloadSchedules applies schedule changes to the running scheduler, the change itself is already stored
+func reloadSchedules(r *http.Request, schedules *scheduler.Scheduler) {
+	if err := schedules.Reload(); err != nil {
+		logging.FromContext(r.Context()).Error("failed to reload schedules", "error", err)
+	}
+}
+
+func SchedulesHandler(w http.ResponseWriter, r *http.Request, database db.Store, schedules *scheduler.Scheduler) {
+	renderSchedules(w, r, database, schedules, "schedules.gohtml", "", nil)
+}
+
+// parseScheduleForm builds a schedule from the schedule form, the returned error is meant to be shown to the user
+func parseScheduleForm(r *http.Request, database db.Store) (*model.Schedule, error) {
+	schedule := model.Schedule{
+		Name:           strings.TrimSpace(r.FormValue("scheduleName")),
+		Kind:           model.ScheduleKind(r.FormValue("kind")),
+		CronExpression: strings.TrimSpace(r.FormValue("cronExpression")),
+		TimeOfDay:      r.FormValue("timeOfDay"),
+		Timezone:       strings.TrimSpace(r.FormValue("timezone")),
+	}
+	if schedule.Name == "" {
+		return nil, errors.New("schedule name is required")
+	}
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	for _, dayStr := range r.Form["weekdays"] {
+		day, err := strconv.Atoi(dayStr)
+		if err != nil || day < 0 || day > 6 {
+			return nil, fmt.Errorf("invalid weekday %s", dayStr)
+		}
+		schedule.Weekdays = append(schedule.Weekdays, time.Weekday(day))
+	}
+
+	// keep only the fields of the chosen kind
+	switch schedule.Kind {
+	case model.ScheduleCron:
+		schedule.TimeOfDay, schedule.Weekdays = "", nil
+	case model.ScheduleDaily:
+		schedule.CronExpression, schedule.Weekdays = "", nil
+	case model.ScheduleWeekly:
+		schedule.CronExpression = ""
+	}
+
+	spec, err := schedule.CronSpec()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = cron.ParseStandard(spec); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %v", err)
+	}
+
+	action, err := parseActionForm(r, database)
+	if err != nil {
+		return nil, err
+	}
+	schedule.Action = *action
+	return &schedule, nil
+}
+
+func CreateScheduleHandler(w http.ResponseWriter, r *http.Request, database db.Store, schedules *scheduler.Scheduler) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := parseScheduleForm(r, database)
+	if err != nil {
+		renderSchedules(w, r, database, schedules, "schedules.gohtml", err.Error(), r.PostForm)
+		return
+	}
+	if err = database.InsertSchedule(schedule); err != nil {
+		logging.FromContext(r.Context()).Error("failed to create schedule", "error", err)
+		http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+	reloadSchedules(r, schedules)
+	renderSchedules(w, r, database, schedules, "schedules.gohtml", "", nil)
+}
+
+// PauseScheduleHandler pauses the schedule, or resumes it when the paused form value is "false"
+func PauseScheduleHandler(w http.ResponseWriter, r *http.Request, database db.Store, schedules *scheduler.Scheduler) {
+	scheduleId, ok := scheduleIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.SetSchedulePaused(scheduleId, r.FormValue("paused") != "false"); err != nil {
+		writeScheduleError(w, r, err, "Failed to update schedule")
+		return
+	}
+	reloadSchedules(r, schedules)
+	renderSchedules(w, r, database, schedules, "schedule_list.gohtml", "", nil)
+}
+
+func DeleteScheduleHandler(w http.ResponseWriter, r *http.Request, database db.Store, schedules *scheduler.Scheduler) {
+	scheduleId, ok := scheduleIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteSchedule(scheduleId); err != nil {
+		writeScheduleError(w, r, err, "Failed to delete schedule")
+		return
+	}
+	reloadSchedules(r, schedules)
+	renderSchedules(w, r, database, schedules, "schedule_list.gohtml", "", nil)
+}
+
+func writeScheduleError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
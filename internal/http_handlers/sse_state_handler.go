@@ -1,17 +1,85 @@
 package http_handlers
 
 import (
+	"NSI-semester-work/internal/auth"
 	"NSI-semester-work/internal/db"
-	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/sse"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
-func SseStateHandler(w http.ResponseWriter, r *http.Request, db *db.Database, sseChannel chan model.Update) {
-	fmt.Println("setting up a new connection")
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// notificationEvents are the events sent to clients connecting with the notifications query parameter
+var notificationEvents = []string{"alert"}
+
+// parseSseFilter returns the device IDs the client asked for via dashboard_id and device_id query parameters,
+// nil means the client wants updates of all devices
+func parseSseFilter(r *http.Request, database db.Store) ([]int, error) {
+	query := r.URL.Query()
+	if !query.Has("dashboard_id") && !query.Has("device_id") {
+		return nil, nil
+	}
+
+	deviceIds := make([]int, 0)
+	for _, dashboardIdStr := range query["dashboard_id"] {
+		dashboardId, err := strconv.Atoi(dashboardIdStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dashboard ID %s", dashboardIdStr)
+		}
+		devices, _, err := database.FetchDashboardContents(dashboardId)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range devices {
+			deviceIds = append(deviceIds, device.Device.ID)
+		}
+	}
+	for _, deviceIdStr := range query["device_id"] {
+		deviceId, err := strconv.Atoi(deviceIdStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device ID %s", deviceIdStr)
+		}
+		deviceIds = append(deviceIds, deviceId)
+	}
+	return deviceIds, nil
+}
+
+// visibleDevices narrows the requested devices down to the ones the user may see
+func visibleDevices(permissions *auth.Permissions, deviceIds []int) []int {
+	if deviceIds == nil {
+		return permissions.ViewableDevices()
+	}
+	visible := make([]int, 0, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		if permissions.CanViewDevice(deviceId) {
+			visible = append(visible, deviceId)
+		}
+	}
+	return visible
+}
+
+func writeSseEvent(w http.ResponseWriter, event sse.Event) error {
+	if _, err := fmt.Fprintf(w, "event: %s\n", event.Name); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(event.Data, "\n") {
+		if _, err := fmt.Fprintf(w, "data: %s\n", line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
+func SseStateHandler(w http.ResponseWriter, r *http.Request, database db.Store, hub *sse.Hub) {
+	deviceIds, err := parseSseFilter(r, database)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deviceIds = visibleDevices(auth.PermissionsFromContext(r.Context()), deviceIds)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -19,38 +87,34 @@ func SseStateHandler(w http.ResponseWriter, r *http.Request, db *db.Database, ss
 		return
 	}
 
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// notification clients get the alerts of every device the user may see, but none of their other events
+	var names []string
+	if r.URL.Query().Has("notifications") {
+		names = notificationEvents
+	}
+	subscriber := hub.Subscribe(deviceIds, names)
+	defer hub.Unsubscribe(subscriber)
+
 	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	logger.Debug("sse client connected", "devices", len(deviceIds))
 
 	for {
 		select {
-		case update := <-sseChannel:
-			// Prepare data to send via SSE.
-			res := fmt.Sprintf("event: stateUpdate-%d-%s\ndata: %s\n\n", update.DeviceID, update.ActionName, update.State)
-			fmt.Println(res) // Logging for debugging purposes.
-
-			// Map to update device state in the database.
-			stateMap := map[string]interface{}{
-				update.ActionName: update.State,
-			}
-
-			// Update state in the database.
-			err := db.UpdateDeviceState(update.DeviceID, stateMap)
-			if err != nil {
-				fmt.Printf("Unable to update state: %s\n", err)
-				continue // Decide if you want to skip sending the event.
-			}
-
-			// Send the SSE data to the client.
-			_, err = fmt.Fprintf(w, "event: stateUpdate-%d-%s\ndata: %s\n\n", update.DeviceID, update.ActionName, update.State)
-			if err != nil {
-				fmt.Println("Error printing state update data:", err)
-				continue
+		case event := <-subscriber.Events:
+			if err := writeSseEvent(w, event); err != nil {
+				logger.Debug("failed to write sse event", "error", err)
+				return
 			}
 			flusher.Flush()
 
 		case <-ctx.Done():
 			// Handle client disconnection.
-			fmt.Println("Client disconnected, closing SSE connection.")
+			logger.Debug("sse client disconnected")
 			return // Exit the handler when the client disconnects.
 		}
 	}
@@ -1,14 +1,68 @@
 package http_handlers
 
 import (
-	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"errors"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"net/http"
 	"strconv"
 )
 
-func ToggleHandler(w http.ResponseWriter, r *http.Request, database *db.Database, mqttClient MQTT.Client) {
+// writeSendError maps errors returned by commands.Sender to http responses
+func writeSendError(w http.ResponseWriter, err error) {
+	if errors.Is(err, commands.ErrDeviceNotFound) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, commands.ErrDeviceOffline) {
+		http.Error(w, "Device is offline", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, commands.ErrUnknownAction) {
+		http.Error(w, "Device has no such action", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, commands.ErrActionTypeMismatch) || errors.Is(err, commands.ErrUnsupportedActionType) {
+		http.Error(w, "The action can not be issued this way", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, commands.ErrInvalidValue) {
+		http.Error(w, "The value has to be a number", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Failed to send command", http.StatusInternalServerError)
+}
+
+// allowControl answers with 403 Forbidden when the logged-in user may not control the device
+func allowControl(w http.ResponseWriter, r *http.Request, deviceId int) bool {
+	if !auth.PermissionsFromContext(r.Context()).CanControlDevice(deviceId) {
+		http.Error(w, "You may not control this device", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// allowView answers with 403 Forbidden when the logged-in user may not see the device
+func allowView(w http.ResponseWriter, r *http.Request, deviceId int) bool {
+	if !auth.PermissionsFromContext(r.Context()).CanViewDevice(deviceId) {
+		http.Error(w, "You may not see this device", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// writeCommandStatus answers with the status of the just sent command, the final status follows as an SSE event
+func writeCommandStatus(w http.ResponseWriter, r *http.Request, command *model.Command) {
+	w.WriteHeader(http.StatusAccepted)
+	if _, err := fmt.Fprint(w, command.Status); err != nil {
+		logging.FromContext(r.Context()).Error("unable to print command status", "error", err)
+	}
+}
+
+func ToggleHandler(w http.ResponseWriter, r *http.Request, sender *commands.Sender) {
 	deviceIdStr := r.PathValue("device_id")
 	actionName := r.PathValue("action_name")
 
@@ -17,12 +71,14 @@ func ToggleHandler(w http.ResponseWriter, r *http.Request, database *db.Database
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
+	if !allowControl(w, r, deviceId) {
+		return
+	}
 
-	deviceUuid, err := database.GetDeviceUUID(deviceId)
-
-	topic := fmt.Sprintf("toggle/%s", deviceUuid)
-	if token := mqttClient.Publish(topic, 0, false, actionName); token.Wait() && token.Error() != nil {
-		http.Error(w, "Failed to send command", http.StatusInternalServerError)
+	command, err := sender.Toggle(deviceId, actionName)
+	if err != nil {
+		writeSendError(w, err)
 		return
 	}
+	writeCommandStatus(w, r, command)
 }
@@ -1,62 +1,77 @@
 package http_handlers
 
 import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/commands"
 	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
 	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"html/template"
-	"log"
+	"math"
 	"net/http"
-	"os"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func HomeHandler(w http.ResponseWriter, database *db.Database) {
+func HomeHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
 	t, err := template.ParseFiles("ui/html/home.gohtml", "ui/html/dashboard_list.gohtml")
 	if err != nil {
-		fmt.Printf("error loading template %s\n", err)
+		logging.FromContext(r.Context()).Error("error loading template", "error", err)
 		http.Error(w, "Error loading template", http.StatusInternalServerError)
 		return
 	}
 
 	dashboards, err := database.FetchDashboards()
 	if err != nil {
-		fmt.Printf("failed to fetch dashboards %s\n", err)
+		logging.FromContext(r.Context()).Error("failed to fetch dashboards", "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	permissions := auth.PermissionsFromContext(r.Context())
+	visible := make([]model.Dashboard, 0, len(dashboards))
+	for _, dashboard := range dashboards {
+		if permissions.CanViewDashboard(dashboard.DashboardId) {
+			visible = append(visible, dashboard)
+		}
+	}
+
 	err = t.Execute(w, map[string]interface{}{
-		"Dashboards": dashboards,
+		"Dashboards": visible,
+		"User":       auth.UserFromContext(r.Context()),
+		"IsAdmin":    permissions.IsAdmin(),
 	})
 	if err != nil {
-		fmt.Printf("failed to execute template %s\n", err)
+		logging.FromContext(r.Context()).Error("failed to execute template", "error", err)
 		http.Error(w, "Error executing template", http.StatusInternalServerError)
 		return
 	}
 
 }
 
-func DashboardCreatorHandler(w http.ResponseWriter, database *db.Database) {
+func DashboardCreatorHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
 	t, err := template.ParseFiles("ui/html/dashboard_creator.gohtml")
 	if err != nil {
-		fmt.Printf("failed to load dashboard creator template %s\n", err)
+		logging.FromContext(r.Context()).Error("failed to load dashboard creator template", "error", err)
 		http.Error(w, "Failed to load the dashboard creator template", http.StatusInternalServerError)
 		return
 	}
 	devices, err := database.FetchDeviceNamesAndIds()
 	if err != nil {
-		fmt.Println("failed to fetch devices")
+		logging.FromContext(r.Context()).Error("failed to fetch devices", "error", err)
 		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 		return
 	}
 	// Render template with devices
 	if err := t.Execute(w, map[string]interface{}{"Devices": devices}); err != nil {
-		fmt.Println(devices)
-		fmt.Printf("error executing template %s\n", err)
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
 		http.Error(w, "Error executing template", http.StatusInternalServerError)
 		return
 	}
@@ -73,7 +88,7 @@ func parseJSONActions(templateActionsStr, customActionsStr string) (map[string]i
 	return templateActions, customActions, nil
 }
 
-func DeviceFeaturesHandler(w http.ResponseWriter, r *http.Request, database *db.Database) {
+func DeviceFeaturesHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
 	stringId := r.PathValue("id")
 	if stringId == "" {
 		http.Error(w, "Device ID parameter is missing", http.StatusBadRequest)
@@ -88,21 +103,21 @@ func DeviceFeaturesHandler(w http.ResponseWriter, r *http.Request, database *db.
 
 	device, err := database.FetchDeviceWithActions(deviceId) // Make sure this function name matches the actual function
 	if err != nil {
-		log.Printf("error fetching device with actions: %s", err)
+		logging.FromContext(r.Context()).Error("error fetching device with actions", logging.DeviceID(deviceId), "error", err)
 		http.Error(w, "Failed to fetch device details", http.StatusInternalServerError)
 		return
 	}
 
 	t, err := template.ParseFiles("ui/html/device_features_template.gohtml")
 	if err != nil {
-		log.Printf("error loading feature template: %s", err)
+		logging.FromContext(r.Context()).Error("error loading feature template", "error", err)
 		http.Error(w, "Error loading feature template", http.StatusInternalServerError)
 		return
 	}
 
 	templateActions, customActions, err := parseJSONActions(device.TemplateActions, device.CustomActions)
 	if err != nil {
-		log.Printf("error parsing actions: %s", err)
+		logging.FromContext(r.Context()).Error("error parsing actions", "error", err)
 		http.Error(w, "Failed to parse actions", http.StatusInternalServerError)
 		return
 	}
@@ -114,18 +129,73 @@ func DeviceFeaturesHandler(w http.ResponseWriter, r *http.Request, database *db.
 	}
 
 	if err := t.Execute(w, data); err != nil {
-		log.Printf("error executing feature template: %s", err)
+		logging.FromContext(r.Context()).Error("error executing feature template", "error", err)
 		http.Error(w, "Error executing feature template", http.StatusInternalServerError)
 		return
 	}
 }
 
-func CreateDashboardHandler(w http.ResponseWriter, r *http.Request, db *db.Database) {
+// parseDashboardDevices collects the device_action_<id> checkboxes of the dashboard form, device_chart_<id> marks
+// provide_value actions that are displayed as a chart and the optional position_<id> orders the devices
+func parseDashboardDevices(form url.Values) ([]model.DeviceInDashboard, error) {
+	var deviceEntries []model.DeviceInDashboard
+
+	for key, values := range form {
+		if !strings.HasPrefix(key, "device_action_") {
+			continue
+		}
+		deviceIDStr := strings.TrimPrefix(key, "device_action_")
+		deviceID, err := strconv.Atoi(deviceIDStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device ID %s: %v", deviceIDStr, err)
+		}
+
+		actionsMap := make(map[string]model.ShownAction)
+		for _, val := range values {
+			parts := strings.SplitN(val, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid action format")
+			}
+			actionsMap[parts[0]] = model.ShownAction{Type: model.ActionType(parts[1])}
+		}
+		for _, actionName := range form["device_chart_"+deviceIDStr] {
+			if action, ok := actionsMap[actionName]; ok && action.Type == model.ActionTypeProvideValue {
+				action.Chart = true
+				actionsMap[actionName] = action
+			}
+		}
+
+		entry := model.DeviceInDashboard{
+			Device:       model.Device{ID: deviceID},
+			ShownActions: actionsMap,
+			Position:     math.MaxInt,
+		}
+		if positionStr := form.Get("position_" + deviceIDStr); positionStr != "" {
+			if entry.Position, err = strconv.Atoi(positionStr); err != nil {
+				return nil, fmt.Errorf("invalid position %s: %v", positionStr, err)
+			}
+		}
+		deviceEntries = append(deviceEntries, entry)
+	}
+
+	// form values are unordered, sort by the requested position and renumber the devices from 0
+	sort.SliceStable(deviceEntries, func(i, j int) bool {
+		if deviceEntries[i].Position != deviceEntries[j].Position {
+			return deviceEntries[i].Position < deviceEntries[j].Position
+		}
+		return deviceEntries[i].Device.ID < deviceEntries[j].Device.ID
+	})
+	for i := range deviceEntries {
+		deviceEntries[i].Position = i
+	}
+	return deviceEntries, nil
+}
+
+func CreateDashboardHandler(w http.ResponseWriter, r *http.Request, db db.Store) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
-	fmt.Println("Form data:", r.Form)
 
 	dashboardName := r.FormValue("dashboardName")
 	if dashboardName == "" {
@@ -135,36 +205,10 @@ func CreateDashboardHandler(w http.ResponseWriter, r *http.Request, db *db.Datab
 
 	r.Form.Del("dashboardName")
 
-	var deviceEntries []model.DeviceInDashboard
-	position := 0
-
-	// Parse device actions from the form
-	for key, values := range r.Form {
-		if strings.HasPrefix(key, "device_action_") {
-			deviceIDStr := strings.TrimPrefix(key, "device_action_")
-			deviceID, err := strconv.Atoi(deviceIDStr)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Invalid device ID %s: %v", deviceIDStr, err), http.StatusBadRequest)
-				continue // Skip this iteration
-			}
-
-			actionsMap := make(map[string]string)
-			for _, val := range values {
-				parts := strings.SplitN(val, ":", 2)
-				if len(parts) != 2 {
-					http.Error(w, "Invalid action format", http.StatusBadRequest)
-					return
-				}
-				actionsMap[parts[0]] = parts[1]
-			}
-
-			deviceEntries = append(deviceEntries, model.DeviceInDashboard{
-				Device:       model.Device{ID: deviceID},
-				ShownActions: actionsMap,
-				Position:     position,
-			})
-			position++
-		}
+	deviceEntries, err := parseDashboardDevices(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	dashboardID, err := db.CreateDashboard(dashboardName)
@@ -174,33 +218,12 @@ func CreateDashboardHandler(w http.ResponseWriter, r *http.Request, db *db.Datab
 	}
 
 	if err = db.InsertDevicesToDashboard(dashboardID, deviceEntries); err != nil {
-		fmt.Println(err)
+		logging.FromContext(r.Context()).Error("failed to save devices", "error", err)
 		http.Error(w, fmt.Sprintf("Failed to save devices: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	dashboards, err := db.FetchDashboards()
-	if err != nil {
-		fmt.Printf("failed to fetch dashboards %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	t, err := template.ParseFiles("ui/html/dashboard_list.gohtml")
-	if err != nil {
-		fmt.Printf("failed to load template %s\n", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = t.Execute(w, map[string]interface{}{
-		"Dashboards": dashboards,
-	})
-	if err != nil {
-		fmt.Printf("failed to execute template %s\n", err)
-		http.Error(w, "Error executing template", http.StatusInternalServerError)
-		return
-	}
+	renderDashboardList(w, r, db, false)
 
 	_, err = fmt.Fprintln(w, "Dashboard saved successfully!")
 	if err != nil {
@@ -208,41 +231,66 @@ func CreateDashboardHandler(w http.ResponseWriter, r *http.Request, db *db.Datab
 	}
 }
 
-func DisplayDashboardHandler(w http.ResponseWriter, r *http.Request, database *db.Database) {
-	deviceIdStr := r.PathValue("id")
-	id, err := strconv.Atoi(deviceIdStr)
-	if err != nil {
-		fmt.Printf("error converting string id to int %s\n", err)
-		http.Error(w, "Invalid dashboard ID", http.StatusBadRequest)
+// renderDashboard renders the dashboard with the controls of the devices the user may not control left out
+func renderDashboard(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker, permissions *auth.Permissions, id int) {
+	if !permissions.CanViewDashboard(id) {
+		http.Error(w, "You may not see this dashboard", http.StatusForbidden)
 		return
 	}
 
-	devices, name, err := database.FetchDashboardContents(id)
+	dashboard, err := database.FetchDashboard(id)
 	if err != nil {
-		fmt.Printf("failed to fetch dashboard contents %s\n", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Dashboard not found", http.StatusNotFound)
+			return
+		}
+		logging.FromContext(r.Context()).Error("failed to fetch dashboard contents", "error", err)
 		http.Error(w, "Failed to fetch dashboard contents", http.StatusInternalServerError)
 		return
 	}
 
+	devicePresence := make(map[int]model.Presence)
+	controllable := make(map[int]bool)
+	for _, device := range dashboard.Devices {
+		devicePresence[device.Device.ID], _ = tracker.Get(device.Device.ID)
+		controllable[device.Device.ID] = permissions.CanControlDevice(device.Device.ID)
+	}
+
 	t, err := template.ParseFiles("ui/html/dashboard.gohtml")
 	if err != nil {
-		fmt.Printf("failed to parse template %s\n", err)
+		logging.FromContext(r.Context()).Error("failed to parse template", "error", err)
 		http.Error(w, "Failed to parse template", http.StatusInternalServerError)
 		return
 	}
 
 	err = t.Execute(w, map[string]interface{}{
-		"Devices": devices,
-		"Name":    name,
+		"ID":           dashboard.DashboardId,
+		"Devices":      dashboard.Devices,
+		"Name":         dashboard.Name,
+		"Presence":     devicePresence,
+		"Controllable": controllable,
+		"IsAdmin":      permissions.IsAdmin(),
 	})
 	if err != nil {
-		fmt.Printf("failed to execute template %s\n", err)
+		logging.FromContext(r.Context()).Error("failed to execute template", "error", err)
 		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
 		return
 	}
 }
 
-func GetLastSensorValueHandler(w http.ResponseWriter, r *http.Request, database *db.Database) {
+func DisplayDashboardHandler(w http.ResponseWriter, r *http.Request, database db.Store, tracker *presence.Tracker) {
+	deviceIdStr := r.PathValue("id")
+	id, err := strconv.Atoi(deviceIdStr)
+	if err != nil {
+		logging.FromContext(r.Context()).Debug("invalid dashboard id", "error", err)
+		http.Error(w, "Invalid dashboard ID", http.StatusBadRequest)
+		return
+	}
+
+	renderDashboard(w, r, database, tracker, auth.PermissionsFromContext(r.Context()), id)
+}
+
+func GetLastSensorValueHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
 	deviceIdStr := r.PathValue("device_id")
 	actionName := r.PathValue("action_name")
 
@@ -251,6 +299,9 @@ func GetLastSensorValueHandler(w http.ResponseWriter, r *http.Request, database
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
+	if !allowView(w, r, deviceId) {
+		return
+	}
 
 	// Query the last value for the specified device and action
 	value, err := database.GetLastSensorValue(deviceId, actionName)
@@ -259,14 +310,13 @@ func GetLastSensorValueHandler(w http.ResponseWriter, r *http.Request, database
 		return
 	}
 
-	fmt.Println(value)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(value); err != nil {
 		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
 	}
 }
 
-func SendCommandHandler(w http.ResponseWriter, r *http.Request, mqttClient MQTT.Client, database *db.Database) {
+func SendCommandHandler(w http.ResponseWriter, r *http.Request, sender *commands.Sender) {
 	deviceIdStr := r.PathValue("device_id")
 	actionName := r.PathValue("action_name")
 
@@ -275,8 +325,14 @@ func SendCommandHandler(w http.ResponseWriter, r *http.Request, mqttClient MQTT.
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
 		return
 	}
+	if !allowControl(w, r, deviceId) {
+		return
+	}
 
-	deviceUuid, err := database.GetDeviceUUID(deviceId)
-
-	mqttClient.Publish(fmt.Sprintf("%s%s", os.Getenv("MQTT_COMMAND_TOPIC"), deviceUuid), 0, false, actionName)
+	command, err := sender.Command(deviceId, actionName)
+	if err != nil {
+		writeSendError(w, err)
+		return
+	}
+	writeCommandStatus(w, r, command)
 }
@@ -0,0 +1,198 @@
+package http_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/webhooks"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	webhookDeliveryLimit = 50
+	webhookSecretBytes   = 32
+)
+
+type webhookDeliveryRow struct {
+	Delivery model.WebhookDelivery
+	URL      string
+}
+
+// renderWebhooks renders the webhooks page or only the subscription list, form holds the values of a rejected form
+func renderWebhooks(w http.ResponseWriter, r *http.Request, database db.Store, templateName string, formError string, form url.Values) {
+	subscriptions, err := database.FetchWebhookSubscriptions()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch webhook subscriptions", "error", err)
+		http.Error(w, "Failed to fetch webhook subscriptions", http.StatusInternalServerError)
+		return
+	}
+	deliveries, err := database.FetchWebhookDeliveries(false, webhookDeliveryLimit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to fetch webhook deliveries", "error", err)
+		http.Error(w, "Failed to fetch webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	urls := make(map[int]string, len(subscriptions))
+	for _, subscription := range subscriptions {
+		urls[subscription.ID] = subscription.URL
+	}
+	deliveryRows := make([]webhookDeliveryRow, len(deliveries))
+	for i, delivery := range deliveries {
+		deliveryRows[i] = webhookDeliveryRow{Delivery: delivery, URL: urls[delivery.SubscriptionID]}
+	}
+
+	t, err := template.ParseFiles("ui/html/webhooks.gohtml", "ui/html/webhook_list.gohtml")
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to load webhooks template", "error", err)
+		http.Error(w, "Failed to load the webhooks template", http.StatusInternalServerError)
+		return
+	}
+	if err = t.ExecuteTemplate(w, templateName, map[string]interface{}{
+		"Subscriptions": subscriptions,
+		"Deliveries":    deliveryRows,
+		"EventTypes":    model.WebhookEventTypes,
+		"MaxAttempts":   webhooks.MaxAttempts,
+		"FormError":     formError,
+		"Form":          form,
+	}); err != nil {
+		logging.FromContext(r.Context()).Error("error executing template", "error", err)
+		http.Error(w, "Error executing template", http.StatusInternalServerError)
+		return
+	}
+}
+
+func webhookSubscriptionIdFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("subscription_id"))
+	if err != nil {
+		http.Error(w, "Invalid webhook subscription ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// reloadWebhooks applies subscription changes to the running dispatcher, the change itself is already stored
+func reloadWebhooks(r *http.Request, dispatcher *webhooks.Dispatcher) {
+	if err := dispatcher.Reload(); err != nil {
+		logging.FromContext(r.Context()).Error("failed to reload webhook subscriptions", "error", err)
+	}
+}
+
+func WebhooksHandler(w http.ResponseWriter, r *http.Request, database db.Store) {
+	renderWebhooks(w, r, database, "webhooks.gohtml", "", nil)
+}
+
+func generateWebhookSecret() (string, error) {
+	secret := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// parseWebhookSubscriptionForm builds a subscription from the webhook form, the returned error is meant to be shown to
+// the user
+func parseWebhookSubscriptionForm(r *http.Request) (*model.WebhookSubscription, error) {
+	subscription := model.WebhookSubscription{
+		URL:     strings.TrimSpace(r.FormValue("url")),
+		Secret:  strings.TrimSpace(r.FormValue("secret")),
+		Enabled: true,
+	}
+	target, err := url.Parse(subscription.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errors.New("the URL has to be an absolute http or https URL")
+	}
+
+	known := make(map[model.WebhookEventType]bool, len(model.WebhookEventTypes))
+	for _, eventType := range model.WebhookEventTypes {
+		known[eventType] = true
+	}
+	for _, eventType := range r.Form["eventTypes"] {
+		if !known[model.WebhookEventType(eventType)] {
+			return nil, fmt.Errorf("unknown event type %s", eventType)
+		}
+		subscription.EventTypes = append(subscription.EventTypes, model.WebhookEventType(eventType))
+	}
+	if len(subscription.EventTypes) == 0 {
+		return nil, errors.New("choose at least one event type")
+	}
+	return &subscription, nil
+}
+
+func CreateWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request, database db.Store, dispatcher *webhooks.Dispatcher) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	subscription, err := parseWebhookSubscriptionForm(r)
+	if err != nil {
+		renderWebhooks(w, r, database, "webhooks.gohtml", err.Error(), r.PostForm)
+		return
+	}
+	if subscription.Secret == "" {
+		if subscription.Secret, err = generateWebhookSecret(); err != nil {
+			logging.FromContext(r.Context()).Error("failed to generate webhook secret", "error", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = database.InsertWebhookSubscription(subscription); err != nil {
+		logging.FromContext(r.Context()).Error("failed to create webhook", "error", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	reloadWebhooks(r, dispatcher)
+	renderWebhooks(w, r, database, "webhooks.gohtml", "", nil)
+}
+
+// SetWebhookSubscriptionEnabledHandler enables the subscription, or disables it when the enabled form value is "false"
+func SetWebhookSubscriptionEnabledHandler(w http.ResponseWriter, r *http.Request, database db.Store, dispatcher *webhooks.Dispatcher) {
+	subscriptionId, ok := webhookSubscriptionIdFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if err := database.SetWebhookSubscriptionEnabled(subscriptionId, r.FormValue("enabled") != "false"); err != nil {
+		writeWebhookError(w, r, err, "Failed to update webhook")
+		return
+	}
+	reloadWebhooks(r, dispatcher)
+	renderWebhooks(w, r, database, "webhook_list.gohtml", "", nil)
+}
+
+func DeleteWebhookSubscriptionHandler(w http.ResponseWriter, r *http.Request, database db.Store, dispatcher *webhooks.Dispatcher) {
+	subscriptionId, ok := webhookSubscriptionIdFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := database.DeleteWebhookSubscription(subscriptionId); err != nil {
+		writeWebhookError(w, r, err, "Failed to delete webhook")
+		return
+	}
+	reloadWebhooks(r, dispatcher)
+	renderWebhooks(w, r, database, "webhook_list.gohtml", "", nil)
+}
+
+func writeWebhookError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	logging.FromContext(r.Context()).Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID, a reverse proxy may set it to tie its own logs to the server's
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestId accepts IDs of proxies, they end up in every log line so they have to be short and plain
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware gives every request an ID, taken from the X-Request-ID header or generated, and returns it in the
+// response header. Lines logged with FromContext(r.Context()) carry the ID, the method and the path.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIDHeader)
+		if !validRequestId(requestId) {
+			requestId = NewID()
+		}
+		w.Header().Set(RequestIDHeader, requestId)
+
+		logger := slog.Default().With(
+			slog.String(KeyRequestID, requestId),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), logger)))
+	})
+}
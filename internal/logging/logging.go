@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Keys of the attributes shared by the whole server, so every line of a request, an MQTT message or a device can be
+// found with one search
+const (
+	KeyRequestID  = "request_id"
+	KeyMessageID  = "message_id"
+	KeyDeviceID   = "device_id"
+	KeyDeviceUUID = "device_uuid"
+)
+
+// Setup makes a logger writing to w with given level (debug, info, warn or error) and format (text or json) the
+// default of slog. Lines of the log package and of libraries using it are written by the same logger at info level.
+func Setup(w io.Writer, level string, format string) error {
+	var leveler slog.Level
+	if err := leveler.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+
+	options := &slog.HandlerOptions{Level: leveler}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format %q, use text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	// slog.SetDefault routes the log package to the handler, its own prefix would only duplicate the time
+	log.SetFlags(0)
+	return nil
+}
+
+func DeviceID(deviceId int) slog.Attr {
+	return slog.Int(KeyDeviceID, deviceId)
+}
+
+func DeviceUUID(uuid string) slog.Attr {
+	return slog.String(KeyDeviceUUID, uuid)
+}
+
+// NewID returns a random ID for a request or message
+func NewID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the logger, handlers log with FromContext to keep its attributes
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of the request or message, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
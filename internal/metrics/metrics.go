@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "iot"
+
+var (
+	// MQTTMessages counts the received messages by topic type (login, status, provide_value, state, ack)
+	MQTTMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_messages_total",
+		Help:      "MQTT messages received from devices by topic type.",
+	}, []string{"topic_type"})
+
+	// MQTTHandlerErrors counts the messages their handler failed to process, by topic type
+	MQTTHandlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_handler_errors_total",
+		Help:      "MQTT messages whose handler failed by topic type.",
+	}, []string{"topic_type"})
+
+	// MQTTConnected is 1 while the server is connected to the broker
+	MQTTConnected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "Whether the server is connected to the MQTT broker.",
+	})
+
+	MQTTConnectionsLost = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connections_lost_total",
+		Help:      "Times the connection to the MQTT broker was lost.",
+	})
+
+	MQTTReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_reconnect_attempts_total",
+		Help:      "Attempts to reconnect to the MQTT broker.",
+	})
+
+	// DBQueryDuration observes every db.Database operation, labeled with the name of the Store method
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database operations by operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+
+	// HTTPRequestDuration observes every request, labeled with the pattern of the route it matched
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of HTTP requests by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	SSEClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sse_clients",
+		Help:      "Open server-sent event connections.",
+	})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveQuery records the duration of the named database operation, it is deferred at the start of the operation
+func ObserveQuery(operation string, start time.Time) {
+	DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,14 @@
+package model
+
+type ActionType string
+
+const (
+	ActionTypeToggle       ActionType = "toggle"
+	ActionTypeNumberInput  ActionType = "number_input"
+	ActionTypeProvideValue ActionType = "provide_value"
+	ActionTypeCommand      ActionType = "command"
+)
+
+func (at ActionType) String() string {
+	return string(at)
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type AlertCondition string
+
+const (
+	AlertAbove   AlertCondition = "above"
+	AlertBelow   AlertCondition = "below"
+	AlertOutside AlertCondition = "outside"
+)
+
+type AlertState string
+
+const (
+	AlertActive   AlertState = "active"
+	AlertResolved AlertState = "resolved"
+)
+
+// AlertDefinition watches the numeric readings of one provide_value action. Above uses High, below uses Low and outside
+// uses both. The alert fires once the readings stay out of range for ForSeconds and resolves with the first reading
+// back in range. Channels are the names of the notification channels the alert is sent to.
+type AlertDefinition struct {
+	ID         int            `json:"id"`
+	Name       string         `json:"name"`
+	DeviceID   int            `json:"device_id"`
+	ActionName string         `json:"action_name"`
+	Condition  AlertCondition `json:"condition"`
+	Low        float64        `json:"low,omitempty"`
+	High       float64        `json:"high,omitempty"`
+	ForSeconds int            `json:"for_seconds"`
+	Channels   []string       `json:"channels"`
+	Enabled    bool           `json:"enabled"`
+}
+
+func (ad AlertDefinition) Validate() error {
+	switch ad.Condition {
+	case AlertAbove, AlertBelow:
+	case AlertOutside:
+		if ad.Low >= ad.High {
+			return errors.New("the low bound has to be below the high bound")
+		}
+	default:
+		return fmt.Errorf("unknown alert condition %q", ad.Condition)
+	}
+	if ad.ForSeconds < 0 {
+		return errors.New("duration can not be negative")
+	}
+	return nil
+}
+
+// Breached reports whether value is out of the allowed range
+func (ad AlertDefinition) Breached(value float64) bool {
+	switch ad.Condition {
+	case AlertAbove:
+		return value > ad.High
+	case AlertBelow:
+		return value < ad.Low
+	case AlertOutside:
+		return value < ad.Low || value > ad.High
+	}
+	return false
+}
+
+func (ad AlertDefinition) For() time.Duration {
+	return time.Duration(ad.ForSeconds) * time.Second
+}
+
+// Describe formats the condition for people
+func (ad AlertDefinition) Describe() string {
+	switch ad.Condition {
+	case AlertAbove:
+		return fmt.Sprintf("%s above %g", ad.ActionName, ad.High)
+	case AlertBelow:
+		return fmt.Sprintf("%s below %g", ad.ActionName, ad.Low)
+	}
+	return fmt.Sprintf("%s outside %g - %g", ad.ActionName, ad.Low, ad.High)
+}
+
+// Alert is one firing of an alert definition, BreachedAt is the first reading out of range
+type Alert struct {
+	ID           int        `json:"id"`
+	DefinitionID int        `json:"definition_id"`
+	State        AlertState `json:"state"`
+	Value        float64    `json:"value"`
+	BreachedAt   time.Time  `json:"breached_at"`
+	FiredAt      time.Time  `json:"fired_at"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+}
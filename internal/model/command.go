@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+type CommandStatus string
+
+const (
+	// CommandPending is stored before the command is published
+	CommandPending   CommandStatus = "pending"
+	CommandDelivered CommandStatus = "delivered"
+	CommandSucceeded CommandStatus = "succeeded"
+	CommandFailed    CommandStatus = "failed"
+	CommandTimedOut  CommandStatus = "timed_out"
+)
+
+// Final reports whether the device (or the lack of its answer) has settled the command
+func (cs CommandStatus) Final() bool {
+	return cs == CommandSucceeded || cs == CommandFailed || cs == CommandTimedOut
+}
+
+// Command is an action sent to a device, Source tells who issued it (web, api, rule:<id>, schedule:<id>...)
+type Command struct {
+	ID            int           `json:"id"`
+	CorrelationID string        `json:"correlation_id"`
+	DeviceID      int           `json:"device_id"`
+	ActionName    string        `json:"action_name"`
+	ActionType    ActionType    `json:"action_type"`
+	Value         string        `json:"value,omitempty"`
+	Source        string        `json:"source"`
+	Status        CommandStatus `json:"status"`
+	Error         string        `json:"error,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	CompletedAt   *time.Time    `json:"completed_at,omitempty"`
+}
@@ -1,7 +1,7 @@
 package model
 
 type Dashboard struct {
-	DashboardId int
-	Name        string
-	Devices     []DeviceInDashboard
+	DashboardId int                 `json:"id"`
+	Name        string              `json:"name"`
+	Devices     []DeviceInDashboard `json:"devices"`
 }
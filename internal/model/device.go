@@ -1,5 +1,19 @@
 package model
 
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+// uuidPattern matches the canonical textual form of a UUID, devices log in with it
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidUUID reports whether uuid is a UUID in its canonical textual form
+func ValidUUID(uuid string) bool {
+	return uuidPattern.MatchString(uuid)
+}
+
 type Device struct {
 	ID                int        `json:"id"`
 	UUID              string     `json:"uuid"`
@@ -8,4 +22,41 @@ type Device struct {
 	CustomActions     string     `json:"custom_actions"`
 	DeviceType        DeviceType `json:"device_type"`
 	ActionsTemplateId int        `json:"actions_template_id"`
+	LastLogin         time.Time  `json:"last_login"`
+	Retired           bool       `json:"retired"`
+	LastSeen          time.Time  `json:"last_seen"`
+	// Provisioned devices have a secret they have to present on every login
+	Provisioned bool `json:"provisioned"`
+	// HeartbeatIntervalMs is announced in the login payload by devices that send heartbeats
+	HeartbeatIntervalMs int `json:"heartbeat_interval_ms"`
+}
+
+// ParseActions decodes the JSON encoded template and custom actions of the device
+func (d *Device) ParseActions() (templateActions map[string]ActionType, customActions map[string]ActionType, err error) {
+	templateActions = make(map[string]ActionType)
+	customActions = make(map[string]ActionType)
+	if d.TemplateActions != "" {
+		if err = json.Unmarshal([]byte(d.TemplateActions), &templateActions); err != nil {
+			return nil, nil, err
+		}
+	}
+	if d.CustomActions != "" {
+		if err = json.Unmarshal([]byte(d.CustomActions), &customActions); err != nil {
+			return nil, nil, err
+		}
+	}
+	return templateActions, customActions, nil
+}
+
+// ActionType looks the action up in template actions first and custom actions second
+func (d *Device) ActionType(actionName string) (ActionType, bool, error) {
+	templateActions, customActions, err := d.ParseActions()
+	if err != nil {
+		return "", false, err
+	}
+	if actionType, ok := templateActions[actionName]; ok {
+		return actionType, true, nil
+	}
+	actionType, ok := customActions[actionName]
+	return actionType, ok, nil
 }
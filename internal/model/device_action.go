@@ -0,0 +1,9 @@
+package model
+
+// DeviceAction is a toggle, number_input or command action issued by the server itself (rules, schedules...),
+// Value is only used by number_input actions
+type DeviceAction struct {
+	DeviceID   int    `json:"device_id"`
+	ActionName string `json:"action_name"`
+	Value      string `json:"value,omitempty"`
+}
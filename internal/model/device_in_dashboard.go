@@ -1,7 +1,27 @@
 package model
 
+import "encoding/json"
+
+// ShownAction is an action displayed in a dashboard tile, Chart is only used by provide_value actions
+type ShownAction struct {
+	Type  ActionType `json:"type"`
+	Chart bool       `json:"chart,omitempty"`
+}
+
+// UnmarshalJSON also accepts the original format of shown_actions, where only the action type was stored
+func (a *ShownAction) UnmarshalJSON(data []byte) error {
+	var actionType string
+	if err := json.Unmarshal(data, &actionType); err == nil {
+		*a = ShownAction{Type: ActionType(actionType)}
+		return nil
+	}
+
+	type shownAction ShownAction
+	return json.Unmarshal(data, (*shownAction)(a))
+}
+
 type DeviceInDashboard struct {
-	Device       Device
-	ShownActions map[string]string
-	Position     int
+	Device       Device                 `json:"device"`
+	ShownActions map[string]ShownAction `json:"shown_actions"`
+	Position     int                    `json:"position"`
 }
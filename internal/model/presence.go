@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceOffline PresenceStatus = "offline"
+	PresenceUnknown PresenceStatus = "unknown"
+)
+
+// Presence tells whether a device is connected, HeartbeatInterval is 0 for devices that do not send heartbeats
+type Presence struct {
+	DeviceID          int            `json:"device_id"`
+	Status            PresenceStatus `json:"status"`
+	LastSeen          time.Time      `json:"last_seen"`
+	HeartbeatInterval time.Duration  `json:"-"`
+}
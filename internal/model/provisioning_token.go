@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// ProvisioningToken lets devices that are not known yet log in and receive their secret, only the hash of the token
+// is stored
+type ProvisioningToken struct {
+	ID        int        `json:"id"`
+	Label     string     `json:"label"`
+	UsesLeft  int        `json:"uses_left"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Usable reports whether a device could still log in with the token at now
+func (pt ProvisioningToken) Usable(now time.Time) bool {
+	return pt.UsesLeft > 0 && (pt.ExpiresAt == nil || pt.ExpiresAt.After(now))
+}
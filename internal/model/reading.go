@@ -0,0 +1,33 @@
+package model
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reading is one provide_value message of a device, Values maps action names to their raw JSON values
+type Reading struct {
+	DeviceID  int
+	Timestamp time.Time
+	Values    map[string]json.RawMessage
+}
+
+// Number returns the value of actionName if it is a JSON number or a string holding one
+func (r Reading) Number(actionName string) (float64, bool) {
+	raw, ok := r.Values[actionName]
+	if !ok {
+		return 0, false
+	}
+	var number float64
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number, true
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	return number, err == nil
+}
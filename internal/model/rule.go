@@ -0,0 +1,143 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ConditionOperator string
+
+const (
+	OperatorLess         ConditionOperator = "<"
+	OperatorLessEqual    ConditionOperator = "<="
+	OperatorGreater      ConditionOperator = ">"
+	OperatorGreaterEqual ConditionOperator = ">="
+	OperatorEqual        ConditionOperator = "=="
+	OperatorNotEqual     ConditionOperator = "!="
+	// OperatorRateAbove and OperatorRateBelow compare the change per minute between the last two values
+	OperatorRateAbove ConditionOperator = "rate_above"
+	OperatorRateBelow ConditionOperator = "rate_below"
+)
+
+// ConditionValue is the value a device action is compared to, JSON numbers and booleans are accepted as well
+type ConditionValue string
+
+func (cv *ConditionValue) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*cv = ConditionValue(str)
+		return nil
+	}
+	var scalar interface{}
+	if err := json.Unmarshal(data, &scalar); err != nil {
+		return err
+	}
+	switch scalar.(type) {
+	case float64, bool:
+		*cv = ConditionValue(strings.TrimSpace(string(data)))
+		return nil
+	}
+	return fmt.Errorf("condition value has to be a string, number or boolean")
+}
+
+// Condition is either a comparison of the latest value of one device action or a combination of conditions,
+// All matches when every sub-condition matches, Any when at least one does
+type Condition struct {
+	All        []Condition       `json:"all,omitempty"`
+	Any        []Condition       `json:"any,omitempty"`
+	DeviceID   int               `json:"device_id,omitempty"`
+	ActionName string            `json:"action_name,omitempty"`
+	Operator   ConditionOperator `json:"operator,omitempty"`
+	Value      ConditionValue    `json:"value,omitempty"`
+}
+
+func (c Condition) isLeaf() bool {
+	return c.All == nil && c.Any == nil
+}
+
+func (c Condition) Validate() error {
+	if !c.isLeaf() {
+		if c.All != nil && c.Any != nil {
+			return errors.New("a condition can not have both all and any")
+		}
+		if len(c.All)+len(c.Any) == 0 {
+			return errors.New("all and any need at least one condition")
+		}
+		for _, sub := range append(c.All, c.Any...) {
+			if err := sub.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if c.DeviceID <= 0 || c.ActionName == "" {
+		return errors.New("a comparison needs device_id and action_name")
+	}
+	switch c.Operator {
+	case OperatorEqual, OperatorNotEqual:
+		return nil
+	case OperatorLess, OperatorLessEqual, OperatorGreater, OperatorGreaterEqual, OperatorRateAbove, OperatorRateBelow:
+		if _, err := strconv.ParseFloat(string(c.Value), 64); err != nil {
+			return fmt.Errorf("operator %s needs a numeric value", c.Operator)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operator %q", c.Operator)
+}
+
+// DeviceIDs returns the IDs of all devices the condition depends on
+func (c Condition) DeviceIDs() []int {
+	if c.isLeaf() {
+		return []int{c.DeviceID}
+	}
+	var ids []int
+	for _, sub := range append(c.All, c.Any...) {
+		ids = append(ids, sub.DeviceIDs()...)
+	}
+	return ids
+}
+
+// Describe formats the condition for people, deviceNames maps device IDs to names
+func (c Condition) Describe(deviceNames map[int]string) string {
+	if c.isLeaf() {
+		device, ok := deviceNames[c.DeviceID]
+		if !ok {
+			device = fmt.Sprintf("#%d", c.DeviceID)
+		}
+		return fmt.Sprintf("%s.%s %s %s", device, c.ActionName, c.Operator, c.Value)
+	}
+
+	joiner, subs := " AND ", c.All
+	if c.Any != nil {
+		joiner, subs = " OR ", c.Any
+	}
+	parts := make([]string, len(subs))
+	for i, sub := range subs {
+		parts[i] = sub.Describe(deviceNames)
+		if !sub.isLeaf() {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, joiner)
+}
+
+// Rule fires its action when its condition starts to match, at most once per cooldown
+type Rule struct {
+	ID              int          `json:"id"`
+	Name            string       `json:"name"`
+	Enabled         bool         `json:"enabled"`
+	Condition       Condition    `json:"condition"`
+	Action          DeviceAction `json:"action"`
+	CooldownSeconds int          `json:"cooldown_seconds"`
+	LastFired       *time.Time   `json:"last_fired,omitempty"`
+	LastError       string       `json:"last_error,omitempty"`
+}
+
+func (r Rule) Cooldown() time.Duration {
+	return time.Duration(r.CooldownSeconds) * time.Second
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ScheduleKind string
+
+const (
+	// ScheduleCron runs on a standard five field cron expression
+	ScheduleCron   ScheduleKind = "cron"
+	ScheduleDaily  ScheduleKind = "daily"
+	ScheduleWeekly ScheduleKind = "weekly"
+)
+
+// Schedule issues its action at the times given by a cron expression or a daily/weekly time, both are interpreted
+// in Timezone. Weekdays are only used by weekly schedules, Sunday is 0.
+type Schedule struct {
+	ID             int            `json:"id"`
+	Name           string         `json:"name"`
+	Kind           ScheduleKind   `json:"kind"`
+	CronExpression string         `json:"cron_expression,omitempty"`
+	TimeOfDay      string         `json:"time_of_day,omitempty"`
+	Weekdays       []time.Weekday `json:"weekdays,omitempty"`
+	Timezone       string         `json:"timezone"`
+	Action         DeviceAction   `json:"action"`
+	Paused         bool           `json:"paused"`
+}
+
+// CronSpec returns the schedule as a cron expression prefixed with its timezone
+func (s Schedule) CronSpec() (string, error) {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return "", fmt.Errorf("unknown timezone %q", s.Timezone)
+	}
+
+	var expression string
+	switch s.Kind {
+	case ScheduleCron:
+		expression = strings.TrimSpace(s.CronExpression)
+		if expression == "" || strings.HasPrefix(expression, "CRON_TZ=") || strings.HasPrefix(expression, "TZ=") {
+			return "", errors.New("cron expression is required, the timezone is set separately")
+		}
+	case ScheduleDaily, ScheduleWeekly:
+		at, err := time.Parse("15:04", s.TimeOfDay)
+		if err != nil {
+			return "", fmt.Errorf("time of day has to be HH:MM")
+		}
+		days := "*"
+		if s.Kind == ScheduleWeekly {
+			if len(s.Weekdays) == 0 {
+				return "", errors.New("weekly schedules need at least one weekday")
+			}
+			dayList := make([]string, len(s.Weekdays))
+			for i, day := range s.Weekdays {
+				dayList[i] = strconv.Itoa(int(day))
+			}
+			days = strings.Join(dayList, ",")
+		}
+		expression = fmt.Sprintf("%d %d * * %s", at.Minute(), at.Hour(), days)
+	default:
+		return "", fmt.Errorf("unknown schedule kind %q", s.Kind)
+	}
+	return fmt.Sprintf("CRON_TZ=%s %s", s.Timezone, expression), nil
+}
+
+// Describe formats when the schedule runs for people
+func (s Schedule) Describe() string {
+	switch s.Kind {
+	case ScheduleDaily:
+		return fmt.Sprintf("daily at %s (%s)", s.TimeOfDay, s.Timezone)
+	case ScheduleWeekly:
+		days := make([]string, len(s.Weekdays))
+		for i, day := range s.Weekdays {
+			days[i] = day.String()[:3]
+		}
+		return fmt.Sprintf("%s at %s (%s)", strings.Join(days, ", "), s.TimeOfDay, s.Timezone)
+	}
+	return fmt.Sprintf("%s (%s)", s.CronExpression, s.Timezone)
+}
+
+// ScheduleRun is one execution of a schedule, CommandStatus follows the command it issued. Failed runs that could not
+// issue a command have no correlation ID.
+type ScheduleRun struct {
+	ID            int           `json:"id"`
+	ScheduleID    int           `json:"schedule_id"`
+	ScheduleName  string        `json:"schedule_name"`
+	RanAt         time.Time     `json:"ran_at"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	CommandStatus CommandStatus `json:"command_status,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleCronSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     string
+		wantErr  string
+	}{
+		{"daily", Schedule{Kind: ScheduleDaily, TimeOfDay: "07:05", Timezone: "UTC"}, "CRON_TZ=UTC 5 7 * * *", ""},
+		{"daily in another timezone", Schedule{Kind: ScheduleDaily, TimeOfDay: "23:30", Timezone: "Europe/Prague"},
+			"CRON_TZ=Europe/Prague 30 23 * * *", ""},
+		{"weekly", Schedule{Kind: ScheduleWeekly, TimeOfDay: "18:00", Timezone: "America/New_York",
+			Weekdays: []time.Weekday{time.Sunday, time.Wednesday, time.Saturday}}, "CRON_TZ=America/New_York 0 18 * * 0,3,6", ""},
+		{"cron", Schedule{Kind: ScheduleCron, CronExpression: " */15 8-17 * * 1-5 ", Timezone: "Asia/Tokyo"},
+			"CRON_TZ=Asia/Tokyo */15 8-17 * * 1-5", ""},
+
+		{"unknown timezone", Schedule{Kind: ScheduleDaily, TimeOfDay: "07:00", Timezone: "Mars/Olympus"}, "", "unknown timezone"},
+		{"invalid time of day", Schedule{Kind: ScheduleDaily, TimeOfDay: "7 am", Timezone: "UTC"}, "", "HH:MM"},
+		{"time of day out of range", Schedule{Kind: ScheduleDaily, TimeOfDay: "24:00", Timezone: "UTC"}, "", "HH:MM"},
+		{"weekly without weekdays", Schedule{Kind: ScheduleWeekly, TimeOfDay: "07:00", Timezone: "UTC"}, "", "weekday"},
+		{"empty cron", Schedule{Kind: ScheduleCron, CronExpression: "  ", Timezone: "UTC"}, "", "cron expression is required"},
+		{"timezone in the cron expression", Schedule{Kind: ScheduleCron, CronExpression: "CRON_TZ=UTC 0 * * * *", Timezone: "UTC"},
+			"", "timezone is set separately"},
+		{"unknown kind", Schedule{Kind: "hourly", Timezone: "UTC"}, "", "unknown schedule kind"},
+	}
+	for _, test := range tests {
+		spec, err := test.schedule.CronSpec()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: CronSpec = %q, %v, want an error about %s", test.name, spec, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || spec != test.want {
+			t.Errorf("%s: CronSpec = %q, %v, want %q", test.name, spec, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type SensorValue struct {
+	Value     json.RawMessage `json:"value"`
+	Timestamp time.Time       `json:"timestamp"`
+}
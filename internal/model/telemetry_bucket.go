@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// TelemetryBucket aggregates the numeric readings of one action within a time bucket
+type TelemetryBucket struct {
+	Bucket time.Time `json:"bucket"`
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Avg    float64   `json:"avg"`
+	Count  int       `json:"count"`
+	Last   float64   `json:"last"`
+}
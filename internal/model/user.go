@@ -0,0 +1,45 @@
+package model
+
+import "time"
+
+// Role caps what a user may do, viewers only look at what they were granted, operators may also control the devices
+// they were granted control of and admins may do everything, including managing users and devices
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Roles lists every role from the least to the most privileged
+var Roles = []Role{RoleViewer, RoleOperator, RoleAdmin}
+
+func (r Role) Valid() bool {
+	return r == RoleViewer || r == RoleOperator || r == RoleAdmin
+}
+
+// User is an account of the web interface, the password is only kept as a bcrypt hash
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	Role         Role      `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Access string
+
+const (
+	AccessView    Access = "view"
+	AccessControl Access = "control"
+)
+
+// Grant gives a user access to either a dashboard or a device, the other ID is 0. Control of a dashboard covers every
+// device shown on it, grants only add up so a device can not be excluded from a dashboard grant.
+type Grant struct {
+	UserID      int    `json:"user_id"`
+	DashboardID int    `json:"dashboard_id,omitempty"`
+	DeviceID    int    `json:"device_id,omitempty"`
+	Access      Access `json:"access"`
+}
@@ -0,0 +1,56 @@
+package model
+
+import "time"
+
+type WebhookEventType string
+
+const (
+	WebhookDeviceLogin  WebhookEventType = "device.login"
+	WebhookStateChanged WebhookEventType = "device.state"
+	WebhookTelemetry    WebhookEventType = "device.telemetry"
+	WebhookCommandSent  WebhookEventType = "command.sent"
+)
+
+// WebhookEventTypes lists every event type subscriptions can choose from
+var WebhookEventTypes = []WebhookEventType{WebhookDeviceLogin, WebhookStateChanged, WebhookTelemetry, WebhookCommandSent}
+
+// WebhookSubscription receives the events of the chosen types, every request is signed with Secret
+type WebhookSubscription struct {
+	ID         int                `json:"id"`
+	URL        string             `json:"url"`
+	Secret     string             `json:"-"`
+	EventTypes []WebhookEventType `json:"event_types"`
+	Enabled    bool               `json:"enabled"`
+}
+
+func (ws WebhookSubscription) Wants(eventType WebhookEventType) bool {
+	for _, wanted := range ws.EventTypes {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDeliveryStatus string
+
+const (
+	DeliveryPending   WebhookDeliveryStatus = "pending"
+	DeliverySucceeded WebhookDeliveryStatus = "succeeded"
+	DeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery is one event sent to one subscription, pending deliveries are retried until they succeed or run out
+// of attempts. ResponseStatus and Error describe the last attempt.
+type WebhookDelivery struct {
+	ID             int                   `json:"id"`
+	SubscriptionID int                   `json:"subscription_id"`
+	EventType      WebhookEventType      `json:"event_type"`
+	Payload        string                `json:"payload"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts"`
+	ResponseStatus int                   `json:"response_status,omitempty"`
+	Error          string                `json:"error,omitempty"`
+	CreatedAt      time.Time             `json:"created_at"`
+	LastAttemptAt  *time.Time            `json:"last_attempt_at,omitempty"`
+}
@@ -0,0 +1,38 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"context"
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+)
+
+// AckHandler handles ack/<uuid> messages, devices answer every command with its correlation ID and
+// a "succeeded" or "failed" status
+func AckHandler(ctx context.Context, msg MQTT.Message, database db.Store, sender *commands.Sender) error {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 2 {
+		return errInvalidTopic
+	}
+	uuid := parts[1]
+
+	deviceId, err := database.GetDeviceIDByUUID(uuid)
+	if err != nil {
+		return fmt.Errorf("error retrieving device ID for UUID %s: %v", uuid, err)
+	}
+
+	var ack commands.Ack
+	if err = json.Unmarshal(msg.Payload(), &ack); err != nil {
+		return fmt.Errorf("error decoding ack of device %s: %v", uuid, err)
+	}
+
+	if err = sender.Acknowledge(deviceId, ack); err != nil {
+		return fmt.Errorf("rejected ack %s of device %s: %v", ack.CorrelationID, uuid, err)
+	}
+	logging.FromContext(ctx).Debug("command acknowledged", logging.DeviceID(deviceId), "correlation_id", ack.CorrelationID, "status", ack.Status)
+	return nil
+}
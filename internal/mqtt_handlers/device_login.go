@@ -1,53 +1,217 @@
 package mqtt_handlers
 
 import (
+	"NSI-semester-work/internal/auth"
 	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
 	"NSI-semester-work/internal/model"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"log"
-	"os"
+	"time"
 )
 
-func HandleDeviceLogin(client MQTT.Client, msg MQTT.Message, database *db.Database) {
-	var device model.Device
-	if err := json.Unmarshal(msg.Payload(), &device); err != nil {
-		log.Printf("Error decoding JSON: %s", err)
-		return
+// LoginConsumer is called after a device logged in and received its state, it must not block
+type LoginConsumer func(device model.Device)
+
+// Login statuses and the reasons sent to devices whose login was rejected
+const (
+	rejectUnknownDevice   = "unknown_device"
+	rejectNotProvisioned  = "not_provisioned"
+	rejectInvalidSecret   = "invalid_secret"
+	rejectInvalidToken    = "invalid_token"
+	loginStatusSuccessful = "successful"
+	loginStatusRejected   = "rejected"
+)
+
+// loginRequest is the login payload, the credentials are kept out of model.Device so they never end up in webhooks
+type loginRequest struct {
+	model.Device
+	Secret            string `json:"secret"`
+	ProvisioningToken string `json:"provisioning_token"`
+}
+
+type loginResponse struct {
+	Login  string          `json:"login"`
+	Reason string          `json:"reason,omitempty"`
+	State  json.RawMessage `json:"state,omitempty"`
+	// Secret is only sent once, when the device was provisioned with a token
+	Secret string `json:"secret,omitempty"`
+}
+
+// provisioning is how a device that may log in gets its secret
+type provisioning int
+
+const (
+	// provisionNone is a device that presented its secret
+	provisionNone provisioning = iota
+	// provisionNew uses up the provisioning token for a new secret
+	provisionNew
+	// provisionRetry issues a new secret for the token that was already used up for the device, the device did not
+	// confirm the first one by logging in with it, e.g. because the login response was lost
+	provisionRetry
+)
+
+// publishLoginResponse sends the response with QoS 1, it may carry the only copy of a newly issued secret
+func publishLoginResponse(client MQTT.Client, responseTopic string, uuid string, response loginResponse) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode login response: %v", err)
+	}
+	token := client.Publish(responseTopic+uuid, 1, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func rejectLogin(ctx context.Context, client MQTT.Client, responseTopic string, uuid string, reason string) error {
+	logging.FromContext(ctx).Warn("rejected device login", "reason", reason)
+	return publishLoginResponse(client, responseTopic, uuid, loginResponse{Login: loginStatusRejected, Reason: reason})
+}
+
+// authenticateDevice checks the credentials of the login request. Provisioned devices have to present their secret,
+// unknown and not yet provisioned devices have to present a usable provisioning token and receive a new secret in
+// return. A device that never logged in with the secret issued for its token may present the token again. An empty
+// reason means the device may log in, the token is only used up once the device is registered.
+func authenticateDevice(request *loginRequest, database db.Store) (provision provisioning, reason string, err error) {
+	deviceId, secretHash, tokenHash, err := database.FetchDeviceCredentials(request.UUID)
+	known := true
+	if errors.Is(err, sql.ErrNoRows) {
+		known = false
+	} else if err != nil {
+		return provisionNone, "", err
+	}
+
+	if secretHash != "" {
+		if auth.TokenMatches(request.Secret, secretHash) {
+			if tokenHash != "" {
+				if err = database.ConfirmDeviceSecret(deviceId); err != nil {
+					return provisionNone, "", fmt.Errorf("failed to confirm device secret: %v", err)
+				}
+			}
+			return provisionNone, "", nil
+		}
+		if auth.TokenMatches(request.ProvisioningToken, tokenHash) {
+			return provisionRetry, "", nil
+		}
+		return provisionNone, rejectInvalidSecret, nil
+	}
+
+	if request.ProvisioningToken == "" {
+		if known {
+			return provisionNone, rejectNotProvisioned, nil
+		}
+		return provisionNone, rejectUnknownDevice, nil
+	}
+	token, err := database.FetchProvisioningToken(auth.HashToken(request.ProvisioningToken))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !token.Usable(time.Now())) {
+		return provisionNone, rejectInvalidToken, nil
+	}
+	if err != nil {
+		return provisionNone, "", err
+	}
+	return provisionNew, "", nil
+}
+
+// issueSecret stores a new secret for the device. A new secret uses up the token and registers the device in the
+// same transaction, so a device is never registered without a secret when the token is used up by another device in
+// the meantime. A retry replaces the unconfirmed secret of the registered device. An empty secret means the token was
+// used up or deleted since the credentials were checked.
+func issueSecret(database db.Store, device *model.Device, provisioningToken string, provision provisioning) (string, error) {
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	tokenHash := auth.HashToken(provisioningToken)
+	if provision == provisionRetry {
+		err = database.ReissueDeviceSecret(device.ID, tokenHash, auth.HashToken(secret))
+	} else {
+		err = database.ProvisionDevice(device, tokenHash, auth.HashToken(secret))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// HandleDeviceLogin answers the login request on responseTopic followed by the device UUID, a rejected login is not
+// an error
+func HandleDeviceLogin(ctx context.Context, client MQTT.Client, msg MQTT.Message, database db.Store, responseTopic string, consumers ...LoginConsumer) error {
+	var request loginRequest
+	if err := json.Unmarshal(msg.Payload(), &request); err != nil {
+		return fmt.Errorf("error decoding JSON: %v", err)
+	}
+	device := request.Device
+	if device.UUID == "" {
+		return errors.New("login request without a device UUID")
+	}
+	logger := logging.FromContext(ctx)
+
+	provision, reason, err := authenticateDevice(&request, database)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate device %s: %v", device.UUID, err)
+	}
+	if reason != "" {
+		return rejectLogin(ctx, client, responseTopic, device.UUID, reason)
 	}
-	log.Println(device)
 
 	actionTemplateId, err := database.FetchTemplateActions(device.DeviceType)
 	if actionTemplateId == -1 {
 		if !errors.Is(err, sql.ErrNoRows) {
-			fmt.Printf("unable to fetch template actionTemplateId %s\n", err)
-			return
+			return fmt.Errorf("unable to fetch template actionTemplateId %v", err)
 		}
 	}
 
 	device.ActionsTemplateId = actionTemplateId
-	err = database.RegisterDevice(&device)
-	if err != nil {
-		log.Println(err)
+	// devices receiving their first secret are registered by issueSecret
+	if provision != provisionNew {
+		err = database.RegisterDevice(&device)
+		if err != nil {
+			logger.Error("failed to register device", "error", err)
+		}
+
+		device.ID, err = database.GetDeviceIDByUUID(device.UUID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch device id: %v", err)
+		}
 	}
 
-	deviceId, err := database.GetDeviceIDByUUID(device.UUID)
-	if err != nil {
-		log.Println("Failed to fetch device id")
-		return
+	issuedSecret := ""
+	if provision != provisionNone {
+		issuedSecret, err = issueSecret(database, &device, request.ProvisioningToken, provision)
+		if err != nil {
+			return fmt.Errorf("failed to store device secret: %v", err)
+		}
+		if issuedSecret == "" {
+			return rejectLogin(ctx, client, responseTopic, device.UUID, rejectInvalidToken)
+		}
+		device.Provisioned = true
 	}
+	deviceId := device.ID
 
 	stateJson, err := database.GetDeviceStates(deviceId)
 	if err != nil {
-		log.Printf("Failed to fetch device states: %s", err)
-		return
+		return fmt.Errorf("failed to fetch device states: %v", err)
 	}
 
-	responseTopic := os.Getenv("MQTT_LOGIN_RESPONSE_TOPIC") + device.UUID
-	responsePayload := fmt.Sprintf("{\"login\": \"successful\", \"state\": %s}", stateJson)
-	token := client.Publish(responseTopic, 0, false, []byte(responsePayload))
-	token.Wait()
+	err = publishLoginResponse(client, responseTopic, device.UUID, loginResponse{
+		Login:  loginStatusSuccessful,
+		State:  json.RawMessage(stateJson),
+		Secret: issuedSecret,
+	})
+	if err != nil {
+		logger.Error("failed to answer the login", logging.DeviceID(deviceId), "error", err)
+	}
+	logger.Info("device logged in", logging.DeviceID(deviceId), "name", device.Name, "device_type", device.DeviceType,
+		"provisioned_now", issuedSecret != "", "secret_reissued", provision == provisionRetry)
+
+	for _, consumer := range consumers {
+		consumer(device)
+	}
+	return nil
 }
@@ -0,0 +1,177 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/auth"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"encoding/json"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+const loginUuid = "123e4567-e89b-12d3-a456-426614174000"
+
+// doneToken is a token that completed without an error
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+type publishedMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+// recordingClient records what is published, the rest of MQTT.Client is not used by the handlers under test
+type recordingClient struct {
+	MQTT.Client
+	published []publishedMessage
+}
+
+func (c *recordingClient) Publish(topic string, qos byte, _ bool, payload interface{}) MQTT.Token {
+	c.published = append(c.published, publishedMessage{topic: topic, qos: qos, payload: payload.([]byte)})
+	return doneToken{}
+}
+
+type testMessage struct {
+	MQTT.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+
+// login sends a login request and returns the response
+func login(t *testing.T, database db.Store, secret string, provisioningToken string) loginResponse {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]string{
+		"uuid":               loginUuid,
+		"name":               "Lamp",
+		"device_type":        "light_switch",
+		"secret":             secret,
+		"provisioning_token": provisioningToken,
+	})
+	client := &recordingClient{}
+	msg := &testMessage{topic: "login/request/" + loginUuid, payload: payload}
+	if err := HandleDeviceLogin(context.Background(), client, msg, database, "login/response/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.published) != 1 {
+		t.Fatalf("published %d messages", len(client.published))
+	}
+	published := client.published[0]
+	if published.topic != "login/response/"+loginUuid || published.qos != 1 {
+		t.Errorf("the response was published to %s with QoS %d", published.topic, published.qos)
+	}
+	var response loginResponse
+	if err := json.Unmarshal(published.payload, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func expectRejected(t *testing.T, response loginResponse, reason string) {
+	t.Helper()
+	if response.Login != loginStatusRejected || response.Reason != reason || response.Secret != "" {
+		t.Errorf("expected a rejection for %s, got %+v", reason, response)
+	}
+}
+
+func TestDeviceLoginProvisioning(t *testing.T) {
+	database := db.NewMemoryStore()
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token),
+		&model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRejected(t, login(t, database, "", "wrong-token"), rejectInvalidToken)
+	if _, err := database.GetDeviceIDByUUID(loginUuid); err == nil {
+		t.Error("a device with an invalid token was registered")
+	}
+	expectRejected(t, login(t, database, "", ""), rejectUnknownDevice)
+
+	first := login(t, database, "", token)
+	if first.Login != loginStatusSuccessful || first.Secret == "" {
+		t.Fatalf("provisioning failed: %+v", first)
+	}
+	if stored, _ := database.FetchProvisioningToken(auth.HashToken(token)); stored.UsesLeft != 0 {
+		t.Errorf("the token has %d uses left", stored.UsesLeft)
+	}
+
+	// the device did not receive the first response and presents the used up token again
+	retry := login(t, database, "", token)
+	if retry.Login != loginStatusSuccessful || retry.Secret == "" || retry.Secret == first.Secret {
+		t.Fatalf("the retry was not issued a new secret: %+v", retry)
+	}
+	expectRejected(t, login(t, database, first.Secret, ""), rejectInvalidSecret)
+
+	// logging in with the secret confirms it, the token can not replace it afterwards
+	if response := login(t, database, retry.Secret, ""); response.Login != loginStatusSuccessful || response.Secret != "" {
+		t.Fatalf("login with the secret failed: %+v", response)
+	}
+	expectRejected(t, login(t, database, "", token), rejectInvalidSecret)
+	if response := login(t, database, retry.Secret, ""); response.Login != loginStatusSuccessful {
+		t.Errorf("the confirmed secret was rejected: %+v", response)
+	}
+}
+
+func TestDeviceLoginRetryAfterTokenDeleted(t *testing.T) {
+	database := db.NewMemoryStore()
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token),
+		&model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if response := login(t, database, "", token); response.Login != loginStatusSuccessful {
+		t.Fatalf("provisioning failed: %+v", response)
+	}
+
+	stored, err := database.FetchProvisioningToken(auth.HashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.DeleteProvisioningToken(stored.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectRejected(t, login(t, database, "", token), rejectInvalidToken)
+}
+
+// racingStore lets another device use up the token right after the login checked it
+type racingStore struct {
+	*db.MemoryStore
+}
+
+func (s racingStore) FetchProvisioningToken(tokenHash string) (*model.ProvisioningToken, error) {
+	token, err := s.MemoryStore.FetchProvisioningToken(tokenHash)
+	other := &model.Device{UUID: "123e4567-e89b-12d3-a456-426614174999", Name: "Other", ActionsTemplateId: -1}
+	if provisionErr := s.MemoryStore.ProvisionDevice(other, tokenHash, "other-secret-hash"); provisionErr != nil {
+		panic(provisionErr)
+	}
+	return token, err
+}
+
+func TestDeviceLoginTokenUsedUpMeanwhile(t *testing.T) {
+	database := db.NewMemoryStore()
+	token := "provisioning-token"
+	if err := database.InsertProvisioningToken(auth.HashToken(token),
+		&model.ProvisioningToken{Label: "test", UsesLeft: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the device is not registered, it would be locked out without a secret
+	expectRejected(t, login(t, racingStore{database}, "", token), rejectInvalidToken)
+	if _, err := database.GetDeviceIDByUUID(loginUuid); err == nil {
+		t.Error("the device was registered without a secret")
+	}
+}
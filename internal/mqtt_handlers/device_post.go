@@ -1,37 +1,33 @@
 package mqtt_handlers
 
 import (
-	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"context"
+	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"log"
 	"strings"
 )
 
-func ValueProvidedHandler(msg MQTT.Message, database *db.Database) {
+func ValueProvidedHandler(ctx context.Context, msg MQTT.Message, pipeline *ValuePipeline) error {
 	topic := msg.Topic()
-	log.Printf("Message received on topic: %s", topic)
 
 	// Assume topic structure is "provide_value/<device_uuid>"
 	parts := strings.Split(topic, "/")
 	if len(parts) != 2 {
-		log.Println("Invalid topic format")
-		return
+		return errInvalidTopic
 	}
 	uuid := parts[1]
 
-	payloadStr := string(msg.Payload())
-	deviceId, err := database.GetDeviceIDByUUID(uuid)
+	deviceId, err := pipeline.database.GetDeviceIDByUUID(uuid)
 	if err != nil {
-		log.Printf("Error retrieving device ID for UUID %s: %s", uuid, err)
-		return
+		return fmt.Errorf("error retrieving device ID for UUID %s: %v", uuid, err)
 	}
 
-	// Insert or update the provided value for the device in the database
-	if err := database.InsertProvidedValue(deviceId, payloadStr); err != nil {
-		log.Printf("Error updating provided value in the database for device %s: %s", uuid, err)
-		return
+	// Store the provided value and hand it to the consumers
+	if err := pipeline.Ingest(deviceId, msg.Payload()); err != nil {
+		return fmt.Errorf("error storing provided value for device %s: %v", uuid, err)
 	}
 
-	// Log successful update
-	log.Printf("Updated provided value for device %s with payload: %s", uuid, payloadStr)
+	logging.FromContext(ctx).Debug("stored provided value", logging.DeviceID(deviceId), "payload", string(msg.Payload()))
+	return nil
 }
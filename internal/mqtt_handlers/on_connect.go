@@ -1,11 +1,13 @@
 package mqtt_handlers
 
 import (
+	"NSI-semester-work/internal/metrics"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"log"
+	"log/slog"
 )
 
 func OnConnectHandler(client MQTT.Client) {
+	metrics.MQTTConnected.Set(1)
 	optsReader := client.OptionsReader()
-	log.Printf("Connected to mqtt broker: %s", optsReader.Servers()[0])
+	slog.Info("connected to mqtt broker", "broker", optsReader.Servers()[0].String())
 }
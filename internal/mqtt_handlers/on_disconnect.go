@@ -1,10 +1,13 @@
 package mqtt_handlers
 
 import (
-	"fmt"
+	"NSI-semester-work/internal/metrics"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
 )
 
 func OnConnectionLost(client MQTT.Client, err error) {
-	fmt.Printf("Connect lost: %v", err)
+	metrics.MQTTConnected.Set(0)
+	metrics.MQTTConnectionsLost.Inc()
+	slog.Warn("lost the connection to the mqtt broker", "error", err)
 }
@@ -1,10 +1,12 @@
 package mqtt_handlers
 
 import (
+	"NSI-semester-work/internal/metrics"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"log"
+	"log/slog"
 )
 
 func OnReconnectingHandler(client MQTT.Client, opts *MQTT.ClientOptions) {
-	log.Println("reconnecting mqtt client")
+	metrics.MQTTReconnects.Inc()
+	slog.Info("reconnecting mqtt client")
 }
@@ -0,0 +1,104 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"context"
+	"testing"
+)
+
+// registeredDevice returns a MemoryStore with one light switch registered under loginUuid
+func registeredDevice(t *testing.T) (*db.MemoryStore, int) {
+	t.Helper()
+	database := db.NewMemoryStore()
+	templateId, err := database.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.RegisterDevice(&model.Device{UUID: loginUuid, Name: "Lamp", ActionsTemplateId: templateId}); err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := database.GetDeviceIDByUUID(loginUuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database, deviceId
+}
+
+func TestStateUpdatedHandler(t *testing.T) {
+	database, deviceId := registeredDevice(t)
+	pipeline := NewStatePipeline(database)
+	var updates []model.Update
+	pipeline.Attach(func(update model.Update) {
+		// consumers only see persisted updates
+		if state, err := database.GetDeviceState(update.DeviceID, update.ActionName); err != nil || state != update.State {
+			t.Errorf("the update %+v was not persisted before the consumer was called: %s, %v", update, state, err)
+		}
+		updates = append(updates, update)
+	})
+
+	msg := &testMessage{topic: "state_updated/" + loginUuid, payload: []byte(`{"Action_name": "Light_state", "Light_state": "on"}`)}
+	if err := StateUpdatedHandler(context.Background(), msg, pipeline); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0] != (model.Update{DeviceID: deviceId, ActionName: "Light_state", State: "on"}) {
+		t.Errorf("unexpected updates %+v", updates)
+	}
+
+	invalid := []*testMessage{
+		{topic: "state_updated", payload: []byte(`{"Action_name": "Light_state", "Light_state": "off"}`)},
+		{topic: "state_updated/" + loginUuid, payload: []byte(`not json`)},
+		{topic: "state_updated/" + loginUuid, payload: []byte(`{"Light_state": "off"}`)},
+		{topic: "state_updated/" + loginUuid, payload: []byte(`{"Action_name": "Light_state", "Light_state": 1}`)},
+		{topic: "state_updated/00000000-0000-4000-8000-000000000000", payload: []byte(`{"Action_name": "Light_state", "Light_state": "off"}`)},
+	}
+	for _, msg := range invalid {
+		if err := StateUpdatedHandler(context.Background(), msg, pipeline); err == nil {
+			t.Errorf("the message %s %s was accepted", msg.topic, msg.payload)
+		}
+	}
+	if state, _ := database.GetDeviceState(deviceId, "Light_state"); state != "on" || len(updates) != 1 {
+		t.Errorf("an invalid message changed the state to %s or reached the consumers %+v", state, updates)
+	}
+}
+
+func TestValueProvidedHandler(t *testing.T) {
+	database, deviceId := registeredDevice(t)
+	pipeline := NewValuePipeline(database)
+	var readings []model.Reading
+	pipeline.Attach(func(reading model.Reading) {
+		readings = append(readings, reading)
+	})
+
+	msg := &testMessage{topic: "provide_value/" + loginUuid, payload: []byte(`{"Temperature": 21.5}`)}
+	if err := ValueProvidedHandler(context.Background(), msg, pipeline); err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 1 || readings[0].DeviceID != deviceId || readings[0].Timestamp.IsZero() {
+		t.Fatalf("unexpected readings %+v", readings)
+	}
+	if temperature, ok := readings[0].Number("Temperature"); !ok || temperature != 21.5 {
+		t.Errorf("the consumed temperature is %v", temperature)
+	}
+	stored, err := database.GetLastSensorReading(deviceId, "Temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored.Value) != "21.5" || !stored.Timestamp.Equal(readings[0].Timestamp) {
+		t.Errorf("the stored reading %s at %v does not match the consumed one", stored.Value, stored.Timestamp)
+	}
+
+	invalid := []*testMessage{
+		{topic: "provide_value/" + loginUuid + "/extra", payload: []byte(`{"Temperature": 22}`)},
+		{topic: "provide_value/00000000-0000-4000-8000-000000000000", payload: []byte(`{"Temperature": 22}`)},
+		{topic: "provide_value/" + loginUuid, payload: []byte(`22`)},
+	}
+	for _, msg := range invalid {
+		if err := ValueProvidedHandler(context.Background(), msg, pipeline); err == nil {
+			t.Errorf("the message %s %s was accepted", msg.topic, msg.payload)
+		}
+	}
+	if value, _ := database.GetLastSensorValue(deviceId, "Temperature"); value != "21.5" || len(readings) != 1 {
+		t.Errorf("an invalid message was stored as %s or reached the consumers %+v", value, readings)
+	}
+}
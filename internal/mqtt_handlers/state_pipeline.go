@@ -0,0 +1,45 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"fmt"
+	"sync"
+)
+
+// StateConsumer is called with every state update after it was persisted, it must not block
+type StateConsumer func(update model.Update)
+
+// StatePipeline persists device state updates and passes them on to the attached consumers (SSE, rules, webhooks...)
+type StatePipeline struct {
+	database  db.Store
+	mu        sync.RWMutex
+	consumers []StateConsumer
+}
+
+func NewStatePipeline(database db.Store) *StatePipeline {
+	return &StatePipeline{database: database}
+}
+
+func (p *StatePipeline) Attach(consumer StateConsumer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consumers = append(p.consumers, consumer)
+}
+
+// Ingest stores the update in devices.state, consumers are only notified once the state is persisted
+func (p *StatePipeline) Ingest(update model.Update) error {
+	stateMap := map[string]interface{}{
+		update.ActionName: update.State,
+	}
+	if err := p.database.UpdateDeviceState(update.DeviceID, stateMap); err != nil {
+		return fmt.Errorf("unable to update state of device %d: %v", update.DeviceID, err)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, consumer := range p.consumers {
+		consumer(update)
+	}
+	return nil
+}
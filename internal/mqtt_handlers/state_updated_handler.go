@@ -1,54 +1,61 @@
 package mqtt_handlers
 
 import (
-	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
 	"NSI-semester-work/internal/model"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"log"
 	"strings"
 )
 
-func parseMessage(msg MQTT.Message) (uuid string, actionName string, stateValue string) {
+// errInvalidTopic is returned for messages on topics without the device UUID as their second level
+var errInvalidTopic = errors.New("invalid topic format")
+
+func parseMessage(msg MQTT.Message) (uuid string, actionName string, stateValue string, err error) {
 	topicParts := strings.Split(msg.Topic(), "/")
 	if len(topicParts) < 2 {
-		log.Println("Invalid topic format")
-		return "", "", ""
+		return "", "", "", errInvalidTopic
 	}
 	uuid = topicParts[1]
 
 	var jsonData map[string]interface{}
-	err := json.Unmarshal(msg.Payload(), &jsonData)
+	err = json.Unmarshal(msg.Payload(), &jsonData)
 	if err != nil {
-		log.Println("JSON parsing error:", err)
-		return "", "", ""
+		return "", "", "", fmt.Errorf("JSON parsing error: %v", err)
 	}
 
 	actionName, ok := jsonData["Action_name"].(string)
 	if !ok {
-		log.Println("Action_name not found or invalid")
-		return "", "", ""
+		return "", "", "", errors.New("Action_name not found or invalid")
 	}
 
 	stateValue, ok = jsonData[actionName].(string)
 	if !ok {
-		log.Printf("State value not found or invalid: %s\n", stateValue)
-		return "", "", ""
+		return "", "", "", fmt.Errorf("state value of %s not found or invalid", actionName)
 	}
 
-	return uuid, actionName, stateValue
+	return uuid, actionName, stateValue, nil
 }
-func StateUpdatedHandler(message MQTT.Message, database *db.Database, sseChannel chan model.Update) {
+func StateUpdatedHandler(ctx context.Context, message MQTT.Message, pipeline *StatePipeline) error {
 	var update model.Update
 
-	var deviceUuid string
-	deviceUuid, update.ActionName, update.State = parseMessage(message)
-	deviceId, err := database.GetDeviceIDByUUID(deviceUuid)
+	deviceUuid, actionName, state, err := parseMessage(message)
+	if err != nil {
+		return err
+	}
+	update.ActionName, update.State = actionName, state
+	deviceId, err := pipeline.database.GetDeviceIDByUUID(deviceUuid)
 	if err != nil {
-		fmt.Printf("no such device with this uuid %d\n", update.DeviceID)
-		return
+		return fmt.Errorf("no such device with this uuid %s: %v", deviceUuid, err)
 	}
 	update.DeviceID = deviceId
-	sseChannel <- update
+
+	if err = pipeline.Ingest(update); err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Debug("stored device state", logging.DeviceID(deviceId), "action", update.ActionName, "state", update.State)
+	return nil
 }
@@ -0,0 +1,38 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/presence"
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+)
+
+// StatusHandler handles status/<uuid> messages, "offline" is expected as the device's last will,
+// "online" after connecting and "heartbeat" periodically
+func StatusHandler(ctx context.Context, msg MQTT.Message, database db.Store, tracker *presence.Tracker) error {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 2 {
+		return errInvalidTopic
+	}
+	uuid := parts[1]
+
+	deviceId, err := database.GetDeviceIDByUUID(uuid)
+	if err != nil {
+		return fmt.Errorf("error retrieving device ID for UUID %s: %v", uuid, err)
+	}
+
+	status := strings.TrimSpace(string(msg.Payload()))
+	logging.FromContext(ctx).Debug("device status", logging.DeviceID(deviceId), "status", status)
+	switch status {
+	case "online", "heartbeat":
+		tracker.Seen(deviceId)
+	case "offline":
+		tracker.SetOffline(deviceId)
+	default:
+		return fmt.Errorf("unknown status %q of device %s", status, uuid)
+	}
+	return nil
+}
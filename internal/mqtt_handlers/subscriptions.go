@@ -0,0 +1,87 @@
+package mqtt_handlers
+
+import (
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"log/slog"
+	"sync"
+)
+
+var errNotSubscribed = errors.New("not subscribed to the device topics")
+
+type subscription struct {
+	topic   string
+	qos     byte
+	handler MQTT.MessageHandler
+}
+
+// Subscriptions keeps the topics of the server and whether the client is subscribed to them. The sessions are clean,
+// the broker forgets the subscriptions with the connection, so they are renewed on every connect.
+type Subscriptions struct {
+	mu            sync.Mutex
+	subscriptions []subscription
+	// err is nil while the client is subscribed to every topic
+	err error
+}
+
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{err: errNotSubscribed}
+}
+
+// Add registers a topic, it is subscribed to by the next Subscribe
+func (s *Subscriptions) Add(topic string, qos byte, handler MQTT.MessageHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions = append(s.subscriptions, subscription{topic: topic, qos: qos, handler: handler})
+}
+
+// Subscribe subscribes the client to every registered topic
+func (s *Subscriptions) Subscribe(client MQTT.Client) error {
+	s.mu.Lock()
+	subscriptions := s.subscriptions
+	s.mu.Unlock()
+
+	err := errNotSubscribed
+	if len(subscriptions) > 0 {
+		err = nil
+	}
+	for _, sub := range subscriptions {
+		if token := client.Subscribe(sub.topic, sub.qos, sub.handler); token.Wait() && token.Error() != nil {
+			err = fmt.Errorf("failed to subscribe to %s: %v", sub.topic, token.Error())
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	return err
+}
+
+// OnConnect renews the subscriptions after a reconnect, before the first Subscribe there is nothing to renew
+func (s *Subscriptions) OnConnect(client MQTT.Client) {
+	s.mu.Lock()
+	renew := len(s.subscriptions) > 0
+	s.mu.Unlock()
+	if !renew {
+		return
+	}
+	if err := s.Subscribe(client); err != nil {
+		slog.Error("failed to renew the mqtt subscriptions", "error", err)
+	}
+}
+
+// OnConnectionLost marks the subscriptions as gone until the next connect renews them
+func (s *Subscriptions) OnConnectionLost(client MQTT.Client, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = errNotSubscribed
+}
+
+// Check returns nil while the client is subscribed to every topic, it is a readiness check
+func (s *Subscriptions) Check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
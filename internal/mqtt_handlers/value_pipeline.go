@@ -0,0 +1,50 @@
+package mqtt_handlers
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// ValueConsumer is called with every reading after it was stored in sensor_data, it must not block
+type ValueConsumer func(reading model.Reading)
+
+// ValuePipeline stores provide_value readings and passes them on to the attached consumers
+type ValuePipeline struct {
+	database  db.Store
+	mu        sync.RWMutex
+	consumers []ValueConsumer
+}
+
+func NewValuePipeline(database db.Store) *ValuePipeline {
+	return &ValuePipeline{database: database}
+}
+
+func (p *ValuePipeline) Attach(consumer ValueConsumer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consumers = append(p.consumers, consumer)
+}
+
+// Ingest stores the JSON object payload of a provide_value message, consumers are notified once it is stored
+func (p *ValuePipeline) Ingest(deviceId int, payload []byte) error {
+	reading := model.Reading{DeviceID: deviceId}
+	if err := json.Unmarshal(payload, &reading.Values); err != nil {
+		return fmt.Errorf("invalid reading payload of device %d: %v", deviceId, err)
+	}
+
+	timestamp, err := p.database.InsertProvidedValue(deviceId, string(payload))
+	if err != nil {
+		return err
+	}
+	reading.Timestamp = timestamp
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, consumer := range p.consumers {
+		consumer(reading)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package presence
+
+import (
+	"NSI-semester-work/internal/model"
+	"sync"
+	"time"
+)
+
+// heartbeatTolerance is how many heartbeat intervals a device may miss before it is considered offline
+const heartbeatTolerance = 3
+
+// ChangeConsumer is called whenever a device goes online or offline, it must not block
+type ChangeConsumer func(presence model.Presence)
+
+// Tracker keeps the online/offline status and last-seen time of every device in memory
+type Tracker struct {
+	mu        sync.Mutex
+	devices   map[int]*model.Presence
+	consumers []ChangeConsumer
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{devices: make(map[int]*model.Presence)}
+}
+
+func (t *Tracker) Attach(consumer ChangeConsumer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.consumers = append(t.consumers, consumer)
+}
+
+// device has to be called with the mutex held
+func (t *Tracker) device(deviceId int) *model.Presence {
+	presence, ok := t.devices[deviceId]
+	if !ok {
+		presence = &model.Presence{DeviceID: deviceId, Status: model.PresenceUnknown}
+		t.devices[deviceId] = presence
+	}
+	return presence
+}
+
+func (t *Tracker) notify(changes []model.Presence) {
+	t.mu.Lock()
+	consumers := t.consumers
+	t.mu.Unlock()
+
+	for _, change := range changes {
+		for _, consumer := range consumers {
+			consumer(change)
+		}
+	}
+}
+
+// Seen records any sign of life of the device, marking it online
+func (t *Tracker) Seen(deviceId int) {
+	t.mu.Lock()
+	presence := t.device(deviceId)
+	presence.LastSeen = time.Now()
+	changed := presence.Status != model.PresenceOnline
+	presence.Status = model.PresenceOnline
+	snapshot := *presence
+	t.mu.Unlock()
+
+	if changed {
+		t.notify([]model.Presence{snapshot})
+	}
+}
+
+// SetOffline is used for last will messages, the last-seen time is kept
+func (t *Tracker) SetOffline(deviceId int) {
+	t.mu.Lock()
+	presence := t.device(deviceId)
+	changed := presence.Status != model.PresenceOffline
+	presence.Status = model.PresenceOffline
+	snapshot := *presence
+	t.mu.Unlock()
+
+	if changed {
+		t.notify([]model.Presence{snapshot})
+	}
+}
+
+// SetHeartbeatInterval enables heartbeat supervision of the device, 0 disables it
+func (t *Tracker) SetHeartbeatInterval(deviceId int, interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.device(deviceId).HeartbeatInterval = interval
+}
+
+func (t *Tracker) Get(deviceId int) (model.Presence, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	presence, ok := t.devices[deviceId]
+	if !ok {
+		return model.Presence{DeviceID: deviceId, Status: model.PresenceUnknown}, false
+	}
+	return *presence, true
+}
+
+// Lookup falls back to the last-seen time stored with the device when the tracker has not heard of it since startup
+func (t *Tracker) Lookup(device *model.Device) model.Presence {
+	presence, ok := t.Get(device.ID)
+	if !ok {
+		presence.LastSeen = device.LastSeen
+	}
+	return presence
+}
+
+// expire marks devices that missed heartbeatTolerance heartbeats as offline
+func (t *Tracker) expire(now time.Time) {
+	var changes []model.Presence
+
+	t.mu.Lock()
+	for _, presence := range t.devices {
+		if presence.HeartbeatInterval == 0 || presence.Status != model.PresenceOnline {
+			continue
+		}
+		if now.Sub(presence.LastSeen) > heartbeatTolerance*presence.HeartbeatInterval {
+			presence.Status = model.PresenceOffline
+			changes = append(changes, *presence)
+		}
+	}
+	t.mu.Unlock()
+
+	t.notify(changes)
+}
+
+// Run checks for missed heartbeats every checkInterval until stop is closed
+func (t *Tracker) Run(checkInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.expire(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package rules
+
+import (
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type valueKey struct {
+	deviceId   int
+	actionName string
+}
+
+// observedValue keeps the last two values of a device action, rates are computed from them
+type observedValue struct {
+	value      string
+	at         time.Time
+	previous   string
+	previousAt time.Time
+}
+
+// Engine evaluates the enabled rules on every state update and reading of the devices they depend on. A rule fires
+// when its condition starts to match (it has to stop matching before it can fire again) and its cooldown has passed.
+type Engine struct {
+	database db.Store
+	sender   *commands.Sender
+
+	mu       sync.Mutex
+	rules    []model.Rule
+	values   map[valueKey]*observedValue
+	matching map[int]bool
+}
+
+func NewEngine(database db.Store, sender *commands.Sender) *Engine {
+	return &Engine{
+		database: database,
+		sender:   sender,
+		values:   make(map[valueKey]*observedValue),
+		matching: make(map[int]bool),
+	}
+}
+
+// Reload fetches the enabled rules, it has to be called after rules are changed. Values the rules depend on are loaded
+// from the database, so rules that already match do not fire until their condition changes.
+func (e *Engine) Reload() error {
+	allRules, err := e.database.FetchRules()
+	if err != nil {
+		return fmt.Errorf("failed to fetch rules: %v", err)
+	}
+
+	enabled := make([]model.Rule, 0, len(allRules))
+	for _, rule := range allRules {
+		if rule.Enabled {
+			enabled = append(enabled, rule)
+		}
+	}
+
+	e.mu.Lock()
+	missing := make(map[valueKey]bool)
+	for _, rule := range enabled {
+		collectKeys(rule.Condition, func(key valueKey) {
+			if _, ok := e.values[key]; !ok {
+				missing[key] = true
+			}
+		})
+	}
+	e.mu.Unlock()
+
+	seeded := make(map[valueKey]string)
+	for key := range missing {
+		if value, ok := e.loadValue(key); ok {
+			seeded[key] = value
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, value := range seeded {
+		if _, ok := e.values[key]; !ok {
+			e.values[key] = &observedValue{value: value, at: time.Now()}
+		}
+	}
+
+	matching := make(map[int]bool, len(enabled))
+	for _, rule := range enabled {
+		if previous, ok := e.matching[rule.ID]; ok {
+			matching[rule.ID] = previous
+		} else {
+			matching[rule.ID] = e.evaluate(rule.Condition)
+		}
+	}
+	e.rules, e.matching = enabled, matching
+	return nil
+}
+
+func collectKeys(condition model.Condition, collect func(key valueKey)) {
+	if condition.All == nil && condition.Any == nil {
+		collect(valueKey{condition.DeviceID, condition.ActionName})
+		return
+	}
+	for _, sub := range append(condition.All, condition.Any...) {
+		collectKeys(sub, collect)
+	}
+}
+
+// loadValue looks the value up in the latest reading of the device, falling back to its stored state
+func (e *Engine) loadValue(key valueKey) (string, bool) {
+	if reading, err := e.database.GetLastSensorReading(key.deviceId, key.actionName); err == nil {
+		return rawValueString(reading.Value), true
+	}
+
+	stateJson, err := e.database.GetDeviceStates(key.deviceId)
+	if err != nil {
+		return "", false
+	}
+	var state map[string]json.RawMessage
+	if err = json.Unmarshal([]byte(stateJson), &state); err != nil {
+		return "", false
+	}
+	raw, ok := state[key.actionName]
+	if !ok {
+		return "", false
+	}
+	return rawValueString(raw), true
+}
+
+// rawValueString unquotes JSON strings and keeps other JSON values as they are
+func rawValueString(raw json.RawMessage) string {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str
+	}
+	return string(raw)
+}
+
+// HandleReading is a mqtt_handlers.ValueConsumer
+func (e *Engine) HandleReading(reading model.Reading) {
+	values := make(map[string]string, len(reading.Values))
+	for actionName, raw := range reading.Values {
+		values[actionName] = rawValueString(raw)
+	}
+	e.observe(reading.DeviceID, values, reading.Timestamp)
+}
+
+// HandleUpdate is a mqtt_handlers.StateConsumer
+func (e *Engine) HandleUpdate(update model.Update) {
+	e.observe(update.DeviceID, map[string]string{update.ActionName: update.State}, time.Now())
+}
+
+// observe stores the new values and evaluates the rules depending on the device, actions are issued asynchronously
+func (e *Engine) observe(deviceId int, values map[string]string, at time.Time) {
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for actionName, value := range values {
+		key := valueKey{deviceId, actionName}
+		observed, ok := e.values[key]
+		if !ok {
+			e.values[key] = &observedValue{value: value, at: at}
+			continue
+		}
+		observed.previous, observed.previousAt = observed.value, observed.at
+		observed.value, observed.at = value, at
+	}
+
+	for _, rule := range e.rules {
+		if !dependsOn(rule.Condition, deviceId) {
+			continue
+		}
+
+		matches := e.evaluate(rule.Condition)
+		wasMatching := e.matching[rule.ID]
+		e.matching[rule.ID] = matches
+		if !matches || wasMatching {
+			continue
+		}
+		if rule.LastFired != nil && time.Since(*rule.LastFired) < rule.Cooldown() {
+			continue
+		}
+
+		firedAt := time.Now()
+		e.setLastFired(rule.ID, firedAt)
+		go e.fire(rule, firedAt)
+	}
+}
+
+func (e *Engine) setLastFired(ruleId int, firedAt time.Time) {
+	for i := range e.rules {
+		if e.rules[i].ID == ruleId {
+			e.rules[i].LastFired = &firedAt
+		}
+	}
+}
+
+func dependsOn(condition model.Condition, deviceId int) bool {
+	for _, id := range condition.DeviceIDs() {
+		if id == deviceId {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate has to be called with e.mu held, comparisons of unknown values do not match
+func (e *Engine) evaluate(condition model.Condition) bool {
+	if condition.All != nil {
+		for _, sub := range condition.All {
+			if !e.evaluate(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	if condition.Any != nil {
+		for _, sub := range condition.Any {
+			if e.evaluate(sub) {
+				return true
+			}
+		}
+		return false
+	}
+
+	observed, ok := e.values[valueKey{condition.DeviceID, condition.ActionName}]
+	if !ok {
+		return false
+	}
+	return compare(condition, observed)
+}
+
+func compare(condition model.Condition, observed *observedValue) bool {
+	expected := string(condition.Value)
+	expectedNumber, expectedErr := strconv.ParseFloat(expected, 64)
+	number, err := strconv.ParseFloat(observed.value, 64)
+	numeric := err == nil && expectedErr == nil
+
+	switch condition.Operator {
+	case model.OperatorEqual:
+		if numeric {
+			return number == expectedNumber
+		}
+		return observed.value == expected
+	case model.OperatorNotEqual:
+		if numeric {
+			return number != expectedNumber
+		}
+		return observed.value != expected
+	case model.OperatorLess:
+		return numeric && number < expectedNumber
+	case model.OperatorLessEqual:
+		return numeric && number <= expectedNumber
+	case model.OperatorGreater:
+		return numeric && number > expectedNumber
+	case model.OperatorGreaterEqual:
+		return numeric && number >= expectedNumber
+	case model.OperatorRateAbove, model.OperatorRateBelow:
+		rate, ok := ratePerMinute(observed)
+		if !ok || expectedErr != nil {
+			return false
+		}
+		if condition.Operator == model.OperatorRateAbove {
+			return rate > expectedNumber
+		}
+		return rate < expectedNumber
+	}
+	return false
+}
+
+func ratePerMinute(observed *observedValue) (float64, bool) {
+	if observed.previousAt.IsZero() {
+		return 0, false
+	}
+	minutes := observed.at.Sub(observed.previousAt).Minutes()
+	if minutes <= 0 {
+		return 0, false
+	}
+	current, err := strconv.ParseFloat(observed.value, 64)
+	if err != nil {
+		return 0, false
+	}
+	previous, err := strconv.ParseFloat(observed.previous, 64)
+	if err != nil {
+		return 0, false
+	}
+	return (current - previous) / minutes, true
+}
+
+// fire issues the rule's action the same way the dashboard does, the outcome is stored with the rule
+func (e *Engine) fire(rule model.Rule, firedAt time.Time) {
+	var errorMessage string
+	if _, err := e.sender.SendAction(fmt.Sprintf("rule:%d", rule.ID), rule.Action); err != nil {
+		errorMessage = err.Error()
+		slog.Error("rule failed to issue its action", "rule_id", rule.ID, "rule", rule.Name, logging.DeviceID(rule.Action.DeviceID), "error", err)
+	} else {
+		slog.Info("rule fired", "rule_id", rule.ID, "rule", rule.Name, logging.DeviceID(rule.Action.DeviceID))
+	}
+
+	if err := e.database.RecordRuleFired(rule.ID, firedAt, errorMessage); err != nil {
+		slog.Error("failed to record rule firing", "rule_id", rule.ID, "error", err)
+	}
+}
@@ -0,0 +1,325 @@
+package rules
+
+import (
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+// doneToken is a token that completed without an error
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// publishingClient accepts every publish, the rest of MQTT.Client is not used by the sender
+type publishingClient struct {
+	MQTT.Client
+}
+
+func (publishingClient) Publish(string, byte, bool, interface{}) MQTT.Token {
+	return doneToken{}
+}
+
+func TestCompare(t *testing.T) {
+	minuteAgo := time.Now().Add(-time.Minute)
+	tests := []struct {
+		operator model.ConditionOperator
+		expected model.ConditionValue
+		observed observedValue
+		want     bool
+	}{
+		{model.OperatorEqual, "on", observedValue{value: "on"}, true},
+		{model.OperatorEqual, "on", observedValue{value: "off"}, false},
+		{model.OperatorEqual, "20", observedValue{value: "20.0"}, true},
+		{model.OperatorNotEqual, "20", observedValue{value: "20.0"}, false},
+		{model.OperatorNotEqual, "on", observedValue{value: "off"}, true},
+		{model.OperatorLess, "30", observedValue{value: "29.9"}, true},
+		{model.OperatorLess, "30", observedValue{value: "30"}, false},
+		{model.OperatorLessEqual, "30", observedValue{value: "30"}, true},
+		{model.OperatorGreater, "30", observedValue{value: "30"}, false},
+		{model.OperatorGreaterEqual, "30", observedValue{value: "30"}, true},
+		// ordering comparisons of values that are not numbers never match
+		{model.OperatorLess, "30", observedValue{value: "cold"}, false},
+		{model.OperatorGreater, "warm", observedValue{value: "40"}, false},
+
+		{model.OperatorRateAbove, "5", observedValue{value: "30", at: time.Now(), previous: "20", previousAt: minuteAgo}, true},
+		{model.OperatorRateAbove, "15", observedValue{value: "30", at: time.Now(), previous: "20", previousAt: minuteAgo}, false},
+		{model.OperatorRateBelow, "-5", observedValue{value: "10", at: time.Now(), previous: "20", previousAt: minuteAgo}, true},
+		{model.OperatorRateBelow, "-15", observedValue{value: "10", at: time.Now(), previous: "20", previousAt: minuteAgo}, false},
+		// rates need two numeric values at different times
+		{model.OperatorRateAbove, "0", observedValue{value: "30", at: time.Now()}, false},
+		{model.OperatorRateBelow, "100", observedValue{value: "30", at: minuteAgo, previous: "20", previousAt: minuteAgo}, false},
+		{model.OperatorRateAbove, "0", observedValue{value: "30", at: time.Now(), previous: "off", previousAt: minuteAgo}, false},
+		{model.OperatorRateAbove, "fast", observedValue{value: "30", at: time.Now(), previous: "20", previousAt: minuteAgo}, false},
+	}
+	for _, test := range tests {
+		condition := model.Condition{Operator: test.operator, Value: test.expected}
+		if got := compare(condition, &test.observed); got != test.want {
+			t.Errorf("%+v %s %s = %v, want %v", test.observed, test.operator, test.expected, got, test.want)
+		}
+	}
+}
+
+// engineTest is an engine over a MemoryStore with a thermometer, a light and the rules under test
+type engineTest struct {
+	t            *testing.T
+	database     *db.MemoryStore
+	engine       *Engine
+	thermometer  int
+	light        int
+	ruleCommands chan model.Command
+}
+
+func newEngineTest(t *testing.T) *engineTest {
+	t.Helper()
+	database := db.NewMemoryStore()
+	register := func(uuid string, name string) int {
+		templateId, err := database.FetchTemplateActions("light_switch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = database.RegisterDevice(&model.Device{UUID: uuid, Name: name, ActionsTemplateId: templateId}); err != nil {
+			t.Fatal(err)
+		}
+		deviceId, err := database.GetDeviceIDByUUID(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return deviceId
+	}
+
+	sender := commands.NewSender(database, publishingClient{}, presence.NewTracker(), time.Minute, "command/")
+	test := &engineTest{
+		t:            t,
+		database:     database,
+		engine:       NewEngine(database, sender),
+		thermometer:  register("123e4567-e89b-12d3-a456-426614174000", "Thermometer"),
+		light:        register("123e4567-e89b-12d3-a456-426614174001", "Light"),
+		ruleCommands: make(chan model.Command, 16),
+	}
+	sender.Attach(func(command model.Command) {
+		if command.Status == model.CommandPending {
+			test.ruleCommands <- command
+		}
+	})
+	return test
+}
+
+// addRule stores an enabled rule toggling the light and reloads the engine
+func (et *engineTest) addRule(condition model.Condition, cooldownSeconds int) int {
+	et.t.Helper()
+	rule := &model.Rule{Name: fmt.Sprintf("Rule %d", time.Now().UnixNano()), Enabled: true, Condition: condition,
+		Action: model.DeviceAction{DeviceID: et.light, ActionName: "Light_state"}, CooldownSeconds: cooldownSeconds}
+	if err := et.database.InsertRule(rule); err != nil {
+		et.t.Fatal(err)
+	}
+	if err := et.engine.Reload(); err != nil {
+		et.t.Fatal(err)
+	}
+	return rule.ID
+}
+
+func (et *engineTest) reading(values map[string]interface{}, at time.Time) {
+	reading := model.Reading{DeviceID: et.thermometer, Timestamp: at, Values: make(map[string]json.RawMessage)}
+	for name, value := range values {
+		raw, _ := json.Marshal(value)
+		reading.Values[name] = raw
+	}
+	et.engine.HandleReading(reading)
+}
+
+// fired returns when the rule last fired, it is set synchronously while the action is issued in the background
+func (et *engineTest) fired(ruleId int) *time.Time {
+	et.engine.mu.Lock()
+	defer et.engine.mu.Unlock()
+	for _, rule := range et.engine.rules {
+		if rule.ID == ruleId {
+			return rule.LastFired
+		}
+	}
+	et.t.Fatalf("rule %d is not loaded", ruleId)
+	return nil
+}
+
+// expectFirings checks how often the rule fired by counting the changes of its last firing
+func (et *engineTest) expectFirings(ruleId int, steps []func(), want []bool) {
+	et.t.Helper()
+	for i, step := range steps {
+		before := et.fired(ruleId)
+		step()
+		after := et.fired(ruleId)
+		if fired := after != before; fired != want[i] {
+			et.t.Errorf("step %d: fired = %v, want %v", i, fired, want[i])
+		}
+	}
+}
+
+func (et *engineTest) temperature(value float64) func() {
+	return func() {
+		et.reading(map[string]interface{}{"Temperature": value}, time.Now())
+	}
+}
+
+func (et *engineTest) state(deviceId int, actionName string, state string) func() {
+	return func() {
+		et.engine.HandleUpdate(model.Update{DeviceID: deviceId, ActionName: actionName, State: state})
+	}
+}
+
+func TestRuleFiresOnRisingEdge(t *testing.T) {
+	et := newEngineTest(t)
+	ruleId := et.addRule(model.Condition{DeviceID: et.thermometer, ActionName: "Temperature",
+		Operator: model.OperatorGreater, Value: "30"}, 0)
+
+	et.expectFirings(ruleId,
+		[]func(){et.temperature(25), et.temperature(31), et.temperature(35), et.temperature(29), et.temperature(32)},
+		// it keeps matching at 35 and has to stop matching before it fires again
+		[]bool{false, true, false, false, true})
+
+	// the action is issued as a command of the rule and the firing is stored
+	for i := 0; i < 2; i++ {
+		select {
+		case command := <-et.ruleCommands:
+			if command.Source != fmt.Sprintf("rule:%d", ruleId) || command.DeviceID != et.light || command.ActionName != "Light_state" {
+				t.Errorf("unexpected command %+v", command)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the rule did not issue its action")
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		rules, err := et.database.FetchRules()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rules[0].LastFired != nil && rules[0].LastError == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the firing was not recorded: %+v", rules[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRuleCooldown(t *testing.T) {
+	et := newEngineTest(t)
+	ruleId := et.addRule(model.Condition{DeviceID: et.thermometer, ActionName: "Temperature",
+		Operator: model.OperatorGreater, Value: "30"}, 3600)
+
+	et.expectFirings(ruleId,
+		[]func(){et.temperature(31), et.temperature(20), et.temperature(31)},
+		// the second edge is within the cooldown
+		[]bool{true, false, false})
+
+	// the cooldown is measured from the last firing
+	et.engine.mu.Lock()
+	longAgo := time.Now().Add(-2 * time.Hour)
+	et.engine.rules[0].LastFired = &longAgo
+	et.engine.mu.Unlock()
+	et.expectFirings(ruleId, []func(){et.temperature(20), et.temperature(31)}, []bool{false, true})
+}
+
+func TestRuleAllAndAny(t *testing.T) {
+	et := newEngineTest(t)
+	hot := model.Condition{DeviceID: et.thermometer, ActionName: "Temperature", Operator: model.OperatorGreater, Value: "30"}
+	lightOff := model.Condition{DeviceID: et.light, ActionName: "Light_state", Operator: model.OperatorEqual, Value: "off"}
+	humid := model.Condition{DeviceID: et.thermometer, ActionName: "Humidity", Operator: model.OperatorGreaterEqual, Value: "80"}
+	ruleId := et.addRule(model.Condition{All: []model.Condition{hot, {Any: []model.Condition{lightOff, humid}}}}, 0)
+
+	et.expectFirings(ruleId, []func(){
+		et.temperature(35),                      // the light state is unknown, unknown values do not match
+		et.state(et.light, "Light_state", "on"), // neither the light is off nor is it humid
+		et.state(et.light, "Light_state", "off"),
+		et.temperature(20),
+		func() { et.reading(map[string]interface{}{"Temperature": 35, "Humidity": 85}, time.Now()) },
+		et.state(et.light, "Light_state", "on"), // still humid
+		func() { et.reading(map[string]interface{}{"Humidity": "79"}, time.Now()) },
+		func() { et.reading(map[string]interface{}{"Humidity": "80"}, time.Now()) },
+	}, []bool{false, false, true, false, true, false, false, true})
+}
+
+func TestRuleRates(t *testing.T) {
+	et := newEngineTest(t)
+	rising := et.addRule(model.Condition{DeviceID: et.thermometer, ActionName: "Temperature",
+		Operator: model.OperatorRateAbove, Value: "2"}, 0)
+	falling := et.addRule(model.Condition{DeviceID: et.thermometer, ActionName: "Temperature",
+		Operator: model.OperatorRateBelow, Value: "-2"}, 0)
+
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int, value float64) func() {
+		return func() {
+			et.reading(map[string]interface{}{"Temperature": value}, start.Add(time.Duration(minutes)*time.Minute))
+		}
+	}
+	steps := []func(){
+		at(0, 20),  // no rate with a single value
+		at(1, 21),  // +1/min
+		at(2, 25),  // +4/min
+		at(4, 31),  // +3/min, still rising
+		at(5, 31),  // 0/min
+		at(15, 1),  // -3/min
+		at(16, 0),  // -1/min
+		at(17, -5), // -5/min
+	}
+	var risingFired, fallingFired []bool
+	for _, step := range steps {
+		risingBefore, fallingBefore := et.fired(rising), et.fired(falling)
+		step()
+		risingFired = append(risingFired, et.fired(rising) != risingBefore)
+		fallingFired = append(fallingFired, et.fired(falling) != fallingBefore)
+	}
+	if fmt.Sprint(risingFired) != fmt.Sprint([]bool{false, false, true, false, false, false, false, false}) {
+		t.Errorf("rate_above fired %v", risingFired)
+	}
+	if fmt.Sprint(fallingFired) != fmt.Sprint([]bool{false, false, false, false, false, true, false, true}) {
+		t.Errorf("rate_below fired %v", fallingFired)
+	}
+}
+
+func TestReloadDoesNotFireMatchingRules(t *testing.T) {
+	et := newEngineTest(t)
+	if err := et.database.UpdateDeviceState(et.light, map[string]interface{}{"Light_state": "off"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := et.database.InsertProvidedValue(et.thermometer, `{"Temperature": 35}`); err != nil {
+		t.Fatal(err)
+	}
+	hot := et.addRule(model.Condition{DeviceID: et.thermometer, ActionName: "Temperature",
+		Operator: model.OperatorGreater, Value: "30"}, 0)
+	off := et.addRule(model.Condition{DeviceID: et.light, ActionName: "Light_state",
+		Operator: model.OperatorEqual, Value: "off"}, 0)
+
+	// both conditions already match with the stored values, they have to change before the rules fire
+	et.expectFirings(hot, []func(){et.temperature(36), et.temperature(20), et.temperature(36)}, []bool{false, false, true})
+	et.expectFirings(off, []func(){et.state(et.light, "Light_state", "off"), et.state(et.light, "Light_state", "on"),
+		et.state(et.light, "Light_state", "off")}, []bool{false, false, true})
+
+	// disabled rules are not evaluated
+	if err := et.database.SetRuleEnabled(hot, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := et.engine.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	et.engine.mu.Lock()
+	loaded := len(et.engine.rules)
+	et.engine.mu.Unlock()
+	if loaded != 1 {
+		t.Errorf("%d rules are loaded", loaded)
+	}
+}
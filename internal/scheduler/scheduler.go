@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/logging"
+	"NSI-semester-work/internal/model"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Scheduler issues the actions of all running (not paused) schedules and records every run
+type Scheduler struct {
+	database db.Store
+	sender   *commands.Sender
+	cron     *cron.Cron
+
+	mu      sync.Mutex
+	entries map[int]cron.EntryID
+}
+
+func NewScheduler(database db.Store, sender *commands.Sender) *Scheduler {
+	return &Scheduler{
+		database: database,
+		sender:   sender,
+		cron:     cron.New(),
+		entries:  make(map[int]cron.EntryID),
+	}
+}
+
+// Start loads the schedules and starts running them in the background
+func (s *Scheduler) Start() error {
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	s.cron.Start()
+	return nil
+}
+
+func (s *Scheduler) Stop() {
+	s.cron.Stop()
+}
+
+// Reload replaces the running schedules with the ones stored in the database, it has to be called after schedules
+// are changed. Schedules with an invalid spec are logged and skipped.
+func (s *Scheduler) Reload() error {
+	schedules, err := s.database.FetchSchedules()
+	if err != nil {
+		return fmt.Errorf("failed to fetch schedules: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for scheduleId, entryId := range s.entries {
+		s.cron.Remove(entryId)
+		delete(s.entries, scheduleId)
+	}
+
+	for _, schedule := range schedules {
+		if schedule.Paused {
+			continue
+		}
+		spec, err := schedule.CronSpec()
+		if err != nil {
+			slog.Warn("skipping schedule", "schedule_id", schedule.ID, "schedule", schedule.Name, "error", err)
+			continue
+		}
+		schedule := schedule
+		entryId, err := s.cron.AddFunc(spec, func() { s.run(schedule) })
+		if err != nil {
+			slog.Warn("skipping schedule", "schedule_id", schedule.ID, "schedule", schedule.Name, "error", err)
+			continue
+		}
+		s.entries[schedule.ID] = entryId
+	}
+	return nil
+}
+
+// NextRun returns the next time the schedule runs, the zero time if it is paused or invalid
+func (s *Scheduler) NextRun(scheduleId int) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entryId, ok := s.entries[scheduleId]
+	if !ok {
+		return time.Time{}
+	}
+	return s.cron.Entry(entryId).Next
+}
+
+// run issues the action of the schedule, the outcome of the command is tracked by commands.Sender
+func (s *Scheduler) run(schedule model.Schedule) {
+	ranAt := time.Now()
+
+	var correlationId, errorMessage string
+	command, err := s.sender.SendAction(fmt.Sprintf("schedule:%d", schedule.ID), schedule.Action)
+	if command != nil {
+		correlationId = command.CorrelationID
+	}
+	if err != nil {
+		errorMessage = err.Error()
+		slog.Error("schedule failed to issue its action", "schedule_id", schedule.ID, "schedule", schedule.Name, logging.DeviceID(schedule.Action.DeviceID), "error", err)
+	}
+
+	if err = s.database.InsertScheduleRun(schedule.ID, ranAt, correlationId, errorMessage); err != nil {
+		slog.Error("failed to record schedule run", "schedule_id", schedule.ID, "error", err)
+	}
+}
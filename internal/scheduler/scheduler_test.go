@@ -0,0 +1,155 @@
+package scheduler
+
+import (
+	"NSI-semester-work/internal/commands"
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"NSI-semester-work/internal/presence"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+// doneToken is a token that completed without an error
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// publishingClient accepts every publish, the rest of MQTT.Client is not used by the sender
+type publishingClient struct {
+	MQTT.Client
+}
+
+func (publishingClient) Publish(string, byte, bool, interface{}) MQTT.Token {
+	return doneToken{}
+}
+
+func newTestScheduler(t *testing.T) (*Scheduler, *db.MemoryStore, int) {
+	t.Helper()
+	database := db.NewMemoryStore()
+	templateId, err := database.FetchTemplateActions("light_switch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid := "123e4567-e89b-12d3-a456-426614174000"
+	if err = database.RegisterDevice(&model.Device{UUID: uuid, Name: "Lamp", ActionsTemplateId: templateId}); err != nil {
+		t.Fatal(err)
+	}
+	deviceId, err := database.GetDeviceIDByUUID(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := commands.NewSender(database, publishingClient{}, presence.NewTracker(), time.Minute, "command/")
+	return NewScheduler(database, sender), database, deviceId
+}
+
+func TestReload(t *testing.T) {
+	scheduler, database, deviceId := newTestScheduler(t)
+	action := model.DeviceAction{DeviceID: deviceId, ActionName: "Light_state"}
+	schedules := map[string]*model.Schedule{
+		"prague":  {Name: "Prague", Kind: model.ScheduleDaily, TimeOfDay: "07:30", Timezone: "Europe/Prague", Action: action},
+		"weekly":  {Name: "Weekly", Kind: model.ScheduleWeekly, TimeOfDay: "12:00", Timezone: "UTC", Weekdays: []time.Weekday{time.Monday}, Action: action},
+		"paused":  {Name: "Paused", Kind: model.ScheduleDaily, TimeOfDay: "08:00", Timezone: "UTC", Action: action, Paused: true},
+		"invalid": {Name: "Invalid", Kind: model.ScheduleCron, CronExpression: "every minute", Timezone: "UTC", Action: action},
+		"zone":    {Name: "Zone", Kind: model.ScheduleDaily, TimeOfDay: "08:00", Timezone: "Nowhere/City", Action: action},
+	}
+	for _, schedule := range schedules {
+		if err := database.InsertSchedule(schedule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := scheduler.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// paused schedules and schedules with an invalid spec are skipped
+	if len(scheduler.entries) != 2 {
+		t.Errorf("%d schedules are running", len(scheduler.entries))
+	}
+	for _, name := range []string{"paused", "invalid", "zone"} {
+		if _, ok := scheduler.entries[schedules[name].ID]; ok {
+			t.Errorf("the %s schedule is running", name)
+		}
+	}
+
+	// the time of day is interpreted in the schedule's timezone
+	prague, err := time.LoadLocation("Europe/Prague")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := scheduler.cron.Entry(scheduler.entries[schedules["prague"].ID])
+	next := entry.Schedule.Next(time.Date(2026, time.January, 10, 12, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, time.January, 11, 7, 30, 0, 0, prague); !next.Equal(want) {
+		t.Errorf("the Prague schedule runs next at %v, want %v", next, want)
+	}
+	entry = scheduler.cron.Entry(scheduler.entries[schedules["weekly"].ID])
+	// Saturday the 10th, the next Monday is the 12th
+	next = entry.Schedule.Next(time.Date(2026, time.January, 10, 12, 0, 0, 0, time.UTC))
+	if want := time.Date(2026, time.January, 12, 12, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("the weekly schedule runs next at %v, want %v", next, want)
+	}
+
+	// reloading replaces the running schedules
+	if err = database.SetSchedulePaused(schedules["prague"].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.SetSchedulePaused(schedules["paused"].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = scheduler.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(scheduler.cron.Entries()) != 2 {
+		t.Errorf("%d cron entries after reloading", len(scheduler.cron.Entries()))
+	}
+	if !scheduler.NextRun(schedules["prague"].ID).IsZero() {
+		t.Error("the paused schedule has a next run")
+	}
+	if _, ok := scheduler.entries[schedules["paused"].ID]; !ok {
+		t.Error("the resumed schedule is not running")
+	}
+}
+
+func TestRunRecordsTheCommand(t *testing.T) {
+	scheduler, database, deviceId := newTestScheduler(t)
+	schedule := &model.Schedule{Name: "Lamp", Kind: model.ScheduleDaily, TimeOfDay: "07:00", Timezone: "UTC",
+		Action: model.DeviceAction{DeviceID: deviceId, ActionName: "Light_state"}}
+	if err := database.InsertSchedule(schedule); err != nil {
+		t.Fatal(err)
+	}
+	failing := &model.Schedule{Name: "Missing action", Kind: model.ScheduleDaily, TimeOfDay: "07:00", Timezone: "UTC",
+		Action: model.DeviceAction{DeviceID: deviceId, ActionName: "Missing"}}
+	if err := database.InsertSchedule(failing); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler.run(*schedule)
+	scheduler.run(*failing)
+
+	runs, err := database.FetchScheduleRuns(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("unexpected runs %+v", runs)
+	}
+	for _, run := range runs {
+		switch run.ScheduleID {
+		case schedule.ID:
+			if run.CorrelationID == "" || run.Error != "" || run.CommandStatus != model.CommandDelivered {
+				t.Errorf("unexpected run %+v", run)
+			}
+		case failing.ID:
+			if run.CorrelationID != "" || run.Error == "" {
+				t.Errorf("unexpected failed run %+v", run)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package sse
+
+import (
+	"NSI-semester-work/internal/metrics"
+	"NSI-semester-work/internal/model"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before new events are dropped for it
+const subscriberBuffer = 32
+
+// Event is a single server-sent event, DeviceID 0 means the event is not tied to any device
+type Event struct {
+	Name     string
+	Data     string
+	DeviceID int
+}
+
+// Subscriber is one SSE connection registered in the Hub
+type Subscriber struct {
+	Events     chan Event
+	allDevices bool
+	deviceIds  map[int]struct{}
+	// names limits the subscriber to these event names, nil means every event
+	names map[string]struct{}
+}
+
+func (s *Subscriber) wants(event Event) bool {
+	if s.names != nil {
+		if _, ok := s.names[event.Name]; !ok {
+			return false
+		}
+	}
+	if s.allDevices || event.DeviceID == 0 {
+		return true
+	}
+	_, ok := s.deviceIds[event.DeviceID]
+	return ok
+}
+
+// Hub fans out every published event to all interested subscribers
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*Subscriber]struct{})}
+}
+
+// Subscribe registers a new subscriber, nil deviceIds subscribes to events of all devices and nil names to events of
+// every name
+func (h *Hub) Subscribe(deviceIds []int, names []string) *Subscriber {
+	subscriber := &Subscriber{
+		Events:     make(chan Event, subscriberBuffer),
+		allDevices: deviceIds == nil,
+		deviceIds:  make(map[int]struct{}, len(deviceIds)),
+	}
+	for _, id := range deviceIds {
+		subscriber.deviceIds[id] = struct{}{}
+	}
+	if names != nil {
+		subscriber.names = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			subscriber.names[name] = struct{}{}
+		}
+	}
+
+	h.mu.Lock()
+	h.subscribers[subscriber] = struct{}{}
+	h.mu.Unlock()
+	metrics.SSEClients.Inc()
+	return subscriber
+}
+
+func (h *Hub) Unsubscribe(subscriber *Subscriber) {
+	h.mu.Lock()
+	_, subscribed := h.subscribers[subscriber]
+	delete(h.subscribers, subscriber)
+	h.mu.Unlock()
+	if subscribed {
+		metrics.SSEClients.Dec()
+	}
+}
+
+// Publish never blocks, events for subscribers with a full buffer are dropped
+func (h *Hub) Publish(event Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for subscriber := range h.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.Events <- event:
+		default:
+			slog.Warn("sse subscriber too slow, dropping event", "event", event.Name)
+		}
+	}
+}
+
+func (h *Hub) PublishUpdate(update model.Update) {
+	h.Publish(Event{
+		Name:     fmt.Sprintf("stateUpdate-%d-%s", update.DeviceID, update.ActionName),
+		Data:     update.State,
+		DeviceID: update.DeviceID,
+	})
+}
+
+// PublishReading sends one valueUpdate event per action in the reading, the data is the raw JSON value
+func (h *Hub) PublishReading(reading model.Reading) {
+	for actionName, value := range reading.Values {
+		h.Publish(Event{
+			Name:     fmt.Sprintf("valueUpdate-%d-%s", reading.DeviceID, actionName),
+			Data:     string(value),
+			DeviceID: reading.DeviceID,
+		})
+	}
+}
+
+func (h *Hub) PublishPresence(presence model.Presence) {
+	h.Publish(Event{
+		Name:     fmt.Sprintf("presence-%d", presence.DeviceID),
+		Data:     string(presence.Status),
+		DeviceID: presence.DeviceID,
+	})
+}
+
+// PublishCommand sends the status of a command, the event name matches the action the command was sent to
+func (h *Hub) PublishCommand(command model.Command) {
+	h.Publish(Event{
+		Name:     fmt.Sprintf("commandStatus-%d-%s", command.DeviceID, command.ActionName),
+		Data:     string(command.Status),
+		DeviceID: command.DeviceID,
+	})
+}
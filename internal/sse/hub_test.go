@@ -0,0 +1,29 @@
+package sse
+
+import "testing"
+
+func TestSubscriberWants(t *testing.T) {
+	tests := []struct {
+		name      string
+		deviceIds []int
+		names     []string
+		event     Event
+		want      bool
+	}{
+		{"all devices", nil, nil, Event{Name: "presence-7", DeviceID: 7}, true},
+		{"subscribed device", []int{7}, nil, Event{Name: "presence-7", DeviceID: 7}, true},
+		{"other device", []int{7}, nil, Event{Name: "presence-8", DeviceID: 8}, false},
+		{"event without device", []int{}, nil, Event{Name: "reload"}, true},
+		{"wanted name", nil, []string{"alert"}, Event{Name: "alert", DeviceID: 7}, true},
+		{"other name", nil, []string{"alert"}, Event{Name: "presence-7", DeviceID: 7}, false},
+		{"wanted name of an invisible device", []int{}, []string{"alert"}, Event{Name: "alert", DeviceID: 7}, false},
+	}
+	hub := NewHub()
+	for _, tt := range tests {
+		subscriber := hub.Subscribe(tt.deviceIds, tt.names)
+		if got := subscriber.wants(tt.event); got != tt.want {
+			t.Errorf("%s: wants = %v, want %v", tt.name, got, tt.want)
+		}
+		hub.Unsubscribe(subscriber)
+	}
+}
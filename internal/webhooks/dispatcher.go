@@ -0,0 +1,285 @@
+package webhooks
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is marked failed
+	MaxAttempts    = 6
+	initialBackoff = 2 * time.Second
+	requestTimeout = 10 * time.Second
+	workers        = 4
+	queueSize      = 1024
+	pendingLimit   = 10000
+	// Retention is how long finished deliveries stay in the delivery log
+	Retention     = 7 * 24 * time.Hour
+	pruneInterval = time.Hour
+)
+
+// Event is the JSON body of every webhook request
+type Event struct {
+	Type       model.WebhookEventType `json:"type"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	Data       interface{}            `json:"data"`
+}
+
+type stateData struct {
+	DeviceID   int    `json:"device_id"`
+	ActionName string `json:"action_name"`
+	State      string `json:"state"`
+}
+
+type telemetryData struct {
+	DeviceID  int                        `json:"device_id"`
+	Timestamp time.Time                  `json:"timestamp"`
+	Values    map[string]json.RawMessage `json:"values"`
+}
+
+type delivery struct {
+	model.WebhookDelivery
+	url    string
+	secret string
+}
+
+// Dispatcher sends device events to the subscribed webhooks. Every request is signed with the subscription's secret,
+// failed requests are retried with exponential backoff and every attempt is stored in the delivery log.
+type Dispatcher struct {
+	database db.Store
+	client   *http.Client
+	events   chan Event
+	queue    chan delivery
+
+	mu            sync.RWMutex
+	subscriptions []model.WebhookSubscription
+}
+
+func NewDispatcher(database db.Store) *Dispatcher {
+	return &Dispatcher{
+		database: database,
+		client:   &http.Client{Timeout: requestTimeout},
+		events:   make(chan Event, queueSize),
+		queue:    make(chan delivery, queueSize),
+	}
+}
+
+// Reload fetches the subscriptions, it has to be called after subscriptions are changed
+func (d *Dispatcher) Reload() error {
+	subscriptions, err := d.database.FetchWebhookSubscriptions()
+	if err != nil {
+		return fmt.Errorf("failed to fetch webhook subscriptions: %v", err)
+	}
+	d.mu.Lock()
+	d.subscriptions = subscriptions
+	d.mu.Unlock()
+	return nil
+}
+
+// Start loads the subscriptions, resumes deliveries left pending by the last run, starts the workers and the job
+// pruning the delivery log
+func (d *Dispatcher) Start() error {
+	if err := d.Reload(); err != nil {
+		return err
+	}
+
+	go d.fanOut()
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	go d.prune()
+
+	pending, err := d.database.FetchWebhookDeliveries(true, pendingLimit)
+	if err != nil {
+		return fmt.Errorf("failed to fetch pending webhook deliveries: %v", err)
+	}
+	d.mu.RLock()
+	subscriptions := make(map[int]model.WebhookSubscription, len(d.subscriptions))
+	for _, subscription := range d.subscriptions {
+		subscriptions[subscription.ID] = subscription
+	}
+	d.mu.RUnlock()
+	for _, pendingDelivery := range pending {
+		subscription, ok := subscriptions[pendingDelivery.SubscriptionID]
+		if !ok {
+			continue
+		}
+		d.enqueue(delivery{WebhookDelivery: pendingDelivery, url: subscription.URL, secret: subscription.Secret})
+	}
+	return nil
+}
+
+// Publish never blocks, events are dropped when the dispatcher falls too far behind
+func (d *Dispatcher) Publish(eventType model.WebhookEventType, data interface{}) {
+	select {
+	case d.events <- Event{Type: eventType, OccurredAt: time.Now(), Data: data}:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event_type", eventType)
+	}
+}
+
+// HandleLogin is a mqtt_handlers.LoginConsumer
+func (d *Dispatcher) HandleLogin(device model.Device) {
+	d.Publish(model.WebhookDeviceLogin, device)
+}
+
+// HandleUpdate is a mqtt_handlers.StateConsumer
+func (d *Dispatcher) HandleUpdate(update model.Update) {
+	d.Publish(model.WebhookStateChanged, stateData{DeviceID: update.DeviceID, ActionName: update.ActionName, State: update.State})
+}
+
+// HandleReading is a mqtt_handlers.ValueConsumer
+func (d *Dispatcher) HandleReading(reading model.Reading) {
+	d.Publish(model.WebhookTelemetry, telemetryData{DeviceID: reading.DeviceID, Timestamp: reading.Timestamp, Values: reading.Values})
+}
+
+// HandleCommand is a commands.Consumer, only commands accepted by the broker are sent
+func (d *Dispatcher) HandleCommand(command model.Command) {
+	if command.Status == model.CommandDelivered {
+		d.Publish(model.WebhookCommandSent, command)
+	}
+}
+
+// fanOut stores one delivery per interested subscription and queues it
+func (d *Dispatcher) fanOut() {
+	for event := range d.events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("failed to encode webhook event", "event_type", event.Type, "error", err)
+			continue
+		}
+
+		d.mu.RLock()
+		subscriptions := d.subscriptions
+		d.mu.RUnlock()
+
+		for _, subscription := range subscriptions {
+			if !subscription.Enabled || !subscription.Wants(event.Type) {
+				continue
+			}
+			newDelivery := delivery{
+				WebhookDelivery: model.WebhookDelivery{
+					SubscriptionID: subscription.ID,
+					EventType:      event.Type,
+					Payload:        string(payload),
+					Status:         model.DeliveryPending,
+				},
+				url:    subscription.URL,
+				secret: subscription.Secret,
+			}
+			if err = d.database.InsertWebhookDelivery(&newDelivery.WebhookDelivery); err != nil {
+				slog.Error("failed to store webhook delivery", "subscription_id", subscription.ID, "error", err)
+				continue
+			}
+			d.enqueue(newDelivery)
+		}
+	}
+}
+
+// enqueue hands the delivery to the workers, deliveries that do not fit stay pending until the next start
+func (d *Dispatcher) enqueue(pending delivery) {
+	select {
+	case d.queue <- pending:
+	default:
+		slog.Warn("webhook delivery queue full, delivery stays pending", "delivery_id", pending.ID)
+	}
+}
+
+// prune deletes deliveries that succeeded or failed more than Retention ago, fanOut stores one for every event and
+// subscription so the log would grow without bounds
+func (d *Dispatcher) prune() {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		deleted, err := d.database.DeleteFinishedWebhookDeliveries(time.Now().Add(-Retention))
+		if err != nil {
+			slog.Error("failed to prune webhook deliveries", "error", err)
+		} else if deleted > 0 {
+			slog.Info("pruned webhook deliveries", "deleted", deleted)
+		}
+		<-ticker.C
+	}
+}
+
+func (d *Dispatcher) work() {
+	for pending := range d.queue {
+		d.attempt(pending)
+	}
+}
+
+// Sign returns the signature of the request body sent at timestamp, receivers compute the same HMAC-SHA256 of
+// "<timestamp>.<body>" with the subscription's secret and compare it to the X-Webhook-Signature header
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) attempt(pending delivery) {
+	now := time.Now()
+	pending.Attempts++
+	pending.LastAttemptAt = &now
+	pending.ResponseStatus, pending.Error = 0, ""
+
+	if err := d.post(&pending); err != nil {
+		pending.Error = err.Error()
+		if pending.Attempts >= MaxAttempts {
+			pending.Status = model.DeliveryFailed
+		} else {
+			time.AfterFunc(backoff(pending.Attempts), func() { d.enqueue(pending) })
+		}
+	} else {
+		pending.Status = model.DeliverySucceeded
+	}
+
+	if err := d.database.UpdateWebhookDelivery(&pending.WebhookDelivery); err != nil {
+		slog.Error("failed to update webhook delivery", "delivery_id", pending.ID, "error", err)
+	}
+}
+
+// backoff is the delay before the retry following the given number of failed attempts, it doubles every time
+func backoff(attempts int) time.Duration {
+	return initialBackoff << (attempts - 1)
+}
+
+func (d *Dispatcher) post(pending *delivery) error {
+	body := []byte(pending.Payload)
+	request, err := http.NewRequest(http.MethodPost, pending.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-Event", string(pending.EventType))
+	request.Header.Set("X-Webhook-Delivery", strconv.Itoa(pending.ID))
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	request.Header.Set("X-Webhook-Signature", Sign(pending.secret, timestamp, body))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	pending.ResponseStatus = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return nil
+}
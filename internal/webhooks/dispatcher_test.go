@@ -0,0 +1,104 @@
+package webhooks
+
+import (
+	"NSI-semester-work/internal/db"
+	"NSI-semester-work/internal/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"device.login"}`)
+	want := "sha256=db1a65fabaa0b7ef6235f367d76b6856d3997f9baab93e138e0bf8e87a8615cc"
+	if got := Sign("secret", "1700000000", body); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+	// the timestamp and the secret are part of the signature
+	if Sign("secret", "1700000001", body) == want || Sign("other", "1700000000", body) == want {
+		t.Error("the signature does not change with the timestamp or the secret")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}
+	if len(want) != MaxAttempts-1 {
+		t.Fatalf("%d retries for %d attempts", len(want), MaxAttempts)
+	}
+	for i, delay := range want {
+		if got := backoff(i + 1); got != delay {
+			t.Errorf("backoff after %d attempts = %v, want %v", i+1, got, delay)
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	database := db.NewMemoryStore()
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if signature := Sign("secret", r.Header.Get("X-Webhook-Timestamp"), body); r.Header.Get("X-Webhook-Signature") != signature {
+			t.Errorf("the request is signed with %s, want %s", r.Header.Get("X-Webhook-Signature"), signature)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	subscription := &model.WebhookSubscription{URL: server.URL, Secret: "secret", Enabled: true}
+	if err := database.InsertWebhookSubscription(subscription); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := NewDispatcher(database)
+	newDelivery := func(attempts int) delivery {
+		stored := model.WebhookDelivery{SubscriptionID: subscription.ID, EventType: model.WebhookDeviceLogin,
+			Payload: `{"type":"device.login"}`, Status: model.DeliveryPending}
+		if err := database.InsertWebhookDelivery(&stored); err != nil {
+			t.Fatal(err)
+		}
+		stored.Attempts = attempts
+		return delivery{WebhookDelivery: stored, url: subscription.URL, secret: subscription.Secret}
+	}
+	stored := func(id int) model.WebhookDelivery {
+		deliveries, err := database.FetchWebhookDeliveries(false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, delivery := range deliveries {
+			if delivery.ID == id {
+				return delivery
+			}
+		}
+		t.Fatalf("delivery %d is missing", id)
+		return model.WebhookDelivery{}
+	}
+
+	tests := []struct {
+		name       string
+		status     int
+		attempts   int
+		wantStatus model.WebhookDeliveryStatus
+	}{
+		{"a failed first attempt stays pending", http.StatusInternalServerError, 0, model.DeliveryPending},
+		{"the last failed attempt fails the delivery", http.StatusBadGateway, MaxAttempts - 1, model.DeliveryFailed},
+		{"redirects are failures", http.StatusFound, MaxAttempts - 1, model.DeliveryFailed},
+		{"a 2xx response succeeds", http.StatusNoContent, 2, model.DeliverySucceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status = test.status
+			pending := newDelivery(test.attempts)
+			dispatcher.attempt(pending)
+
+			got := stored(pending.ID)
+			if got.Status != test.wantStatus || got.Attempts != test.attempts+1 || got.ResponseStatus != test.status ||
+				got.LastAttemptAt == nil {
+				t.Errorf("unexpected delivery %+v", got)
+			}
+			if (got.Error == "") != (test.wantStatus == model.DeliverySucceeded) {
+				t.Errorf("unexpected error %q", got.Error)
+			}
+		})
+	}
+}